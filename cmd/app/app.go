@@ -6,7 +6,14 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/dropfolder"
+	"github.com/morzik45/stk-registry/pkg/email/handlers"
+	"github.com/morzik45/stk-registry/pkg/email/outbox"
 	"github.com/morzik45/stk-registry/pkg/email/receiver"
+	"github.com/morzik45/stk-registry/pkg/email/security"
+	"github.com/morzik45/stk-registry/pkg/email/sender"
+	"github.com/morzik45/stk-registry/pkg/email/templates"
+	"github.com/morzik45/stk-registry/pkg/importer"
 	"github.com/morzik45/stk-registry/pkg/logging"
 	"github.com/morzik45/stk-registry/pkg/postgres"
 	"github.com/morzik45/stk-registry/pkg/scheduler"
@@ -14,6 +21,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -23,9 +31,21 @@ type App struct {
 	db                    *postgres.DB
 	cfg                   *config.Config
 	logger                *zap.Logger
-	emailReceiver         *receiver.Receiver
+	emailHandlers         *handlers.Registry
+	emailReceiver         receiver.MailReceiver
+	emailReprocessor      *receiver.Reprocessor
+	quarantineResolver    *receiver.QuarantineResolver
 	emailCheckerScheduler *scheduler.ScheduledExecutor
 	emailSenderScheduler  *scheduler.ScheduledExecutor
+	emailSender           *sender.Sender
+	outbox                *outbox.Outbox
+	mailTemplates         *templates.Templates
+	outboxScheduler       *scheduler.ScheduledExecutor
+	correctionScheduler   *scheduler.ScheduledExecutor
+	correctionMutex       sync.Mutex
+	emailWatcherCancel    context.CancelFunc
+	dropFolder            *dropfolder.DropFolder
+	dropFolderScheduler   *scheduler.ScheduledExecutor
 }
 
 func NewApp(ctx context.Context, cfg *config.Config) (*App, error) {
@@ -52,11 +72,45 @@ func NewApp(ctx context.Context, cfg *config.Config) (*App, error) {
 		return nil, err
 	}
 
-	app.emailReceiver, err = receiver.NewReceiver(app.db, app.cfg, app.logger)
+	// Типы документов РСТК из конфига, остальные задаются через API
+	err = importer.SyncRstkTypes(ctx, app.db, app.cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	// Обработчики вложений по типам писем, новые виды документов регистрируются здесь
+	app.emailHandlers, err = handlers.NewDefaultRegistry(app.db, app.cfg, app.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// С настройками по умолчанию пароль по незашифрованному соединению не передаётся, см. README
+	for _, problem := range security.PlainAuthProblems(app.cfg) {
+		app.logger.Error("Email credentials will be refused over an unencrypted connection", zap.String("problem", problem))
+	}
+
+	app.emailReceiver, err = receiver.NewMailReceiver(app.db, app.cfg, app.logger, app.emailHandlers)
+	if err != nil {
+		return nil, err
+	}
+
+	app.emailSender, err = sender.New(app.cfg, app.logger)
+	if err != nil {
+		return nil, err
+	}
+	app.outbox = outbox.New(app.db, app.cfg, app.logger, app.emailSender)
+	app.mailTemplates = templates.New(app.db, app.cfg, app.logger)
+
+	app.emailReprocessor = receiver.NewReprocessor(app.db, app.cfg, app.logger, app.emailHandlers)
+	app.quarantineResolver = receiver.NewQuarantineResolver(app.db, app.cfg, app.logger, app.emailHandlers)
+
+	if cfg.DropFolder.Path != "" {
+		app.dropFolder, err = dropfolder.New(app.db, app.cfg, app.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	app.initFrontend()
 	app.initBackend()
 
@@ -97,18 +151,26 @@ func (app *App) Run(ctx context.Context) {
 }
 
 func (app *App) Close(ctx context.Context) {
+	if app.emailWatcherCancel != nil {
+		app.emailWatcherCancel()
+	}
 	if app.emailCheckerScheduler != nil {
 		app.emailCheckerScheduler.Stop()
 	}
 	if app.emailSenderScheduler != nil {
 		app.emailSenderScheduler.Stop()
 	}
+	if app.correctionScheduler != nil {
+		app.correctionScheduler.Stop()
+	}
+	if app.outboxScheduler != nil {
+		app.outboxScheduler.Stop()
+	}
+	if app.dropFolderScheduler != nil {
+		app.dropFolderScheduler.Stop()
+	}
 	err := app.db.Close()
 	if err != nil {
 		app.logger.Error("failed to close postgres client", zap.Error(err))
 	}
 }
-
-func (app *App) emailChecker() {
-
-}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
-	"github.com/morzik45/stk-registry/pkg/persons"
+	"github.com/morzik45/stk-registry/pkg/importer"
 	"github.com/morzik45/stk-registry/pkg/postgres"
 	"github.com/morzik45/stk-registry/pkg/utils"
 	"net/http"
@@ -25,9 +26,39 @@ func (app *App) initBackend() {
 	updates.GET("", app.getUpdatesInfo)
 	updates.POST("/uploadERC", app.uploadERC)
 	updates.POST("/uploadRSTK", app.uploadRSTK)
+	updates.POST("/reprocess", app.reprocessEmails)
 	updates.DELETE("/rstk/:id", app.deleteRSTK)
 	updates.POST("/make-rstk-excel", app.makeRstkExcel)
 
+	api.GET("/ingestion-runs", app.getIngestionRuns)
+
+	quarantine := api.Group("/quarantine")
+	quarantine.GET("", app.getQuarantine)
+	quarantine.GET("/:id/raw", app.getQuarantineRaw)
+	quarantine.POST("/:id/assign", app.assignQuarantine)
+	quarantine.POST("/:id/discard", app.discardQuarantine)
+
+	outbox := api.Group("/outbox")
+	outbox.GET("", app.getOutbox)
+	outbox.POST("/:id/resend", app.resendOutbox)
+	outbox.POST("/:id/cancel", app.cancelOutbox)
+
+	api.GET("/corrections", app.getCorrectionBatches)
+
+	rstkTypes := api.Group("/rstk-types")
+	rstkTypes.GET("", app.getRstkTypes)
+	rstkTypes.PUT("/:name", app.saveRstkType)
+	rstkTypes.DELETE("/:name", app.deleteRstkType)
+
+	snilsCandidates := api.Group("/snils-candidates")
+	snilsCandidates.GET("", app.getSnilsCandidates)
+	snilsCandidates.POST("/:id/confirm", app.confirmSnils)
+
+	mailTemplates := api.Group("/mail-templates")
+	mailTemplates.GET("", app.getMailTemplates)
+	mailTemplates.PUT("/:kind", app.saveMailTemplate)
+	mailTemplates.DELETE("/:kind", app.deleteMailTemplate)
+
 }
 
 func (app *App) makeRstkExcel(c *gin.Context) {
@@ -98,30 +129,12 @@ func (app *App) uploadRSTK(c *gin.Context) {
 		return
 	}
 
-	var fromDate time.Time
-
-	if len(file.Filename) > 13 {
-		fromDateStr := file.Filename[:10]
-		fromDate, err = time.Parse("2006-01-02", fromDateStr)
-		if err != nil {
-			fromDate, err = time.Parse("02.01.2006", fromDateStr)
-			if err != nil {
-				fromDate = time.Now()
-			}
-		}
-	}
-
 	reader, err := file.Open()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-
-	p, t := persons.ParseDocumentFromRSTK(reader)
-	if t == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Не удалось определить тип документа"})
-		return
-	}
+	defer reader.Close()
 
 	tx, err := app.db.BeginTx(c.Request.Context())
 	if err != nil {
@@ -132,17 +145,15 @@ func (app *App) uploadRSTK(c *gin.Context) {
 		_ = tx.Rollback()
 	}(tx)
 
-	ru := postgres.RstkUpdate{TypeID: t, FromDate: fromDate}
-	err = app.db.RstkUpdates.Create(c.Request.Context(), &ru, tx)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// type - имя типа документа, если в файле нет заголовка
+	ru, count, rejected, err := importer.ImportRstk(c.Request.Context(), app.db, tx, importer.RstkFromDate(file.Filename), c.PostForm("type"), reader)
+	if errors.Is(err, importer.ErrUnknownRstkTypeName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неизвестный тип документа: " + c.PostForm("type")})
 		return
-	}
-	for i := range p {
-		p[i].RstkUpdateID = ru.ID
-	}
-	err = app.db.PersonsFromRSTK.CreateMany(c.Request.Context(), p, tx)
-	if err != nil {
+	} else if errors.Is(err, importer.ErrUnknownRstkType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Не удалось определить тип документа", "encoding": ru.Encoding})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -151,11 +162,18 @@ func (app *App) uploadRSTK(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "ok",
+		"rows":      count,
+		"type_id":   ru.TypeID,
+		"encoding":  ru.Encoding,
+		"delimiter": ru.Delimiter,
+		"rejected":  rejected,
+	})
 }
 
 func (app *App) uploadERC(c *gin.Context) {
-	_, err := app.emailReceiver.Receive()
+	_, err := app.emailReceiver.Receive(postgres.TriggerAPI)
 	if err != nil {
 		c.JSON(500, gin.H{
 			"status": "error",
@@ -204,11 +222,31 @@ func (app *App) getUpdatesInfo(c *gin.Context) {
 		})
 		return
 	}
+
+	failedEmails, err := app.db.EmailAttachments.GetFailedEmails(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	errorCodes, err := app.db.ErcUpdates.GetErrorCodes(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
 	c.JSON(200, gin.H{
-		"status":      "ok",
-		"erc":         erc,
-		"stat":        stat,
-		"errors_data": errorsData,
-		"rstk":        rstkUpdates,
+		"status":        "ok",
+		"erc":           erc,
+		"stat":          stat,
+		"errors_data":   errorsData,
+		"rstk":          rstkUpdates,
+		"failed_emails": failedEmails,
+		"error_codes":   errorCodes,
 	})
 }
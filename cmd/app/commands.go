@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/email/handlers"
+	"github.com/morzik45/stk-registry/pkg/email/receiver"
+	"github.com/morzik45/stk-registry/pkg/logging"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"os"
+	"text/tabwriter"
+)
+
+// runCommand выполняет служебную команду вместо запуска сервера, например:
+//
+//	registry reprocess -id 15
+//	registry reprocess -from 2022-08-01 -to 2022-08-31 -dry-run
+//	registry reprocess -all
+func runCommand(ctx context.Context, cfg *config.Config, name string, args []string) error {
+	switch name {
+	case "reprocess":
+		return reprocessCommand(ctx, cfg, args)
+	default:
+		return fmt.Errorf("unknown command: %s", name)
+	}
+}
+
+func reprocessCommand(ctx context.Context, cfg *config.Config, args []string) error {
+	var req reprocessRequest
+	fs := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	fs.IntVar(&req.EmailID, "id", 0, "идентификатор письма")
+	fs.StringVar(&req.From, "from", "", "начало периода получения писем, 2006-01-02")
+	fs.StringVar(&req.To, "to", "", "конец периода получения писем включительно, 2006-01-02")
+	fs.BoolVar(&req.All, "all", false, "переразобрать все письма")
+	fs.BoolVar(&req.DryRun, "dry-run", false, "только показать изменения, не сохраняя их")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	filter, err := req.filter()
+	if err != nil {
+		return err
+	}
+
+	logger, err := logging.NewLogger(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = logger.Sync() }()
+
+	db, err := postgres.NewDB(ctx, cfg, logger)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+
+	registry, err := handlers.NewDefaultRegistry(db, cfg, logger)
+	if err != nil {
+		return err
+	}
+	summary, err := receiver.NewReprocessor(db, cfg, logger, registry).Reprocess(ctx, filter, req.DryRun)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "email\treceived\tadded\tremoved\tchanged\tunchanged\terror")
+	for _, d := range summary.Details {
+		_, _ = fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%d\t%s\n",
+			d.EmailID, d.Received.Format("2006-01-02 15:04"), d.Added, d.Removed, d.Changed, d.Unchanged, d.Error)
+	}
+	_, _ = fmt.Fprintf(w, "total %d\t\t%d\t%d\t%d\t%d\tfailed: %d\n",
+		summary.Emails, summary.Added, summary.Removed, summary.Changed, summary.Unchanged, summary.Failed)
+	if summary.DryRun {
+		_, _ = fmt.Fprintln(w, "dry run, nothing saved")
+	}
+	return w.Flush()
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+func (app *App) getCorrectionBatches(c *gin.Context) {
+	limit, _ := strconv.ParseInt(c.Query("limit"), 10, 64)
+	offset, _ := strconv.ParseInt(c.Query("offset"), 10, 64)
+	batches, err := app.db.CorrectionBatches.List(c.Request.Context(), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   batches,
+	})
+}
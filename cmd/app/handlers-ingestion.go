@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+// Размер страницы списков, если limit не указан, и наибольший допустимый
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// pageParams читает limit и offset из запроса: оба неотрицательные целые, limit не больше maxPageLimit,
+// пустой или нулевой limit - defaultPageLimit
+func pageParams(c *gin.Context) (limit, offset int64, err error) {
+	if s := c.Query("limit"); s != "" {
+		if limit, err = strconv.ParseInt(s, 10, 64); err != nil || limit < 0 {
+			return 0, 0, errors.New("limit должен быть неотрицательным целым числом")
+		}
+	}
+	if s := c.Query("offset"); s != "" {
+		if offset, err = strconv.ParseInt(s, 10, 64); err != nil || offset < 0 {
+			return 0, 0, errors.New("offset должен быть неотрицательным целым числом")
+		}
+	}
+	if limit == 0 {
+		limit = defaultPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return limit, offset, nil
+}
+
+func (app *App) getIngestionRuns(c *gin.Context) {
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	runs, total, err := app.db.IngestionRuns.List(c.Request.Context(), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   runs,
+		"total":  total,
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPageParams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		query         string
+		limit, offset int64
+		ok            bool
+	}{
+		{"", defaultPageLimit, 0, true},
+		{"limit=0", defaultPageLimit, 0, true},
+		{"limit=20&offset=40", 20, 40, true},
+		{"limit=100000", maxPageLimit, 0, true},
+		{"limit=-1", 0, 0, false},
+		{"offset=-5", 0, 0, false},
+		{"limit=abc", 0, 0, false},
+		{"offset=1.5", 0, 0, false},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/api/ingestion-runs?"+tt.query, nil)
+		limit, offset, err := pageParams(c)
+		if (err == nil) != tt.ok || limit != tt.limit || offset != tt.offset {
+			t.Errorf("pageParams(%q) = %d, %d, %v", tt.query, limit, offset, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+func (app *App) getOutbox(c *gin.Context) {
+	limit, _ := strconv.ParseInt(c.Query("limit"), 10, 64)
+	offset, _ := strconv.ParseInt(c.Query("offset"), 10, 64)
+	messages, err := app.db.Outbox.List(c.Request.Context(), c.Query("status"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   messages,
+	})
+}
+
+func (app *App) resendOutbox(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	err = app.db.Outbox.Resend(c.Request.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusConflict, gin.H{"status": "error", "error": "Письмо не найдено, уже ожидает отправки или это неотправленная коррекция, записи которой уйдут следующим пакетом"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	go app.deliverOutbox()
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (app *App) cancelOutbox(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	err = app.outbox.Cancel(c.Request.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusConflict, gin.H{"status": "error", "error": "Письмо не найдено или уже отправлено"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
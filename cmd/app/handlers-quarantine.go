@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/morzik45/stk-registry/pkg/email/handlers"
+	"github.com/morzik45/stk-registry/pkg/email/receiver"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// quarantineTypeAliases короткие имена встроенных типов писем
+var quarantineTypeAliases = map[string]string{
+	"erc": handlers.TypeErcRegister,
+}
+
+func (app *App) getQuarantine(c *gin.Context) {
+	status := c.DefaultQuery("status", postgres.QuarantinePending)
+	if status == "all" {
+		status = ""
+	}
+	emails, err := app.db.Quarantine.List(c.Request.Context(), status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   emails,
+	})
+}
+
+func (app *App) getQuarantineRaw(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	q, err := app.db.Quarantine.Get(c.Request.Context(), id, nil)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "Письмо не найдено"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=quarantine-"+strconv.Itoa(q.ID)+".eml")
+	c.Data(http.StatusOK, "message/rfc822", q.File)
+}
+
+func (app *App) assignQuarantine(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	var req struct {
+		Type string `json:"type"` // имя типа письма, например erc_register или correction
+	}
+	if err = c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	typeName := req.Type
+	if alias, ok := quarantineTypeAliases[typeName]; ok {
+		typeName = alias
+	}
+
+	res, err := app.quarantineResolver.Assign(c.Request.Context(), id, typeName)
+	if err != nil {
+		app.quarantineError(c, err)
+		return
+	}
+	if res.IsHaveNew {
+		// Как и при получении письма, отправляем на коррекцию записи с ошибками
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			defer cancel()
+			if err := app.MakeAndSendToCorrection(ctx); err != nil {
+				app.logger.Error("failed to make and send to correction", zap.Error(err))
+			}
+		}()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   res,
+	})
+}
+
+func (app *App) discardQuarantine(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	if err = app.quarantineResolver.Discard(c.Request.Context(), id); err != nil {
+		app.quarantineError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (app *App) quarantineError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "Письмо не найдено"})
+	case errors.Is(err, receiver.ErrUnknownType):
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+	case errors.Is(err, receiver.ErrQuarantineResolved), errors.Is(err, receiver.ErrAlreadyIngested):
+		c.JSON(http.StatusConflict, gin.H{"status": "error", "error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"net/http"
+	"time"
+)
+
+type reprocessRequest struct {
+	EmailID int    `json:"email_id"`
+	From    string `json:"from"` // 2006-01-02
+	To      string `json:"to"`   // 2006-01-02, включительно
+	All     bool   `json:"all"`
+	DryRun  bool   `json:"dry_run"`
+}
+
+// filter переводит запрос в фильтр писем. Пустой запрос - ошибка, чтобы случайно не переразобрать всё.
+func (r reprocessRequest) filter() (filter postgres.EmailFilter, err error) {
+	if r.EmailID == 0 && r.From == "" && r.To == "" && !r.All {
+		return filter, errors.New("не указаны письма: email_id, период from/to или all")
+	}
+	filter.ID = r.EmailID
+	if r.From != "" {
+		filter.From, err = time.ParseInLocation("2006-01-02", r.From, time.Local)
+		if err != nil {
+			return filter, errors.New("неверный формат даты from")
+		}
+	}
+	if r.To != "" {
+		filter.To, err = time.ParseInLocation("2006-01-02", r.To, time.Local)
+		if err != nil {
+			return filter, errors.New("неверный формат даты to")
+		}
+		filter.To = filter.To.Add(24*time.Hour - time.Second)
+	}
+	return filter, nil
+}
+
+func (app *App) reprocessEmails(c *gin.Context) {
+	var req reprocessRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	filter, err := req.filter()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+
+	summary, err := app.emailReprocessor.Reprocess(c.Request.Context(), filter, req.DryRun)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   summary,
+	})
+}
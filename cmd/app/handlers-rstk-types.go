@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/morzik45/stk-registry/pkg/importer"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"net/http"
+)
+
+func (app *App) getRstkTypes(c *gin.Context) {
+	types, err := app.db.RstkUpdateTypes.List(c.Request.Context(), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   types,
+	})
+}
+
+func (app *App) saveRstkType(c *gin.Context) {
+	var req struct {
+		Description   string `json:"description"`
+		HeaderPattern string `json:"header_pattern"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	t := postgres.RstkUpdateType{
+		Name:          c.Param("name"),
+		Description:   req.Description,
+		HeaderPattern: req.HeaderPattern,
+	}
+	if err := importer.ValidateRstkType(t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "Ошибка в типе документа: " + err.Error()})
+		return
+	}
+	if err := app.db.RstkUpdateTypes.Save(c.Request.Context(), &t, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": t})
+}
+
+func (app *App) deleteRstkType(c *gin.Context) {
+	err := app.db.RstkUpdateTypes.Delete(c.Request.Context(), c.Param("name"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusConflict, gin.H{"status": "error", "error": "Тип не найден или по нему уже загружены списки"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+func (app *App) getSnilsCandidates(c *gin.Context) {
+	limit, _ := strconv.ParseInt(c.Query("limit"), 10, 64)
+	offset, _ := strconv.ParseInt(c.Query("offset"), 10, 64)
+	persons, err := app.db.PersonsFromErc.ListSnilsCandidates(c.Request.Context(), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   persons,
+	})
+}
+
+// confirmSnils оператор выбирает СНИЛС из кандидатов строки
+func (app *App) confirmSnils(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	var req struct {
+		Snils string `json:"snils" binding:"required"`
+	}
+	if err = c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	err = app.db.PersonsFromErc.ConfirmSnils(c.Request.Context(), id, req.Snils, nil)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusConflict, gin.H{"status": "error", "error": "Строка не найдена, такого кандидата нет или СНИЛС уже выбран"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/morzik45/stk-registry/pkg/email/templates"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"net/http"
+)
+
+// mailTemplateInfo шаблоны письма: заданные оператором и те, что используются сейчас
+type mailTemplateInfo struct {
+	Kind      string                 `json:"kind"`
+	Custom    *postgres.MailTemplate `json:"custom"`
+	Effective templates.Source       `json:"effective"`
+}
+
+func (app *App) getMailTemplates(c *gin.Context) {
+	custom, err := app.db.MailTemplates.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	data := make([]mailTemplateInfo, 0)
+	for _, kind := range templates.Kinds() {
+		info := mailTemplateInfo{Kind: kind}
+		for i := range custom {
+			if custom[i].Kind == kind {
+				info.Custom = &custom[i]
+			}
+		}
+		info.Effective, err = app.mailTemplates.Source(c.Request.Context(), kind)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+			return
+		}
+		data = append(data, info)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   data,
+	})
+}
+
+func (app *App) saveMailTemplate(c *gin.Context) {
+	var req templates.Source
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	t := postgres.MailTemplate{
+		Kind:     c.Param("kind"),
+		Subject:  req.Subject,
+		TextBody: req.Text,
+		HTMLBody: req.HTML,
+	}
+	err := app.mailTemplates.Check(t)
+	if errors.Is(err, templates.ErrUnknownKind) {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "Неизвестный вид письма"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "Ошибка в шаблоне: " + err.Error()})
+		return
+	}
+	if err = app.db.MailTemplates.Save(c.Request.Context(), &t); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "data": t})
+}
+
+func (app *App) deleteMailTemplate(c *gin.Context) {
+	err := app.db.MailTemplates.Delete(c.Request.Context(), c.Param("kind"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "Шаблоны не заданы"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -2,12 +2,21 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/morzik45/stk-registry/pkg/config"
+	"os"
 )
 
 func main() {
 	ctx := context.Background()
 	cfg := config.GetConfig()
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, cfg, os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	app, err := NewApp(ctx, cfg)
 	if err != nil {
 		panic(err)
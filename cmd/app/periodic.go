@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/email/receiver"
 	"github.com/morzik45/stk-registry/pkg/email/sender"
+	"github.com/morzik45/stk-registry/pkg/email/templates"
+	"github.com/morzik45/stk-registry/pkg/postgres"
 	"github.com/morzik45/stk-registry/pkg/scheduler"
 	"github.com/morzik45/stk-registry/pkg/utils"
 	"go.uber.org/zap"
-	"io"
 	"time"
 )
 
@@ -17,27 +18,49 @@ func (app *App) RunPeriodicTasks() {
 	// Периодически проверяем почту на новые сообщения от ЕРЦ.
 	// Откладываем проверку на минуту для ожидания полной инициализации приложения и
 	// спама при падении приложения после запуска и постоянного рестарта.
-	if len(app.cfg.Email.FromErc) > 0 {
+	if len(app.cfg.Email.FromErc) > 0 || len(app.cfg.Email.Routes) > 0 {
 		app.emailCheckerScheduler = scheduler.NewTimedExecutor(
 			time.Minute,
 			app.cfg.Email.CheckInterval,
 		)
-		app.emailCheckerScheduler.Start(func() {
+		app.emailCheckerScheduler.Start(func() { app.checkEmail(postgres.TriggerScheduler) }, true)
+
+		// Если получатель умеет ждать письма (IMAP IDLE), проверяем почту сразу по приходу письма.
+		if watcher, ok := app.emailReceiver.(receiver.Watcher); ok && app.cfg.Email.IMAPIdle {
+			var ctx context.Context
+			ctx, app.emailWatcherCancel = context.WithCancel(context.Background())
+			go watcher.Watch(ctx, func() { app.checkEmail(postgres.TriggerIdle) })
+		}
+	}
+	// Загружаем файлы, которые операторы положили в папку.
+	if app.dropFolder != nil {
+		app.dropFolderScheduler = scheduler.NewTimedExecutor(
+			time.Minute,
+			app.cfg.DropFolder.Interval,
+		)
+		app.dropFolderScheduler.Start(app.scanDropFolder, false)
+	}
+	// Отправляем письма из очереди, повторяя неудачные попытки.
+	app.outboxScheduler = scheduler.NewTimedExecutor(
+		time.Minute,
+		app.cfg.Outbox.Interval,
+	)
+	app.outboxScheduler.Start(app.deliverOutbox, false)
+	// Раз в час проверяем, нет ли записей, которые не исправили в срок.
+	if app.cfg.Correction.EscalateDays > 0 {
+		app.correctionScheduler = scheduler.NewTimedExecutor(
+			time.Minute,
+			time.Hour,
+		)
+		app.correctionScheduler.Start(func() {
 			defer utils.Recover(app.logger)
-			isHaveNew, err := app.emailReceiver.Receive()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			err := app.EscalateCorrections(ctx)
 			if err != nil {
-				app.logger.Error("failed to get new from erc", zap.Error(err))
+				app.logger.Error("failed to escalate corrections", zap.Error(err))
 			}
-			if isHaveNew {
-				app.logger.Info("new erc message found")
-				ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-				defer cancel()
-				err = app.MakeAndSendToCorrection(ctx)
-				if err != nil {
-					app.logger.Error("failed to make and send to correction", zap.Error(err))
-				}
-			}
-		}, true)
+		}, false)
 	}
 	// Раз в сутки отправляем отчёт о выданных картах в ЕРЦ(если есть новые карты).
 	// Рассчитываем время до ближайшей отправки отчёта о картах в ЕРЦ.
@@ -61,31 +84,179 @@ func (app *App) RunPeriodicTasks() {
 	}, true)
 }
 
+// checkEmail забирает новые письма и, если пришли новые данные от ЕРЦ, отправляет ошибочные записи на коррекцию
+func (app *App) checkEmail(trigger string) {
+	defer utils.Recover(app.logger)
+	isHaveNew, err := app.emailReceiver.Receive(trigger)
+	if err != nil {
+		app.logger.Error("failed to get new from erc", zap.Error(err))
+	}
+	if isHaveNew {
+		app.logger.Info("new erc message found")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		err = app.MakeAndSendToCorrection(ctx)
+		if err != nil {
+			app.logger.Error("failed to make and send to correction", zap.Error(err))
+		}
+	}
+}
+
+// scanDropFolder загружает файлы из папки и, если пришли новые данные от ЕРЦ, отправляет ошибочные записи на коррекцию
+func (app *App) scanDropFolder() {
+	defer utils.Recover(app.logger)
+	if app.dropFolder.Scan() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		err := app.MakeAndSendToCorrection(ctx)
+		if err != nil {
+			app.logger.Error("failed to make and send to correction", zap.Error(err))
+		}
+	}
+}
+
+// deliverOutbox отправляет письма из очереди, которым подошло время
+func (app *App) deliverOutbox() {
+	defer utils.Recover(app.logger)
+	app.outbox.Deliver()
+}
+
+// MakeAndSendToCorrection отправляет на коррекцию новым пакетом записи с ошибками, которые ещё не отправлялись
 func (app *App) MakeAndSendToCorrection(ctx context.Context) (err error) {
+	app.correctionMutex.Lock()
+	defer app.correctionMutex.Unlock()
+
 	// Получим из базы записи с ошибками
 	forCorrection, err := app.db.PersonsFromErc.SelectForCorrection(ctx)
 	if err != nil {
 		app.logger.Error("failed to get persons for correction", zap.Error(err))
 		return
 	}
+	if len(forCorrection) == 0 {
+		app.logger.Info("no new persons for correction")
+		return
+	}
 	// сформируем Excel файл для отправки на коррекцию
 	correction, err := utils.MakeExcelForCorrection(forCorrection)
 	if err != nil {
 		app.logger.Error("failed to make excel for correction", zap.Error(err))
 		return
 	}
-	// отправим письмо с коррекцией на почту
-	err = sender.SendFiles([]io.Reader{correction}, app.cfg.Email.ToCorrection, "subject", app.cfg)
+	// сформируем письмо по шаблону, по его Message-ID найдём пакет, когда придёт ответ
+	m, err := app.mailTemplates.Render(ctx, postgres.OutboxCorrection, templates.CorrectionData(app.cfg.Organization, forCorrection))
+	if err != nil {
+		app.logger.Error("failed to render correction email", zap.Error(err))
+		return
+	}
+	m.MessageID = sender.NewMessageID(app.cfg)
+	m.To = app.cfg.Email.ToCorrection
+	m.Attachments = []sender.Attachment{{
+		Filename:    sender.XlsxFilename(),
+		ContentType: sender.XlsxContentType,
+		Data:        correction.Bytes(),
+	}}
+
+	// письмо и пакет сохраняем вместе, иначе записи уйдут без пакета или пакет останется без письма
+	tx, err := app.db.BeginTx(ctx)
+	if err != nil {
+		app.logger.Error("failed to begin transaction", zap.Error(err))
+		return
+	}
+	defer func(tx *sqlx.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	outboxID, err := app.outbox.Enqueue(ctx, tx, postgres.OutboxCorrection, m)
+	if err != nil {
+		app.logger.Error("failed to enqueue correction", zap.Error(err))
+		return
+	}
+	batch := postgres.CorrectionBatch{OutboxID: &outboxID, MessageID: m.MessageID}
+	ids := make([]int, 0, len(forCorrection))
+	for _, p := range forCorrection {
+		ids = append(ids, p.ID)
+	}
+	err = app.db.CorrectionBatches.Create(ctx, &batch, ids, tx)
+	if err != nil {
+		app.logger.Error("failed to create correction batch", zap.Error(err))
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		app.logger.Error("failed to commit transaction", zap.Error(err))
+		return
+	}
+	app.logger.Info("correction batch created", zap.Int("batch", batch.ID), zap.Int("rows", len(ids)))
+	go app.deliverOutbox()
+	return
+}
+
+// EscalateCorrections напоминает о записях, которые не исправили за CORRECTION_ESCALATE_DAYS дней.
+// О каждой записи напоминаем один раз.
+func (app *App) EscalateCorrections(ctx context.Context) (err error) {
+	app.correctionMutex.Lock()
+	defer app.correctionMutex.Unlock()
+
+	tx, err := app.db.BeginTx(ctx)
+	if err != nil {
+		app.logger.Error("failed to begin transaction", zap.Error(err))
+		return
+	}
+	defer func(tx *sqlx.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	overdue, err := app.db.CorrectionBatches.Escalate(ctx, time.Now().AddDate(0, 0, -app.cfg.Correction.EscalateDays), tx)
+	if err != nil {
+		app.logger.Error("failed to escalate corrections", zap.Error(err))
+		return
+	}
+	if len(overdue) == 0 {
+		return
+	}
+
+	persons := make([]postgres.PersonFromErcForCorrection, 0, len(overdue))
+	for _, o := range overdue {
+		persons = append(persons, o.PersonFromErcForCorrection)
+	}
+	// Ответ на напоминание сопоставляется с пакетами по номерам записей в файле
+	correction, err := utils.MakeExcelForCorrection(persons)
+	if err != nil {
+		app.logger.Error("failed to make excel for correction", zap.Error(err))
+		return
+	}
+	m, err := app.mailTemplates.Render(ctx, postgres.OutboxEscalation, templates.EscalationData(app.cfg.Organization, overdue))
+	if err != nil {
+		app.logger.Error("failed to render escalation email", zap.Error(err))
+		return
+	}
+	m.To = app.cfg.Correction.EscalateTo
+	if len(m.To) == 0 {
+		m.To = app.cfg.Email.ToCorrection
+	}
+	m.Attachments = []sender.Attachment{{
+		Filename:    sender.XlsxFilename(),
+		ContentType: sender.XlsxContentType,
+		Data:        correction.Bytes(),
+	}}
+	_, err = app.outbox.Enqueue(ctx, tx, postgres.OutboxEscalation, m)
+	if err != nil {
+		app.logger.Error("failed to enqueue escalation", zap.Error(err))
+		return
+	}
+	err = tx.Commit()
 	if err != nil {
-		app.logger.Error("failed to send correction", zap.Error(err))
+		app.logger.Error("failed to commit transaction", zap.Error(err))
 		return
 	}
+	app.logger.Warn("corrections overdue, escalated", zap.Int("rows", len(overdue)))
+	go app.deliverOutbox()
 	return
 }
 
 // MakeAndSendReportToERC отправляет отчёт в ЕРЦ по выбранным картам
 func (app *App) MakeAndSendReportToERC(ctx context.Context) error {
-	// Открываем транзакцию, если не получится отправить в ерц, то откатиться и не помечать как отправленное
+	// Открываем транзакцию, если не получится поставить письмо в очередь, то откатиться и не помечать как отправленное
 	tx, err := app.db.BeginTx(ctx)
 	if err != nil {
 		app.logger.Error("failed to begin transaction", zap.Error(err))
@@ -95,8 +266,18 @@ func (app *App) MakeAndSendReportToERC(ctx context.Context) error {
 		_ = tx.Rollback()
 	}(tx)
 
-	// Собираем данные для отчета
-	r, err := app.db.RstkUpdates.ReportForErcWithMark(ctx, tx)
+	// Собираем данные для отчета. В режиме dry-run не помечаем карты отправленными,
+	// чтобы их можно было отправить ещё раз.
+	var r []postgres.RstkUpdateReportForERC
+	if app.emailSender.DryRun() {
+		r, err = app.db.RstkUpdates.ReportForERC(ctx, 0, 0)
+	} else {
+		r, err = app.db.RstkUpdates.ReportForErcWithMark(ctx, tx)
+	}
+	if err != nil {
+		app.logger.Error("failed to get report", zap.Error(err))
+		return err
+	}
 
 	// Если нет данных для отчета, заканчиваем работу
 	if len(r) == 0 {
@@ -110,15 +291,23 @@ func (app *App) MakeAndSendReportToERC(ctx context.Context) error {
 		return err
 	}
 
-	// Отправляем отчет в ерц
-	err = sender.SendFiles(
-		[]io.Reader{buf},
-		app.cfg.Email.ToErc,
-		fmt.Sprintf("МКУ ТУ Реестр выданых карт за %s", time.Now().Format("02.01.2006")),
-		app.cfg,
-	)
+	// Формируем письмо по шаблону
+	m, err := app.mailTemplates.Render(ctx, postgres.OutboxErcReport, templates.ErcReportData(app.cfg.Organization, r))
+	if err != nil {
+		app.logger.Error("failed to render report email", zap.Error(err))
+		return err
+	}
+	m.To = app.cfg.Email.ToErc
+	m.Attachments = []sender.Attachment{{
+		Filename:    sender.XlsxFilename(),
+		ContentType: sender.XlsxContentType,
+		Data:        buf.Bytes(),
+	}}
+
+	// Ставим отчет в очередь на отправку в ерц в той же транзакции, что и отметку об отправке
+	_, err = app.outbox.Enqueue(ctx, tx, postgres.OutboxErcReport, m)
 	if err != nil {
-		app.logger.Error("failed to send report", zap.Error(err))
+		app.logger.Error("failed to enqueue report", zap.Error(err))
 		return err
 	}
 
@@ -128,5 +317,6 @@ func (app *App) MakeAndSendReportToERC(ctx context.Context) error {
 		app.logger.Error("failed to commit transaction", zap.Error(err))
 		return err
 	}
+	go app.deliverOutbox()
 	return nil
 }
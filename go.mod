@@ -4,23 +4,25 @@ go 1.18
 
 require (
 	github.com/caarlos0/env/v6 v6.9.3
+	github.com/emersion/go-imap v1.2.1
 	github.com/emersion/go-message v0.16.0
 	github.com/gin-contrib/static v0.0.1
 	github.com/gin-gonic/gin v1.8.1
 	github.com/golang-migrate/migrate/v4 v4.15.2
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/jordan-wright/email v4.0.1-0.20210109023952-943e75fe5223+incompatible
-	github.com/knadh/go-pop3 v0.3.0
 	github.com/lib/pq v1.10.0
 	github.com/natefinch/lumberjack v2.0.0+incompatible
 	github.com/strpc/zaptelegram v0.0.0-20220123232459-384b0247ac93
 	github.com/xuri/excelize/v2 v2.6.0
+	go.mozilla.org/pkcs7 v0.10.0
 	go.uber.org/zap v1.21.0
 	golang.org/x/text v0.3.7
 )
 
 require (
 	github.com/BurntSushi/toml v1.1.0 // indirect
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
 	github.com/emersion/go-textwrapper v0.0.0-20200911093747-65d896831594 // indirect
 	github.com/gin-contrib/sse v0.1.0 // indirect
 	github.com/go-playground/locales v0.14.0 // indirect
@@ -0,0 +1,11 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS imap_states
+(
+    "mailbox"      VARCHAR(255) PRIMARY KEY,
+    "uid_validity" BIGINT                   NOT NULL,
+    "last_uid"     BIGINT                   NOT NULL DEFAULT 0,
+    "updated_at"   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMIT;
@@ -0,0 +1,15 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS mailbox_seen
+(
+    "id"         SERIAL PRIMARY KEY,
+    "mailbox"    VARCHAR(255)             NOT NULL,
+    "uid"        VARCHAR(255)             NOT NULL,
+    "message_id" VARCHAR(255)             NOT NULL DEFAULT '',
+    "email_id"   INTEGER REFERENCES emails (id) ON DELETE SET NULL,
+    "status"     VARCHAR(32)              NOT NULL,
+    "seen_at"    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE ("mailbox", "uid")
+);
+
+COMMIT;
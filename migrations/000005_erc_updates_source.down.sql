@@ -0,0 +1,11 @@
+BEGIN;
+
+DELETE FROM erc_updates WHERE email_id IS NULL;
+ALTER TABLE erc_updates
+    DROP COLUMN IF EXISTS "created_at";
+ALTER TABLE erc_updates
+    DROP COLUMN IF EXISTS "source";
+ALTER TABLE erc_updates
+    ALTER COLUMN email_id SET NOT NULL;
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+-- Реестры ЕРЦ могут приходить не только по почте, но и через папку для файлов.
+ALTER TABLE erc_updates
+    ALTER COLUMN email_id DROP NOT NULL;
+ALTER TABLE erc_updates
+    ADD COLUMN IF NOT EXISTS "source" VARCHAR(32) NOT NULL DEFAULT 'email';
+ALTER TABLE erc_updates
+    ADD COLUMN IF NOT EXISTS "created_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+COMMIT;
@@ -0,0 +1,20 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS quarantine
+(
+    "id"                SERIAL PRIMARY KEY,
+    "message_id"        VARCHAR(255)             NOT NULL UNIQUE,
+    "from_address"      VARCHAR(255)             NOT NULL DEFAULT '',
+    "subject"           TEXT                     NOT NULL DEFAULT '',
+    "headers"           TEXT                     NOT NULL DEFAULT '',
+    "reason"            VARCHAR(32)              NOT NULL,
+    "datetime_received" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "file"              BYTEA                    NOT NULL,
+    "status"            VARCHAR(16)              NOT NULL DEFAULT 'pending',
+    "email_id"          INTEGER REFERENCES emails (id) ON DELETE SET NULL,
+    "created_at"        TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "resolved_at"       TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS quarantine_status_idx ON quarantine (status);
+
+COMMIT;
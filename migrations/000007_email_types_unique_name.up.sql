@@ -0,0 +1,5 @@
+BEGIN;
+
+CREATE UNIQUE INDEX IF NOT EXISTS email_types_name_idx ON email_types ("name");
+
+COMMIT;
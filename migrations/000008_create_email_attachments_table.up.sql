@@ -0,0 +1,17 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS email_attachments
+(
+    "id"           SERIAL PRIMARY KEY,
+    "email_id"     INTEGER                  NOT NULL REFERENCES emails (id) ON DELETE CASCADE,
+    "filename"     VARCHAR(255)             NOT NULL,
+    "content_type" VARCHAR(255)             NOT NULL DEFAULT '',
+    "handler"      VARCHAR(255)             NOT NULL,
+    "status"       VARCHAR(16)              NOT NULL,
+    "rows"         INTEGER                  NOT NULL DEFAULT 0,
+    "error"        TEXT                     NOT NULL DEFAULT '',
+    "created_at"   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS email_attachments_email_id_idx ON email_attachments (email_id);
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE IF EXISTS ingestion_runs;
+
+COMMIT;
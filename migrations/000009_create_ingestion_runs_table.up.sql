@@ -0,0 +1,19 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS ingestion_runs
+(
+    "id"            SERIAL PRIMARY KEY,
+    "trigger"       VARCHAR(32)              NOT NULL,
+    "mailbox"       VARCHAR(255)             NOT NULL,
+    "started_at"    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "finished_at"   TIMESTAMP WITH TIME ZONE,
+    "seen"          INTEGER                  NOT NULL DEFAULT 0,
+    "skipped"       INTEGER                  NOT NULL DEFAULT 0,
+    "ingested"      INTEGER                  NOT NULL DEFAULT 0,
+    "failed"        INTEGER                  NOT NULL DEFAULT 0,
+    "rows_inserted" INTEGER                  NOT NULL DEFAULT 0,
+    "error"         TEXT                     NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS ingestion_runs_started_at_idx ON ingestion_runs (started_at);
+
+COMMIT;
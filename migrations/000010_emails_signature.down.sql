@@ -0,0 +1,11 @@
+BEGIN;
+
+ALTER TABLE quarantine
+    DROP COLUMN IF EXISTS details;
+
+ALTER TABLE emails
+    DROP COLUMN IF EXISTS signature_status,
+    DROP COLUMN IF EXISTS signature_signer,
+    DROP COLUMN IF EXISTS signature_error;
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+ALTER TABLE emails
+    ADD COLUMN IF NOT EXISTS signature_status VARCHAR(16) NOT NULL DEFAULT 'not_checked',
+    ADD COLUMN IF NOT EXISTS signature_signer TEXT        NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS signature_error  TEXT        NOT NULL DEFAULT '';
+
+ALTER TABLE quarantine
+    ADD COLUMN IF NOT EXISTS details TEXT NOT NULL DEFAULT '';
+
+COMMIT;
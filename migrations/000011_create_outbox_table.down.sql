@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE IF EXISTS outbox_attachments;
+DROP TABLE IF EXISTS outbox;
+
+COMMIT;
@@ -0,0 +1,29 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS outbox
+(
+    "id"              SERIAL PRIMARY KEY,
+    "kind"            VARCHAR(32)              NOT NULL,
+    "recipients"      TEXT[]                   NOT NULL,
+    "subject"         TEXT                     NOT NULL,
+    "body"            TEXT                     NOT NULL DEFAULT '',
+    "status"          VARCHAR(16)              NOT NULL DEFAULT 'pending',
+    "attempts"        INTEGER                  NOT NULL DEFAULT 0,
+    "next_attempt_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "last_error"      TEXT                     NOT NULL DEFAULT '',
+    "created_at"      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "sent_at"         TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS outbox_status_next_attempt_at_idx ON outbox (status, next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS outbox_attachments
+(
+    "id"           SERIAL PRIMARY KEY,
+    "outbox_id"    INTEGER      NOT NULL REFERENCES outbox (id) ON DELETE CASCADE,
+    "filename"     VARCHAR(255) NOT NULL,
+    "content_type" VARCHAR(255) NOT NULL,
+    "data"         BYTEA        NOT NULL
+);
+CREATE INDEX IF NOT EXISTS outbox_attachments_outbox_id_idx ON outbox_attachments (outbox_id);
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE outbox
+    DROP COLUMN IF EXISTS "html_body";
+
+DROP TABLE IF EXISTS mail_templates;
+
+COMMIT;
@@ -0,0 +1,16 @@
+BEGIN;
+
+-- Шаблоны исходящих писем, заданные оператором. Пустое поле - берётся шаблон из папки или встроенный.
+CREATE TABLE IF NOT EXISTS mail_templates
+(
+    "kind"       VARCHAR(32) PRIMARY KEY,
+    "subject"    TEXT                     NOT NULL DEFAULT '',
+    "text_body"  TEXT                     NOT NULL DEFAULT '',
+    "html_body"  TEXT                     NOT NULL DEFAULT '',
+    "updated_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE outbox
+    ADD COLUMN IF NOT EXISTS "html_body" TEXT NOT NULL DEFAULT '';
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP TABLE IF EXISTS correction_batch_rows;
+DROP TABLE IF EXISTS correction_batches;
+
+ALTER TABLE outbox
+    DROP COLUMN IF EXISTS "message_id";
+
+COMMIT;
@@ -0,0 +1,48 @@
+BEGIN;
+
+ALTER TABLE outbox
+    ADD COLUMN IF NOT EXISTS "message_id" VARCHAR(255) NOT NULL DEFAULT '';
+
+-- Пакеты записей с ошибками, отправленные на коррекцию
+CREATE TABLE IF NOT EXISTS correction_batches
+(
+    "id"           SERIAL PRIMARY KEY,
+    "outbox_id"    INTEGER REFERENCES outbox (id) ON DELETE SET NULL,
+    "message_id"   VARCHAR(255)             NOT NULL DEFAULT '', -- Message-ID письма, ответ ищется по In-Reply-To и References
+    "status"       VARCHAR(16)              NOT NULL DEFAULT 'open',
+    "created_at"   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "escalated_at" TIMESTAMP WITH TIME ZONE,
+    "closed_at"    TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS correction_batches_message_id_idx ON correction_batches (message_id);
+CREATE INDEX IF NOT EXISTS correction_batches_status_idx ON correction_batches (status);
+
+-- Записи пакета. Каждая запись с ошибкой попадает на коррекцию один раз.
+CREATE TABLE IF NOT EXISTS correction_batch_rows
+(
+    "batch_id"       INTEGER                  NOT NULL REFERENCES correction_batches (id) ON DELETE CASCADE,
+    "person_id"      INTEGER                  NOT NULL REFERENCES persons_from_erc (id) ON DELETE CASCADE,
+    "status"         VARCHAR(16)              NOT NULL DEFAULT 'pending',
+    "reply_email_id" INTEGER REFERENCES emails (id) ON DELETE SET NULL,
+    "corrected_at"   TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY ("batch_id", "person_id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS correction_batch_rows_person_id_idx ON correction_batch_rows (person_id);
+
+-- До пакетов все записи с ошибками отправлялись на коррекцию при каждой проверке почты. Чтобы после
+-- обновления они не ушли ещё раз, переносим их в закрытый пакет без письма. Записи по-прежнему ждут
+-- исправления: ответ на старое письмо сопоставляется с ними по номерам записей.
+WITH legacy AS (
+    INSERT INTO correction_batches (status, closed_at)
+    SELECT 'closed', CURRENT_TIMESTAMP
+    WHERE EXISTS(SELECT 1 FROM persons_from_erc WHERE errors IS NOT NULL AND cardinality(errors) > 0)
+    RETURNING id
+)
+INSERT INTO correction_batch_rows (batch_id, person_id)
+SELECT legacy.id, pfe.id
+FROM legacy,
+     persons_from_erc pfe
+WHERE pfe.errors IS NOT NULL
+  AND cardinality(pfe.errors) > 0;
+
+COMMIT;
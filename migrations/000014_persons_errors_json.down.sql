@@ -0,0 +1,29 @@
+BEGIN;
+
+ALTER TABLE persons_from_erc
+    ADD COLUMN errors_text VARCHAR[];
+UPDATE persons_from_erc
+SET errors_text = ARRAY(SELECT CASE
+                                   WHEN e ->> 'code' = 'legacy' THEN e ->> 'value'
+                                   ELSE concat_ws(': ', NULLIF(e ->> 'field', ''), e ->> 'code', e ->> 'value') END
+                        FROM jsonb_array_elements(errors) AS e)
+WHERE errors IS NOT NULL;
+ALTER TABLE persons_from_erc
+    DROP COLUMN errors;
+ALTER TABLE persons_from_erc
+    RENAME COLUMN errors_text TO errors;
+
+ALTER TABLE persons_from_rstk
+    ADD COLUMN errors_text VARCHAR[];
+UPDATE persons_from_rstk
+SET errors_text = ARRAY(SELECT CASE
+                                   WHEN e ->> 'code' = 'legacy' THEN e ->> 'value'
+                                   ELSE concat_ws(': ', NULLIF(e ->> 'field', ''), e ->> 'code', e ->> 'value') END
+                        FROM jsonb_array_elements(errors) AS e)
+WHERE errors IS NOT NULL;
+ALTER TABLE persons_from_rstk
+    DROP COLUMN errors;
+ALTER TABLE persons_from_rstk
+    RENAME COLUMN errors_text TO errors;
+
+COMMIT;
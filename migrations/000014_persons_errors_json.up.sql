@@ -0,0 +1,27 @@
+BEGIN;
+
+-- Ошибки разбора хранятся как JSON: [{"code": ..., "field": ..., "value": ..., "column": ...}].
+-- Старые текстовые ошибки сохраняются с кодом legacy, текст - в value, столбец неизвестен (-1).
+ALTER TABLE persons_from_erc
+    ADD COLUMN errors_json JSONB;
+UPDATE persons_from_erc
+SET errors_json = (SELECT jsonb_agg(jsonb_build_object('code', 'legacy', 'field', '', 'value', e, 'column', -1))
+                   FROM unnest(errors) AS e)
+WHERE errors IS NOT NULL AND cardinality(errors) > 0;
+ALTER TABLE persons_from_erc
+    DROP COLUMN errors;
+ALTER TABLE persons_from_erc
+    RENAME COLUMN errors_json TO errors;
+
+ALTER TABLE persons_from_rstk
+    ADD COLUMN errors_json JSONB;
+UPDATE persons_from_rstk
+SET errors_json = (SELECT jsonb_agg(jsonb_build_object('code', 'legacy', 'field', '', 'value', e, 'column', -1))
+                   FROM unnest(errors) AS e)
+WHERE errors IS NOT NULL AND cardinality(errors) > 0;
+ALTER TABLE persons_from_rstk
+    DROP COLUMN errors;
+ALTER TABLE persons_from_rstk
+    RENAME COLUMN errors_json TO errors;
+
+COMMIT;
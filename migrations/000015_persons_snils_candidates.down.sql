@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE persons_from_erc
+    DROP COLUMN IF EXISTS snils_candidates;
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+-- Кандидаты для восстановления СНИЛС по похожим ФИО:
+-- [{"snils": ..., "family": ..., "name": ..., "patronymic": ..., "birthdate": ..., "score": ..., "applied": ...}].
+-- applied - СНИЛС кандидата подставлен в строку автоматически или оператором.
+ALTER TABLE persons_from_erc
+    ADD COLUMN IF NOT EXISTS snils_candidates JSONB;
+
+COMMIT;
@@ -0,0 +1,13 @@
+BEGIN;
+
+ALTER TABLE persons_from_erc
+    DROP COLUMN IF EXISTS family_raw,
+    DROP COLUMN IF EXISTS name_raw,
+    DROP COLUMN IF EXISTS patronymic_raw;
+
+ALTER TABLE persons_from_rstk
+    DROP COLUMN IF EXISTS family_raw,
+    DROP COLUMN IF EXISTS name_raw,
+    DROP COLUMN IF EXISTS patronymic_raw;
+
+COMMIT;
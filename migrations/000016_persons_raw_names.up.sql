@@ -0,0 +1,30 @@
+BEGIN;
+
+-- ФИО как в файле, до приведения к единому виду (parser.Name).
+-- Для старых строк исходным считается сохранённое значение, само оно приводится к виду
+-- "Слово-Слово" без лишних пробелов. Латинские буквы-двойники исправляются только при новой загрузке.
+ALTER TABLE persons_from_erc
+    ADD COLUMN IF NOT EXISTS family_raw     VARCHAR NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS name_raw       VARCHAR NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS patronymic_raw VARCHAR NOT NULL DEFAULT '';
+UPDATE persons_from_erc
+SET family_raw     = family,
+    name_raw       = name,
+    patronymic_raw = patronymic,
+    family         = INITCAP(REGEXP_REPLACE(BTRIM(family), '\s+', ' ', 'g')),
+    name           = INITCAP(REGEXP_REPLACE(BTRIM(name), '\s+', ' ', 'g')),
+    patronymic     = INITCAP(REGEXP_REPLACE(BTRIM(patronymic), '\s+', ' ', 'g'));
+
+ALTER TABLE persons_from_rstk
+    ADD COLUMN IF NOT EXISTS family_raw     VARCHAR NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS name_raw       VARCHAR NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS patronymic_raw VARCHAR NOT NULL DEFAULT '';
+UPDATE persons_from_rstk
+SET family_raw     = family,
+    name_raw       = name,
+    patronymic_raw = patronymic,
+    family         = INITCAP(REGEXP_REPLACE(BTRIM(family), '\s+', ' ', 'g')),
+    name           = INITCAP(REGEXP_REPLACE(BTRIM(name), '\s+', ' ', 'g')),
+    patronymic     = INITCAP(REGEXP_REPLACE(BTRIM(patronymic), '\s+', ' ', 'g'));
+
+COMMIT;
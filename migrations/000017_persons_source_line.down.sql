@@ -0,0 +1,11 @@
+BEGIN;
+
+ALTER TABLE persons_from_erc
+    DROP COLUMN IF EXISTS source_line,
+    DROP COLUMN IF EXISTS line_number;
+
+ALTER TABLE persons_from_rstk
+    DROP COLUMN IF EXISTS source_line,
+    DROP COLUMN IF EXISTS line_number;
+
+COMMIT;
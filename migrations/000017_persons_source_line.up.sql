@@ -0,0 +1,12 @@
+BEGIN;
+
+-- Исходная строка файла и её номер (с 1), у строк, загруженных раньше, номер 0 - неизвестен
+ALTER TABLE persons_from_erc
+    ADD COLUMN IF NOT EXISTS source_line TEXT    NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS line_number INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE persons_from_rstk
+    ADD COLUMN IF NOT EXISTS source_line TEXT    NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS line_number INTEGER NOT NULL DEFAULT 0;
+
+COMMIT;
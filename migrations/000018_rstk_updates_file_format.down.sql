@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE rstk_updates
+    DROP COLUMN IF EXISTS encoding,
+    DROP COLUMN IF EXISTS delimiter;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+-- Кодировка и разделитель столбцов, определённые при загрузке файла, у старых загрузок пустые
+ALTER TABLE rstk_updates
+    ADD COLUMN IF NOT EXISTS encoding  VARCHAR(16) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS delimiter VARCHAR(4)  NOT NULL DEFAULT '';
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP INDEX IF EXISTS rstk_update_types_name_idx;
+ALTER TABLE rstk_update_types
+    DROP COLUMN IF EXISTS header_pattern;
+
+COMMIT;
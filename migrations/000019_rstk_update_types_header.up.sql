@@ -0,0 +1,15 @@
+BEGIN;
+
+-- Тип документа РСТК определяется по первой строке файла, подходящей под header_pattern (регулярное выражение)
+ALTER TABLE rstk_update_types
+    ADD COLUMN IF NOT EXISTS header_pattern TEXT NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX IF NOT EXISTS rstk_update_types_name_idx ON rstk_update_types (name);
+
+UPDATE rstk_update_types
+SET header_pattern = '(?i)^\s*список\s+социальных\s+карт\s*$'
+WHERE name = 'stk';
+UPDATE rstk_update_types
+SET header_pattern = '(?i)^\s*список\s+банковских\s+карт\s*$'
+WHERE name = 'mir';
+
+COMMIT;
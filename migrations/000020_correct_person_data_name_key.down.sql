@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP INDEX IF EXISTS correct_person_data_name_key_idx;
+DROP FUNCTION IF EXISTS name_key(TEXT);
+
+COMMIT;
@@ -0,0 +1,25 @@
+BEGIN;
+
+-- name_key приводит имя к виду для сравнения так же, как parser.NameKey: строчные буквы, ё как е,
+-- латинские двойники заменены русскими буквами, прочие символы кроме дефиса убраны, пробелы схлопнуты.
+-- Регистр переводится через TRANSLATE, а не только LOWER: LOWER не знает русских букв при локали C.
+CREATE OR REPLACE FUNCTION name_key(s TEXT) RETURNS TEXT
+    LANGUAGE SQL
+    IMMUTABLE
+    PARALLEL SAFE
+AS
+$$
+SELECT BTRIM(REGEXP_REPLACE(REGEXP_REPLACE(
+                                    LOWER(TRANSLATE(s,
+                                                    'АБВГДЕЁЖЗИЙКЛМНОПРСТУФХЦЧШЩЪЫЬЭЮЯёABCEHKMOPTXYabcehkmoptxy',
+                                                    'абвгдеежзийклмнопрстуфхцчшщъыьэюяеавсенкмортхуавсенкмортху')),
+                                    '[^a-zа-я[:space:]-]', '', 'g'),
+                            '[[:space:]]+', ' ', 'g'))
+$$;
+
+-- Эталонные данные грузятся как есть (часто заглавными буквами), а ФИО из реестров приводятся
+-- к виду "Иванов" (parser.Name), поэтому точный поиск сравнивает ключи
+CREATE INDEX IF NOT EXISTS correct_person_data_name_key_idx
+    ON correct_person_data (name_key("family"), name_key("name"), name_key("patronymic"), "birthdate");
+
+COMMIT;
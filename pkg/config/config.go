@@ -44,7 +44,11 @@ type Config struct {
 	}
 	Email struct {
 		Host           string        `env:"EMAIL_HOST"`
+		Protocol       string        `env:"EMAIL_PROTOCOL" envDefault:"pop3"` // pop3 или imap
 		PortPOP3       int           `env:"EMAIL_PORT_POP3" envDefault:"110"`
+		PortIMAP       int           `env:"EMAIL_PORT_IMAP" envDefault:"143"`
+		IMAPMailbox    string        `env:"EMAIL_IMAP_MAILBOX" envDefault:"INBOX"`
+		IMAPIdle       bool          `env:"EMAIL_IMAP_IDLE" envDefault:"true"` // ждать новые письма через IDLE, не дожидаясь CheckInterval
 		PortSMTP       int           `env:"EMAIL_PORT_SMTP" envDefault:"25"`
 		Username       string        `env:"EMAIL_USERNAME"`
 		Password       string        `env:"EMAIL_PASSWORD"`
@@ -54,6 +58,72 @@ type Config struct {
 		FromCorrection string        `env:"EMAIL_FROM_CORRECTION"`
 		SendReportAt   TimeToday     `env:"EMAIL_SEND_REPORT_AT" envDefault:"06:00"`
 		CheckInterval  time.Duration `env:"EMAIL_CHECK_INTERVAL" envDefault:"30m"`
+		// Папка с шаблонами исходящих писем <вид>.subject.tmpl, <вид>.txt.tmpl, <вид>.html.tmpl,
+		// шаблоны из базы важнее, если файла нет - используется встроенный шаблон.
+		TemplatesDir string `env:"EMAIL_TEMPLATES_DIR"`
+		// Дополнительные маршруты "тип|регулярка отправителя|регулярка темы" через ";",
+		// проверяются раньше FromErc и FromCorrection.
+		Routes []string `env:"EMAIL_ROUTES" envSeparator:";"`
+		// Прекращать проверку ящика на первом письме старше последнего сохранённого.
+		// Ускоряет проверку большого ящика, но теряет письма, пришедшие с опозданием.
+		DateCutoff bool `env:"EMAIL_DATE_CUTOFF" envDefault:"false"`
+
+		// Ограничения распаковки архивов zip, gzip и tar из вложений
+		UnpackMaxEntries int   `env:"EMAIL_UNPACK_MAX_ENTRIES" envDefault:"100"`
+		UnpackMaxSize    int64 `env:"EMAIL_UNPACK_MAX_SIZE" envDefault:"104857600"` // байт после распаковки
+		UnpackMaxDepth   int   `env:"EMAIL_UNPACK_MAX_DEPTH" envDefault:"2"`        // 1 - без вложенных архивов
+
+		// Удаление писем с сервера: keep - не удалять, delete - сразу после загрузки,
+		// days - старше RetentionDays дней, count - все, кроме RetentionCount последних.
+		// Удаляются только письма, сохранённые в emails.
+		Retention      string `env:"EMAIL_RETENTION" envDefault:"keep"`
+		RetentionDays  int    `env:"EMAIL_RETENTION_DAYS" envDefault:"30"`
+		RetentionCount int    `env:"EMAIL_RETENTION_COUNT" envDefault:"1000"`
+
+		// Защита соединений: plain, starttls или tls. В режиме plain без AllowPlainAuth пароль не передаётся,
+		// поэтому с настройками по умолчанию почта не принимается, см. README.
+		POP3Security    string   `env:"EMAIL_POP3_SECURITY" envDefault:"plain"`
+		IMAPSecurity    string   `env:"EMAIL_IMAP_SECURITY" envDefault:"plain"`
+		SMTPSecurity    string   `env:"EMAIL_SMTP_SECURITY" envDefault:"plain"`
+		TLSCAFile       string   `env:"EMAIL_TLS_CA_FILE"`                         // дополнительные корневые сертификаты в PEM
+		TLSPinnedSHA256 []string `env:"EMAIL_TLS_PINNED_SHA256"`                   // отпечатки SHA-256 допустимых сертификатов сервера
+		AllowPlainAuth  bool     `env:"EMAIL_ALLOW_PLAIN_AUTH" envDefault:"false"` // разрешить передавать пароль без шифрования
+
+		// Как доставлять исходящие письма: smtp, dir - файлами .eml в TransportDir,
+		// dry-run - только писать в лог, не помечая отчёт в ЕРЦ отправленным.
+		Transport    string `env:"EMAIL_TRANSPORT" envDefault:"smtp"`
+		TransportDir string `env:"EMAIL_TRANSPORT_DIR"`
+
+		// Проверка подписи S/MIME: "тип письма=файл PEM с доверенными сертификатами" через ";".
+		// Письма этих типов без верной подписи уходят в карантин, остальные типы не проверяются.
+		SMIMETrustStores []string `env:"EMAIL_SMIME_TRUST_STORES" envSeparator:";"`
+	}
+	Outbox struct {
+		Interval    time.Duration `env:"OUTBOX_INTERVAL" envDefault:"1m"` // как часто проверять очередь исходящих писем
+		MaxAttempts int           `env:"OUTBOX_MAX_ATTEMPTS" envDefault:"10"`
+		BackoffBase time.Duration `env:"OUTBOX_BACKOFF_BASE" envDefault:"1m"` // пауза после первой неудачной попытки, дальше удваивается
+		BackoffMax  time.Duration `env:"OUTBOX_BACKOFF_MAX" envDefault:"6h"`
+	}
+	Correction struct {
+		EscalateDays int      `env:"CORRECTION_ESCALATE_DAYS" envDefault:"7"` // через сколько дней без ответа напоминать, 0 - не напоминать
+		EscalateTo   []string `env:"CORRECTION_ESCALATE_TO"`                  // кому напоминать, по умолчанию EMAIL_TO_CORRECTION
+	}
+	// Типы документов РСТК "имя|описание|регулярка заголовка" через ";", добавляются в базу при запуске
+	RstkTypes []string `env:"RSTK_TYPES" envSeparator:";"`
+	// JSON-файл с описаниями форматов реестров ЕРЦ (см. persons.ErcFormat), проверяются раньше встроенного формата
+	ErcFormatsFile string `env:"ERC_FORMATS_FILE"`
+	// Восстановление СНИЛС с ошибкой по ФИО и дате рождения: exact - только точное совпадение,
+	// fuzzy - ещё и похожие ФИО с той же датой рождения (оценка сходства от 0 до 1).
+	SnilsMatch struct {
+		Mode          string  `env:"SNILS_MATCH_MODE" envDefault:"exact"`
+		Threshold     float64 `env:"SNILS_MATCH_THRESHOLD" envDefault:"0.9"`    // с какой оценки СНИЛС подставляется сам, если кандидат один
+		MinScore      float64 `env:"SNILS_MATCH_MIN_SCORE" envDefault:"0.7"`    // кандидаты ниже не показываются оператору
+		MaxCandidates int     `env:"SNILS_MATCH_MAX_CANDIDATES" envDefault:"5"` // сколько кандидатов сохранять для оператора
+	}
+	DropFolder struct {
+		Path     string        `env:"DROP_FOLDER_PATH"` // если не задан, папка не проверяется
+		Interval time.Duration `env:"DROP_FOLDER_INTERVAL" envDefault:"1m"`
+		Settle   time.Duration `env:"DROP_FOLDER_SETTLE" envDefault:"10s"` // сколько файл не должен меняться, чтобы считаться скопированным
 	}
 	Postgres struct {
 		Host     string `env:"POSTGRES_HOST" envDefault:"localhost"`
@@ -0,0 +1,180 @@
+// Package dropfolder загружает файлы ЕРЦ и РСТК, которые операторы кладут в папку (флешка, сетевая папка).
+//
+// Структура папки:
+//
+//	<path>/erc/         - реестры ЕРЦ, текстовые или xlsx
+//	<path>/rstk/        - списки карт РСТК, текстовые или xlsx
+//	<path>/<тип>/done/   - загруженные файлы, если строки реестра пропущены - рядом <имя>.error.txt со списком
+//	<path>/<тип>/failed/ - файлы с ошибкой, рядом с каждым лежит <имя>.error.txt с описанием
+//
+// Папка опрашивается периодически, а не через уведомления файловой системы: на сетевых папках
+// уведомления не работают.
+package dropfolder
+
+import (
+	"context"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/importer"
+	"github.com/morzik45/stk-registry/pkg/persons"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KindErc  = "erc"
+	KindRstk = "rstk"
+
+	doneDir   = "done"
+	failedDir = "failed"
+)
+
+type DropFolder struct {
+	logger *zap.Logger
+	config *config.Config
+	db     *postgres.DB
+	parser *persons.ErcParser
+	mutex  sync.Mutex
+}
+
+func New(db *postgres.DB, cfg *config.Config, logger *zap.Logger) (*DropFolder, error) {
+	ercParser, err := persons.NewErcParser(db, cfg)
+	if err != nil {
+		return nil, err
+	}
+	df := DropFolder{
+		db:     db,
+		parser: ercParser,
+		config: cfg,
+		logger: logger.Named("drop_folder"),
+	}
+	for _, kind := range []string{KindErc, KindRstk} {
+		for _, dir := range []string{"", doneDir, failedDir} {
+			if err := os.MkdirAll(filepath.Join(cfg.DropFolder.Path, kind, dir), 0o755); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &df, nil
+}
+
+// Scan загружает все файлы, появившиеся в папке с прошлой проверки.
+// isHaveNew - загружен хотя бы один непустой реестр ЕРЦ.
+func (df *DropFolder) Scan() (isHaveNew bool) {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+
+	for _, kind := range []string{KindErc, KindRstk} {
+		files, err := df.readyFiles(filepath.Join(df.config.DropFolder.Path, kind))
+		if err != nil {
+			df.logger.Error("Error reading drop folder", zap.String("kind", kind), zap.Error(err))
+			continue
+		}
+		for _, path := range files {
+			count, rejected, err := df.importFile(kind, path)
+			if err != nil {
+				df.logger.Error("Error importing file", zap.String("file", path), zap.Error(err))
+				df.moveFailed(kind, path, err)
+				continue
+			}
+			df.logger.Info("File imported", zap.String("file", path), zap.Int("rows", count), zap.Int("rejected", len(rejected)))
+			if kind == KindErc && count > 0 {
+				isHaveNew = true
+			}
+			target := df.move(path, filepath.Join(df.config.DropFolder.Path, kind, doneDir))
+			if len(rejected) > 0 && target != path {
+				df.writeReport(target, path, rejected.String())
+			}
+		}
+	}
+	return
+}
+
+// readyFiles возвращает файлы, которые не менялись хотя бы DropFolder.Settle, чтобы не взять недокопированный файл.
+func (df *DropFolder) readyFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(info.ModTime()) < df.config.DropFolder.Settle {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	return files, nil
+}
+
+// importFile загружает файл, rejected - строки, пропущенные при разборе
+func (df *DropFolder) importFile(kind, path string) (count int, rejected persons.RejectedRows, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	tx, err := df.db.BeginTx(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func(tx *sqlx.Tx) { _ = tx.Rollback() }(tx)
+
+	switch kind {
+	case KindErc:
+		eu := postgres.ErcUpdate{Name: filepath.Base(path), Source: postgres.ErcSourceDropFolder}
+		count, rejected, err = importer.ImportErc(ctx, df.db, tx, df.parser, &eu, f)
+	case KindRstk:
+		_, count, rejected, err = importer.ImportRstk(ctx, df.db, tx, importer.RstkFromDate(path), "", f)
+	default:
+		err = fmt.Errorf("unknown file kind: %s", kind)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return count, rejected, tx.Commit()
+}
+
+// move переносит файл в папку dir, добавляя к имени время, чтобы не затереть одноимённые файлы.
+func (df *DropFolder) move(path, dir string) string {
+	target := filepath.Join(dir, time.Now().Format("20060102-150405")+"_"+filepath.Base(path))
+	if err := os.Rename(path, target); err != nil {
+		df.logger.Error("Error moving file", zap.String("file", path), zap.String("to", target), zap.Error(err))
+		return path
+	}
+	return target
+}
+
+func (df *DropFolder) moveFailed(kind, path string, importErr error) {
+	target := df.move(path, filepath.Join(df.config.DropFolder.Path, kind, failedDir))
+	if target == path {
+		// Файл не удалось перенести, отчёт рядом с ним был бы принят за новый файл
+		return
+	}
+	df.writeReport(target, path, importErr.Error())
+}
+
+// writeReport пишет отчёт об ошибках рядом с перенесённым файлом target
+func (df *DropFolder) writeReport(target, path, errText string) {
+	report := fmt.Sprintf("file: %s\ntime: %s\nerror: %s\n",
+		filepath.Base(path), time.Now().Format("2006-01-02 15:04:05"), errText)
+	if err := os.WriteFile(target+".error.txt", []byte(report), 0o644); err != nil {
+		df.logger.Error("Error writing error report", zap.String("file", target), zap.Error(err))
+	}
+}
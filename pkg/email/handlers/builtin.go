@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/importer"
+	"github.com/morzik45/stk-registry/pkg/persons"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"github.com/morzik45/stk-registry/pkg/utils"
+	"go.uber.org/zap"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErcRegister сохраняет реестры выданных купонов от ЕРЦ
+type ErcRegister struct {
+	db     *postgres.DB
+	parser *persons.ErcParser
+	logger *zap.Logger
+}
+
+func (h *ErcRegister) Handle(ctx context.Context, tx *sqlx.Tx, e *postgres.Email, a Attachment) (Result, error) {
+	eu := postgres.ErcUpdate{
+		EmailID: &e.ID,
+		Name:    a.Filename,
+		Source:  postgres.ErcSourceEmail,
+	}
+	count, rejected, err := importer.ImportErc(ctx, h.db, tx, h.parser, &eu, a.Body)
+	var formatErr *persons.FormatError
+	if errors.As(err, &formatErr) {
+		return Result{}, &ParseError{Err: err}
+	} else if err != nil {
+		return Result{}, err
+	}
+	if len(rejected) > 0 {
+		h.logger.Warn("Rows rejected in attachment", zap.String("filename", a.Filename), zap.Int("rejected", len(rejected)))
+	}
+	if count == 0 {
+		h.logger.Info("No persons found in attachment", zap.String("filename", a.Filename))
+	}
+	return Result{Rows: count, IsHaveNew: count > 0, Warning: rejected.String()}, nil
+}
+
+// Correction применяет исправления данных, присланные в ответ на коррекцию.
+// Письмо относится к пакету коррекции, на который отвечает (In-Reply-To, References). Если пакет
+// не найден, каждая запись сопоставляется по номеру с пакетом, в который она была отправлена.
+// Записи, которые не ждут исправления, пропускаются, их номера попадают в Result.Warning.
+type Correction struct {
+	db     *postgres.DB
+	logger *zap.Logger
+}
+
+func (h *Correction) Handle(ctx context.Context, tx *sqlx.Tx, e *postgres.Email, a Attachment) (Result, error) {
+	correct, err := utils.ParseExcelForCorrection(a.Body, h.logger)
+	if err != nil {
+		return Result{}, &ParseError{Err: err}
+	}
+	if len(correct) == 0 {
+		h.logger.Info("No persons found in attachment", zap.String("filename", a.Filename))
+		return Result{}, nil
+	}
+
+	batchID := 0
+	batch, err := h.db.CorrectionBatches.GetByMessageID(ctx, referencedMessageIDs(e.File), tx)
+	if err == nil {
+		batchID = batch.ID
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return Result{}, err
+	}
+
+	ids := make([]int, 0, len(correct))
+	for _, p := range correct {
+		ids = append(ids, p.ID)
+	}
+	waiting, err := h.db.CorrectionBatches.WaitingRows(ctx, ids, tx)
+	if err != nil {
+		return Result{}, err
+	}
+	rows := make(map[int]postgres.CorrectionBatchRow, len(waiting))
+	for _, r := range waiting {
+		rows[r.PersonID] = r
+	}
+
+	applied, batches := 0, make(map[int]bool)
+	var skipped []int
+	for i := range correct {
+		row, ok := rows[correct[i].ID]
+		if !ok || (batchID != 0 && row.BatchID != batchID) {
+			h.logger.Warn("Person is not waiting for correction in this batch, skipped",
+				zap.Int("id", correct[i].ID), zap.Int("batch", batchID))
+			skipped = append(skipped, correct[i].ID)
+			continue
+		}
+		// После ошибки транзакция прервана, продолжать нет смысла: вложение откатится целиком
+		err = h.db.PersonsFromErc.UpdateFromCorrection(ctx, correct[i], tx)
+		if err != nil {
+			return Result{}, err
+		}
+		err = h.db.CorrectionBatches.MarkCorrected(ctx, row, e.ID, tx)
+		if err != nil {
+			return Result{}, err
+		}
+		batches[row.BatchID] = true
+		applied++
+	}
+	for id := range batches {
+		err = h.db.CorrectionBatches.CloseAnswered(ctx, id, tx)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	h.logger.Info("Corrections applied", zap.Int("batch", batchID), zap.Int("applied", applied), zap.Int("rows", len(correct)))
+	return Result{Rows: applied, Warning: skippedWarning(skipped)}, nil
+}
+
+// maxSkippedReport сколько номеров пропущенных записей перечисляется в предупреждении
+const maxSkippedReport = 50
+
+// skippedWarning предупреждение о записях ответа, которые не ждали исправления
+func skippedWarning(ids []int) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	list := make([]string, 0, len(ids))
+	for i, id := range ids {
+		if i == maxSkippedReport {
+			list = append(list, fmt.Sprintf("и ещё %d", len(ids)-i))
+			break
+		}
+		list = append(list, strconv.Itoa(id))
+	}
+	return fmt.Sprintf("пропущено записей, не ждущих исправления в этом пакете: %d (%s)", len(ids), strings.Join(list, ", "))
+}
+
+// messageIDPattern идентификатор письма в угловых скобках
+var messageIDPattern = regexp.MustCompile(`<([^<>\s]+)>`)
+
+// referencedMessageIDs возвращает Message-ID писем (без угловых скобок), на которые отвечает письмо raw
+func referencedMessageIDs(raw []byte) []string {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	for _, h := range []string{"In-Reply-To", "References"} {
+		for _, id := range messageIDPattern.FindAllStringSubmatch(m.Header.Get(h), -1) {
+			ids = append(ids, id[1])
+		}
+	}
+	return ids
+}
@@ -0,0 +1,113 @@
+// Package handlers обработчики вложений входящих писем.
+//
+// Каждому типу письма (имя из email_types) соответствует обработчик, тип письма определяется
+// маршрутами из конфига (см. ParseRoutes). Чтобы принимать новый вид документов, достаточно
+// зарегистрировать обработчик под новым именем и добавить маршрут в EMAIL_ROUTES.
+package handlers
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/persons"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"go.uber.org/zap"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Встроенные типы писем
+const (
+	TypeErcRegister = "erc_register" // реестр выданных купонов от ЕРЦ
+	TypeCorrection  = "correction"   // исправление данных по купонам
+)
+
+// Attachment вложение письма
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Body        io.Reader
+}
+
+// Result итог обработки вложения
+type Result struct {
+	Rows      int    // сохранено или изменено строк
+	IsHaveNew bool   // появились новые записи ЕРЦ, которые нужно проверить и отправить на коррекцию
+	Warning   string // замечания к обработке, например пропущенные строки, сохраняются в email_attachments.error
+}
+
+// ParseError ошибка разбора содержимого вложения, остальные ошибки обработчика считаются ошибками БД
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Handler обрабатывает вложения писем одного типа.
+type Handler interface {
+	// Handle сохраняет данные вложения a письма e в транзакции tx, письмо к этому моменту уже сохранено.
+	// Каждое вложение обрабатывается под своей точкой сохранения, при ошибке изменения вложения откатываются.
+	Handle(ctx context.Context, tx *sqlx.Tx, e *postgres.Email, a Attachment) (Result, error)
+}
+
+// HandlerFunc позволяет использовать функцию как Handler
+type HandlerFunc func(ctx context.Context, tx *sqlx.Tx, e *postgres.Email, a Attachment) (Result, error)
+
+func (f HandlerFunc) Handle(ctx context.Context, tx *sqlx.Tx, e *postgres.Email, a Attachment) (Result, error) {
+	return f(ctx, tx, e, a)
+}
+
+// Registry обработчики вложений по имени типа письма
+type Registry struct {
+	mutex    sync.RWMutex
+	handlers map[string]Handler
+}
+
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[string]Handler)}
+}
+
+// NewDefaultRegistry создаёт реестр со встроенными обработчиками реестров ЕРЦ и коррекций
+func NewDefaultRegistry(db *postgres.DB, cfg *config.Config, logger *zap.Logger) (*Registry, error) {
+	ercParser, err := persons.NewErcParser(db, cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRegistry()
+	r.Register(TypeErcRegister, &ErcRegister{db: db, parser: ercParser, logger: logger.Named("erc_register")})
+	r.Register(TypeCorrection, &Correction{db: db, logger: logger.Named("correction")})
+	return r, nil
+}
+
+// Register добавляет обработчик для типа писем, обработчик с тем же именем заменяется
+func (r *Registry) Register(typeName string, h Handler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.handlers[typeName] = h
+}
+
+func (r *Registry) Get(typeName string) (Handler, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	h, ok := r.handlers[typeName]
+	return h, ok
+}
+
+// Names возвращает имена зарегистрированных типов по алфавиту
+func (r *Registry) Names() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	names := make([]string, 0, len(r.handlers))
+	for name := range r.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
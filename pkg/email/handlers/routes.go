@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"regexp"
+	"strings"
+)
+
+// Route определяет тип письма по адресу отправителя и теме
+type Route struct {
+	Type    string
+	From    *regexp.Regexp // nil - любой отправитель
+	Subject *regexp.Regexp // nil - любая тема
+}
+
+func (rt Route) Match(from, subject string) bool {
+	if rt.From != nil && !rt.From.MatchString(from) {
+		return false
+	}
+	if rt.Subject != nil && !rt.Subject.MatchString(subject) {
+		return false
+	}
+	return true
+}
+
+// ParseRoutes собирает маршруты из EMAIL_ROUTES, за ними идут адреса EMAIL_FROM_ERC и EMAIL_FROM_CORRECTION.
+//
+// Маршруты в EMAIL_ROUTES разделяются ";", маршрут имеет вид "тип|регулярка отправителя|регулярка темы",
+// пустая регулярка подходит под всё, например:
+//
+//	erc_ack|^noreply@erc\.ru$|(?i)^квитанция;pensioners||(?i)список пенсионеров
+func ParseRoutes(cfg *config.Config) ([]Route, error) {
+	var routes []Route
+	for _, s := range cfg.Email.Routes {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		parts := strings.Split(s, "|")
+		if len(parts) > 3 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid email route: %s", s)
+		}
+		rt := Route{Type: strings.TrimSpace(parts[0])}
+		var err error
+		if len(parts) > 1 && parts[1] != "" {
+			if rt.From, err = regexp.Compile(parts[1]); err != nil {
+				return nil, fmt.Errorf("invalid sender pattern in email route %s: %w", s, err)
+			}
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			if rt.Subject, err = regexp.Compile(parts[2]); err != nil {
+				return nil, fmt.Errorf("invalid subject pattern in email route %s: %w", s, err)
+			}
+		}
+		if rt.From == nil && rt.Subject == nil {
+			return nil, fmt.Errorf("email route matches any email: %s", s)
+		}
+		routes = append(routes, rt)
+	}
+
+	if cfg.Email.FromErc != "" {
+		routes = append(routes, Route{Type: TypeErcRegister, From: exactAddress(cfg.Email.FromErc)})
+	}
+	if cfg.Email.FromCorrection != "" {
+		routes = append(routes, Route{Type: TypeCorrection, From: exactAddress(cfg.Email.FromCorrection)})
+	}
+	return routes, nil
+}
+
+// MatchRoute возвращает тип первого подходящего маршрута
+func MatchRoute(routes []Route, from, subject string) (string, bool) {
+	for _, rt := range routes {
+		if rt.Match(from, subject) {
+			return rt.Type, true
+		}
+	}
+	return "", false
+}
+
+func exactAddress(addr string) *regexp.Regexp {
+	return regexp.MustCompile("(?i)^" + regexp.QuoteMeta(addr) + "$")
+}
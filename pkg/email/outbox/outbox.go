@@ -0,0 +1,208 @@
+// Package outbox отправляет исходящие письма через очередь в таблице outbox.
+//
+// Письмо сначала сохраняется в очередь (в той же транзакции, что и данные, по которым оно сформировано),
+// затем Deliver отправляет его. Если сервер недоступен, отправка повторяется с экспоненциально
+// растущей паузой, пока не кончатся попытки.
+package outbox
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/email/sender"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Сколько писем отправлять за один проход
+const batchSize = 20
+
+type Outbox struct {
+	logger *zap.Logger
+	config *config.Config
+	db     *postgres.DB
+	sender *sender.Sender
+	mutex  sync.Mutex
+}
+
+func New(db *postgres.DB, cfg *config.Config, logger *zap.Logger, sender *sender.Sender) *Outbox {
+	return &Outbox{
+		db:     db,
+		config: cfg,
+		logger: logger.Named("outbox"),
+		sender: sender,
+	}
+}
+
+// Enqueue ставит письмо вида kind (postgres.Outbox*) в очередь в рамках транзакции tx,
+// если tx == nil, письмо с вложениями сохраняется в отдельной транзакции
+func (o *Outbox) Enqueue(ctx context.Context, tx *sqlx.Tx, kind string, m sender.Message) (id int, err error) {
+	if tx == nil {
+		tx, err = o.db.BeginTx(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer func(tx *sqlx.Tx) {
+			_ = tx.Rollback()
+		}(tx)
+		id, err = o.Enqueue(ctx, tx, kind, m)
+		if err != nil {
+			return 0, err
+		}
+		return id, tx.Commit()
+	}
+
+	message := postgres.OutboxMessage{
+		Kind:       kind,
+		MessageID:  m.MessageID,
+		Recipients: m.To,
+		Subject:    m.Subject,
+		Body:       m.Body,
+		HTMLBody:   m.HTML,
+	}
+	for _, a := range m.Attachments {
+		message.Attachments = append(message.Attachments, postgres.OutboxAttachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Data:        a.Data,
+		})
+	}
+	err = o.db.Outbox.Create(ctx, &message, tx)
+	if err != nil {
+		return 0, err
+	}
+	o.logger.Info("Message enqueued", zap.Int("id", message.ID), zap.String("kind", kind), zap.Strings("to", m.To))
+	return message.ID, nil
+}
+
+// Deliver отправляет письма, которым подошло время отправки
+func (o *Outbox) Deliver() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	messages, err := o.db.Outbox.SelectDue(ctx, batchSize)
+	if err != nil {
+		o.logger.Error("Error selecting messages to send", zap.Error(err))
+		return
+	}
+	for i := range messages {
+		o.deliver(ctx, &messages[i])
+	}
+}
+
+func (o *Outbox) deliver(ctx context.Context, message *postgres.OutboxMessage) {
+	err := o.send(ctx, message)
+	message.Attempts++
+	if err == nil {
+		now := time.Now()
+		message.Status = postgres.OutboxSent
+		message.SentAt = &now
+		message.LastError = ""
+		o.logger.Info("Message sent", zap.Int("id", message.ID), zap.String("kind", message.Kind))
+	} else {
+		message.LastError = err.Error()
+		if message.Attempts >= o.config.Outbox.MaxAttempts {
+			message.Status = postgres.OutboxFailed
+			o.logger.Error("Message not sent, no attempts left", zap.Int("id", message.ID), zap.Int("attempts", message.Attempts), zap.Error(err))
+		} else {
+			message.NextAttemptAt = time.Now().Add(o.backoff(message.Attempts))
+			o.logger.Warn("Message not sent, will retry", zap.Int("id", message.ID), zap.Time("at", message.NextAttemptAt), zap.Error(err))
+		}
+	}
+	if err = o.save(ctx, message); err != nil {
+		// Если письмо ушло, а отметка не сохранилась, оно будет отправлено повторно
+		o.logger.Error("Error saving message status", zap.Int("id", message.ID), zap.Error(err))
+	}
+}
+
+// save сохраняет итог попытки. Если письмо на коррекцию так и не ушло, его пакет отменяется в той же транзакции.
+func (o *Outbox) save(ctx context.Context, message *postgres.OutboxMessage) error {
+	tx, err := o.db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sqlx.Tx) { _ = tx.Rollback() }(tx)
+
+	if err = o.db.Outbox.Update(ctx, message, tx); err != nil {
+		return err
+	}
+	if message.Status == postgres.OutboxFailed && message.Kind == postgres.OutboxCorrection {
+		if err = o.release(ctx, message.ID, tx); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Cancel отменяет отправку письма id, пакет коррекции, если письмо на коррекцию, отменяется в той же транзакции.
+// Если письма нет или оно уже не ждёт отправки, возвращается sql.ErrNoRows.
+func (o *Outbox) Cancel(ctx context.Context, id int) error {
+	tx, err := o.db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sqlx.Tx) { _ = tx.Rollback() }(tx)
+
+	if err = o.db.Outbox.Cancel(ctx, id, tx); err != nil {
+		return err
+	}
+	if err = o.release(ctx, id, tx); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	o.logger.Info("Message cancelled", zap.Int("id", id))
+	return nil
+}
+
+// release возвращает неисправленные записи пакета письма id в очередь на коррекцию
+func (o *Outbox) release(ctx context.Context, id int, tx *sqlx.Tx) error {
+	n, err := o.db.CorrectionBatches.Release(ctx, id, tx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		o.logger.Warn("Correction batch cancelled, rows will be sent again", zap.Int("id", id), zap.Int("rows", n))
+	}
+	return nil
+}
+
+func (o *Outbox) send(ctx context.Context, message *postgres.OutboxMessage) error {
+	attachments, err := o.db.Outbox.GetAttachments(ctx, message.ID)
+	if err != nil {
+		return err
+	}
+	m := sender.Message{
+		MessageID: message.MessageID,
+		To:        message.Recipients,
+		Subject:   message.Subject,
+		Body:      message.Body,
+		HTML:      message.HTMLBody,
+	}
+	for _, a := range attachments {
+		m.Attachments = append(m.Attachments, sender.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Data:        a.Data,
+		})
+	}
+	return o.sender.SendMessage(m)
+}
+
+// backoff пауза перед следующей попыткой: BackoffBase, 2*BackoffBase, 4*BackoffBase... но не больше BackoffMax
+func (o *Outbox) backoff(attempts int) time.Duration {
+	d := o.config.Outbox.BackoffBase
+	for i := 1; i < attempts && d < o.config.Outbox.BackoffMax; i++ {
+		d *= 2
+	}
+	if d > o.config.Outbox.BackoffMax {
+		d = o.config.Outbox.BackoffMax
+	}
+	return d
+}
@@ -0,0 +1,125 @@
+package outbox
+
+import (
+	"context"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/email/sender"
+	"github.com/morzik45/stk-registry/pkg/parser"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"github.com/morzik45/stk-registry/pkg/postgres/pgtest"
+	"go.uber.org/zap"
+	"net"
+	"testing"
+)
+
+// closedPort порт, на котором никто не слушает: отправка через него всегда не удаётся
+func closedPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+	return port
+}
+
+// newTestOutbox очередь с одной попыткой отправки на недоступный сервер
+func newTestOutbox(t *testing.T, db *postgres.DB) *Outbox {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Email.Host = "127.0.0.1"
+	cfg.Email.PortSMTP = closedPort(t)
+	cfg.Email.Username = "stk@example.com"
+	cfg.Outbox.MaxAttempts = 1
+	s, err := sender.New(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(db, cfg, zap.NewNop(), s)
+}
+
+// enqueueCorrection ставит в очередь письмо на коррекцию с пакетом из одной записи с ошибкой
+func enqueueCorrection(t *testing.T, db *postgres.DB, o *Outbox) (outboxID int, batch postgres.CorrectionBatch) {
+	t.Helper()
+	ctx := context.Background()
+	u := postgres.ErcUpdate{Name: "register.txt", Source: postgres.ErcSourceDropFolder}
+	if err := db.ErcUpdates.Create(ctx, &u, nil); err != nil {
+		t.Fatal(err)
+	}
+	person := postgres.PersonFromERC{ErcUpdateID: u.ID, Snils: "123", Family: "Иванов", Name: "Иван", LineNumber: 1}
+	person.Errors = parser.Errors{{Code: parser.CodeSnilsLength, Field: "snils", Value: "123"}}
+	if err := db.PersonsFromErc.CreateMany(ctx, []postgres.PersonFromERC{person}, nil); err != nil {
+		t.Fatal(err)
+	}
+	persons, err := db.PersonsFromErc.SelectForCorrection(ctx)
+	if err != nil || len(persons) != 1 {
+		t.Fatalf("persons for correction: %v, %v", persons, err)
+	}
+
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	m := sender.Message{MessageID: "correction@example.com", To: []string{"erc@example.com"}, Subject: "correction"}
+	outboxID, err = o.Enqueue(ctx, tx, postgres.OutboxCorrection, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch = postgres.CorrectionBatch{OutboxID: &outboxID, MessageID: m.MessageID}
+	if err = db.CorrectionBatches.Create(ctx, &batch, []int{persons[0].ID}, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return outboxID, batch
+}
+
+// checkReleased проверяет, что пакет отменён, а запись снова ждёт отправки на коррекцию
+func checkReleased(t *testing.T, db *postgres.DB, batchID int) {
+	t.Helper()
+	ctx := context.Background()
+	batches, err := db.CorrectionBatches.List(ctx, 10, 0)
+	if err != nil || len(batches) != 1 {
+		t.Fatalf("batches: %v, %v", batches, err)
+	}
+	if b := batches[0]; b.ID != batchID || b.Status != postgres.CorrectionBatchCancelled || b.Rows != 0 || b.ClosedAt == nil {
+		t.Errorf("batch after release: %+v", b)
+	}
+	persons, err := db.PersonsFromErc.SelectForCorrection(ctx)
+	if err != nil || len(persons) != 1 {
+		t.Errorf("persons for correction after release: %v, %v", persons, err)
+	}
+}
+
+func TestCancelReleasesCorrectionBatch(t *testing.T) {
+	db := pgtest.New(t)
+	o := newTestOutbox(t, db)
+	outboxID, batch := enqueueCorrection(t, db, o)
+
+	if err := o.Cancel(context.Background(), outboxID); err != nil {
+		t.Fatal(err)
+	}
+	checkReleased(t, db, batch.ID)
+
+	// Отменённую коррекцию заново не отправляем, записи уйдут следующим пакетом
+	if err := db.Outbox.Resend(context.Background(), outboxID); err == nil {
+		t.Error("cancelled correction message was queued again")
+	}
+}
+
+func TestFailedDeliveryReleasesCorrectionBatch(t *testing.T) {
+	db := pgtest.New(t)
+	o := newTestOutbox(t, db)
+	outboxID, batch := enqueueCorrection(t, db, o)
+
+	o.Deliver()
+
+	messages, err := db.Outbox.List(context.Background(), postgres.OutboxFailed, 10, 0)
+	if err != nil || len(messages) != 1 || messages[0].ID != outboxID {
+		t.Fatalf("failed messages: %v, %v", messages, err)
+	}
+	checkReleased(t, db, batch.ID)
+}
@@ -0,0 +1,210 @@
+// Package pop3 минимальный клиент POP3 (RFC 1939) с поддержкой TLS и STLS (RFC 2595).
+// Нужен вместо knadh/go-pop3, который не умеет STARTTLS и собственные настройки TLS.
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MessageID номер письма в текущей сессии и его постоянный идентификатор из UIDL.
+type MessageID struct {
+	ID  int
+	UID string
+}
+
+// Conn соединение с POP3 сервером.
+type Conn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	w     *bufio.Writer
+	isTLS bool
+}
+
+// Dial подключается к серверу. Если tlsConfig не nil, соединение сразу устанавливается по TLS.
+func Dial(addr string, timeout time.Duration, tlsConfig *tls.Config) (*Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConn(conn, tlsConfig != nil)
+	// Сервер первым присылает приветствие +OK.
+	if _, err = c.readLine(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newConn(conn net.Conn, isTLS bool) *Conn {
+	return &Conn{
+		conn:  conn,
+		r:     bufio.NewReader(conn),
+		w:     bufio.NewWriter(conn),
+		isTLS: isTLS,
+	}
+}
+
+// IsTLS сообщает, зашифровано ли соединение.
+func (c *Conn) IsTLS() bool {
+	return c.isTLS
+}
+
+// StartTLS переводит открытое соединение в TLS командой STLS.
+func (c *Conn) StartTLS(tlsConfig *tls.Config) error {
+	if c.isTLS {
+		return errors.New("connection is already encrypted")
+	}
+	if _, err := c.cmd(false, "STLS"); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	*c = *newConn(tlsConn, true)
+	return nil
+}
+
+// Auth авторизуется командами USER и PASS.
+func (c *Conn) Auth(user, password string) error {
+	if _, err := c.cmd(false, "USER %s", user); err != nil {
+		return err
+	}
+	_, err := c.cmd(false, "PASS %s", password)
+	return err
+}
+
+// Stat возвращает количество писем в ящике и их общий размер.
+func (c *Conn) Stat() (count, size int, err error) {
+	b, err := c.cmd(false, "STAT")
+	if err != nil {
+		return 0, 0, err
+	}
+	f := strings.Fields(string(b))
+	if len(f) < 2 {
+		return 0, 0, fmt.Errorf("invalid STAT response: %s", b)
+	}
+	if count, err = strconv.Atoi(f[0]); err != nil {
+		return 0, 0, err
+	}
+	if size, err = strconv.Atoi(f[1]); err != nil {
+		return 0, 0, err
+	}
+	return count, size, nil
+}
+
+// Uidl возвращает постоянные идентификаторы всех писем в ящике.
+func (c *Conn) Uidl() ([]MessageID, error) {
+	b, err := c.cmd(true, "UIDL")
+	if err != nil {
+		return nil, err
+	}
+	var out []MessageID
+	for _, line := range bytes.Split(b, []byte("\r\n")) {
+		f := strings.Fields(string(line))
+		if len(f) < 2 {
+			continue
+		}
+		id, err := strconv.Atoi(f[0])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, MessageID{ID: id, UID: f[1]})
+	}
+	return out, nil
+}
+
+// RetrRaw возвращает письмо целиком в исходном виде.
+func (c *Conn) RetrRaw(id int) (*bytes.Buffer, error) {
+	b, err := c.cmd(true, "RETR %d", id)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(b), nil
+}
+
+// Dele помечает письмо на удаление, сервер удалит его после QUIT.
+func (c *Conn) Dele(id int) error {
+	_, err := c.cmd(false, "DELE %d", id)
+	return err
+}
+
+// Quit завершает сессию и закрывает соединение.
+func (c *Conn) Quit() error {
+	_, err := c.cmd(false, "QUIT")
+	closeErr := c.conn.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// cmd отправляет команду и возвращает текст ответа после +OK,
+// для многострочных ответов - все строки до завершающей точки.
+func (c *Conn) cmd(isMulti bool, format string, args ...interface{}) ([]byte, error) {
+	if _, err := fmt.Fprintf(c.w, format+"\r\n", args...); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	info, err := c.readLine()
+	if err != nil || !isMulti {
+		return info, err
+	}
+	return c.readMulti()
+}
+
+func (c *Conn) readLine() ([]byte, error) {
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	switch {
+	case bytes.HasPrefix(line, []byte("+OK")):
+		return bytes.TrimSpace(line[3:]), nil
+	case bytes.HasPrefix(line, []byte("-ERR")):
+		return nil, fmt.Errorf("pop3: %s", bytes.TrimSpace(line[4:]))
+	default:
+		return nil, fmt.Errorf("pop3: unexpected response: %s", line)
+	}
+}
+
+func (c *Conn) readMulti() ([]byte, error) {
+	var buf bytes.Buffer
+	for {
+		line, err := c.r.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if bytes.Equal(line, []byte(".")) {
+			return buf.Bytes(), nil
+		}
+		// Строки, начинающиеся с точки, сервер экранирует второй точкой.
+		if bytes.HasPrefix(line, []byte("..")) {
+			line = line[1:]
+		}
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+}
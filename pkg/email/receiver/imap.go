@@ -0,0 +1,378 @@
+package receiver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/email/handlers"
+	"github.com/morzik45/stk-registry/pkg/email/security"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Пауза перед повторным подключением, если IDLE-соединение оборвалось.
+const idleReconnectDelay = time.Minute
+
+// IMAPReceiver получает письма по IMAP.
+// Забирает только письма с UID больше последнего обработанного, позиция хранится в imap_states.
+type IMAPReceiver struct {
+	processor
+	security  security.Mode
+	tlsConfig *tls.Config
+	connMutex sync.Mutex
+}
+
+func NewIMAPReceiver(db *postgres.DB, cfg *config.Config, logger *zap.Logger, registry *handlers.Registry) (*IMAPReceiver, error) {
+	mode, err := security.ParseMode(cfg.Email.IMAPSecurity)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = retentionMode(cfg); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := security.TLSConfig(cfg.Email.Host, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := IMAPReceiver{
+		processor: processor{
+			config:   cfg,
+			db:       db,
+			logger:   logger.Named("email_receiver_imap"),
+			handlers: registry,
+		},
+		security:  mode,
+		tlsConfig: tlsConfig,
+	}
+	if err = r.initRouting(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Connect to the server.
+func (r *IMAPReceiver) connect() (*client.Client, error) {
+	addr := fmt.Sprintf("%s:%d", r.config.Email.Host, r.config.Email.PortIMAP)
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var (
+		c   *client.Client
+		err error
+	)
+	if r.security == security.TLS {
+		c, err = client.DialWithDialerTLS(dialer, addr, r.tlsConfig)
+	} else {
+		c, err = client.DialWithDialer(dialer, addr)
+	}
+	if err != nil {
+		r.logger.Error("Error connecting to mail server",
+			zap.String("host", r.config.Email.Host),
+			zap.Int("port", r.config.Email.PortIMAP),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	if r.security == security.StartTLS {
+		if err = c.StartTLS(r.tlsConfig); err != nil {
+			r.logger.Error("Error starting TLS with mail server", zap.Error(err))
+			_ = c.Logout()
+			return nil, err
+		}
+	}
+	if err = security.CheckAuth(c.IsTLS(), r.config); err != nil {
+		r.logger.Error("Error authenticating to mail server", zap.Error(err))
+		_ = c.Logout()
+		return nil, err
+	}
+	if err = c.Login(r.config.Email.Username, r.config.Email.Password); err != nil {
+		r.logger.Error("Error authenticating to mail server",
+			zap.String("username", r.config.Email.Username),
+			zap.Error(err),
+		)
+		_ = c.Logout()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Disconnect from the server.
+func (r *IMAPReceiver) disconnect(c *client.Client) {
+	if err := c.Logout(); err != nil && !errors.Is(err, client.ErrAlreadyLoggedOut) {
+		r.logger.Error("Error disconnecting from mail server", zap.Error(err))
+	}
+}
+
+func (r *IMAPReceiver) Receive(trigger string) (isHaveNew bool, err error) {
+	r.connMutex.Lock()
+	defer r.connMutex.Unlock()
+
+	ctx := context.TODO()
+	mailbox := r.config.Email.IMAPMailbox
+	run := r.startRun(ctx, trigger, r.mailbox())
+	defer func() { r.finishRun(ctx, run, err) }()
+
+	c, err := r.connect()
+	if err != nil {
+		return
+	}
+	defer r.disconnect(c)
+
+	status, err := c.Select(mailbox, true)
+	if err != nil {
+		r.logger.Error("Ошибка выбора почтового ящика", zap.String("mailbox", mailbox), zap.Error(err))
+		return
+	}
+
+	state, err := r.db.ImapStates.Get(ctx, mailbox)
+	if err != nil {
+		r.logger.Error("Ошибка получения состояния почтового ящика", zap.Error(err))
+		return
+	}
+	if state.UidValidity != status.UidValidity {
+		// Сервер перенумеровал письма, старые UID больше ничего не значат.
+		if state.UidValidity != 0 {
+			r.logger.Warn("UIDVALIDITY почтового ящика изменился, ящик будет прочитан заново",
+				zap.Uint32("old", state.UidValidity),
+				zap.Uint32("new", status.UidValidity),
+			)
+		}
+		state.UidValidity = status.UidValidity
+		state.LastUid = 0
+		if err = r.db.ImapStates.Save(ctx, &state); err != nil {
+			r.logger.Error("Ошибка сохранения состояния почтового ящика", zap.Error(err))
+			return
+		}
+	}
+	if status.Messages == 0 {
+		return
+	}
+
+	uids, err := r.newUids(c, state.LastUid)
+	if err != nil {
+		r.logger.Error("Ошибка поиска новых сообщений", zap.Error(err))
+		return
+	}
+	r.logger.Debug("Новых сообщений на сервере:", zap.Int("count", len(uids)))
+
+	afterTime := time.Time(r.config.InitDate)
+	for _, uid := range uids {
+		var body []byte
+		body, err = r.fetch(c, uid)
+		if err != nil {
+			// Не сдвигаем позицию, письмо будет получено при следующей проверке.
+			r.logger.Error("Ошибка при получении сообщения", zap.Uint32("uid", uid), zap.Error(err))
+			countFailed(run)
+			return
+		}
+
+		var res messageResult
+		res, err = r.parseMessage(body, afterTime)
+		if err != nil {
+			// Не сдвигаем позицию, письмо будет обработано при следующей проверке.
+			r.logger.Error("Ошибка при обработке сообщения", zap.Uint32("uid", uid), zap.Error(err))
+			countFailed(run)
+			return
+		}
+		countMessage(run, res)
+		if res.IsHaveNew {
+			isHaveNew = true
+		}
+
+		r.markSeen(ctx, r.mailbox(), fmt.Sprintf("%d:%d", state.UidValidity, uid), res)
+
+		state.LastUid = uid
+		if err = r.db.ImapStates.Save(ctx, &state); err != nil {
+			r.logger.Error("Ошибка сохранения состояния почтового ящика", zap.Error(err))
+			return
+		}
+	}
+
+	r.cleanup(ctx, c, state.UidValidity)
+	return
+}
+
+// cleanup удаляет письма по политике хранения. Ошибки только логируются:
+// письма останутся на сервере до следующей проверки.
+func (r *IMAPReceiver) cleanup(ctx context.Context, c *client.Client, uidValidity uint32) {
+	found, err := c.UidSearch(imap.NewSearchCriteria())
+	if err != nil {
+		r.logger.Error("Ошибка получения списка сообщений", zap.Error(err))
+		return
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+	uids := make([]string, 0, len(found))
+	byKey := make(map[string]uint32, len(found))
+	for _, uid := range found {
+		key := fmt.Sprintf("%d:%d", uidValidity, uid)
+		uids = append(uids, key)
+		byKey[key] = uid
+	}
+
+	toDelete, err := r.toDelete(ctx, r.mailbox(), uids)
+	if err != nil {
+		r.logger.Error("Ошибка выбора сообщений для удаления", zap.Error(err))
+		return
+	}
+	if len(toDelete) == 0 {
+		return
+	}
+	seqSet := new(imap.SeqSet)
+	for _, key := range toDelete {
+		seqSet.AddNum(byKey[key])
+	}
+
+	// Ящик открыт только на чтение, для удаления откроем его заново
+	if _, err = c.Select(r.config.Email.IMAPMailbox, false); err != nil {
+		r.logger.Error("Ошибка выбора почтового ящика", zap.Error(err))
+		return
+	}
+	flags := []interface{}{imap.DeletedFlag}
+	if err = c.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil); err != nil {
+		r.logger.Error("Ошибка пометки сообщений на удаление", zap.Error(err))
+		return
+	}
+	if err = c.Expunge(nil); err != nil {
+		r.logger.Error("Ошибка удаления сообщений", zap.Error(err))
+		return
+	}
+	r.logger.Info("Сообщения удалены с сервера", zap.Int("count", len(toDelete)))
+}
+
+// mailbox ключ почтового ящика в таблице mailbox_seen
+func (r *IMAPReceiver) mailbox() string {
+	return fmt.Sprintf("imap:%s@%s/%s", r.config.Email.Username, r.config.Email.Host, r.config.Email.IMAPMailbox)
+}
+
+// newUids возвращает по возрастанию UID писем, пришедших после lastUid.
+func (r *IMAPReceiver) newUids(c *client.Client, lastUid uint32) ([]uint32, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(lastUid+1, 0) // 0 означает "*"
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = seqSet
+	if lastUid == 0 {
+		// Первый проход по ящику, письма до начальной даты не нужны.
+		criteria.Since = time.Time(r.config.InitDate)
+	}
+	found, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, err
+	}
+	// "N:*" всегда включает последнее письмо, даже если его UID меньше N.
+	uids := make([]uint32, 0, len(found))
+	for _, uid := range found {
+		if uid > lastUid {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, nil
+}
+
+// fetch получает письмо целиком, не помечая его прочитанным.
+func (r *IMAPReceiver) fetch(c *client.Client, uid uint32) ([]byte, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	section := &imap.BodySectionName{Peek: true}
+
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, messages)
+	}()
+
+	var body []byte
+	for msg := range messages {
+		literal := msg.GetBody(section)
+		if literal == nil {
+			continue
+		}
+		b, err := io.ReadAll(literal)
+		if err != nil {
+			for range messages {
+			}
+			<-done
+			return nil, err
+		}
+		body = b
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return nil, fmt.Errorf("message with uid %d not found", uid)
+	}
+	return body, nil
+}
+
+// Watch держит отдельное соединение в режиме IDLE и вызывает onNew, когда в ящике появляются письма.
+// Работает до отмены ctx, при обрыве соединения переподключается.
+func (r *IMAPReceiver) Watch(ctx context.Context, onNew func()) {
+	for {
+		err := r.idle(ctx, onNew)
+		if ctx.Err() != nil {
+			return
+		}
+		r.logger.Error("IDLE connection lost, reconnecting", zap.Error(err), zap.Duration("after", idleReconnectDelay))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(idleReconnectDelay):
+		}
+	}
+}
+
+func (r *IMAPReceiver) idle(ctx context.Context, onNew func()) error {
+	c, err := r.connect()
+	if err != nil {
+		return err
+	}
+	defer r.disconnect(c)
+
+	status, err := c.Select(r.config.Email.IMAPMailbox, true)
+	if err != nil {
+		return err
+	}
+	messages := status.Messages
+
+	updates := make(chan client.Update, 10)
+	c.Updates = updates
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Idle(stop, nil)
+	}()
+	r.logger.Info("Waiting for new messages (IDLE)", zap.String("mailbox", r.config.Email.IMAPMailbox))
+
+	for {
+		select {
+		case update := <-updates:
+			mu, ok := update.(*client.MailboxUpdate)
+			if !ok {
+				continue
+			}
+			if mu.Mailbox.Messages > messages {
+				r.logger.Info("New message in mailbox", zap.Uint32("messages", mu.Mailbox.Messages))
+				go onNew()
+			}
+			messages = mu.Mailbox.Messages
+		case err = <-done:
+			if err == nil {
+				err = errors.New("idle stopped by server")
+			}
+			return err
+		case <-ctx.Done():
+			close(stop)
+			return <-done
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/email/handlers"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"github.com/morzik45/stk-registry/pkg/postgres/pgtest"
+	"go.uber.org/zap"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testBackend почтовый ящик в памяти, который умеет сообщать клиентам о новых письмах.
+// idle получает сигнал, когда клиент переходит в режим IDLE.
+type testBackend struct {
+	*memory.Backend
+	updates chan backend.Update
+	idle    chan struct{}
+}
+
+func (b *testBackend) Updates() <-chan backend.Update {
+	return b.updates
+}
+
+// idleListener отдаёт соединения, которые замечают команду IDLE от клиента
+type idleListener struct {
+	net.Listener
+	idle chan struct{}
+}
+
+func (l *idleListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &idleConn{Conn: c, idle: l.idle}, nil
+}
+
+type idleConn struct {
+	net.Conn
+	idle chan struct{}
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if bytes.Contains(b[:n], []byte(" IDLE\r\n")) {
+		select {
+		case c.idle <- struct{}{}:
+		default:
+		}
+	}
+	return n, err
+}
+
+// startIMAPServer запускает IMAP-сервер в памяти. В INBOX пользователя username/password
+// сразу лежит одно письмо с UID 6.
+func startIMAPServer(t *testing.T) (*testBackend, *config.Config) {
+	t.Helper()
+	be := &testBackend{Backend: memory.New(), updates: make(chan backend.Update), idle: make(chan struct{}, 1)}
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Serve(&idleListener{Listener: l, idle: be.idle}) }()
+	t.Cleanup(func() { _ = s.Close() })
+
+	cfg := &config.Config{}
+	cfg.Email.Host = "127.0.0.1"
+	cfg.Email.PortIMAP = l.Addr().(*net.TCPAddr).Port
+	cfg.Email.Username = "username"
+	cfg.Email.Password = "password"
+	cfg.Email.IMAPMailbox = "INBOX"
+	cfg.Email.IMAPSecurity = "plain"
+	cfg.Email.AllowPlainAuth = true
+	return be, cfg
+}
+
+func newTestIMAPReceiver(t *testing.T, db *postgres.DB, cfg *config.Config) *IMAPReceiver {
+	t.Helper()
+	r, err := NewIMAPReceiver(db, cfg, zap.NewNop(), handlers.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// appendMessage кладёт в INBOX новое письмо, UID письма - следующий по порядку
+func appendMessage(t *testing.T, r *IMAPReceiver, n int) {
+	t.Helper()
+	c, err := r.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.disconnect(c)
+	body := fmt.Sprintf("From: someone@example.com\r\n"+
+		"To: stk@example.com\r\n"+
+		"Subject: message %d\r\n"+
+		"Message-ID: <imap-test-%d@example.com>\r\n"+
+		"Date: %s\r\n"+
+		"\r\n"+
+		"text\r\n", n, n, time.Now().Format(time.RFC1123Z))
+	if err = c.Append("INBOX", nil, time.Now(), bytes.NewBufferString(body)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIMAPNewUids(t *testing.T) {
+	_, cfg := startIMAPServer(t)
+	r := newTestIMAPReceiver(t, nil, cfg)
+	appendMessage(t, r, 1) // UID 7
+	appendMessage(t, r, 2) // UID 8
+
+	c, err := r.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.disconnect(c)
+	if _, err = c.Select("INBOX", true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		lastUid uint32
+		want    []uint32
+	}{
+		{0, []uint32{6, 7, 8}},
+		{6, []uint32{7, 8}},
+		{7, []uint32{8}},
+		{8, []uint32{}}, // "9:*" сервер всё равно отвечает последним письмом
+	}
+	for _, tt := range tests {
+		got, err := r.newUids(c, tt.lastUid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("newUids(%d) = %v, want %v", tt.lastUid, got, tt.want)
+		}
+	}
+
+	body, err := r.fetch(c, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte("Subject: message 1")) {
+		t.Errorf("fetch(7) returned another message:\n%s", body)
+	}
+}
+
+func TestIMAPWatch(t *testing.T) {
+	be, cfg := startIMAPServer(t)
+	r := newTestIMAPReceiver(t, nil, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	notified := make(chan struct{}, 10)
+	go func() {
+		r.Watch(ctx, func() { notified <- struct{}{} })
+		close(stopped)
+	}()
+
+	// Сервер сообщает о письмах только клиентам, уже выбравшим ящик, поэтому ждём IDLE
+	select {
+	case <-be.idle:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not start IDLE")
+	}
+	status := imap.NewMailboxStatus("INBOX", []imap.StatusItem{imap.StatusMessages})
+	status.Messages = 2
+	be.updates <- &backend.MailboxUpdate{Update: backend.NewUpdate("username", "INBOX"), MailboxStatus: status}
+
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not report new message")
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not stop after context cancel")
+	}
+}
+
+// lastRun последняя запись журнала проверок ящика
+func lastRun(t *testing.T, db *postgres.DB) postgres.IngestionRun {
+	t.Helper()
+	runs, _, err := db.IngestionRuns.List(context.Background(), 1, 0)
+	if err != nil || len(runs) == 0 {
+		t.Fatalf("ingestion runs: %v, %v", runs, err)
+	}
+	return runs[0]
+}
+
+func TestIMAPReceiveOnlyNew(t *testing.T) {
+	db := pgtest.New(t)
+	ctx := context.Background()
+	_, cfg := startIMAPServer(t)
+	r := newTestIMAPReceiver(t, db, cfg)
+	appendMessage(t, r, 1) // UID 7
+
+	if _, err := r.Receive(postgres.TriggerAPI); err != nil {
+		t.Fatal(err)
+	}
+	if run := lastRun(t, db); run.Seen != 2 {
+		t.Fatalf("first receive saw %d messages, want 2", run.Seen)
+	}
+	state, err := db.ImapStates.Get(ctx, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.UidValidity != 1 || state.LastUid != 7 {
+		t.Fatalf("state after first receive: %+v", state)
+	}
+
+	appendMessage(t, r, 2) // UID 8
+	if _, err = r.Receive(postgres.TriggerAPI); err != nil {
+		t.Fatal(err)
+	}
+	if run := lastRun(t, db); run.Seen != 1 {
+		t.Fatalf("second receive saw %d messages, want only the new one", run.Seen)
+	}
+
+	if _, err = r.Receive(postgres.TriggerAPI); err != nil {
+		t.Fatal(err)
+	}
+	if run := lastRun(t, db); run.Seen != 0 {
+		t.Fatalf("receive without new messages saw %d messages", run.Seen)
+	}
+}
+
+func TestIMAPReceiveUidValidityReset(t *testing.T) {
+	db := pgtest.New(t)
+	ctx := context.Background()
+	_, cfg := startIMAPServer(t)
+	r := newTestIMAPReceiver(t, db, cfg)
+
+	// Позиция от прошлой нумерации писем: UID 100 при UIDVALIDITY 42, у сервера UIDVALIDITY 1
+	if err := db.ImapStates.Save(ctx, &postgres.ImapState{Mailbox: "INBOX", UidValidity: 42, LastUid: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Receive(postgres.TriggerAPI); err != nil {
+		t.Fatal(err)
+	}
+	if run := lastRun(t, db); run.Seen != 1 {
+		t.Fatalf("receive after UIDVALIDITY change saw %d messages, want 1", run.Seen)
+	}
+	state, err := db.ImapStates.Get(ctx, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.UidValidity != 1 || state.LastUid != 6 {
+		t.Fatalf("state after UIDVALIDITY change: %+v", state)
+	}
+}
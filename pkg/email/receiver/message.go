@@ -0,0 +1,397 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/email/handlers"
+	"github.com/morzik45/stk-registry/pkg/email/smime"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"github.com/morzik45/stk-registry/pkg/unpack"
+	"go.uber.org/zap"
+	"io"
+	"strings"
+	"time"
+)
+
+// processor разбирает полученные письма и сохраняет их в БД, общий для всех протоколов.
+type processor struct {
+	logger   *zap.Logger
+	config   *config.Config
+	db       *postgres.DB
+	handlers *handlers.Registry
+	routes   []handlers.Route
+	verifier *smime.Verifier
+}
+
+// initRouting загружает маршруты писем и хранилища сертификатов S/MIME из конфига,
+// для каждого маршрута должен быть обработчик
+func (r *processor) initRouting() (err error) {
+	r.verifier, err = smime.NewVerifier(r.config)
+	if err != nil {
+		return err
+	}
+	r.routes, err = handlers.ParseRoutes(r.config)
+	if err != nil {
+		return err
+	}
+	for _, rt := range r.routes {
+		if _, ok := r.handlers.Get(rt.Type); !ok {
+			return fmt.Errorf("no handler for email type %s, known types: %s", rt.Type, strings.Join(r.handlers.Names(), ", "))
+		}
+	}
+	return nil
+}
+
+// markSeen отмечает письмо как обработанное, чтобы не загружать его повторно.
+func (r *processor) markSeen(ctx context.Context, mailbox, uid string, res messageResult) {
+	m := postgres.SeenMessage{
+		Mailbox:   mailbox,
+		UID:       uid,
+		MessageID: res.MessageID,
+		Status:    res.Status,
+	}
+	if res.EmailID != 0 {
+		m.EmailID = &res.EmailID
+	}
+	if err := r.db.MailboxSeen.Create(ctx, &m, nil); err != nil {
+		// Не страшно, при следующей проверке письмо распознается как уже загруженное по Message-ID
+		r.logger.Error("Error marking message as seen", zap.String("uid", uid), zap.Error(err))
+	}
+}
+
+// messageResult итог обработки одного письма.
+type messageResult struct {
+	Status    string // одно из postgres.Seen*
+	EmailID   int
+	MessageID string
+	Date      time.Time
+	IsHaveNew bool
+	Rows      int // сохранено строк из вложений
+}
+
+// parseMessage разбирает письмо и сохраняет его в БД.
+// Ошибка возвращается только если письмо стоит попробовать обработать ещё раз (например, недоступна БД),
+// всё, что зависит только от содержимого письма, отражается в res.Status.
+func (r *processor) parseMessage(body []byte, afterTime time.Time) (res messageResult, err error) {
+	ctx := context.TODO()
+
+	// Парсим сообщение
+	var mr *mail.Reader
+	mr, err = mail.CreateReader(bytes.NewReader(body))
+	if err != nil {
+		r.logger.Error("Error creating mail reader", zap.Error(err))
+		return messageResult{Status: postgres.SeenInvalid}, nil
+	}
+
+	// Получаем информацию о письме
+	var e postgres.Email
+	header := mr.Header
+
+	e.MessageID, err = header.MessageID()
+	if err != nil || e.MessageID == "" {
+		// Без Message-ID письмо всё равно нужно уметь узнать повторно, берём хэш содержимого.
+		sum := sha256.Sum256(body)
+		e.MessageID = "sha256-" + hex.EncodeToString(sum[:]) + "@stk-registry"
+		r.logger.Warn("Message-ID not found, using body hash", zap.String("message_id", e.MessageID), zap.Error(err))
+	}
+	res.MessageID = e.MessageID
+
+	if e.DatetimeReceived, err = header.Date(); err != nil || e.DatetimeReceived.IsZero() {
+		r.logger.Warn("Ошибка получения даты, используется текущее время", zap.Error(err))
+		e.DatetimeReceived = time.Now()
+	}
+	res.Date = e.DatetimeReceived
+	if !e.DatetimeReceived.After(afterTime) {
+		r.logger.Info("Письмо старше чем последнее полученное", zap.Time("datetime", e.DatetimeReceived), zap.Time("last", afterTime))
+		res.Status = postgres.SeenTooOld
+		return res, nil
+	}
+
+	var fromAddr []*mail.Address
+	if fromAddr, err = header.AddressList("From"); err != nil || len(fromAddr) == 0 {
+		r.logger.Error("Error getting from address", zap.Error(err))
+		res.Status = postgres.SeenInvalid
+		return res, nil
+	} else {
+		e.FromAddress = fromAddr[0].Address
+	}
+
+	subject, _ := header.Subject()
+	typeName, ok := handlers.MatchRoute(r.routes, e.FromAddress, subject)
+	if !ok {
+		r.logger.Info("Email from address is not expected", zap.String("from", e.FromAddress), zap.String("subject", subject))
+		// Письмо не подошло ни под один маршрут (например, ЕРЦ сменил адрес), оператор решит, что с ним делать
+		if err = r.quarantine(ctx, &e, body, &header, postgres.QuarantineUnexpectedSender, ""); err != nil {
+			return messageResult{}, err
+		}
+		res.Status = postgres.SeenQuarantined
+		return res, nil
+	}
+	if e.TypeID, err = r.db.EmailTypes.Ensure(ctx, typeName, nil); err != nil {
+		r.logger.Error("Error getting email type", zap.String("type", typeName), zap.Error(err))
+		return messageResult{}, err
+	}
+
+	// Адрес отправителя легко подделать, для настроенных типов писем требуем подпись S/MIME
+	sig := r.verifier.Verify(typeName, e.FromAddress, body)
+	e.SignatureStatus, e.SignatureSigner, e.SignatureError = sig.Status, sig.Signer, sig.Error
+	if sig.Status == smime.StatusUnsigned || sig.Status == smime.StatusInvalid {
+		r.logger.Warn("Email signature is not valid", zap.String("from", e.FromAddress), zap.String("status", sig.Status), zap.String("error", sig.Error))
+		reason := postgres.QuarantineBadSignature
+		if sig.Status == smime.StatusUnsigned {
+			reason = postgres.QuarantineUnsigned
+		}
+		if err = r.quarantine(ctx, &e, body, &header, reason, sig.Error); err != nil {
+			return messageResult{}, err
+		}
+		res.Status = postgres.SeenQuarantined
+		return res, nil
+	}
+
+	e.DatetimeParsed = time.Now() // Время парсинга письма
+	e.File = body                 // Сохраняем письмо в базу данных
+
+	// На этом этапе мы получили всю информацию о письме. Сохраним ее в транзакции, чтобы получить ее идентификатор.
+	// Создадим транзакцию для записи в БД
+	var tx *sqlx.Tx
+	tx, err = r.db.BeginTx(ctx)
+	if err != nil {
+		r.logger.Error("Error starting transaction", zap.Error(err))
+		return
+	}
+	defer func(tx *sqlx.Tx) { _ = tx.Rollback() }(tx)
+
+	// Письмо уже могло быть загружено раньше (например, отметка о просмотре не успела сохраниться).
+	res.EmailID, err = r.db.Emails.GetIDByMessageID(ctx, e.MessageID, tx)
+	if err == nil {
+		r.logger.Info("Email already ingested", zap.String("message_id", e.MessageID), zap.Int("email_id", res.EmailID))
+		res.Status = postgres.SeenDuplicate
+		return res, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		r.logger.Error("Error searching email in db", zap.Error(err))
+		return
+	}
+
+	err = r.db.Emails.Create(ctx, &e, tx)
+	if err != nil {
+		r.logger.Error("Error creating email in db", zap.Error(err))
+		return
+	}
+	res.EmailID = e.ID
+
+	attachments := r.processAttachments(ctx, tx, &e, typeName, mr)
+	if attachments.TxFailed {
+		return messageResult{}, errors.New("email transaction aborted")
+	}
+	if attachments.Recognized == 0 && attachments.Failed > 0 {
+		// Ни одно вложение не разобрано, письмо не сохраняем, а отдаём оператору
+		_ = tx.Rollback()
+		if err = r.quarantine(ctx, &e, body, &header, postgres.QuarantineUnrecognizedAttachment, ""); err != nil {
+			return messageResult{}, err
+		}
+		return messageResult{Status: postgres.SeenQuarantined, MessageID: e.MessageID, Date: e.DatetimeReceived}, nil
+	}
+	res.IsHaveNew = attachments.IsHaveNew
+	res.Rows = attachments.Rows
+
+	// Закроем транзакцию сохранения в БД
+	err = tx.Commit()
+	if err != nil {
+		r.logger.Error("Error committing transaction", zap.Error(err))
+		return messageResult{}, err
+	}
+	res.Status = postgres.SeenIngested
+	return res, nil
+}
+
+// attachmentsResult итог разбора вложений письма
+type attachmentsResult struct {
+	IsHaveNew  bool // в письме от ЕРЦ нашлись новые записи
+	Recognized int  // вложений разобрано
+	Failed     int  // вложений не удалось разобрать
+	Rows       int  // сохранено строк
+	TxFailed   bool // транзакция письма прервана, письмо нужно обработать ещё раз
+}
+
+// processAttachments передаёт вложения письма e обработчику типа typeName, данные сохраняются в рамках транзакции tx.
+func (r *processor) processAttachments(ctx context.Context, tx *sqlx.Tx, e *postgres.Email, typeName string, mr *mail.Reader) (res attachmentsResult) {
+	handler, ok := r.handlers.Get(typeName)
+	if !ok {
+		r.logger.Error("No handler for email type", zap.String("type", typeName))
+		return
+	}
+
+	// Ищем вложения в письме.
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			r.logger.Error("Error getting next part", zap.Error(err))
+			break
+		}
+		h, ok := part.Header.(*mail.AttachmentHeader)
+		if !ok {
+			continue
+		}
+		if contentType, _, _ := h.ContentType(); smime.IsSignature(contentType) {
+			continue // подпись S/MIME проверяется отдельно, это не данные
+		}
+		var a handlers.Attachment
+		a.Filename, err = h.Filename()
+		if err != nil {
+			r.logger.Error("Error getting filename", zap.Error(err))
+			res.Failed++
+			continue
+		}
+		a.ContentType, _, _ = h.ContentType()
+		a.Body = part.Body
+
+		attachments, err := r.unpack(a)
+		if err != nil {
+			r.logger.Error("Error unpacking attachment", zap.String("filename", a.Filename), zap.Error(err))
+			res.Failed++
+			status := postgres.EmailAttachment{
+				EmailID:     e.ID,
+				Filename:    a.Filename,
+				ContentType: a.ContentType,
+				Handler:     typeName,
+				Status:      postgres.AttachmentParseError,
+				Error:       err.Error(),
+			}
+			if err = r.db.EmailAttachments.Create(ctx, &status, tx); err != nil {
+				r.logger.Error("Error saving attachment status", zap.String("filename", a.Filename), zap.Error(err))
+				res.TxFailed = true
+				break
+			}
+			continue
+		}
+
+		for _, a := range attachments {
+			status, isHaveNew, err := r.handleAttachment(ctx, tx, e, typeName, handler, a)
+			if err != nil {
+				// Транзакция письма больше непригодна, дальше обрабатывать нечего
+				r.logger.Error("Error saving attachment status", zap.String("filename", a.Filename), zap.Error(err))
+				res.Failed++
+				res.TxFailed = true
+				return
+			}
+			if status.Status != postgres.AttachmentOk {
+				res.Failed++
+				continue
+			}
+			res.Recognized++
+			res.Rows += status.Rows
+			if isHaveNew {
+				res.IsHaveNew = true // Есть новые данные
+			}
+		}
+	}
+
+	return
+}
+
+// unpack распаковывает архив zip, gzip или tar, каждый файл из него обрабатывается как отдельное вложение.
+// Остальные вложения возвращаются как есть.
+func (r *processor) unpack(a handlers.Attachment) ([]handlers.Attachment, error) {
+	if !unpack.IsArchive(a.Filename, a.ContentType) {
+		return []handlers.Attachment{a}, nil
+	}
+	files, err := unpack.Unpack(a.Filename, a.ContentType, a.Body, unpack.Limits{
+		MaxEntries: r.config.Email.UnpackMaxEntries,
+		MaxSize:    r.config.Email.UnpackMaxSize,
+		MaxDepth:   r.config.Email.UnpackMaxDepth,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Info("Attachment unpacked", zap.String("filename", a.Filename), zap.Int("files", len(files)))
+	attachments := make([]handlers.Attachment, 0, len(files))
+	for _, f := range files {
+		attachments = append(attachments, handlers.Attachment{
+			Filename: f.Name,
+			Body:     bytes.NewReader(f.Data),
+		})
+	}
+	return attachments, nil
+}
+
+// handleAttachment обрабатывает вложение под отдельной точкой сохранения и записывает итог в email_attachments.
+// Ошибка обработчика откатывает только изменения этого вложения, возвращаемая ошибка означает,
+// что не удалось работать с самой транзакцией.
+func (r *processor) handleAttachment(ctx context.Context, tx *sqlx.Tx, e *postgres.Email, typeName string, handler handlers.Handler, a handlers.Attachment) (status postgres.EmailAttachment, isHaveNew bool, err error) {
+	status = postgres.EmailAttachment{
+		EmailID:     e.ID,
+		Filename:    a.Filename,
+		ContentType: a.ContentType,
+		Handler:     typeName,
+		Status:      postgres.AttachmentOk,
+	}
+
+	if _, err = tx.ExecContext(ctx, "SAVEPOINT attachment"); err != nil {
+		return
+	}
+	result, handleErr := handler.Handle(ctx, tx, e, a)
+	if handleErr != nil {
+		r.logger.Error("Error handling attachment", zap.String("type", typeName), zap.String("filename", a.Filename), zap.Error(handleErr))
+		if _, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT attachment"); err != nil {
+			return
+		}
+		status.Status = postgres.AttachmentDBError
+		var parseErr *handlers.ParseError
+		if errors.As(handleErr, &parseErr) {
+			status.Status = postgres.AttachmentParseError
+		}
+		status.Error = handleErr.Error()
+	} else {
+		status.Rows = result.Rows
+		status.Error = result.Warning
+		isHaveNew = result.IsHaveNew
+	}
+	if _, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT attachment"); err != nil {
+		return
+	}
+
+	err = r.db.EmailAttachments.Create(ctx, &status, tx)
+	return
+}
+
+// quarantine помещает письмо в карантин вместе с заголовками и исходным текстом
+func (r *processor) quarantine(ctx context.Context, e *postgres.Email, body []byte, header *mail.Header, reason, details string) error {
+	q := postgres.QuarantinedEmail{
+		MessageID:        e.MessageID,
+		FromAddress:      e.FromAddress,
+		Reason:           reason,
+		Details:          details,
+		DatetimeReceived: e.DatetimeReceived,
+		File:             body,
+	}
+	q.Subject, _ = header.Subject()
+
+	var headers strings.Builder
+	fields := header.Fields()
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		headers.WriteString(fields.Key() + ": " + value + "\n")
+	}
+	q.Headers = headers.String()
+
+	if err := r.db.Quarantine.Create(ctx, &q, nil); err != nil {
+		r.logger.Error("Error saving email to quarantine", zap.String("message_id", e.MessageID), zap.Error(err))
+		return err
+	}
+	r.logger.Warn("Email moved to quarantine", zap.String("message_id", e.MessageID), zap.String("reason", reason))
+	return nil
+}
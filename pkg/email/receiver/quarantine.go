@@ -0,0 +1,154 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/email/handlers"
+	"github.com/morzik45/stk-registry/pkg/email/smime"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"go.uber.org/zap"
+	"time"
+)
+
+var (
+	ErrQuarantineResolved = errors.New("решение по письму уже принято")
+	ErrAlreadyIngested    = errors.New("письмо с таким Message-ID уже загружено")
+	ErrUnknownType        = errors.New("неизвестный тип письма")
+)
+
+// QuarantineResolver выполняет решения оператора по письмам из карантина.
+type QuarantineResolver struct {
+	processor
+}
+
+func NewQuarantineResolver(db *postgres.DB, cfg *config.Config, logger *zap.Logger, registry *handlers.Registry) *QuarantineResolver {
+	return &QuarantineResolver{
+		processor: processor{
+			config:   cfg,
+			db:       db,
+			handlers: registry,
+			logger:   logger.Named("email_quarantine"),
+		},
+	}
+}
+
+// AssignResult итог обработки письма из карантина
+type AssignResult struct {
+	EmailID    int  `json:"email_id"`
+	Recognized int  `json:"recognized"`
+	Failed     int  `json:"failed"`
+	IsHaveNew  bool `json:"is_have_new"`
+}
+
+// Assign обрабатывает письмо из карантина как письмо типа typeName,
+// так же, как если бы оно пришло по маршруту этого типа.
+func (qr *QuarantineResolver) Assign(ctx context.Context, id int, typeName string) (res AssignResult, err error) {
+	if _, ok := qr.handlers.Get(typeName); !ok {
+		return res, fmt.Errorf("%w: %s", ErrUnknownType, typeName)
+	}
+
+	tx, err := qr.db.BeginTx(ctx)
+	if err != nil {
+		return
+	}
+	defer func(tx *sqlx.Tx) { _ = tx.Rollback() }(tx)
+
+	q, err := qr.db.Quarantine.Get(ctx, id, tx)
+	if err != nil {
+		return
+	}
+	if q.Status != postgres.QuarantinePending {
+		return res, ErrQuarantineResolved
+	}
+
+	_, err = qr.db.Emails.GetIDByMessageID(ctx, q.MessageID, tx)
+	if err == nil {
+		return res, ErrAlreadyIngested
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+
+	typeID, err := qr.db.EmailTypes.Ensure(ctx, typeName, tx)
+	if err != nil {
+		return
+	}
+	e := postgres.Email{
+		TypeID:           typeID,
+		MessageID:        q.MessageID,
+		FromAddress:      q.FromAddress,
+		DatetimeReceived: q.DatetimeReceived,
+		DatetimeParsed:   time.Now(),
+		File:             q.File,
+		SignatureStatus:  smime.StatusNotChecked,
+	}
+	// Оператор принял письмо, несмотря на подпись: сохраняем, что с ней было не так
+	switch q.Reason {
+	case postgres.QuarantineUnsigned:
+		e.SignatureStatus, e.SignatureError = smime.StatusUnsigned, q.Details
+	case postgres.QuarantineBadSignature:
+		e.SignatureStatus, e.SignatureError = smime.StatusInvalid, q.Details
+	}
+	err = qr.db.Emails.Create(ctx, &e, tx)
+	if err != nil {
+		return
+	}
+	res.EmailID = e.ID
+
+	mr, err := mail.CreateReader(bytes.NewReader(q.File))
+	if err != nil {
+		return res, fmt.Errorf("failed to parse stored email: %w", err)
+	}
+	attachments := qr.processAttachments(ctx, tx, &e, typeName, mr)
+	if attachments.TxFailed {
+		return res, errors.New("email transaction aborted")
+	}
+	res.Recognized = attachments.Recognized
+	res.Failed = attachments.Failed
+	res.IsHaveNew = attachments.IsHaveNew
+
+	err = qr.db.Quarantine.Resolve(ctx, q.ID, postgres.QuarantineAssigned, &e.ID, tx)
+	if err != nil {
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		return
+	}
+	qr.logger.Info("Quarantined email assigned",
+		zap.Int("id", q.ID),
+		zap.String("type", typeName),
+		zap.Int("email_id", e.ID),
+		zap.Int("recognized", res.Recognized),
+		zap.Int("failed", res.Failed),
+	)
+	return res, nil
+}
+
+// Discard отклоняет письмо из карантина, исходный текст остаётся в таблице
+func (qr *QuarantineResolver) Discard(ctx context.Context, id int) error {
+	tx, err := qr.db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sqlx.Tx) { _ = tx.Rollback() }(tx)
+
+	q, err := qr.db.Quarantine.Get(ctx, id, tx)
+	if err != nil {
+		return err
+	}
+	if q.Status != postgres.QuarantinePending {
+		return ErrQuarantineResolved
+	}
+	err = qr.db.Quarantine.Resolve(ctx, q.ID, postgres.QuarantineDiscarded, nil, tx)
+	if err != nil {
+		return err
+	}
+	qr.logger.Info("Quarantined email discarded", zap.Int("id", q.ID), zap.String("message_id", q.MessageID))
+	return tx.Commit()
+}
@@ -3,44 +3,81 @@ package receiver
 import (
 	"bytes"
 	"context"
-	_ "github.com/emersion/go-message/charset"
-	"github.com/emersion/go-message/mail"
-	"github.com/jmoiron/sqlx"
-	"github.com/knadh/go-pop3"
+	"crypto/tls"
+	"fmt"
 	"github.com/morzik45/stk-registry/pkg/config"
-	"github.com/morzik45/stk-registry/pkg/persons"
+	"github.com/morzik45/stk-registry/pkg/email/handlers"
+	"github.com/morzik45/stk-registry/pkg/email/pop3"
+	"github.com/morzik45/stk-registry/pkg/email/security"
 	"github.com/morzik45/stk-registry/pkg/postgres"
-	"github.com/morzik45/stk-registry/pkg/utils"
 	"go.uber.org/zap"
-	"io"
+	"strings"
 	"sync"
 	"time"
 )
 
 // TODO: Это всё надо нещадно рефакторить, накидывал на скорость.
 
+const dialTimeout = 10 * time.Second
+
+// MailReceiver забирает новые письма с почтового сервера и сохраняет их в БД.
+// trigger - что запустило проверку (postgres.Trigger*), попадает в журнал ingestion_runs.
+type MailReceiver interface {
+	Receive(trigger string) (isHaveNew bool, err error)
+}
+
+// Watcher реализуют получатели, которые умеют сами узнавать о новых письмах (IMAP IDLE).
+// onNew вызывается каждый раз, когда сервер сообщает о новом письме в ящике.
+type Watcher interface {
+	Watch(ctx context.Context, onNew func())
+}
+
+// NewMailReceiver создаёт получателя писем по протоколу из конфига.
+func NewMailReceiver(db *postgres.DB, cfg *config.Config, logger *zap.Logger, registry *handlers.Registry) (MailReceiver, error) {
+	switch strings.ToLower(cfg.Email.Protocol) {
+	case "", "pop3":
+		return NewReceiver(db, cfg, logger, registry)
+	case "imap":
+		return NewIMAPReceiver(db, cfg, logger, registry)
+	default:
+		return nil, fmt.Errorf("unknown email protocol: %s", cfg.Email.Protocol)
+	}
+}
+
+// Receiver получает письма по POP3.
 type Receiver struct {
-	client    *pop3.Client
+	processor
+	security  security.Mode
+	tlsConfig *tls.Config
 	conn      *pop3.Conn
 	connMutex sync.Mutex
-	logger    *zap.Logger
-	config    *config.Config
-	db        *postgres.DB
 }
 
-func NewReceiver(db *postgres.DB, cfg *config.Config, logger *zap.Logger) (*Receiver, error) {
-	// Initialize the client.
-	p := pop3.New(pop3.Opt{
-		Host:       cfg.Email.Host,
-		Port:       cfg.Email.PortPOP3,
-		TLSEnabled: false,
-	})
+func NewReceiver(db *postgres.DB, cfg *config.Config, logger *zap.Logger, registry *handlers.Registry) (*Receiver, error) {
+	mode, err := security.ParseMode(cfg.Email.POP3Security)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = retentionMode(cfg); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := security.TLSConfig(cfg.Email.Host, cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	r := Receiver{
-		client: p,
-		config: cfg,
-		db:     db,
-		logger: logger.Named("email_receiver"),
+		processor: processor{
+			config:   cfg,
+			db:       db,
+			logger:   logger.Named("email_receiver"),
+			handlers: registry,
+		},
+		security:  mode,
+		tlsConfig: tlsConfig,
+	}
+	if err = r.initRouting(); err != nil {
+		return nil, err
 	}
 
 	return &r, nil
@@ -69,7 +106,11 @@ func (r *Receiver) connect() (err error) {
 	}(&isConnected)
 
 	r.logger.Info("Connecting to mail server...")
-	r.conn, err = r.client.NewConn()
+	var implicitTLS *tls.Config
+	if r.security == security.TLS {
+		implicitTLS = r.tlsConfig
+	}
+	r.conn, err = pop3.Dial(fmt.Sprintf("%s:%d", r.config.Email.Host, r.config.Email.PortPOP3), dialTimeout, implicitTLS)
 	if err != nil {
 		r.logger.Error("Error connecting to mail server",
 			zap.String("host", r.config.Email.Host),
@@ -78,6 +119,22 @@ func (r *Receiver) connect() (err error) {
 		)
 		return err
 	}
+	defer func(isConnected *bool) {
+		if !*isConnected {
+			_ = r.conn.Quit()
+			r.conn = nil
+		}
+	}(&isConnected)
+	if r.security == security.StartTLS {
+		if err = r.conn.StartTLS(r.tlsConfig); err != nil {
+			r.logger.Error("Error starting TLS with mail server", zap.Error(err))
+			return err
+		}
+	}
+	if err = security.CheckAuth(r.conn.IsTLS(), r.config); err != nil {
+		r.logger.Error("Error authenticating to mail server", zap.Error(err))
+		return err
+	}
 	if err = r.conn.Auth(r.config.Email.Username, r.config.Email.Password); err != nil {
 		r.logger.Error("Error authenticating to mail server",
 			zap.String("username", r.config.Email.Username),
@@ -104,183 +161,109 @@ func (r *Receiver) disconnect() {
 	r.connMutex.Unlock()
 }
 
-func (r *Receiver) Receive() (isHaveNew bool, err error) {
-	afterTime := r.GetLastEmail()
+func (r *Receiver) Receive(trigger string) (isHaveNew bool, err error) {
+	ctx := context.TODO()
+	mailbox := r.mailbox()
+	run := r.startRun(ctx, trigger, mailbox)
+	defer func() { r.finishRun(ctx, run, err) }()
+
+	// Письма до начальной даты не нужны, дата последнего письма используется только если включена отсечка.
+	afterTime := time.Time(r.config.InitDate)
+	if r.config.Email.DateCutoff {
+		afterTime = r.GetLastEmail()
+	}
 	if err = r.connect(); err != nil {
 		return
 	}
 	defer r.disconnect()
-	//Print the total number of messages and their size.
-	count, _, err := r.conn.Stat()
+
+	// Письма узнаём по постоянным идентификаторам UIDL, номера писем меняются от сессии к сессии.
+	uidl, err := r.conn.Uidl()
 	if err != nil {
-		r.logger.Error("Ошибка получения количества сообщений", zap.Error(err))
+		r.logger.Error("Ошибка получения списка сообщений", zap.Error(err))
 		return
 	}
-	r.logger.Debug("Всего сообщений на сервере:", zap.Int("count", count))
+	seen, err := r.db.MailboxSeen.GetUIDs(ctx, mailbox)
+	if err != nil {
+		r.logger.Error("Ошибка получения обработанных сообщений", zap.Error(err))
+		return
+	}
+	r.logger.Debug("Всего сообщений на сервере:", zap.Int("count", len(uidl)), zap.Int("seen", len(seen)))
+
+	var failed int
+	// Идём от новых писем к старым.
+	for i := len(uidl) - 1; i >= 0; i-- {
+		m := uidl[i]
+		if _, ok := seen[m.UID]; ok {
+			continue
+		}
 
-	// Pull all messages on the server. Message IDs go from count to 1.
-	for id := count; id > 0; id-- {
 		// Получим тело сообщения
 		var mes *bytes.Buffer
-		mes, err = r.conn.RetrRaw(id)
+		mes, err = r.conn.RetrRaw(m.ID)
 		if err != nil {
-			r.logger.Error("Ошибка при получении сообщения", zap.Int("id", id), zap.Error(err))
+			r.logger.Error("Ошибка при получении сообщения", zap.Int("id", m.ID), zap.String("uid", m.UID), zap.Error(err))
+			failed++
+			countFailed(run)
 			continue
 		}
 
 		// Парсим сообщение
-		isNeedMore, _isHaveNew := r.parseMessage(mes.Bytes(), afterTime)
-		if !isHaveNew && _isHaveNew { // Если не переворачивали флаг ранее и есть новые данные
+		var res messageResult
+		res, err = r.parseMessage(mes.Bytes(), afterTime)
+		if err != nil {
+			// Не отмечаем письмо, попробуем ещё раз при следующей проверке
+			r.logger.Error("Ошибка при обработке сообщения", zap.String("uid", m.UID), zap.Error(err))
+			failed++
+			countFailed(run)
+			continue
+		}
+		countMessage(run, res)
+		if res.IsHaveNew {
 			isHaveNew = true
 		}
-		if !isNeedMore {
-			// Если вернулось false, то пошли уже старые сообщения и необходимо остановиться
+		if res.Status == postgres.SeenTooOld && r.config.Email.DateCutoff {
+			// Пошли уже старые сообщения, дальше можно не смотреть
 			break
 		}
-
-	}
-	return
-}
-
-func (r *Receiver) parseMessage(body []byte, afterTime time.Time) (isNeedMore, isHaveNew bool) {
-	var err error
-	isNeedMore = true // по умолчанию нужно продолжать получать сообщения
-
-	// Парсим сообщение
-	var mr *mail.Reader
-	mr, err = mail.CreateReader(bytes.NewReader(body))
-	if err != nil {
-		r.logger.Error("Error creating mail reader", zap.Error(err))
-		return
+		r.markSeen(ctx, mailbox, m.UID, res)
 	}
 
-	// Получаем информацию о письме
-	var e postgres.Email
-	header := mr.Header
-	if e.DatetimeReceived, err = header.Date(); err != nil {
-		r.logger.Error("Ошибка получения даты", zap.Error(err))
-		return
-	}
-	if !e.DatetimeReceived.After(afterTime) {
-		r.logger.Info("Письмо старше чем последнее полученное", zap.Time("datetime", e.DatetimeReceived), zap.Time("last", afterTime))
-		isNeedMore = false // не нужно продолжать получать сообщения
-		return
-	}
+	r.cleanup(ctx, mailbox, uidl)
 
-	var fromAddr []*mail.Address
-	if fromAddr, err = header.AddressList("From"); err != nil {
-		r.logger.Error("Error getting from address", zap.Error(err))
-		return
-	} else {
-		e.FromAddress = fromAddr[0].Address
-		switch e.FromAddress {
-		case r.config.Email.FromErc:
-			e.TypeID = 1
-		case r.config.Email.FromCorrection:
-			e.TypeID = 2
-		default:
-			r.logger.Info("Email from address is not expected", zap.String("from", e.FromAddress), zap.String("erc", r.config.Email.FromErc), zap.String("correction", r.config.Email.FromCorrection))
-			// Мы ждём письмо от нужного адреса, но получили письмо от другого адреса, просто пропускаем
-			return
-		}
+	err = nil
+	if failed > 0 {
+		err = fmt.Errorf("failed to process %d messages", failed)
 	}
+	return
+}
 
-	e.MessageID, err = header.MessageID()
-	if err != nil {
-		r.logger.Error("Error getting message id", zap.Error(err))
-		return
-	}
-	e.DatetimeParsed = time.Now() // Время парсинга письма
-	e.File = body                 // Сохраняем письмо в базу данных
+// mailbox ключ почтового ящика в таблице mailbox_seen
+func (r *Receiver) mailbox() string {
+	return fmt.Sprintf("pop3:%s@%s", r.config.Email.Username, r.config.Email.Host)
+}
 
-	// На этом этапе мы получили всю информацию о письме. Сохраним ее в транзакции, чтобы получить ее идентификатор.
-	// Создадим транзакцию для записи в БД
-	var tx *sqlx.Tx
-	tx, err = r.db.BeginTx(context.TODO())
-	if err != nil {
-		r.logger.Error("Error starting transaction", zap.Error(err))
-		return
+// cleanup помечает на удаление письма по политике хранения, сервер удалит их после QUIT.
+// Ошибки только логируются: письма останутся на сервере до следующей проверки.
+func (r *Receiver) cleanup(ctx context.Context, mailbox string, uidl []pop3.MessageID) {
+	uids := make([]string, 0, len(uidl))
+	ids := make(map[string]int, len(uidl))
+	for _, m := range uidl {
+		uids = append(uids, m.UID)
+		ids[m.UID] = m.ID
 	}
-	defer func(tx *sqlx.Tx) { _ = tx.Rollback() }(tx)
-
-	err = r.db.Emails.Create(context.TODO(), &e, tx)
+	toDelete, err := r.toDelete(ctx, mailbox, uids)
 	if err != nil {
-		r.logger.Error("Error creating email in db", zap.Error(err))
+		r.logger.Error("Ошибка выбора сообщений для удаления", zap.Error(err))
 		return
 	}
-
-	// Ищем вложения в письме.
-	for {
-		var part *mail.Part
-		part, err = mr.NextPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			r.logger.Error("Error getting next part", zap.Error(err))
-			break
-		}
-		switch h := part.Header.(type) {
-		case *mail.AttachmentHeader:
-			var eu postgres.ErcUpdate
-			eu.EmailID = e.ID
-			eu.Name, err = h.Filename()
-			if err != nil {
-				r.logger.Error("Error getting filename", zap.Error(err))
-				continue
-			}
-
-			switch e.TypeID {
-			case 1: // ЕРЦ
-				// Сохраняем вложение в транзакции.
-				err = r.db.ErcUpdates.Create(context.TODO(), &eu, tx)
-				if err != nil {
-					r.logger.Error("Error creating erc update", zap.Error(err))
-					continue
-				}
-
-				ps := persons.ParseDocumentFromErc(part.Body, r.db.CorrectPersonsData)
-				if len(ps) == 0 {
-					r.logger.Info("No persons found in attachment", zap.String("filename", eu.Name))
-					continue
-				} else {
-					if !isHaveNew {
-						isHaveNew = true // Есть новые данные
-					}
-				}
-				for i := range ps {
-					ps[i].ErcUpdateID = eu.ID
-				}
-				err = r.db.PersonsFromErc.CreateMany(context.TODO(), ps, tx)
-				if err != nil {
-					r.logger.Error("Error creating persons from erc", zap.Error(err))
-					continue
-				}
-			case 2: // Коррекция
-				var correct []postgres.PersonFromErcForCorrection
-				correct, err = utils.ParseExcelForCorrection(part.Body, r.logger)
-				if err != nil {
-					r.logger.Error("Error parsing excel for correction", zap.Error(err))
-					continue
-				}
-				if len(correct) == 0 {
-					r.logger.Info("No persons found in attachment", zap.String("filename", eu.Name))
-					continue
-				}
-				for i := range correct {
-					err = r.db.PersonsFromErc.UpdateFromCorrection(context.TODO(), correct[i], tx)
-					if err != nil {
-						r.logger.Error("Error updating person from correction", zap.Error(err))
-						continue
-					}
-				}
-			}
+	for _, uid := range toDelete {
+		if err = r.conn.Dele(ids[uid]); err != nil {
+			r.logger.Error("Ошибка удаления сообщения", zap.String("uid", uid), zap.Error(err))
+			return
 		}
 	}
-
-	// Закроем транзакцию сохранения в БД
-	err = tx.Commit()
-	if err != nil {
-		r.logger.Error("Error committing transaction", zap.Error(err))
+	if len(toDelete) > 0 {
+		r.logger.Info("Сообщения удалены с сервера", zap.Int("count", len(toDelete)))
 	}
-	return
 }
@@ -0,0 +1,301 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/email/handlers"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"go.uber.org/zap"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Reprocessor повторно разбирает сохранённые в emails.file письма ЕРЦ,
+// например после исправления ошибки в разборе реестра.
+//
+// Записи persons_from_erc письма удаляются и создаются заново. История коррекции (записи пакетов
+// и применённые исправления) переносится на новые записи, сопоставленные со старыми по historyKey.
+// Если хотя бы одну запись с историей сопоставить не удалось, письмо не переразбирается
+// (ErrCorrectionHistoryLost).
+type Reprocessor struct {
+	processor
+}
+
+func NewReprocessor(db *postgres.DB, cfg *config.Config, logger *zap.Logger, registry *handlers.Registry) *Reprocessor {
+	return &Reprocessor{
+		processor: processor{
+			config:   cfg,
+			db:       db,
+			handlers: registry,
+			logger:   logger.Named("email_reprocessor"),
+		},
+	}
+}
+
+var ErrCorrectionHistoryLost = errors.New("после переразбора не найдены записи, отправленные на коррекцию")
+
+// EmailDiff изменения записей одного письма после повторного разбора
+type EmailDiff struct {
+	EmailID   int       `json:"email_id"`
+	MessageID string    `json:"message_id"`
+	Received  time.Time `json:"received"`
+	Added     int       `json:"added"`
+	Removed   int       `json:"removed"`
+	Changed   int       `json:"changed"`
+	Unchanged int       `json:"unchanged"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ReprocessSummary итог повторного разбора
+type ReprocessSummary struct {
+	DryRun    bool        `json:"dry_run"`
+	Emails    int         `json:"emails"`
+	Failed    int         `json:"failed"`
+	Added     int         `json:"added"`
+	Removed   int         `json:"removed"`
+	Changed   int         `json:"changed"`
+	Unchanged int         `json:"unchanged"`
+	Details   []EmailDiff `json:"details"`
+}
+
+// Reprocess заново разбирает письма ЕРЦ, подходящие под фильтр. Каждое письмо обрабатывается в своей транзакции,
+// при dryRun транзакции откатываются и в БД ничего не меняется.
+func (rp *Reprocessor) Reprocess(ctx context.Context, filter postgres.EmailFilter, dryRun bool) (summary ReprocessSummary, err error) {
+	// Коррекции не переразбираем: они правят записи по идентификаторам, которых после переразбора уже нет.
+	filter.TypeID = postgres.EmailTypeErc
+	ids, err := rp.db.Emails.SelectIDs(ctx, filter)
+	if err != nil {
+		return
+	}
+
+	summary.DryRun = dryRun
+	for _, id := range ids {
+		diff, err := rp.reprocessEmail(ctx, id, dryRun)
+		if err != nil {
+			rp.logger.Error("Error reprocessing email", zap.Int("email_id", id), zap.Error(err))
+			diff.EmailID = id
+			diff.Error = err.Error()
+			summary.Failed++
+		}
+		summary.Emails++
+		summary.Added += diff.Added
+		summary.Removed += diff.Removed
+		summary.Changed += diff.Changed
+		summary.Unchanged += diff.Unchanged
+		summary.Details = append(summary.Details, diff)
+	}
+	return summary, nil
+}
+
+func (rp *Reprocessor) reprocessEmail(ctx context.Context, id int, dryRun bool) (diff EmailDiff, err error) {
+	tx, err := rp.db.BeginTx(ctx)
+	if err != nil {
+		return
+	}
+	defer func(tx *sqlx.Tx) { _ = tx.Rollback() }(tx)
+
+	e, err := rp.db.Emails.Get(ctx, id, tx)
+	if err != nil {
+		return
+	}
+	diff.EmailID = e.ID
+	diff.MessageID = e.MessageID
+	diff.Received = e.DatetimeReceived
+
+	before, err := rp.db.PersonsFromErc.GetByEmail(ctx, e.ID, tx)
+	if err != nil {
+		return
+	}
+	// Записи пакетов удалятся каскадом вместе со строками, запоминаем их до удаления
+	history, err := rp.db.CorrectionBatches.RowsByEmail(ctx, e.ID, tx)
+	if err != nil {
+		return
+	}
+
+	err = rp.db.ErcUpdates.DeleteByEmail(ctx, e.ID, tx)
+	if err != nil {
+		return
+	}
+	err = rp.db.EmailAttachments.DeleteByEmail(ctx, e.ID, tx)
+	if err != nil {
+		return
+	}
+
+	mr, err := mail.CreateReader(bytes.NewReader(e.File))
+	if err != nil {
+		return diff, fmt.Errorf("failed to parse stored email: %w", err)
+	}
+	attachments := rp.processAttachments(ctx, tx, &e, handlers.TypeErcRegister, mr)
+	if attachments.TxFailed {
+		return diff, errors.New("email transaction aborted")
+	}
+
+	after, err := rp.db.PersonsFromErc.GetByEmail(ctx, e.ID, tx)
+	if err != nil {
+		return
+	}
+	if len(history) > 0 {
+		err = rp.restoreHistory(ctx, tx, before, after, history)
+		if err != nil {
+			return
+		}
+		// Исправления из ответов на коррекцию применены заново, сравниваем уже с ними
+		after, err = rp.db.PersonsFromErc.GetByEmail(ctx, e.ID, tx)
+		if err != nil {
+			return
+		}
+	}
+	diffPersons(&diff, before, after)
+
+	if dryRun {
+		return diff, nil
+	}
+	return diff, tx.Commit()
+}
+
+// historyKey признаки, по которым запись с историей коррекции находится среди записей после переразбора.
+// СНИЛС и ФИО в ключ не входят: их могли исправить по ответу на коррекцию или по-другому разобрать.
+type historyKey struct {
+	LineNumber int
+	Date       time.Time
+	Year       int
+	Semester   int
+	Color      string
+	Count      int
+	CashierID  int
+}
+
+func newHistoryKey(p postgres.PersonFromERC) historyKey {
+	return historyKey{
+		LineNumber: p.LineNumber,
+		Date:       p.Date,
+		Year:       p.Year,
+		Semester:   p.Semester,
+		Color:      p.Color,
+		Count:      p.Count,
+		CashierID:  p.CashierID,
+	}
+}
+
+// restoreHistory переносит записи пакетов коррекции со старых записей before на новые after и заново
+// применяет полученные исправления. Запись переносится, только если ей соответствует ровно одна новая запись,
+// иначе возвращается ErrCorrectionHistoryLost с номерами строк.
+func (rp *Reprocessor) restoreHistory(ctx context.Context, tx *sqlx.Tx, before, after []postgres.PersonFromERC, history []postgres.CorrectionBatchRow) error {
+	old := make(map[int]postgres.PersonFromERC, len(before))
+	for _, p := range before {
+		old[int(p.ID)] = p
+	}
+	found := make(map[historyKey][]postgres.PersonFromERC, len(after))
+	for _, p := range after {
+		k := newHistoryKey(p)
+		found[k] = append(found[k], p)
+	}
+
+	var lost []int
+	used := make(map[int]bool, len(history))
+	moved := make([]postgres.CorrectionBatchRow, 0, len(history))
+	corrected := make([]postgres.PersonFromErcForCorrection, 0)
+	for _, row := range history {
+		prev := old[row.PersonID]
+		candidates := found[newHistoryKey(prev)]
+		if len(candidates) != 1 || used[int(candidates[0].ID)] {
+			lost = append(lost, prev.LineNumber)
+			continue
+		}
+		row.PersonID = int(candidates[0].ID)
+		used[row.PersonID] = true
+		moved = append(moved, row)
+		if row.Status == postgres.CorrectionRowCorrected {
+			corrected = append(corrected, postgres.PersonFromErcForCorrection{
+				ID:         row.PersonID,
+				Family:     prev.Family,
+				Name:       prev.Name,
+				Patronymic: prev.Patronymic,
+				Birthdate:  prev.Birthdate,
+				Snils:      prev.Snils,
+			})
+		}
+	}
+	if len(lost) > 0 {
+		sort.Ints(lost)
+		return fmt.Errorf("%w: строки %v", ErrCorrectionHistoryLost, lost)
+	}
+
+	for _, row := range moved {
+		if err := rp.db.CorrectionBatches.RestoreRow(ctx, row, tx); err != nil {
+			return err
+		}
+	}
+	for _, p := range corrected {
+		if err := rp.db.PersonsFromErc.UpdateFromCorrection(ctx, p, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saleKey признаки, по которым строка реестра до и после переразбора считается одной и той же продажей
+type saleKey struct {
+	Snils     string
+	Date      time.Time
+	Year      int
+	Semester  int
+	Color     string
+	Count     int
+	CashierID int
+}
+
+func newSaleKey(p postgres.PersonFromERC) saleKey {
+	return saleKey{
+		Snils:     p.Snils,
+		Date:      p.Date,
+		Year:      p.Year,
+		Semester:  p.Semester,
+		Color:     p.Color,
+		Count:     p.Count,
+		CashierID: p.CashierID,
+	}
+}
+
+// diffPersons считает добавленные, удалённые и изменённые строки, сравнивая их по saleKey
+func diffPersons(diff *EmailDiff, before, after []postgres.PersonFromERC) {
+	old := make(map[saleKey][]postgres.PersonFromERC, len(before))
+	for _, p := range before {
+		k := newSaleKey(p)
+		old[k] = append(old[k], p)
+	}
+	for _, p := range after {
+		k := newSaleKey(p)
+		candidates := old[k]
+		if len(candidates) == 0 {
+			diff.Added++
+			continue
+		}
+		prev := candidates[0]
+		old[k] = candidates[1:]
+		if samePerson(prev, p) {
+			diff.Unchanged++
+		} else {
+			diff.Changed++
+		}
+	}
+	for _, rest := range old {
+		diff.Removed += len(rest)
+	}
+}
+
+func samePerson(a, b postgres.PersonFromERC) bool {
+	// Идентификаторы после переразбора всегда новые
+	a.ID, b.ID = 0, 0
+	a.ErcUpdateID, b.ErcUpdateID = 0, 0
+	if len(a.Errors) == 0 && len(b.Errors) == 0 {
+		a.Errors, b.Errors = nil, nil
+	}
+	return reflect.DeepEqual(a, b)
+}
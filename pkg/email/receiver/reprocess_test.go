@@ -0,0 +1,253 @@
+package receiver
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/email/handlers"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"github.com/morzik45/stk-registry/pkg/postgres/pgtest"
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding/charmap"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMessage письмо с одним вложением register.txt
+func testMessage(messageID string) []byte {
+	return []byte(fmt.Sprintf("From: erc@example.com\r\n"+
+		"To: stk@example.com\r\n"+
+		"Subject: register\r\n"+
+		"Message-ID: <%s>\r\n"+
+		"Date: Mon, 02 Jan 2023 10:00:00 +0300\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/mixed; boundary=b\r\n"+
+		"\r\n"+
+		"--b\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n"+
+		"register attached\r\n"+
+		"--b\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Disposition: attachment; filename=register.txt\r\n"+
+		"\r\n"+
+		"line\r\n"+
+		"--b--\r\n", messageID))
+}
+
+// countingRegistry реестр, в котором обработчик реестров ЕРЦ только считает вложения
+func countingRegistry(calls *int) *handlers.Registry {
+	registry := handlers.NewRegistry()
+	registry.Register(handlers.TypeErcRegister, handlers.HandlerFunc(
+		func(ctx context.Context, tx *sqlx.Tx, e *postgres.Email, a handlers.Attachment) (handlers.Result, error) {
+			if _, err := io.ReadAll(a.Body); err != nil {
+				return handlers.Result{}, err
+			}
+			*calls++
+			return handlers.Result{Rows: 1}, nil
+		}))
+	return registry
+}
+
+func TestQuarantineResolverUsesRegistry(t *testing.T) {
+	var calls int
+	qr := NewQuarantineResolver(nil, &config.Config{}, zap.NewNop(), countingRegistry(&calls))
+	// Тип проверяется по реестру до обращения к БД, без реестра здесь была паника
+	_, err := qr.Assign(context.Background(), 1, "unknown")
+	if !errors.Is(err, ErrUnknownType) {
+		t.Fatalf("Assign with unknown type: got %v, want %v", err, ErrUnknownType)
+	}
+}
+
+func TestReprocessAndAssign(t *testing.T) {
+	db := pgtest.New(t)
+	ctx := context.Background()
+	cfg := &config.Config{}
+
+	e := postgres.Email{
+		TypeID:           postgres.EmailTypeErc,
+		MessageID:        "reprocess@example.com",
+		FromAddress:      "erc@example.com",
+		DatetimeReceived: time.Now(),
+		DatetimeParsed:   time.Now(),
+		File:             testMessage("reprocess@example.com"),
+	}
+	if err := db.Emails.Create(ctx, &e, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	rp := NewReprocessor(db, cfg, zap.NewNop(), countingRegistry(&calls))
+	summary, err := rp.Reprocess(ctx, postgres.EmailFilter{ID: e.ID}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Emails != 1 || summary.Failed != 0 {
+		t.Fatalf("reprocess summary: %+v", summary)
+	}
+	if calls != 1 {
+		t.Fatalf("handler called %d times on reprocess, want 1", calls)
+	}
+
+	q := postgres.QuarantinedEmail{
+		MessageID:        "quarantine@example.com",
+		FromAddress:      "unknown@example.com",
+		Subject:          "register",
+		Reason:           postgres.QuarantineUnexpectedSender,
+		DatetimeReceived: time.Now(),
+		File:             testMessage("quarantine@example.com"),
+	}
+	if err = db.Quarantine.Create(ctx, &q, nil); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := db.Quarantine.List(ctx, postgres.QuarantinePending)
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("pending quarantine: %v, %v", pending, err)
+	}
+	q.ID = pending[0].ID
+
+	calls = 0
+	qr := NewQuarantineResolver(db, cfg, zap.NewNop(), countingRegistry(&calls))
+	res, err := qr.Assign(ctx, q.ID, handlers.TypeErcRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Recognized != 1 || res.Failed != 0 || calls != 1 {
+		t.Fatalf("assign result %+v, handler called %d times", res, calls)
+	}
+	resolved, err := db.Quarantine.Get(ctx, q.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Status != postgres.QuarantineAssigned {
+		t.Fatalf("quarantine status %s, want %s", resolved.Status, postgres.QuarantineAssigned)
+	}
+}
+
+// registerMessage письмо с реестром ЕРЦ register.txt в windows-1251
+func registerMessage(t *testing.T, messageID string, lines ...string) []byte {
+	t.Helper()
+	data, err := charmap.Windows1251.NewEncoder().String(strings.Join(lines, "\r\n") + "\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(fmt.Sprintf("From: erc@example.com\r\n"+
+		"To: stk@example.com\r\n"+
+		"Subject: register\r\n"+
+		"Message-ID: <%s>\r\n"+
+		"Date: Mon, 02 Jan 2023 10:00:00 +0300\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/mixed; boundary=b\r\n"+
+		"\r\n"+
+		"--b\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Transfer-Encoding: base64\r\n"+
+		"Content-Disposition: attachment; filename=register.txt\r\n"+
+		"\r\n"+
+		"%s\r\n"+
+		"--b--\r\n", messageID, base64.StdEncoding.EncodeToString([]byte(data))))
+}
+
+// reprocessOnce переразбирает одно письмо и возвращает его итог
+func reprocessOnce(t *testing.T, rp *Reprocessor, emailID int) EmailDiff {
+	t.Helper()
+	summary, err := rp.Reprocess(context.Background(), postgres.EmailFilter{ID: emailID}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Details) != 1 {
+		t.Fatalf("reprocess summary: %+v", summary)
+	}
+	return summary.Details[0]
+}
+
+func TestReprocessKeepsCorrectionHistory(t *testing.T) {
+	db := pgtest.New(t)
+	ctx := context.Background()
+	cfg := &config.Config{}
+
+	e := postgres.Email{
+		TypeID:           postgres.EmailTypeErc,
+		MessageID:        "corrected@example.com",
+		FromAddress:      "erc@example.com",
+		DatetimeReceived: time.Now(),
+		DatetimeParsed:   time.Now(),
+		File: registerMessage(t, "corrected@example.com",
+			"123|04.03.1950|Иванов|Иван|Иванович|2022|1|синий|2|1|02.01.2022|5|Касса",
+			"456|05.03.1950|Петров|Пётр|Петрович|2022|1|синий|2|1|02.01.2022|5|Касса"),
+	}
+	if err := db.Emails.Create(ctx, &e, nil); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := handlers.NewDefaultRegistry(db, cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := NewReprocessor(db, cfg, zap.NewNop(), registry)
+
+	// Первый разбор, затем обе строки с ошибкой в СНИЛС отправлены на коррекцию, по первой пришёл ответ
+	if diff := reprocessOnce(t, rp, e.ID); diff.Error != "" || diff.Added != 2 {
+		t.Fatalf("first parse: %+v", diff)
+	}
+	before, err := db.PersonsFromErc.GetByEmail(ctx, e.ID, nil)
+	if err != nil || len(before) != 2 {
+		t.Fatalf("persons after first parse: %v, %v", before, err)
+	}
+	batch := postgres.CorrectionBatch{MessageID: "batch@example.com"}
+	if err = db.CorrectionBatches.Create(ctx, &batch, []int{int(before[0].ID), int(before[1].ID)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	fixed := postgres.PersonFromErcForCorrection{
+		ID: int(before[0].ID), Family: "Иванов", Name: "Иван", Patronymic: "Иванович",
+		Birthdate: before[0].Birthdate, Snils: "11223344595",
+	}
+	if err = db.PersonsFromErc.UpdateFromCorrection(ctx, fixed, nil); err != nil {
+		t.Fatal(err)
+	}
+	row := postgres.CorrectionBatchRow{BatchID: batch.ID, PersonID: fixed.ID}
+	if err = db.CorrectionBatches.MarkCorrected(ctx, row, e.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := reprocessOnce(t, rp, e.ID); diff.Error != "" || diff.Unchanged != 2 {
+		t.Fatalf("reprocess with history: %+v", diff)
+	}
+	after, err := db.PersonsFromErc.GetByEmail(ctx, e.ID, nil)
+	if err != nil || len(after) != 2 {
+		t.Fatalf("persons after reprocess: %v, %v", after, err)
+	}
+	if after[0].ID == before[0].ID || after[0].Snils != "11223344595" || after[0].Errors != nil {
+		t.Errorf("correction not applied to the new row: %+v", after[0])
+	}
+	history, err := db.CorrectionBatches.RowsByEmail(ctx, e.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]string{after[0].ID: postgres.CorrectionRowCorrected, after[1].ID: postgres.CorrectionRowPending}
+	if len(history) != 2 {
+		t.Fatalf("correction rows after reprocess: %+v", history)
+	}
+	for _, r := range history {
+		if r.BatchID != batch.ID || want[int64(r.PersonID)] != r.Status {
+			t.Errorf("correction row %+v, want status %q", r, want[int64(r.PersonID)])
+		}
+	}
+
+	// Строку, которую не удаётся сопоставить, не теряем: письмо не переразбирается
+	if _, err = db.DB.ExecContext(ctx, "UPDATE persons_from_erc SET line_number = 99 WHERE id = $1", after[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	diff := reprocessOnce(t, rp, e.ID)
+	if !strings.Contains(diff.Error, ErrCorrectionHistoryLost.Error()) || !strings.Contains(diff.Error, "99") {
+		t.Fatalf("reprocess with unmatched row: %+v", diff)
+	}
+	kept, err := db.PersonsFromErc.GetByEmail(ctx, e.ID, nil)
+	if err != nil || len(kept) != 2 || kept[0].ID != after[0].ID || kept[1].ID != after[1].ID {
+		t.Fatalf("persons after refused reprocess: %v, %v", kept, err)
+	}
+}
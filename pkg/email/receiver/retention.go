@@ -0,0 +1,65 @@
+package receiver
+
+import (
+	"context"
+	"fmt"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"strings"
+	"time"
+)
+
+// Политика удаления писем с сервера (EMAIL_RETENTION)
+const (
+	RetentionKeep   = "keep"   // не удалять
+	RetentionDelete = "delete" // удалять сразу после загрузки
+	RetentionDays   = "days"   // удалять письма старше EMAIL_RETENTION_DAYS дней
+	RetentionCount  = "count"  // оставлять EMAIL_RETENTION_COUNT последних писем
+)
+
+func retentionMode(cfg *config.Config) (string, error) {
+	mode := strings.ToLower(cfg.Email.Retention)
+	switch mode {
+	case "":
+		return RetentionKeep, nil
+	case RetentionKeep, RetentionDelete, RetentionDays, RetentionCount:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown email retention policy: %s", cfg.Email.Retention)
+	}
+}
+
+// toDelete выбирает письма, которые можно удалить с сервера по политике хранения.
+// uids - UID всех писем ящика от старых к новым. Удаляются только письма, исходный текст которых сохранён в emails.
+func (r *processor) toDelete(ctx context.Context, mailbox string, uids []string) ([]string, error) {
+	mode, err := retentionMode(r.config)
+	if err != nil || mode == RetentionKeep {
+		return nil, err
+	}
+	stored, err := r.db.MailboxSeen.GetStored(ctx, mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().AddDate(0, 0, -r.config.Email.RetentionDays)
+	keepFrom := len(uids) - r.config.Email.RetentionCount // письма с этого индекса остаются на сервере
+	var result []string
+	for i, uid := range uids {
+		received, ok := stored[uid]
+		if !ok {
+			continue
+		}
+		switch mode {
+		case RetentionDelete:
+			result = append(result, uid)
+		case RetentionDays:
+			if received.Before(deadline) {
+				result = append(result, uid)
+			}
+		case RetentionCount:
+			if i < keepFrom {
+				result = append(result, uid)
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,47 @@
+package receiver
+
+import (
+	"context"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"go.uber.org/zap"
+)
+
+// startRun записывает в журнал начало проверки ящика. Журнал не должен мешать получению писем,
+// поэтому ошибки только логируются.
+func (r *processor) startRun(ctx context.Context, trigger, mailbox string) *postgres.IngestionRun {
+	run := &postgres.IngestionRun{Trigger: trigger, Mailbox: mailbox}
+	if err := r.db.IngestionRuns.Create(ctx, run); err != nil {
+		r.logger.Error("Error creating ingestion run", zap.Error(err))
+	}
+	return run
+}
+
+// countMessage учитывает в журнале обработанное письмо
+func countMessage(run *postgres.IngestionRun, res messageResult) {
+	run.Seen++
+	run.RowsInserted += res.Rows
+	if res.Status == postgres.SeenIngested {
+		run.Ingested++
+	} else {
+		run.Skipped++
+	}
+}
+
+// countFailed учитывает в журнале письмо, которое не удалось получить или обработать
+func countFailed(run *postgres.IngestionRun) {
+	run.Seen++
+	run.Failed++
+}
+
+// finishRun записывает в журнал итоги проверки
+func (r *processor) finishRun(ctx context.Context, run *postgres.IngestionRun, err error) {
+	if run.ID == 0 {
+		return
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	if err := r.db.IngestionRuns.Finish(ctx, run); err != nil {
+		r.logger.Error("Error finishing ingestion run", zap.Int("id", run.ID), zap.Error(err))
+	}
+}
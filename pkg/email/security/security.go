@@ -0,0 +1,123 @@
+package security
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"os"
+	"strings"
+)
+
+// Mode способ защиты соединения с почтовым сервером.
+type Mode string
+
+const (
+	Plain    Mode = "plain"    // без шифрования
+	StartTLS Mode = "starttls" // обычное соединение, переводимое в TLS командой STARTTLS/STLS
+	TLS      Mode = "tls"      // TLS с момента подключения (POP3S, IMAPS, SMTPS)
+)
+
+// ErrPlainAuth возвращается при попытке передать логин и пароль по незашифрованному соединению.
+var ErrPlainAuth = errors.New("refusing to send credentials over unencrypted connection, set EMAIL_ALLOW_PLAIN_AUTH=true to allow")
+
+// ParseMode разбирает режим из конфига, пустая строка означает Plain.
+func ParseMode(s string) (Mode, error) {
+	switch Mode(strings.ToLower(strings.TrimSpace(s))) {
+	case "", Plain:
+		return Plain, nil
+	case StartTLS:
+		return StartTLS, nil
+	case TLS:
+		return TLS, nil
+	default:
+		return "", fmt.Errorf("unknown email security mode: %s", s)
+	}
+}
+
+// CheckAuth проверяет, можно ли отправлять учётные данные по соединению.
+func CheckAuth(isTLS bool, cfg *config.Config) error {
+	if !isTLS && !cfg.Email.AllowPlainAuth {
+		return ErrPlainAuth
+	}
+	return nil
+}
+
+// PlainAuthProblems проверяет при запуске, не придётся ли передавать пароль без шифрования. По умолчанию
+// режимы защиты plain, а EMAIL_ALLOW_PLAIN_AUTH выключен: приём почты с такими настройками всегда
+// завершается ErrPlainAuth, отправка - если SMTP-сервер не предлагает STARTTLS. Возвращает описания
+// таких настроек для лога, пустой список - всё в порядке.
+func PlainAuthProblems(cfg *config.Config) []string {
+	if cfg.Email.AllowPlainAuth || cfg.Email.Username == "" {
+		return nil
+	}
+	var problems []string
+	receive, receiveMode := "EMAIL_POP3_SECURITY", cfg.Email.POP3Security
+	if strings.EqualFold(cfg.Email.Protocol, "imap") {
+		receive, receiveMode = "EMAIL_IMAP_SECURITY", cfg.Email.IMAPSecurity
+	}
+	if mode, err := ParseMode(receiveMode); err == nil && mode == Plain {
+		problems = append(problems, fmt.Sprintf(
+			"%s=plain: почта не будет приниматься, задайте %s=tls или starttls либо EMAIL_ALLOW_PLAIN_AUTH=true",
+			receive, receive))
+	}
+	if mode, err := ParseMode(cfg.Email.SMTPSecurity); err == nil && mode == Plain && strings.EqualFold(cfg.Email.Transport, "smtp") {
+		problems = append(problems,
+			"EMAIL_SMTP_SECURITY=plain: письма не будут отправляться, если сервер не предлагает STARTTLS, "+
+				"задайте EMAIL_SMTP_SECURITY=tls или starttls либо EMAIL_ALLOW_PLAIN_AUTH=true")
+	}
+	return problems
+}
+
+// TLSConfig собирает настройки TLS для подключения к почтовому серверу host.
+// Если задан EMAIL_TLS_CA_FILE, сертификаты из него добавляются к системным.
+// Если заданы отпечатки EMAIL_TLS_PINNED_SHA256, сертификат сервера проверяется только по ним,
+// это позволяет работать с внутренними серверами на самоподписанных сертификатах.
+func TLSConfig(host string, cfg *config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.Email.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.Email.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.Email.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(cfg.Email.TLSPinnedSHA256) > 0 {
+		pins := make(map[string]struct{}, len(cfg.Email.TLSPinnedSHA256))
+		for _, pin := range cfg.Email.TLSPinnedSHA256 {
+			pin = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(pin), ":", ""))
+			if pin != "" {
+				pins[pin] = struct{}{}
+			}
+		}
+		// Цепочку не проверяем, доверяем только сертификату с известным отпечатком.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server did not present a certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if _, ok := pins[hex.EncodeToString(sum[:])]; !ok {
+				return fmt.Errorf("server certificate sha256 %x does not match pinned", sum)
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
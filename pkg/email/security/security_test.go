@@ -0,0 +1,48 @@
+package security
+
+import (
+	"github.com/morzik45/stk-registry/pkg/config"
+	"strings"
+	"testing"
+)
+
+func TestPlainAuthProblems(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(cfg *config.Config)
+		want      []string // переменные, о которых сообщается
+	}{
+		{"defaults", func(cfg *config.Config) {}, []string{"EMAIL_POP3_SECURITY", "EMAIL_SMTP_SECURITY"}},
+		{"imap", func(cfg *config.Config) { cfg.Email.Protocol = "imap" }, []string{"EMAIL_IMAP_SECURITY", "EMAIL_SMTP_SECURITY"}},
+		{"allowed", func(cfg *config.Config) { cfg.Email.AllowPlainAuth = true }, nil},
+		{"no credentials", func(cfg *config.Config) { cfg.Email.Username = "" }, nil},
+		{"encrypted", func(cfg *config.Config) {
+			cfg.Email.POP3Security, cfg.Email.SMTPSecurity = "tls", "starttls"
+		}, nil},
+		{"other protocol plain", func(cfg *config.Config) {
+			cfg.Email.POP3Security, cfg.Email.SMTPSecurity = "TLS", "tls"
+		}, nil},
+		{"file transport", func(cfg *config.Config) {
+			cfg.Email.POP3Security, cfg.Email.Transport = "tls", "dir"
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Email.Username = "stk@example.com"
+			cfg.Email.Protocol, cfg.Email.Transport = "pop3", "smtp"
+			cfg.Email.POP3Security, cfg.Email.IMAPSecurity, cfg.Email.SMTPSecurity = "plain", "plain", "plain"
+			tt.configure(cfg)
+
+			problems := PlainAuthProblems(cfg)
+			if len(problems) != len(tt.want) {
+				t.Fatalf("problems: %q", problems)
+			}
+			for i, name := range tt.want {
+				if !strings.HasPrefix(problems[i], name+"=plain") || !strings.Contains(problems[i], "EMAIL_ALLOW_PLAIN_AUTH=true") {
+					t.Errorf("problem %d: %s", i, problems[i])
+				}
+			}
+		})
+	}
+}
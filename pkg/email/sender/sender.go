@@ -1,15 +1,20 @@
 package sender
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"github.com/jordan-wright/email"
 	"github.com/morzik45/stk-registry/pkg/config"
+	"go.uber.org/zap"
 	"io"
 	"net/smtp"
+	"strings"
 	"time"
 )
 
-// Небольшой хак для авторизации на почте без SSL
+// Небольшой хак для авторизации на почте без SSL, используется только если это явно разрешено в конфиге
 type unencryptedAuth struct {
 	smtp.Auth
 }
@@ -20,30 +25,107 @@ func (a unencryptedAuth) Start(server *smtp.ServerInfo) (string, []byte, error)
 	return a.Auth.Start(&s)
 }
 
+// Attachment вложение письма
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Message исходящее письмо
+type Message struct {
+	MessageID   string // без угловых скобок, если пустой - будет создан при отправке
+	To          []string
+	Subject     string
+	Body        string // текст письма
+	HTML        string // HTML-версия письма, если пустая - отправляется только текст
+	Attachments []Attachment
+}
+
+// NewMessageID создаёт Message-ID для письма, по нему потом можно найти ответ
+func NewMessageID(cfg *config.Config) string {
+	domain := "localhost"
+	if i := strings.LastIndex(cfg.Email.Username, "@"); i >= 0 && i < len(cfg.Email.Username)-1 {
+		domain = cfg.Email.Username[i+1:]
+	} else if cfg.Email.Host != "" {
+		domain = cfg.Email.Host
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%d.%s@%s", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
+
+// XlsxContentType тип вложений Excel
+const XlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// XlsxFilename имя файла для отчёта Excel, сформированного сейчас
+func XlsxFilename() string {
+	return time.Now().Format("20060201150405") + ".xlsx"
+}
+
+// Sender отправляет письма через транспорт, выбранный в конфиге
+type Sender struct {
+	config    *config.Config
+	transport Transport
+}
+
+func New(cfg *config.Config, logger *zap.Logger) (*Sender, error) {
+	transport, err := NewTransport(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &Sender{config: cfg, transport: transport}, nil
+}
+
+// DryRun письма никуда не отправляются, только пишутся в лог
+func (s *Sender) DryRun() bool {
+	_, ok := s.transport.(dryRunTransport)
+	return ok
+}
+
 // SendFiles отправляет !Excel! файлы на почту
-func SendFiles(readers []io.Reader, to []string, subject string, cfg *config.Config) error {
+func (s *Sender) SendFiles(readers []io.Reader, to []string, subject string) error {
+	m := Message{To: to, Subject: subject}
+
+	// Прикрепляем !Excel! файлы
+	for _, r := range readers {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		m.Attachments = append(m.Attachments, Attachment{
+			Filename:    XlsxFilename(),
+			ContentType: XlsxContentType,
+			Data:        data,
+		})
+	}
+
+	return s.SendMessage(m)
+}
+
+// SendMessage отправляет письмо
+func (s *Sender) SendMessage(m Message) error {
 
 	// Подготовка письма
 	e := email.NewEmail()
-	e.From = fmt.Sprintf("%s <%s>", cfg.Organization, cfg.Email.Username) // От кого
-	e.To = to                                                             // Кому
-	e.Subject = subject                                                   // Тема
+	e.From = fmt.Sprintf("%s <%s>", s.config.Organization, s.config.Email.Username) // От кого
+	e.To = m.To                                                                     // Кому
+	e.Subject = m.Subject                                                           // Тема
+	e.Text = []byte(m.Body)
+	if m.HTML != "" {
+		e.HTML = []byte(m.HTML)
+	}
+	if m.MessageID != "" {
+		e.Headers.Set("Message-Id", "<"+m.MessageID+">")
+	}
 
-	// Прикрепляем !Excel! файлы
-	for _, r := range readers {
-		_, err := e.Attach(
-			r,
-			time.Now().Format("20060201150405")+".xlsx",
-			"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
-		)
+	for _, a := range m.Attachments {
+		_, err := e.Attach(bytes.NewReader(a.Data), a.Filename, a.ContentType)
 		if err != nil {
 			return err
 		}
 	}
 
 	// Отправляем письмо
-	return e.Send(
-		fmt.Sprintf("%s:%d", cfg.Email.Host, cfg.Email.PortSMTP),
-		unencryptedAuth{smtp.PlainAuth("", cfg.Email.Username, cfg.Email.Password, cfg.Email.Host)},
-	)
+	return s.transport.Send(e)
 }
@@ -0,0 +1,203 @@
+package sender
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/jordan-wright/email"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/email/security"
+	"go.uber.org/zap"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Виды транспорта (EMAIL_TRANSPORT)
+const (
+	TransportSMTP   = "smtp"    // отправка через SMTP-сервер
+	TransportDir    = "dir"     // письма сохраняются в EMAIL_TRANSPORT_DIR файлами .eml
+	TransportDryRun = "dry-run" // письма только пишутся в лог, отчёт в ЕРЦ не помечается отправленным
+)
+
+// Transport доставляет готовое письмо
+type Transport interface {
+	Send(e *email.Email) error
+}
+
+// NewTransport создаёт транспорт, выбранный в конфиге
+func NewTransport(cfg *config.Config, logger *zap.Logger) (Transport, error) {
+	switch strings.ToLower(cfg.Email.Transport) {
+	case TransportSMTP, "":
+		return smtpTransport{config: cfg}, nil
+	case TransportDir:
+		if cfg.Email.TransportDir == "" {
+			return nil, fmt.Errorf("transport %s: EMAIL_TRANSPORT_DIR is not set", TransportDir)
+		}
+		err := os.MkdirAll(cfg.Email.TransportDir, 0o755)
+		if err != nil {
+			return nil, err
+		}
+		return &dirTransport{dir: cfg.Email.TransportDir}, nil
+	case TransportDryRun:
+		return dryRunTransport{logger: logger.Named("dry-run")}, nil
+	default:
+		return nil, fmt.Errorf("unknown email transport %q", cfg.Email.Transport)
+	}
+}
+
+type smtpTransport struct {
+	config *config.Config
+}
+
+func (t smtpTransport) Send(e *email.Email) error {
+	cfg := t.config
+	mode, err := security.ParseMode(cfg.Email.SMTPSecurity)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := security.TLSConfig(cfg.Email.Host, cfg)
+	if err != nil {
+		return err
+	}
+
+	addr := fmt.Sprintf("%s:%d", cfg.Email.Host, cfg.Email.PortSMTP)
+	// smtp.PlainAuth сам откажется отправлять пароль, если соединение не зашифровано
+	var auth smtp.Auth = smtp.PlainAuth("", cfg.Email.Username, cfg.Email.Password, cfg.Email.Host)
+
+	switch mode {
+	case security.TLS:
+		return e.SendWithTLS(addr, auth, tlsConfig)
+	case security.StartTLS:
+		return e.SendWithStartTLS(addr, auth, tlsConfig)
+	default:
+		return t.sendPlain(e, addr, auth, tlsConfig)
+	}
+}
+
+// sendPlain отправляет письмо без обязательного шифрования. Если сервер предлагает STARTTLS, соединение
+// шифруется с настройками security.TLSConfig: e.Send перешёл бы на TLS сам, но с проверкой сертификата
+// по умолчанию, без EMAIL_TLS_CA_FILE и отпечатков.
+func (t smtpTransport) sendPlain(e *email.Email, addr string, auth smtp.Auth, tlsConfig *tls.Config) error {
+	from, to, raw, err := envelope(e)
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err = c.Hello("localhost"); err != nil {
+		return err
+	}
+	isTLS := false
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+		isTLS = true
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		if err = security.CheckAuth(isTLS, t.config); err != nil {
+			return err
+		}
+		if !isTLS {
+			auth = unencryptedAuth{auth}
+		}
+		if err = c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(raw); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// envelope адреса отправителя и получателей (To, Cc, Bcc) для SMTP и текст письма, так же как в email.Send
+func envelope(e *email.Email) (from string, to []string, raw []byte, err error) {
+	to = make([]string, 0, len(e.To)+len(e.Cc)+len(e.Bcc))
+	for _, list := range [][]string{e.To, e.Cc, e.Bcc} {
+		for _, s := range list {
+			addr, err := mail.ParseAddress(s)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			to = append(to, addr.Address)
+		}
+	}
+	sender := e.Sender
+	if sender == "" {
+		sender = e.From
+	}
+	if sender == "" || len(to) == 0 {
+		return "", nil, nil, errors.New("no sender or recipients")
+	}
+	addr, err := mail.ParseAddress(sender)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	raw, err = e.Bytes()
+	return addr.Address, to, raw, err
+}
+
+type dirTransport struct {
+	dir     string
+	counter uint64
+}
+
+func (t *dirTransport) Send(e *email.Email) error {
+	raw, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%d.eml", time.Now().Format("20060102-150405.000000"), atomic.AddUint64(&t.counter, 1))
+	// Пишем во временный файл, чтобы тот, кто забирает письма из папки, не увидел его недописанным
+	tmp := filepath.Join(t.dir, "."+name+".tmp")
+	err = os.WriteFile(tmp, raw, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.dir, name))
+}
+
+type dryRunTransport struct {
+	logger *zap.Logger
+}
+
+func (t dryRunTransport) Send(e *email.Email) error {
+	attachments := make([]string, 0, len(e.Attachments))
+	for _, a := range e.Attachments {
+		attachments = append(attachments, a.Filename)
+	}
+	t.logger.Info("Message not sent",
+		zap.Strings("to", e.To),
+		zap.String("subject", e.Subject),
+		zap.Int("text_size", len(e.Text)),
+		zap.Int("html_size", len(e.HTML)),
+		zap.Strings("attachments", attachments),
+	)
+	return nil
+}
@@ -0,0 +1,164 @@
+package sender
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"github.com/jordan-wright/email"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSignedCert сертификат для 127.0.0.1, которому системные корневые сертификаты не доверяют
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// smtpResult что получил тестовый сервер
+type smtpResult struct {
+	tls  bool
+	data string
+	err  error
+}
+
+// startSMTPServer принимает одно письмо, предлагает STARTTLS с сертификатом cert, AUTH не предлагает
+func startSMTPServer(t *testing.T, cert tls.Certificate) (int, <-chan smtpResult) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	done := make(chan smtpResult, 1)
+	go func() {
+		var res smtpResult
+		defer func() { done <- res }()
+		conn, err := l.Accept()
+		if err != nil {
+			res.err = err
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		tp := textproto.NewConn(conn)
+		_ = tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				res.err = err
+				return
+			}
+			cmd := strings.ToUpper(strings.Fields(line + " ")[0])
+			switch cmd {
+			case "EHLO":
+				if res.tls {
+					_ = tp.PrintfLine("250 localhost")
+				} else {
+					_ = tp.PrintfLine("250-localhost")
+					_ = tp.PrintfLine("250 STARTTLS")
+				}
+			case "STARTTLS":
+				_ = tp.PrintfLine("220 ready")
+				tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+				if err = tlsConn.Handshake(); err != nil {
+					res.err = err
+					return
+				}
+				res.tls = true
+				conn = tlsConn
+				tp = textproto.NewConn(conn)
+			case "MAIL", "RCPT":
+				_ = tp.PrintfLine("250 ok")
+			case "DATA":
+				_ = tp.PrintfLine("354 go ahead")
+				var data []byte
+				data, res.err = tp.ReadDotBytes()
+				res.data = string(data)
+				_ = tp.PrintfLine("250 ok")
+			case "QUIT":
+				_ = tp.PrintfLine("221 bye")
+				return
+			default:
+				_ = tp.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, done
+}
+
+func testEmail() *email.Email {
+	e := email.NewEmail()
+	e.From = "stk@example.com"
+	e.To = []string{"erc@example.com"}
+	e.Subject = "report"
+	e.Text = []byte("text")
+	return e
+}
+
+func TestSMTPPlainUsesConfiguredStartTLS(t *testing.T) {
+	cert := selfSignedCert(t)
+	sum := sha256.Sum256(cert.Certificate[0])
+
+	port, done := startSMTPServer(t, cert)
+	cfg := &config.Config{}
+	cfg.Email.Host = "127.0.0.1"
+	cfg.Email.PortSMTP = port
+	cfg.Email.SMTPSecurity = "plain"
+	cfg.Email.TLSPinnedSHA256 = []string{hex.EncodeToString(sum[:])}
+
+	// Сертификат самоподписанный: с проверкой по умолчанию STARTTLS не прошёл бы, с отпечатком проходит
+	if err := (smtpTransport{config: cfg}).Send(testEmail()); err != nil {
+		t.Fatal(err)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if !res.tls || !strings.Contains(res.data, "Subject: report") {
+		t.Fatalf("server got tls=%v, data:\n%s", res.tls, res.data)
+	}
+}
+
+func TestSMTPPlainRejectsWrongPin(t *testing.T) {
+	port, done := startSMTPServer(t, selfSignedCert(t))
+	cfg := &config.Config{}
+	cfg.Email.Host = "127.0.0.1"
+	cfg.Email.PortSMTP = port
+	cfg.Email.SMTPSecurity = "plain"
+	cfg.Email.TLSPinnedSHA256 = []string{strings.Repeat("00", sha256.Size)}
+
+	if err := (smtpTransport{config: cfg}).Send(testEmail()); err == nil {
+		t.Fatal("sent over STARTTLS with a certificate that does not match the pin")
+	}
+	if res := <-done; res.data != "" {
+		t.Fatalf("server received message: %s", res.data)
+	}
+}
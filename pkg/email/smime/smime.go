@@ -0,0 +1,249 @@
+// Package smime проверяет подписи S/MIME (PKCS#7) входящих писем.
+//
+// Поддерживаются только письма с отделённой подписью (multipart/signed). Письма, где данные
+// вложены в саму подпись (application/pkcs7-mime), считаются неверно подписанными.
+// Подписи по ГОСТ библиотека pkcs7 не проверяет.
+package smime
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-message/textproto"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"go.mozilla.org/pkcs7"
+	"io"
+	"mime"
+	"os"
+	"strings"
+)
+
+// Результат проверки подписи, хранится в emails.signature_status
+const (
+	StatusNotChecked = "not_checked" // для типа письма проверка не настроена
+	StatusValid      = "valid"       // подпись верна и выдана доверенным сертификатом
+	StatusUnsigned   = "unsigned"    // письмо не подписано
+	StatusInvalid    = "invalid"     // подпись неверна или сертификат не доверенный
+)
+
+// Result итог проверки подписи письма
+type Result struct {
+	Status string
+	Signer string // субъект сертификата подписавшего
+	Error  string
+}
+
+// Verifier проверяет подписи по хранилищам доверенных сертификатов для каждого типа писем.
+type Verifier struct {
+	stores map[string]*x509.CertPool
+}
+
+// NewVerifier загружает хранилища из EMAIL_SMIME_TRUST_STORES: "тип=файл PEM" через ";".
+func NewVerifier(cfg *config.Config) (*Verifier, error) {
+	v := Verifier{stores: make(map[string]*x509.CertPool)}
+	for _, s := range cfg.Email.SMIMETrustStores {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		typeName, path, ok := strings.Cut(s, "=")
+		typeName, path = strings.TrimSpace(typeName), strings.TrimSpace(path)
+		if !ok || typeName == "" || path == "" {
+			return nil, fmt.Errorf("invalid S/MIME trust store: %s", s)
+		}
+		pool, err := loadPool(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load S/MIME trust store for %s: %w", typeName, err)
+		}
+		v.stores[typeName] = pool
+	}
+	return &v, nil
+}
+
+func loadPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// Required сообщает, нужно ли проверять подпись писем этого типа
+func (v *Verifier) Required(typeName string) bool {
+	_, ok := v.stores[typeName]
+	return ok
+}
+
+// Verify проверяет подпись письма body типа typeName. from - адрес отправителя: если в сертификате
+// указаны адреса, отправитель должен быть среди них.
+func (v *Verifier) Verify(typeName, from string, body []byte) Result {
+	pool, ok := v.stores[typeName]
+	if !ok {
+		return Result{Status: StatusNotChecked}
+	}
+
+	content, signature, err := splitSigned(body)
+	if errors.Is(err, errUnsigned) {
+		return Result{Status: StatusUnsigned, Error: err.Error()}
+	} else if err != nil {
+		return Result{Status: StatusInvalid, Error: err.Error()}
+	}
+
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		return Result{Status: StatusInvalid, Error: "failed to parse signature: " + err.Error()}
+	}
+	p7.Content = content
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return Result{Status: StatusInvalid, Error: "signature must have exactly one signer"}
+	}
+	res := Result{Signer: signer.Subject.String()}
+	if err = p7.VerifyWithChain(pool); err != nil {
+		res.Status = StatusInvalid
+		res.Error = err.Error()
+		return res
+	}
+	if len(signer.EmailAddresses) > 0 && !containsFold(signer.EmailAddresses, from) {
+		res.Status = StatusInvalid
+		res.Error = fmt.Sprintf("certificate is issued for %s, not for %s", strings.Join(signer.EmailAddresses, ", "), from)
+		return res
+	}
+	res.Status = StatusValid
+	return res
+}
+
+var errUnsigned = errors.New("message is not signed")
+
+// IsSignature сообщает, что часть письма с типом contentType - отделённая подпись S/MIME
+func IsSignature(contentType string) bool {
+	switch strings.ToLower(contentType) {
+	case "application/pkcs7-signature", "application/x-pkcs7-signature":
+		return true
+	}
+	return false
+}
+
+// splitSigned выделяет из письма multipart/signed подписанную часть в исходном виде и подпись в DER.
+func splitSigned(body []byte) (content, signature []byte, err error) {
+	// Подпись считается от текста с переводами строк CRLF
+	if !bytes.Contains(body, []byte("\r\n")) {
+		body = bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n"))
+	}
+
+	br := bufio.NewReader(bytes.NewReader(body))
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, errUnsigned
+	}
+	switch mediaType {
+	case "multipart/signed":
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return nil, nil, errors.New("opaque signed messages are not supported")
+	default:
+		return nil, nil, errUnsigned
+	}
+	if !IsSignature(params["protocol"]) {
+		return nil, nil, fmt.Errorf("unsupported signature protocol: %s", params["protocol"])
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, nil, errors.New("multipart/signed without boundary")
+	}
+
+	rest, err := io.ReadAll(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	parts := splitParts(rest, boundary)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("multipart/signed must have 2 parts, found %d", len(parts))
+	}
+
+	signature, err = decodeSignature(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return parts[0], signature, nil
+}
+
+// splitParts делит тело multipart на части по RFC 2046, перевод строки перед разделителем к части не относится.
+func splitParts(body []byte, boundary string) [][]byte {
+	delimiter := []byte("\r\n--" + boundary)
+	// Первый разделитель может стоять в самом начале тела
+	body = append([]byte("\r\n"), body...)
+
+	var parts [][]byte
+	i := bytes.Index(body, delimiter)
+	for i >= 0 {
+		start := i + len(delimiter)
+		if bytes.HasPrefix(body[start:], []byte("--")) {
+			break // завершающий разделитель
+		}
+		lineEnd := bytes.Index(body[start:], []byte("\r\n"))
+		if lineEnd < 0 {
+			break
+		}
+		start += lineEnd + 2
+		next := bytes.Index(body[start:], delimiter)
+		if next < 0 {
+			break
+		}
+		parts = append(parts, body[start:start+next])
+		i = start + next
+	}
+	return parts
+}
+
+func decodeSignature(part []byte) ([]byte, error) {
+	br := bufio.NewReader(bytes.NewReader(part))
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		return io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(removeWhitespace(data))))
+	case "", "binary", "7bit", "8bit":
+		if block, _ := pem.Decode(data); block != nil {
+			return block.Bytes, nil
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unsupported signature encoding: %s", header.Get("Content-Transfer-Encoding"))
+	}
+}
+
+func removeWhitespace(data []byte) []byte {
+	return bytes.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, data)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package smime
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"go.mozilla.org/pkcs7"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA удостоверяющий центр, выпускающий сертификаты для подписи писем
+type testCA struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+// issue выпускает сертификат подписавшего для адресов emails
+func (ca testCA) issue(t *testing.T, name string, emails ...string) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: name},
+		EmailAddresses: emails,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// signedMessage письмо multipart/signed с отделённой подписью части content
+func signedMessage(t *testing.T, ca testCA, cert *x509.Certificate, key *rsa.PrivateKey, content string) string {
+	t.Helper()
+	sd, err := pkcs7.NewSignedData([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sd.AddSignerChain(cert, key, []*x509.Certificate{ca.cert}, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	sd.Detach()
+	signature, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(signature)
+	var lines []string
+	for len(encoded) > 76 {
+		lines, encoded = append(lines, encoded[:76]), encoded[76:]
+	}
+	lines = append(lines, encoded)
+
+	return strings.Join([]string{
+		"From: erc@example.com",
+		"Subject: register",
+		`Content-Type: multipart/signed; protocol="application/pkcs7-signature"; micalg=sha-256; boundary="sig"`,
+		"",
+		"--sig",
+		content,
+		"--sig",
+		"Content-Type: application/pkcs7-signature; name=smime.p7s",
+		"Content-Transfer-Encoding: base64",
+		"",
+		strings.Join(lines, "\r\n"),
+		"--sig--",
+		"",
+	}, "\r\n")
+}
+
+const signedContent = "Content-Type: text/plain; charset=utf-8\r\n\r\nреестр"
+
+func TestVerify(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	other := newTestCA(t, "Other CA")
+	cert, key := ca.issue(t, "ERC", "erc@example.com")
+	anyAddress, anyKey := ca.issue(t, "ERC without email")
+
+	trusted, untrusted := x509.NewCertPool(), x509.NewCertPool()
+	trusted.AddCert(ca.cert)
+	untrusted.AddCert(other.cert)
+
+	signed := signedMessage(t, ca, cert, key, signedContent)
+	tests := []struct {
+		name     string
+		pool     *x509.CertPool
+		typeName string
+		from     string
+		body     string
+		status   string
+		err      string
+	}{
+		{"valid", trusted, "erc_register", "ERC@example.com", signed, StatusValid, ""},
+		{"lf line endings", trusted, "erc_register", "erc@example.com", strings.ReplaceAll(signed, "\r\n", "\n"), StatusValid, ""},
+		{"certificate without email", trusted, "erc_register", "anyone@example.com", signedMessage(t, ca, anyAddress, anyKey, signedContent), StatusValid, ""},
+		{"untrusted chain", untrusted, "erc_register", "erc@example.com", signed, StatusInvalid, "x509"},
+		{"other sender", trusted, "erc_register", "other@example.com", signed, StatusInvalid, "not for other@example.com"},
+		{"modified content", trusted, "erc_register", "erc@example.com", strings.Replace(signed, "реестр", "реестр!", 1), StatusInvalid, ""},
+		{"unsigned", trusted, "erc_register", "erc@example.com", "From: erc@example.com\r\nContent-Type: text/plain\r\n\r\nреестр", StatusUnsigned, "not signed"},
+		{"opaque", trusted, "erc_register", "erc@example.com", "Content-Type: application/pkcs7-mime; smime-type=signed-data\r\n\r\nMIIB", StatusInvalid, "opaque"},
+		{"not checked", trusted, "correction", "erc@example.com", signed, StatusNotChecked, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Verifier{stores: map[string]*x509.CertPool{"erc_register": tt.pool}}
+			res := v.Verify(tt.typeName, tt.from, []byte(tt.body))
+			if res.Status != tt.status || !strings.Contains(res.Error, tt.err) {
+				t.Fatalf("Verify() = %+v, want status %s, error %q", res, tt.status, tt.err)
+			}
+			if tt.status == StatusValid && !strings.Contains(res.Signer, "CN=ERC") {
+				t.Errorf("signer %q", res.Signer)
+			}
+		})
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Email.SMIMETrustStores = []string{" erc_register = " + path, ""}
+	v, err := NewVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Required("erc_register") || v.Required("correction") {
+		t.Errorf("stores: %v", v.stores)
+	}
+
+	for _, stores := range [][]string{{"erc_register"}, {"erc_register=" + filepath.Join(t.TempDir(), "missing.pem")}} {
+		cfg.Email.SMIMETrustStores = stores
+		if _, err = NewVerifier(cfg); err == nil {
+			t.Errorf("NewVerifier(%q) accepted", stores)
+		}
+	}
+}
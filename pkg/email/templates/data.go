@@ -0,0 +1,74 @@
+package templates
+
+import (
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"strconv"
+	"time"
+)
+
+// Сколько записей показывать в сводной таблице
+const summaryLimit = 50
+
+// ErcReportData переменные для отчёта о выданных картах
+func ErcReportData(organization string, rows []postgres.RstkUpdateReportForERC) Data {
+	data := Data{
+		Organization: organization,
+		Date:         time.Now(),
+		Rows:         len(rows),
+		Summary:      Table{Columns: []string{"№ п/п", "Фамилия Имя Отчество", "СНИЛС", "Дата готовности к выдаче"}},
+	}
+	for i, r := range rows {
+		if data.PeriodFrom.IsZero() || r.Date.Before(data.PeriodFrom) {
+			data.PeriodFrom = r.Date
+		}
+		if r.Date.After(data.PeriodTo) {
+			data.PeriodTo = r.Date
+		}
+		if i < summaryLimit {
+			data.Summary.Rows = append(data.Summary.Rows, []string{strconv.Itoa(i + 1), r.FullName, r.Snils, formatDate(r.Date)})
+		}
+	}
+	data.Summary.More = len(rows) - len(data.Summary.Rows)
+	return data
+}
+
+// CorrectionData переменные для письма с записями на коррекцию
+func CorrectionData(organization string, rows []postgres.PersonFromErcForCorrection) Data {
+	data := Data{
+		Organization: organization,
+		Date:         time.Now(),
+		Rows:         len(rows),
+		Summary:      Table{Columns: []string{"№ п/п", "Фамилия", "Имя", "Отчество", "Дата рождения", "СНИЛС"}},
+	}
+	for i, r := range rows {
+		if i == summaryLimit {
+			break
+		}
+		data.Summary.Rows = append(data.Summary.Rows, []string{strconv.Itoa(r.ID), r.Family, r.Name, r.Patronymic, formatDate(r.Birthdate), r.Snils})
+	}
+	data.Summary.More = len(rows) - len(data.Summary.Rows)
+	return data
+}
+
+// EscalationData переменные для напоминания о записях, не исправленных в срок
+func EscalationData(organization string, rows []postgres.CorrectionOverdue) Data {
+	data := Data{
+		Organization: organization,
+		Date:         time.Now(),
+		Rows:         len(rows),
+		Summary:      Table{Columns: []string{"№ п/п", "Фамилия", "Имя", "Отчество", "Дата рождения", "СНИЛС", "Отправлена"}},
+	}
+	for i, r := range rows {
+		if data.PeriodFrom.IsZero() || r.SentAt.Before(data.PeriodFrom) {
+			data.PeriodFrom = r.SentAt
+		}
+		if r.SentAt.After(data.PeriodTo) {
+			data.PeriodTo = r.SentAt
+		}
+		if i < summaryLimit {
+			data.Summary.Rows = append(data.Summary.Rows, []string{strconv.Itoa(r.ID), r.Family, r.Name, r.Patronymic, formatDate(r.Birthdate), r.Snils, formatDate(r.SentAt)})
+		}
+	}
+	data.Summary.More = len(rows) - len(data.Summary.Rows)
+	return data
+}
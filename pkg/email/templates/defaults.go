@@ -0,0 +1,67 @@
+package templates
+
+import "github.com/morzik45/stk-registry/pkg/postgres"
+
+// summaryTemplate сводная таблица, доступна во всех HTML-шаблонах
+const summaryTemplate = `{{define "summary"}}{{if .Rows}}<table border="1" cellpadding="4" cellspacing="0" style="border-collapse: collapse">
+<tr>{{range .Columns}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{if .More}}<p>…и ещё {{.More}} {{plural .More "запись" "записи" "записей"}}, полный список во вложении.</p>
+{{end}}{{end}}{{end}}`
+
+// defaults встроенные шаблоны
+var defaults = map[string]Source{
+	postgres.OutboxErcReport: {
+		Subject: `{{.Organization}} Реестр выданных карт за {{date .Date}}`,
+		Text: `Здравствуйте!
+
+Во вложении реестр выданных карт за {{date .Date}}: {{.Rows}} {{plural .Rows "запись" "записи" "записей"}}.
+{{- if not .PeriodFrom.IsZero}}
+Карты готовы к выдаче с {{date .PeriodFrom}} по {{date .PeriodTo}}.
+{{- end}}
+
+{{.Organization}}
+`,
+		HTML: `<p>Здравствуйте!</p>
+<p>Во вложении реестр выданных карт за {{date .Date}}: {{.Rows}} {{plural .Rows "запись" "записи" "записей"}}.
+{{- if not .PeriodFrom.IsZero}} Карты готовы к выдаче с {{date .PeriodFrom}} по {{date .PeriodTo}}.{{end}}</p>
+{{template "summary" .Summary}}
+<p>{{.Organization}}</p>
+`,
+	},
+	postgres.OutboxCorrection: {
+		Subject: `{{.Organization}} Записи с ошибками на коррекцию от {{date .Date}}`,
+		Text: `Здравствуйте!
+
+Во вложении {{.Rows}} {{plural .Rows "запись" "записи" "записей"}} реестра ЕРЦ с ошибками.
+Исправьте данные в файле и пришлите его ответом на это письмо.
+
+{{.Organization}}
+`,
+		HTML: `<p>Здравствуйте!</p>
+<p>Во вложении {{.Rows}} {{plural .Rows "запись" "записи" "записей"}} реестра ЕРЦ с ошибками.
+Исправьте данные в файле и пришлите его ответом на это письмо.</p>
+{{template "summary" .Summary}}
+<p>{{.Organization}}</p>
+`,
+	},
+	postgres.OutboxEscalation: {
+		Subject: `{{.Organization}} Нет ответа на коррекцию: {{.Rows}} {{plural .Rows "запись" "записи" "записей"}}`,
+		Text: `Здравствуйте!
+
+{{.Rows}} {{plural .Rows "запись" "записи" "записей"}} с ошибками, отправленные на коррекцию
+{{- if eq (date .PeriodFrom) (date .PeriodTo)}} {{date .PeriodFrom}}{{else}} с {{date .PeriodFrom}} по {{date .PeriodTo}}{{end}}, до сих пор не исправлены.
+Список во вложении. Исправьте данные в файле и пришлите его ответом на это письмо.
+
+{{.Organization}}
+`,
+		HTML: `<p>Здравствуйте!</p>
+<p>{{.Rows}} {{plural .Rows "запись" "записи" "записей"}} с ошибками, отправленные на коррекцию
+{{- if eq (date .PeriodFrom) (date .PeriodTo)}} {{date .PeriodFrom}}{{else}} с {{date .PeriodFrom}} по {{date .PeriodTo}}{{end}}, до сих пор не исправлены.
+Исправьте данные в файле и пришлите его ответом на это письмо.</p>
+{{template "summary" .Summary}}
+<p>{{.Organization}}</p>
+`,
+	},
+}
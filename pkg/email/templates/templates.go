@@ -0,0 +1,233 @@
+// Package templates формирует тему и текст исходящих писем по шаблонам.
+//
+// Шаблоны задаются для каждого вида письма (postgres.Outbox*) отдельно для темы, текста и HTML-версии.
+// Каждая часть берётся из первого источника, где она задана: таблица mail_templates,
+// файл в папке EMAIL_TEMPLATES_DIR (<вид>.subject.tmpl, <вид>.txt.tmpl, <вид>.html.tmpl), встроенный шаблон.
+// Тема и текст - text/template, HTML - html/template. Переменные описаны в Data.
+package templates
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/email/sender"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"go.uber.org/zap"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// ErrUnknownKind для вида письма нет шаблонов
+var ErrUnknownKind = errors.New("unknown mail kind")
+
+// Data переменные шаблонов
+type Data struct {
+	Organization string    // организация-отправитель
+	Date         time.Time // дата отчёта
+	Rows         int       // сколько записей во вложении
+	PeriodFrom   time.Time // период, к которому относятся записи, пустой, если неизвестен
+	PeriodTo     time.Time
+	Summary      Table // первые записи вложения, выводится в HTML через {{template "summary" .Summary}}
+}
+
+// Table сводная таблица для HTML-версии письма
+type Table struct {
+	Columns []string
+	Rows    [][]string
+	More    int // сколько записей не вошло в таблицу
+}
+
+// Source исходный текст шаблонов письма
+type Source struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text_body"`
+	HTML    string `json:"html_body"`
+}
+
+// Части шаблона и расширения файлов для них
+const (
+	partSubject = "subject"
+	partText    = "txt"
+	partHTML    = "html"
+)
+
+var funcs = map[string]interface{}{
+	"date":   formatDate,
+	"plural": plural,
+}
+
+type Templates struct {
+	logger *zap.Logger
+	config *config.Config
+	db     *postgres.DB
+}
+
+func New(db *postgres.DB, cfg *config.Config, logger *zap.Logger) *Templates {
+	return &Templates{
+		db:     db,
+		config: cfg,
+		logger: logger.Named("templates"),
+	}
+}
+
+// Kinds виды писем, для которых есть шаблоны
+func Kinds() []string {
+	return []string{postgres.OutboxErcReport, postgres.OutboxCorrection, postgres.OutboxEscalation}
+}
+
+// Source возвращает шаблоны, которые сейчас используются для письма вида kind
+func (t *Templates) Source(ctx context.Context, kind string) (Source, error) {
+	src, err := t.base(kind)
+	if err != nil {
+		return Source{}, err
+	}
+	custom, err := t.db.MailTemplates.Get(ctx, kind)
+	if errors.Is(err, sql.ErrNoRows) {
+		return src, nil
+	} else if err != nil {
+		return Source{}, err
+	}
+	return overlay(src, custom), nil
+}
+
+// Check проверяет шаблоны оператора для письма вида custom.Kind вместе с частями,
+// которые будут взяты из папки или встроенных шаблонов
+func (t *Templates) Check(custom postgres.MailTemplate) error {
+	src, err := t.base(custom.Kind)
+	if err != nil {
+		return err
+	}
+	return Validate(overlay(src, custom))
+}
+
+// base шаблоны письма вида kind без учёта заданных оператором
+func (t *Templates) base(kind string) (Source, error) {
+	src, ok := defaults[kind]
+	if !ok {
+		return Source{}, ErrUnknownKind
+	}
+	dir := t.config.Email.TemplatesDir
+	if dir == "" {
+		return src, nil
+	}
+	for part, s := range map[string]*string{partSubject: &src.Subject, partText: &src.Text, partHTML: &src.HTML} {
+		data, err := os.ReadFile(filepath.Join(dir, kind+"."+part+".tmpl"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return Source{}, err
+		}
+		*s = string(data)
+	}
+	return src, nil
+}
+
+// overlay заменяет части шаблона теми, что задал оператор
+func overlay(src Source, custom postgres.MailTemplate) Source {
+	if custom.Subject != "" {
+		src.Subject = custom.Subject
+	}
+	if custom.TextBody != "" {
+		src.Text = custom.TextBody
+	}
+	if custom.HTMLBody != "" {
+		src.HTML = custom.HTMLBody
+	}
+	return src
+}
+
+// Render формирует тему и текст письма вида kind, получателей и вложения заполняет вызывающий
+func (t *Templates) Render(ctx context.Context, kind string, data Data) (sender.Message, error) {
+	src, err := t.Source(ctx, kind)
+	if err != nil {
+		return sender.Message{}, err
+	}
+	m, err := render(src, data)
+	if err != nil {
+		return sender.Message{}, fmt.Errorf("template %s: %w", kind, err)
+	}
+	return m, nil
+}
+
+// Validate проверяет, что шаблоны разбираются и выполняются на примере данных
+func Validate(src Source) error {
+	_, err := render(src, Data{
+		Organization: "Организация",
+		Date:         time.Now(),
+		Rows:         1,
+		PeriodFrom:   time.Now(),
+		PeriodTo:     time.Now(),
+		Summary:      Table{Columns: []string{"Столбец"}, Rows: [][]string{{"Значение"}}},
+	})
+	return err
+}
+
+func render(src Source, data Data) (m sender.Message, err error) {
+	subject, err := renderText(partSubject, src.Subject, data)
+	if err != nil {
+		return
+	}
+	// Тема письма - одна строка
+	m.Subject = strings.Join(strings.Fields(subject), " ")
+
+	m.Body, err = renderText(partText, src.Text, data)
+	if err != nil {
+		return
+	}
+
+	if src.HTML == "" {
+		return
+	}
+	tmpl, err := htmltemplate.New(partHTML).Funcs(funcs).Parse(summaryTemplate)
+	if err != nil {
+		return
+	}
+	tmpl, err = tmpl.Parse(src.HTML)
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	m.HTML = buf.String()
+	return
+}
+
+func renderText(name, src string, data Data) (string, error) {
+	tmpl, err := texttemplate.New(name).Funcs(funcs).Parse(src)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	return buf.String(), err
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("02.01.2006")
+}
+
+// plural выбирает форму слова для числа n: {{plural .Rows "запись" "записи" "записей"}}
+func plural(n int, one, few, many string) string {
+	n %= 100
+	if n >= 11 && n <= 14 {
+		return many
+	}
+	switch n % 10 {
+	case 1:
+		return one
+	case 2, 3, 4:
+		return few
+	default:
+		return many
+	}
+}
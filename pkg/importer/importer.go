@@ -0,0 +1,99 @@
+// Package importer сохраняет в БД файлы ЕРЦ и РСТК, откуда бы они ни пришли: из письма, с сайта или из папки.
+package importer
+
+import (
+	"context"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/persons"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// ErrUnknownRstkType документ РСТК не удалось отнести ни к одному известному типу
+var ErrUnknownRstkType = errors.New("не удалось определить тип документа")
+
+// ImportErc разбирает реестр ЕРЦ и сохраняет его как новое обновление update в рамках транзакции tx.
+// Если формат файла не известен, возвращается *persons.FormatError и ничего не сохраняется.
+// Возвращает количество сохранённых строк и строки, пропущенные при разборе.
+func ImportErc(ctx context.Context, db *postgres.DB, tx *sqlx.Tx, p *persons.ErcParser, update *postgres.ErcUpdate, reader io.Reader) (int, persons.RejectedRows, error) {
+	if update.Source == "" {
+		update.Source = postgres.ErcSourceEmail
+	}
+	ps, rejected, err := p.ParseDocument(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = db.ErcUpdates.Create(ctx, update, tx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(ps) == 0 {
+		return 0, rejected, nil
+	}
+	for i := range ps {
+		ps[i].ErcUpdateID = update.ID
+	}
+	err = db.PersonsFromErc.CreateMany(ctx, ps, tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	return len(ps), rejected, nil
+}
+
+// ImportRstk разбирает список карт РСТК и сохраняет его как новое обновление в рамках транзакции tx.
+// Тип документа определяется по заголовку файла, если typeName пустой, иначе берётся тип с этим именем.
+// Определённые кодировка и разделитель столбцов сохраняются в обновлении, строки, которые не удалось разобрать,
+// возвращаются в rejected.
+func ImportRstk(ctx context.Context, db *postgres.DB, tx *sqlx.Tx, fromDate time.Time, typeName string, reader io.Reader) (postgres.RstkUpdate, int, persons.RejectedRows, error) {
+	types, typeID, err := rstkTypes(ctx, db, tx, typeName)
+	if err != nil {
+		return postgres.RstkUpdate{}, 0, nil, err
+	}
+	doc, err := persons.ParseDocumentFromRSTK(reader, types, typeID)
+	if err != nil {
+		return postgres.RstkUpdate{}, 0, nil, err
+	}
+	if doc.Type == 0 {
+		return postgres.RstkUpdate{Encoding: doc.Encoding}, 0, doc.Rejected, ErrUnknownRstkType
+	}
+	p := doc.Persons
+
+	ru := postgres.RstkUpdate{TypeID: doc.Type, FromDate: fromDate, Encoding: doc.Encoding, Delimiter: doc.Delimiter}
+	err = db.RstkUpdates.Create(ctx, &ru, tx)
+	if err != nil {
+		return ru, 0, nil, err
+	}
+	if len(p) == 0 {
+		return ru, 0, doc.Rejected, nil
+	}
+	for i := range p {
+		p[i].RstkUpdateID = ru.ID
+	}
+	err = db.PersonsFromRSTK.CreateMany(ctx, p, tx)
+	if err != nil {
+		return ru, 0, nil, err
+	}
+	return ru, len(p), doc.Rejected, nil
+}
+
+// RstkFromDate определяет дату списка РСТК по началу имени файла ("2006-01-02..." или "02.01.2006..."),
+// если дату определить не удалось - возвращает текущее время.
+func RstkFromDate(filename string) time.Time {
+	name := filepath.Base(filename)
+	if len(name) > 13 {
+		fromDateStr := name[:10]
+		fromDate, err := time.Parse("2006-01-02", fromDateStr)
+		if err == nil {
+			return fromDate
+		}
+		fromDate, err = time.Parse("02.01.2006", fromDateStr)
+		if err == nil {
+			return fromDate
+		}
+	}
+	return time.Now()
+}
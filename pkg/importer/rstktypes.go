@@ -0,0 +1,96 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/persons"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"regexp"
+	"strings"
+)
+
+// ErrUnknownRstkTypeName явно указан тип документа, которого нет в rstk_update_types
+var ErrUnknownRstkTypeName = errors.New("неизвестный тип документа")
+
+// ParseRstkTypes разбирает типы документов РСТК из RSTK_TYPES.
+//
+// Типы разделяются ";", тип имеет вид "имя|описание|регулярка заголовка", регулярка может содержать "|", но не ";":
+//
+//	stk|Список социальных карт|(?i)^список социальных карт$;pushkin|Пушкинская карта|(?i)^реестр пушкинских карт
+func ParseRstkTypes(cfg *config.Config) ([]postgres.RstkUpdateType, error) {
+	var types []postgres.RstkUpdateType
+	for _, s := range cfg.RstkTypes {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, "|", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid RSTK type: %s", s)
+		}
+		t := postgres.RstkUpdateType{
+			Name:          strings.TrimSpace(parts[0]),
+			Description:   strings.TrimSpace(parts[1]),
+			HeaderPattern: parts[2],
+		}
+		if err := ValidateRstkType(t); err != nil {
+			return nil, fmt.Errorf("invalid RSTK type %s: %w", s, err)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// ValidateRstkType проверяет тип документа перед сохранением
+func ValidateRstkType(t postgres.RstkUpdateType) error {
+	if t.Name == "" {
+		return errors.New("name is empty")
+	}
+	if t.Description == "" {
+		return errors.New("description is empty")
+	}
+	_, err := regexp.Compile(t.HeaderPattern)
+	return err
+}
+
+// SyncRstkTypes добавляет в базу типы документов из RSTK_TYPES, у существующих типов обновляет описание и заголовок.
+// Типы, заданные только через API, не трогает.
+func SyncRstkTypes(ctx context.Context, db *postgres.DB, cfg *config.Config) error {
+	types, err := ParseRstkTypes(cfg)
+	if err != nil {
+		return err
+	}
+	for i := range types {
+		if err = db.RstkUpdateTypes.Save(ctx, &types[i], nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rstkTypes читает типы документов из базы. Если typeName не пустой, возвращает и ID этого типа.
+func rstkTypes(ctx context.Context, db *postgres.DB, tx *sqlx.Tx, typeName string) (types []persons.RstkType, typeID int, err error) {
+	list, err := db.RstkUpdateTypes.List(ctx, tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, t := range list {
+		if typeName != "" && t.Name == typeName {
+			typeID = t.ID
+		}
+		rt := persons.RstkType{ID: t.ID}
+		if t.HeaderPattern != "" {
+			if rt.Header, err = regexp.Compile(t.HeaderPattern); err != nil {
+				return nil, 0, fmt.Errorf("invalid header pattern of RSTK type %s: %w", t.Name, err)
+			}
+		}
+		types = append(types, rt)
+	}
+	if typeName != "" && typeID == 0 {
+		return nil, 0, ErrUnknownRstkTypeName
+	}
+	return types, typeID, nil
+}
@@ -0,0 +1,159 @@
+// Package matching восстанавливает СНИЛС по ФИО и дате рождения из correct_person_data.
+//
+// В режиме exact СНИЛС ищется по точному совпадению ФИО и даты рождения. В режиме fuzzy, если точного
+// совпадения нет, сравниваются ФИО всех людей с той же датой рождения: имена приводятся к виду для
+// сравнения (parser.NameKey) и оцениваются по расстоянию Левенштейна. СНИЛС подставляется, только если
+// ровно у одного кандидата оценка не ниже порога, иначе кандидаты сохраняются для оператора.
+package matching
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/parser"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"sort"
+)
+
+// Режимы поиска СНИЛС
+const (
+	ModeExact = "exact"
+	ModeFuzzy = "fuzzy"
+)
+
+// Вес фамилии, имени и отчества в общей оценке
+const (
+	weightFamily     = 0.4
+	weightName       = 0.3
+	weightPatronymic = 0.3
+)
+
+type Matcher struct {
+	data          *postgres.CorrectPersonsData
+	mode          string
+	threshold     float64
+	minScore      float64
+	maxCandidates int
+}
+
+func New(db *postgres.DB, cfg *config.Config) *Matcher {
+	return &Matcher{
+		data:          db.CorrectPersonsData,
+		mode:          cfg.SnilsMatch.Mode,
+		threshold:     cfg.SnilsMatch.Threshold,
+		minScore:      cfg.SnilsMatch.MinScore,
+		maxCandidates: cfg.SnilsMatch.MaxCandidates,
+	}
+}
+
+// RecoverSnils ищет СНИЛС для person. Если СНИЛС найден, он записывается в person.Snils и возвращается true.
+// candidates - кандидаты для оператора (или единственный подставленный с Applied), nil при точном совпадении.
+func (m *Matcher) RecoverSnils(ctx context.Context, person *postgres.CorrectPersonData) (found bool, candidates postgres.SnilsCandidates, err error) {
+	exact := *person
+	err = m.data.SearchSnils(ctx, &exact)
+	if err == nil {
+		person.Snils = exact.Snils
+		return true, nil, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return false, nil, err
+	}
+	if m.mode != ModeFuzzy {
+		return false, nil, nil
+	}
+
+	sameBirthdate, err := m.data.SelectByBirthdate(ctx, person.Birthdate)
+	if err != nil {
+		return false, nil, err
+	}
+	snils, candidates := m.pick(*person, sameBirthdate)
+	if snils == "" {
+		return false, candidates, nil
+	}
+	person.Snils = snils
+	return true, candidates, nil
+}
+
+// pick оценивает сходство person с людьми с той же датой рождения. Возвращает СНИЛС, если ровно у одного
+// кандидата оценка не ниже порога (он единственный в candidates, с Applied), иначе пустой СНИЛС и
+// кандидатов для оператора с оценкой не ниже minScore, лучшие первыми.
+func (m *Matcher) pick(person postgres.CorrectPersonData, sameBirthdate []postgres.CorrectPersonData) (snils string, candidates postgres.SnilsCandidates) {
+	for _, c := range sameBirthdate {
+		score := Score(person, c)
+		if score < m.minScore {
+			continue
+		}
+		candidates = append(candidates, postgres.SnilsCandidate{
+			Snils:      c.Snils,
+			Family:     c.Family,
+			Name:       c.Name,
+			Patronymic: c.Patronymic,
+			Birthdate:  c.Birthdate,
+			Score:      score,
+		})
+	}
+	if len(candidates) == 0 {
+		return "", nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+
+	if candidates[0].Score >= m.threshold && (len(candidates) == 1 || candidates[1].Score < m.threshold) {
+		candidates[0].Applied = true
+		return candidates[0].Snils, candidates[:1]
+	}
+	if m.maxCandidates > 0 && len(candidates) > m.maxCandidates {
+		candidates = candidates[:m.maxCandidates]
+	}
+	return "", candidates
+}
+
+// Score оценка сходства ФИО от 0 до 1, 1 - совпадают после приведения к виду для сравнения
+func Score(a, b postgres.CorrectPersonData) float64 {
+	return weightFamily*Similarity(a.Family, b.Family) +
+		weightName*Similarity(a.Name, b.Name) +
+		weightPatronymic*Similarity(a.Patronymic, b.Patronymic)
+}
+
+// Similarity сходство строк от 0 до 1 по расстоянию Левенштейна между parser.NameKey(a) и parser.NameKey(b)
+func Similarity(a, b string) float64 {
+	ra, rb := []rune(parser.NameKey(a)), []rune(parser.NameKey(b))
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(Levenshtein(ra, rb))/float64(longest)
+}
+
+// Levenshtein минимальное число вставок, удалений и замен символов, превращающих a в b
+func Levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,174 @@
+package matching
+
+import (
+	"context"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/parser"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"github.com/morzik45/stk-registry/pkg/postgres/pgtest"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNameKeyMatchesSQL(t *testing.T) {
+	db := pgtest.New(t)
+	for _, s := range []string{
+		"ИВАНОВ", "Семёнов", "  Петров-  Водкин ", "Гусейн  оглы", "ИBAHOB", "О'Нил", "Smith", "Анна-Мария\tЁлкина",
+	} {
+		var key string
+		if err := db.DB.GetContext(context.Background(), &key, "SELECT name_key($1)", s); err != nil {
+			t.Fatal(err)
+		}
+		if want := parser.NameKey(s); key != want {
+			t.Errorf("name_key(%q) = %q, parser.NameKey = %q", s, key, want)
+		}
+	}
+}
+
+func TestRecoverSnilsExactIgnoresCase(t *testing.T) {
+	db := pgtest.New(t)
+	ctx := context.Background()
+	birthdate := time.Date(1950, 3, 4, 0, 0, 0, 0, time.UTC)
+	// Эталонные данные приходят заглавными буквами и с "Ё"
+	_, err := db.DB.ExecContext(ctx, `
+		INSERT INTO correct_person_data (snils, family, name, patronymic, birthdate)
+		VALUES ('11223344595', 'СЕМЁНОВ', 'ПЁТР', 'ИВАНОВИЧ', $1)`, birthdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.SnilsMatch.Mode = ModeExact
+	m := New(db, cfg)
+
+	for _, family := range []string{"Семёнов", "Семенов"} {
+		// Так ФИО выглядит после parser.Name
+		person := postgres.CorrectPersonData{Family: family, Name: "Пётр", Patronymic: "Иванович", Birthdate: birthdate}
+		found, candidates, err := m.RecoverSnils(ctx, &person)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || person.Snils != "11223344595" || candidates != nil {
+			t.Errorf("RecoverSnils(%s) = %v, %q, %v", family, found, person.Snils, candidates)
+		}
+	}
+
+	other := postgres.CorrectPersonData{Family: "Семенов", Name: "Пётр", Patronymic: "Петрович", Birthdate: birthdate}
+	found, _, err := m.RecoverSnils(ctx, &other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Errorf("RecoverSnils matched another patronymic: %q", other.Snils)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "иванов", 6},
+		{"иванов", "", 6},
+		{"иванов", "иванов", 0},
+		{"иванов", "иваноф", 1},  // замена
+		{"иванов", "иванова", 1}, // вставка
+		{"иванова", "иванов", 1}, // удаление
+		{"петр", "пётр", 1},      // руны, а не байты
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := Levenshtein([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("Levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"", "", 1},
+		{"Иванов", "ИВАНОВ", 1},
+		{"Семёнов", "Семенов", 1},
+		{"Иванов", "Ивaнов", 1}, // латинская "a"
+		{"Петров-Водкин", "петров - водкин", 1 - 2.0/15}, // пробелы вокруг дефиса остаются
+		{"Иванов", "Иванова", 1 - 1.0/7},
+		{"Иванов", "Петров", 1 - 4.0/6},
+		{"Иванов", "", 0},
+	}
+	for _, tt := range tests {
+		if got := Similarity(tt.a, tt.b); !almostEqual(got, tt.want) {
+			t.Errorf("Similarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestScoreWeights(t *testing.T) {
+	ivanov := postgres.CorrectPersonData{Family: "Иванов", Name: "Иван", Patronymic: "Иванович"}
+	tests := []struct {
+		name  string
+		other postgres.CorrectPersonData
+		want  float64
+	}{
+		{"same", ivanov, 1},
+		{"other family", postgres.CorrectPersonData{Family: "Ххххххх", Name: "Иван", Patronymic: "Иванович"}, weightName + weightPatronymic},
+		{"other name", postgres.CorrectPersonData{Family: "Иванов", Name: "Хххх", Patronymic: "Иванович"}, weightFamily + weightPatronymic},
+		{"other patronymic", postgres.CorrectPersonData{Family: "Иванов", Name: "Иван", Patronymic: "Хххххххх"}, weightFamily + weightName},
+		{"one letter in family", postgres.CorrectPersonData{Family: "Иваноф", Name: "Иван", Patronymic: "Иванович"}, 1 - weightFamily/6},
+	}
+	for _, tt := range tests {
+		if got := Score(ivanov, tt.other); !almostEqual(got, tt.want) {
+			t.Errorf("%s: Score = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPick(t *testing.T) {
+	m := &Matcher{mode: ModeFuzzy, threshold: 0.9, minScore: 0.6, maxCandidates: 2}
+	person := postgres.CorrectPersonData{Family: "Иванов", Name: "Иван", Patronymic: "Иванович"}
+	ivanov := postgres.CorrectPersonData{Snils: "1", Family: "Иваноф", Name: "Иван", Patronymic: "Иванович"}   // 0.93
+	ivanova := postgres.CorrectPersonData{Snils: "2", Family: "Иванова", Name: "Иван", Patronymic: "Иванович"} // 0.94
+	petrov := postgres.CorrectPersonData{Snils: "3", Family: "Петров", Name: "Иван", Patronymic: "Иванович"}   // 0.73
+	stranger := postgres.CorrectPersonData{Snils: "5", Family: "Ххххххх", Name: "Хххх", Patronymic: "Хххххххх"}
+
+	tests := []struct {
+		name       string
+		same       []postgres.CorrectPersonData
+		snils      string
+		candidates []string
+	}{
+		{"nobody", nil, "", nil},
+		{"below min score", []postgres.CorrectPersonData{stranger}, "", nil},
+		{"single above threshold", []postgres.CorrectPersonData{petrov, ivanov, stranger}, "1", []string{"1"}},
+		{"ambiguous best", []postgres.CorrectPersonData{ivanov, ivanova}, "", []string{"2", "1"}},
+		{"below threshold", []postgres.CorrectPersonData{petrov}, "", []string{"3"}},
+		{"max candidates", []postgres.CorrectPersonData{petrov, ivanov, ivanova}, "", []string{"2", "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snils, candidates := m.pick(person, tt.same)
+			if snils != tt.snils {
+				t.Errorf("snils %q, want %q", snils, tt.snils)
+			}
+			var got []string
+			for _, c := range candidates {
+				got = append(got, c.Snils)
+				if c.Applied != (snils != "") {
+					t.Errorf("candidate %s applied = %v", c.Snils, c.Applied)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.candidates, ",") {
+				t.Errorf("candidates %v, want %v", got, tt.candidates)
+			}
+		})
+	}
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
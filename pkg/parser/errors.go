@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Коды ошибок разбора, не меняются: по ним интерфейс группирует и переводит ошибки
+const (
+	CodeEmptyField     = "empty_field"     // пустое значение
+	CodeSnilsLength    = "snils_length"    // в СНИЛС не 11 цифр
+	CodeSnilsChecksum  = "snils_checksum"  // не сходится контрольное число СНИЛС
+	CodeDateFormat     = "date_format"     // дата не в формате ДД.ММ.ГГГГ
+	CodeIntFormat      = "int_format"      // не число
+	CodeYearFormat     = "year_format"     // год не из 4 цифр
+	CodeSemesterFormat = "semester_format" // полугодие не 1 и не 2
+	CodeMixedScript    = "mixed_script"    // в слове и русские, и латинские буквы
+	CodeInvalid        = "invalid"         // прочие ошибки, подробности в Value
+)
+
+// Error ошибка разбора значения. Field и Column заполняет тот, кто знает, откуда взято значение.
+type Error struct {
+	Code   string `json:"code"`
+	Field  string `json:"field"`  // имя поля, как в таблице базы
+	Value  string `json:"value"`  // исходное значение
+	Column int    `json:"column"` // номер столбца в строке файла, с нуля
+}
+
+func (e *Error) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %q", e.Code, e.Value)
+	}
+	return fmt.Sprintf("%s: %s: %q", e.Field, e.Code, e.Value)
+}
+
+func newError(code, value string) error {
+	return &Error{Code: code, Value: value}
+}
+
+// Errors ошибки разбора строки, в базе хранятся как JSON, пустой список - NULL
+type Errors []Error
+
+// Add добавляет ошибку разбора поля field из столбца column, ничего не делает, если err == nil
+func (es *Errors) Add(err error, field string, column int) {
+	if err == nil {
+		return
+	}
+	var e *Error
+	if !errors.As(err, &e) {
+		e = &Error{Code: CodeInvalid, Value: err.Error()}
+	}
+	*es = append(*es, Error{Code: e.Code, Field: field, Value: e.Value, Column: column})
+}
+
+func (es Errors) Value() (driver.Value, error) {
+	if len(es) == 0 {
+		return nil, nil
+	}
+	return json.Marshal([]Error(es))
+}
+
+func (es *Errors) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*es = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, (*[]Error)(es))
+	case string:
+		return json.Unmarshal([]byte(v), (*[]Error)(es))
+	default:
+		return fmt.Errorf("unsupported type %T for parser.Errors", value)
+	}
+}
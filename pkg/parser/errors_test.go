@@ -0,0 +1,93 @@
+package parser
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestErrorsAdd(t *testing.T) {
+	var es Errors
+	es.Add(nil, "snils", 0)
+	if es != nil {
+		t.Fatalf("Add(nil) added %v", es)
+	}
+
+	_, err := Snils("123")
+	es.Add(err, "snils", 1)
+	es.Add(errors.New("что-то пошло не так"), "number", 3)
+	want := Errors{
+		{Code: CodeSnilsLength, Field: "snils", Value: "123", Column: 1},
+		{Code: CodeInvalid, Field: "number", Value: "что-то пошло не так", Column: 3},
+	}
+	if !reflect.DeepEqual(es, want) {
+		t.Errorf("errors %+v, want %+v", es, want)
+	}
+	if msg := es[0].Error(); msg != `snils: snils_length: "123"` {
+		t.Errorf("message %s", msg)
+	}
+	if msg := err.Error(); msg != `snils_length: "123"` {
+		t.Errorf("message without field %s", msg)
+	}
+}
+
+func TestErrorsValueScan(t *testing.T) {
+	es := Errors{
+		{Code: CodeEmptyField, Field: "patronymic", Value: "Иванов Иван", Column: 0},
+		{Code: CodeDateFormat, Field: "date", Value: "31.02.2022", Column: 2},
+	}
+	v, err := es.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := v.([]byte)
+	if !ok {
+		t.Fatalf("Value() = %T, want []byte", v)
+	}
+	want := `[{"code":"empty_field","field":"patronymic","value":"Иванов Иван","column":0},` +
+		`{"code":"date_format","field":"date","value":"31.02.2022","column":2}]`
+	if string(data) != want {
+		t.Errorf("Value() = %s", data)
+	}
+
+	for _, src := range []interface{}{data, string(data)} {
+		var got Errors
+		if err = got.Scan(src); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, es) {
+			t.Errorf("Scan(%T) = %+v", src, got)
+		}
+	}
+}
+
+func TestErrorsEmptyIsNull(t *testing.T) {
+	for _, es := range []Errors{nil, {}} {
+		v, err := es.Value()
+		if err != nil || v != nil {
+			t.Errorf("Value() of %#v = %v, %v, want NULL", es, v, err)
+		}
+	}
+
+	es := Errors{{Code: CodeInvalid}}
+	if err := es.Scan(nil); err != nil || es != nil {
+		t.Errorf("Scan(NULL) = %v, %v", es, err)
+	}
+	if err := es.Scan(42); err == nil {
+		t.Error("Scan(int) accepted")
+	}
+	if err := es.Scan([]byte("{")); err == nil {
+		t.Error("Scan of invalid JSON accepted")
+	}
+}
+
+func TestErrorsScanLegacy(t *testing.T) {
+	// Так миграция 000014 переносит старые текстовые ошибки
+	var es Errors
+	if err := es.Scan(`[{"code": "legacy", "field": "", "value": "неверный СНИЛС", "column": -1}]`); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Errors{{Code: "legacy", Value: "неверный СНИЛС", Column: -1}}); !reflect.DeepEqual(es, want) {
+		t.Errorf("legacy errors %+v", es)
+	}
+}
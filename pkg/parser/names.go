@@ -0,0 +1,106 @@
+package parser
+
+import (
+	"strings"
+	"unicode"
+)
+
+// lookalikes латинские буквы, которые в ФИО пишут вместо похожих русских
+var lookalikes = map[rune]rune{
+	'a': 'а', 'b': 'в', 'c': 'с', 'e': 'е', 'h': 'н', 'k': 'к', 'm': 'м',
+	'o': 'о', 'p': 'р', 't': 'т', 'x': 'х', 'y': 'у',
+}
+
+// lowercaseParticles части отчества, которые пишутся со строчной буквы
+var lowercaseParticles = map[string]bool{"оглы": true, "кызы": true, "улы": true, "уулу": true}
+
+// Name приводит фамилию, имя или отчество к единому виду: лишние пробелы убраны, каждое слово и каждая
+// часть двойной фамилии через дефис с заглавной буквы. Латинские буквы в русском слове, похожие на русские,
+// заменяются русскими. Если в слове остались и русские, и латинские буквы, возвращается значение и ошибка
+// CodeMixedScript. Буква ё сохраняется, для сравнения имён используется NameKey.
+func Name(data string) (string, error) {
+	words := strings.Fields(data)
+	if len(words) == 0 {
+		return "", newError(CodeEmptyField, data)
+	}
+	mixed := false
+	for i, word := range words {
+		parts := strings.Split(word, "-")
+		for j, part := range parts {
+			var ok bool
+			part, ok = fixScript(strings.ToLower(part))
+			mixed = mixed || !ok
+			if !lowercaseParticles[part] {
+				part = title(part)
+			}
+			parts[j] = part
+		}
+		words[i] = strings.Join(parts, "-")
+	}
+	// "Иванова - Петрова" - это одна двойная фамилия
+	name := strings.Trim(strings.Join(words, " "), "-")
+	name = strings.ReplaceAll(strings.ReplaceAll(name, " -", "-"), "- ", "-")
+	if mixed {
+		return name, newError(CodeMixedScript, data)
+	}
+	return name, nil
+}
+
+// fixScript заменяет латинские двойники в слове с русскими буквами, false - остались латинские буквы
+func fixScript(word string) (string, bool) {
+	cyrillic, latin := false, false
+	for _, r := range word {
+		cyrillic = cyrillic || unicode.Is(unicode.Cyrillic, r)
+		latin = latin || unicode.Is(unicode.Latin, r)
+	}
+	if !cyrillic || !latin {
+		return word, true
+	}
+	ok := true
+	word = strings.Map(func(r rune) rune {
+		if l, found := lookalikes[r]; found {
+			return l
+		}
+		if unicode.Is(unicode.Latin, r) {
+			ok = false
+		}
+		return r
+	}, word)
+	return word, ok
+}
+
+func title(word string) string {
+	for i, r := range word {
+		return string(unicode.ToUpper(r)) + word[i+len(string(r)):]
+	}
+	return word
+}
+
+// NameKey приводит имя к виду для сравнения: строчные буквы, ё как е, латинские двойники
+// заменены русскими буквами, прочие символы кроме дефиса убраны, пробелы схлопнуты.
+// Результат не показывается пользователю.
+func NameKey(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToLower(s) {
+		if l, ok := lookalikes[r]; ok {
+			r = l
+		}
+		switch {
+		case r == 'ё':
+			r = 'е'
+		case r == '-' || unicode.IsLetter(r):
+		case unicode.IsSpace(r):
+			space = b.Len() > 0
+			continue
+		default:
+			continue
+		}
+		if space {
+			b.WriteRune(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+		code string // код ошибки, пустой - без ошибки
+	}{
+		{"spaces and case", "  иВАНОВ  ", "Иванов", ""},
+		{"double family", "ИВАНОВА-ПЕТРОВА", "Иванова-Петрова", ""},
+		{"spaces around hyphen", "Иванова - петрова", "Иванова-Петрова", ""},
+		{"trailing hyphen", "Иванов-", "Иванов", ""},
+		{"double name", "анна-мария", "Анна-Мария", ""},
+		{"oglu", "ГУСЕЙН ОГЛЫ", "Гусейн оглы", ""},
+		{"kyzy", "алиева кызы", "Алиева кызы", ""},
+		{"yo kept", "СЕМЁНОВ", "Семёнов", ""},
+		{"latin lookalikes", "Ивaнoв", "Иванов", ""}, // латинские "a" и "o"
+		{"latin uppercase", "ИBAHOB", "Иванов", ""},  // "B", "A", "H", "O", "B" латинские
+		{"latin in hyphen part", "Петров-Boдкин", "Петров-Водкин", ""},
+		{"all latin", "SMITH", "Smith", ""},
+		{"mixed script", "Иваnов", "Иваnов", CodeMixedScript},
+		{"mixed script in second word", "Гусейн oглыz", "Гусейн Оглыz", CodeMixedScript},
+		{"empty", "   ", "", CodeEmptyField},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Name(tt.in)
+			if got != tt.want {
+				t.Errorf("Name(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			var e *Error
+			switch {
+			case tt.code == "" && err != nil:
+				t.Errorf("Name(%q) error: %v", tt.in, err)
+			case tt.code != "" && (!errors.As(err, &e) || e.Code != tt.code || e.Value != tt.in):
+				t.Errorf("Name(%q) error %v, want code %s", tt.in, err, tt.code)
+			}
+		})
+	}
+}
+
+func TestNameKey(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Иванов", "иванов"},
+		{"Семёнов", "семенов"},
+		{"ЁЛКИНА", "елкина"},
+		{"ИBAHOB", "иванов"},
+		{"  Петров-  Водкин ", "петров- водкин"},
+		{"Гусейн  оглы", "гусейн оглы"},
+		{"Анна-Мария\tЁлкина", "анна-мария елкина"},
+		{"О'Нил", "онил"},
+		{"Иванов 2", "иванов"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NameKey(tt.in); got != tt.want {
+			t.Errorf("NameKey(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	// ФИО после Name и исходное значение сравниваются одинаково
+	for _, in := range []string{"СЕМЁНОВ", "ивaнoв", "Иванова-ПЕТРОВА", "ГУСЕЙН ОГЛЫ"} {
+		name, _ := Name(in)
+		if NameKey(name) != NameKey(in) {
+			t.Errorf("NameKey(Name(%q)) = %q, NameKey = %q", in, NameKey(name), NameKey(in))
+		}
+	}
+}
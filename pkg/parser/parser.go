@@ -1,14 +1,13 @@
 package parser
 
 import (
-	"fmt"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// TODO: Не информативные ошибки в контроле данных.
-// Тут надо возвращать смысл, а на уровень выше добавлять контекст
+// Функции разбора возвращают *Error с кодом и исходным значением,
+// имя поля и номер столбца добавляет вызывающий через Errors.Add.
 
 func Snils(data string) (string, error) {
 	// FIXME: в функции 3 цикла for, можно обойтись одним прохождением по массиву
@@ -20,7 +19,7 @@ func Snils(data string) (string, error) {
 	}
 
 	if len(fSnils) != 11 {
-		return fSnils, fmt.Errorf("invalid snils length: %s", data)
+		return fSnils, newError(CodeSnilsLength, data)
 	}
 
 	letters := strings.Split(fSnils, "")
@@ -53,7 +52,7 @@ func Snils(data string) (string, error) {
 	}
 
 	if checksum != fSnils[hashLen:] {
-		return fSnils, fmt.Errorf("invalid snils, incrorrect checksum: %s", data)
+		return fSnils, newError(CodeSnilsChecksum, data)
 	}
 
 	return fSnils, nil
@@ -68,14 +67,14 @@ func Date(data string) (time.Time, error) {
 	}
 	t, err := time.Parse("02012006", newStr)
 	if err != nil {
-		return time.Time{}, err
+		return time.Time{}, newError(CodeDateFormat, data)
 	}
 	return t, nil
 }
 
 func String(data string) (string, error) {
 	if data == "" {
-		return "", fmt.Errorf("invalid string: %s", data)
+		return "", newError(CodeEmptyField, data)
 	}
 	return data, nil
 }
@@ -88,11 +87,11 @@ func Int(data string) (int, error) {
 		}
 	}
 	if newStr == "" {
-		return 0, fmt.Errorf("invalid int: %s", data)
+		return 0, newError(CodeIntFormat, data)
 	}
 	count, err := strconv.Atoi(newStr)
 	if err != nil {
-		return 0, err
+		return 0, newError(CodeIntFormat, data)
 	}
 	return count, nil
 }
@@ -105,11 +104,11 @@ func Year(data string) (int, error) {
 		}
 	}
 	if len(newStr) != 4 {
-		return 0, fmt.Errorf("invalid year: %s", data)
+		return 0, newError(CodeYearFormat, data)
 	}
 	year, err := strconv.Atoi(newStr)
 	if err != nil {
-		return 0, err
+		return 0, newError(CodeYearFormat, data)
 	}
 	return year, nil
 }
@@ -122,11 +121,11 @@ func Semester(data string) (int, error) {
 		}
 	}
 	if newStr == "" {
-		return 0, fmt.Errorf("invalid semester: %s", data)
+		return 0, newError(CodeSemesterFormat, data)
 	}
 	semester, err := strconv.Atoi(newStr)
 	if err != nil {
-		return 0, err
+		return 0, newError(CodeSemesterFormat, data)
 	}
 	return semester, nil
 }
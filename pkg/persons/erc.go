@@ -4,7 +4,8 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"github.com/morzik45/stk-registry/pkg/parser"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/matching"
 	"github.com/morzik45/stk-registry/pkg/postgres"
 	"github.com/morzik45/stk-registry/pkg/utils"
 	"io"
@@ -12,26 +13,62 @@ import (
 	"strings"
 )
 
-func parseRowFromErc(data string, correctData *postgres.CorrectPersonsData) (r postgres.PersonFromERC, err error) {
-	rows := strings.Split(data, "|")
-	if len(rows) != 13 {
-		return postgres.PersonFromERC{}, fmt.Errorf("invalid row: %s", data)
+// ErcParser разбирает реестры ЕРЦ в известных форматах и восстанавливает ошибочные данные людей
+type ErcParser struct {
+	correctData *postgres.CorrectPersonsData
+	matcher     *matching.Matcher
+	formats     []ErcFormat
+}
+
+func NewErcParser(db *postgres.DB, cfg *config.Config) (*ErcParser, error) {
+	formats, err := LoadErcFormats(cfg.ErcFormatsFile)
+	if err != nil {
+		return nil, err
 	}
+	return &ErcParser{
+		correctData: db.CorrectPersonsData,
+		matcher:     matching.New(db, cfg),
+		formats:     formats,
+	}, nil
+}
 
-	// TODO: Переписать, полная хрень...
-	var snilsErr, birthDateErr, familyErr, nameErr, PatronymicErr error
-	r.Snils, snilsErr = parser.Snils(rows[0])
-	r.Birthdate, birthDateErr = parser.Date(rows[1])
-	r.Family, familyErr = parser.String(rows[2])
-	r.Name, nameErr = parser.String(rows[3])
-	r.Patronymic, PatronymicErr = parser.String(rows[4])
+// parseRow разбирает строку реестра, уже разделённую на столбцы формата
+func (p *ErcParser) parseRow(format *ErcFormat, cells []string) (r postgres.PersonFromERC, err error) {
+	if !format.fits(cells) {
+		return postgres.PersonFromERC{}, fmt.Errorf("столбцов %d, не подходит под формат %s", len(cells), format.Name)
+	}
+
+	errs := make(map[string]error)
+	for i, c := range format.Columns {
+		if c.Field == "" {
+			continue
+		}
+		var value string
+		if i < len(cells) {
+			value = cells[i]
+		}
+		if c.Optional && strings.TrimSpace(value) == "" {
+			continue
+		}
+		switch c.Field {
+		case "family":
+			r.FamilyRaw = value
+		case "name":
+			r.NameRaw = value
+		case "patronymic":
+			r.PatronymicRaw = value
+		}
+		errs[c.Field] = setErcField(&r, c.Field, c.Type, value)
+	}
 
-	if (birthDateErr != nil || familyErr != nil || nameErr != nil || PatronymicErr != nil) && snilsErr == nil {
+	snilsErr := errs["snils"]
+	personErr := errs["birthdate"] != nil || errs["family"] != nil || errs["name"] != nil || errs["patronymic"] != nil
+	if personErr && snilsErr == nil {
 		// если ошибка в дате или в фамилии, или в имени, или в отчестве, но нет ошибки в СНИЛСе, то ищем по СНИЛСу
 		person := postgres.CorrectPersonData{
 			Snils: r.Snils,
 		}
-		err = correctData.SearchBySnils(context.TODO(), &person)
+		err = p.correctData.SearchBySnils(context.TODO(), &person)
 		if err == nil {
 			// если нашли, то заполняем поля по найденной записи
 			r.Birthdate = person.Birthdate
@@ -39,108 +76,161 @@ func parseRowFromErc(data string, correctData *postgres.CorrectPersonsData) (r p
 			r.Name = person.Name
 			r.Patronymic = person.Patronymic
 			// и обнуляем ошибки
-			birthDateErr = nil
-			familyErr = nil
-			nameErr = nil
-			PatronymicErr = nil
+			delete(errs, "birthdate")
+			delete(errs, "family")
+			delete(errs, "name")
+			delete(errs, "patronymic")
 		}
-	} else if snilsErr != nil && (birthDateErr == nil || familyErr == nil || nameErr == nil || PatronymicErr == nil) {
-		// если ошибка в СНИЛСе и нет ошибок в дате, фамилии, имени и отчестве - ищем по ним
+	} else if snilsErr != nil && errs["birthdate"] == nil {
+		// если ошибка в СНИЛСе, ищем по дате рождения и ФИО
 		person := postgres.CorrectPersonData{
 			Birthdate:  r.Birthdate,
 			Family:     r.Family,
 			Name:       r.Name,
 			Patronymic: r.Patronymic,
 		}
-		err = correctData.SearchSnils(context.TODO(), &person)
-		if err == nil {
+		var found bool
+		found, r.SnilsCandidates, err = p.matcher.RecoverSnils(context.TODO(), &person)
+		if err != nil {
+			log.Printf("error: %s", err)
+		} else if found {
 			r.Snils = person.Snils // заполняем СНИЛС по найденной записи
-			snilsErr = nil         // обнуляем ошибку в СНИЛСе
+			delete(errs, "snils")  // обнуляем ошибку в СНИЛСе
 		}
 	}
 
 	// если не удалось исправить ошибки, то сохраняем их
-	if birthDateErr != nil {
-		r.Errors = append(r.Errors, birthDateErr.Error())
-	}
-	if familyErr != nil {
-		r.Errors = append(r.Errors, familyErr.Error())
-	}
-	if nameErr != nil {
-		r.Errors = append(r.Errors, nameErr.Error())
-	}
-	if PatronymicErr != nil {
-		r.Errors = append(r.Errors, PatronymicErr.Error())
-	}
-	if snilsErr != nil {
-		r.Errors = append(r.Errors, snilsErr.Error())
-	}
-
-	r.Year, err = parser.Year(rows[5])
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
-	}
-
-	r.Semester, err = parser.Semester(rows[6])
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
-	}
-
-	r.Color, err = parser.String(rows[7])
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
-	}
-
-	r.Count, err = parser.Int(rows[8])
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
+	for i, c := range format.Columns {
+		if c.Field != "" {
+			r.Errors.Add(errs[c.Field], c.Field, i)
+		}
 	}
+	return r, nil
+}
 
-	r.Spent, err = parser.Int(rows[9])
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
+// detect определяет формат файла по первой непустой строке
+func (p *ErcParser) detect(raw string, lineNumber int) (format *ErcFormat, isHeader bool, err error) {
+	fe := &FormatError{Line: lineNumber}
+	for i := range p.formats {
+		f := &p.formats[i]
+		line, err := utils.StringFromEncoding(f.Encoding, raw)
+		if err != nil {
+			continue
+		}
+		if ok, header := f.detect(line); ok {
+			return f, header, nil
+		}
+		if fe.Value == "" {
+			fe.Value = line
+		}
+		fe.Formats = append(fe.Formats, f.describe())
 	}
-
-	r.Date, err = parser.Date(rows[10])
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
+	if r := []rune(fe.Value); len(r) > 200 {
+		fe.Value = string(r[:200]) + "…"
 	}
+	return nil, false, fe
+}
 
-	r.CashierID, err = parser.Int(rows[11])
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
-	}
+// ParseDocument разбирает реестр, текстовый или xlsx, формат определяется по первой непустой строке
+// (для xlsx - по заголовку таблицы). Если формат определить не удалось, возвращается *FormatError.
+// Строки, которые не удалось разобрать (не подходят под формат, не перекодируются), не попадают
+// в result и возвращаются в rejected с номером строки и причиной.
+func (p *ErcParser) ParseDocument(reader io.Reader) (result []postgres.PersonFromERC, rejected RejectedRows, err error) {
+	var format *ErcFormat
 
-	r.CashierName, err = parser.String(rows[12])
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
+	br := bufio.NewReader(reader)
+	if magic, _ := br.Peek(4); utils.IsExcel(magic) {
+		return p.parseExcel(br)
 	}
 
-	return r, nil
-}
-
-func ParseDocumentFromErc(reader io.Reader, correctData *postgres.CorrectPersonsData) (result []postgres.PersonFromERC) {
-	var err error
-
-	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	scanner := bufio.NewScanner(br)
 	for scanner.Scan() {
+		lineNumber++
+		if format == nil {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			var isHeader bool
+			format, isHeader, err = p.detect(scanner.Text(), lineNumber)
+			if err != nil {
+				return nil, nil, err
+			}
+			if isHeader {
+				continue
+			}
+		}
+
 		var line string
-		line, err = utils.StringFromWindows1251(scanner.Text())
+		line, err = utils.StringFromEncoding(format.Encoding, scanner.Text())
 		if err != nil {
-			log.Printf("error: %s", err)
+			rejected = append(rejected, RejectedRow{Line: lineNumber, Reason: err.Error()})
 			continue
 		}
 		if len(line) == 0 {
 			continue
 		}
 		var n postgres.PersonFromERC
-		n, err = parseRowFromErc(line, correctData)
+		n, err = p.parseRow(format, format.split(line))
 		if err != nil {
-			log.Println(err)
+			rejected = append(rejected, RejectedRow{Line: lineNumber, Reason: err.Error()})
 			continue
 		}
+		n.SourceLine, n.LineNumber = line, lineNumber
 		result = append(result, n)
 	}
 
-	return result
+	return result, rejected, scanner.Err()
+}
+
+// parseExcel разбирает реестр в формате xlsx: подходит первый формат, все обязательные столбцы
+// которого нашлись в заголовке таблицы.
+func (p *ErcParser) parseExcel(reader io.Reader) (result []postgres.PersonFromERC, rejected RejectedRows, err error) {
+	rows, err := utils.ExcelRows(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		format  *ErcFormat
+		header  int
+		columns map[string]int
+	)
+	for i := range p.formats {
+		if header, columns = excelHeader(rows, p.formats[i].excelHeaders(), p.formats[i].excelFits); header != -1 {
+			format = &p.formats[i]
+			break
+		}
+	}
+	if format == nil {
+		fe := &FormatError{}
+		for i, row := range rows {
+			if !excelEmpty(row) {
+				fe.Line, fe.Value = i+1, excelLine(row)
+				break
+			}
+		}
+		if r := []rune(fe.Value); len(r) > 200 {
+			fe.Value = string(r[:200]) + "…"
+		}
+		for i := range p.formats {
+			fe.Formats = append(fe.Formats, p.formats[i].describeExcel())
+		}
+		return nil, nil, fe
+	}
+
+	for i := header + 1; i < len(rows); i++ {
+		if excelEmpty(rows[i]) {
+			continue
+		}
+		var n postgres.PersonFromERC
+		n, err = p.parseRow(format, format.excelCells(rows[i], columns))
+		if err != nil {
+			rejected = append(rejected, RejectedRow{Line: i + 1, Reason: err.Error()})
+			continue
+		}
+		n.SourceLine, n.LineNumber = excelLine(rows[i]), i+1
+		result = append(result, n)
+	}
+	return result, rejected, nil
 }
@@ -0,0 +1,52 @@
+package persons
+
+import (
+	"fmt"
+	"golang.org/x/text/encoding/charmap"
+	"strings"
+	"testing"
+)
+
+func TestParseDocumentRejectedRows(t *testing.T) {
+	formats, err := LoadErcFormats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ErcParser{formats: formats}
+
+	row := "112-233-445 95|04.03.1950|Иванов|Иван|Иванович|2022|1|синий|2|1|02.01.2022|5|Касса"
+	text := strings.Join([]string{row, "обрыв строки|04.03.1950", row, ""}, "\r\n")
+	data, err := charmap.Windows1251.NewEncoder().String(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, rejected, err := p.ParseDocument(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0].LineNumber != 1 || result[1].LineNumber != 3 {
+		t.Fatalf("parsed rows: %+v", result)
+	}
+	if len(rejected) != 1 || rejected[0].Line != 2 || !strings.Contains(rejected[0].Reason, "erc-v1") {
+		t.Fatalf("rejected rows: %+v", rejected)
+	}
+}
+
+func TestRejectedRowsString(t *testing.T) {
+	if s := RejectedRows(nil).String(); s != "" {
+		t.Errorf("empty report: %q", s)
+	}
+
+	rows := make(RejectedRows, maxRejectedReport+3)
+	for i := range rows {
+		rows[i] = RejectedRow{Line: i + 1, Reason: "причина"}
+	}
+	s := rows.String()
+	if !strings.HasPrefix(s, fmt.Sprintf("пропущено строк: %d; строка 1: причина", len(rows))) {
+		t.Errorf("report start: %q", s)
+	}
+	if !strings.HasSuffix(s, "; и ещё 3") || strings.Contains(s, fmt.Sprintf("строка %d:", maxRejectedReport+1)) {
+		t.Errorf("report end: %q", s)
+	}
+}
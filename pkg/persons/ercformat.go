@@ -0,0 +1,382 @@
+package persons
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/morzik45/stk-registry/pkg/parser"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"github.com/morzik45/stk-registry/pkg/utils"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErcColumn столбец реестра ЕРЦ, номер столбца - его место в ErcFormat.Columns
+type ErcColumn struct {
+	Field    string `json:"field"`    // поле, как в таблице persons_from_erc, пустое - столбец пропускается
+	Type     string `json:"type"`     // как разбирать значение, по умолчанию зависит от поля
+	Optional bool   `json:"optional"` // столбца может не быть в конце строки, пустое значение не считается ошибкой
+
+	Headers []string `json:"headers"` // названия столбца в заголовке таблицы xlsx, по умолчанию см. ercHeaders
+}
+
+// ErcFormat версия формата реестра ЕРЦ.
+//
+// Формат файла определяется по первой непустой строке: если задан Header, строка должна подходить под него
+// и дальше пропускается, иначе число столбцов в строке должно быть от числа столбцов до последнего
+// обязательного включительно до числа всех столбцов.
+//
+// В xlsx порядок столбцов не важен: они ищутся по названиям (ErcColumn.Headers) в строке заголовка таблицы,
+// формат подходит, если найдены все обязательные столбцы. Delimiter, Encoding и Header для xlsx не нужны.
+type ErcFormat struct {
+	Name      string      `json:"name"`
+	Delimiter string      `json:"delimiter"` // по умолчанию "|"
+	Encoding  string      `json:"encoding"`  // windows-1251 (по умолчанию), cp866 или utf-8
+	Header    string      `json:"header"`    // регулярное выражение для строки заголовка
+	Columns   []ErcColumn `json:"columns"`
+
+	header   *regexp.Regexp
+	required int // сколько столбцов должно быть в строке как минимум
+}
+
+// Типы значений столбцов
+const (
+	TypeString   = "string"   // непустая строка
+	TypeName     = "name"     // фамилия, имя или отчество, см. parser.Name
+	TypeSnils    = "snils"    // СНИЛС с проверкой контрольного числа
+	TypeDate     = "date"     // дата ДД.ММ.ГГГГ
+	TypeInt      = "int"      // целое число
+	TypeYear     = "year"     // год из 4 цифр
+	TypeSemester = "semester" // полугодие 1 или 2
+)
+
+// ercFields поля persons_from_erc, которые можно брать из реестра, и тип значения по умолчанию
+var ercFields = map[string]string{
+	"snils":        TypeSnils,
+	"birthdate":    TypeDate,
+	"family":       TypeName,
+	"name":         TypeName,
+	"patronymic":   TypeName,
+	"year":         TypeYear,
+	"semester":     TypeSemester,
+	"color":        TypeString,
+	"count":        TypeInt,
+	"spent":        TypeInt,
+	"date":         TypeDate,
+	"cashier_id":   TypeInt,
+	"cashier_name": TypeString,
+}
+
+// ercHeaders названия столбцов в xlsx по умолчанию
+var ercHeaders = map[string][]string{
+	"snils":        {"СНИЛС"},
+	"birthdate":    {"Дата рождения"},
+	"family":       {"Фамилия"},
+	"name":         {"Имя"},
+	"patronymic":   {"Отчество"},
+	"year":         {"Год"},
+	"semester":     {"Полугодие"},
+	"color":        {"Цвет", "Цвет купона"},
+	"count":        {"Количество", "Кол-во", "Количество купонов"},
+	"spent":        {"Израсходовано", "Использовано"},
+	"date":         {"Дата", "Дата выдачи"},
+	"cashier_id":   {"Код кассира", "Номер кассира"},
+	"cashier_name": {"Кассир", "ФИО кассира"},
+}
+
+// ercRequiredFields без этих полей строку не связать с человеком
+var ercRequiredFields = []string{"snils", "birthdate", "family", "name", "patronymic"}
+
+// typeKinds во что разбирается значение каждого типа: в строку, число или дату
+var typeKinds = map[string]string{
+	TypeString:   TypeString,
+	TypeName:     TypeString,
+	TypeSnils:    TypeString,
+	TypeDate:     TypeDate,
+	TypeInt:      TypeInt,
+	TypeYear:     TypeInt,
+	TypeSemester: TypeInt,
+}
+
+// DefaultErcFormat формат, в котором ЕРЦ присылает реестры сейчас
+var DefaultErcFormat = ErcFormat{
+	Name:      "erc-v1",
+	Delimiter: "|",
+	Encoding:  "windows-1251",
+	Columns: []ErcColumn{
+		{Field: "snils"}, {Field: "birthdate"}, {Field: "family"}, {Field: "name"}, {Field: "patronymic"},
+		{Field: "year"}, {Field: "semester"}, {Field: "color"}, {Field: "count"}, {Field: "spent"},
+		{Field: "date"}, {Field: "cashier_id"}, {Field: "cashier_name"},
+	},
+}
+
+// LoadErcFormats читает форматы из JSON-файла path (список ErcFormat) и добавляет после них DefaultErcFormat.
+// Форматы проверяются в том же порядке, если path пустой - используется только DefaultErcFormat.
+func LoadErcFormats(path string) ([]ErcFormat, error) {
+	var formats []ErcFormat
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &formats); err != nil {
+			return nil, fmt.Errorf("invalid ERC formats file %s: %w", path, err)
+		}
+	}
+	formats = append(formats, DefaultErcFormat)
+	for i := range formats {
+		if err := formats[i].init(); err != nil {
+			return nil, fmt.Errorf("invalid ERC format %q: %w", formats[i].Name, err)
+		}
+	}
+	return formats, nil
+}
+
+// init проверяет описание формата и заполняет значения по умолчанию
+func (f *ErcFormat) init() (err error) {
+	if f.Name == "" {
+		return errors.New("name is empty")
+	}
+	if f.Delimiter == "" {
+		f.Delimiter = "|"
+	}
+	if f.Encoding == "" {
+		f.Encoding = "windows-1251"
+	}
+	switch f.Encoding {
+	case "windows-1251", "cp866", "utf-8":
+	default:
+		return fmt.Errorf("unknown encoding %q", f.Encoding)
+	}
+	if f.Header != "" {
+		if f.header, err = regexp.Compile(f.Header); err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]bool)
+	f.required = 0
+	for i, c := range f.Columns {
+		if c.Field == "" {
+			continue
+		}
+		defaultType, ok := ercFields[c.Field]
+		if !ok {
+			return fmt.Errorf("column %d: unknown field %q", i, c.Field)
+		}
+		if seen[c.Field] {
+			return fmt.Errorf("column %d: field %q is already used", i, c.Field)
+		}
+		seen[c.Field] = true
+		if c.Type == "" {
+			f.Columns[i].Type = defaultType
+		} else if typeKinds[c.Type] != typeKinds[defaultType] {
+			return fmt.Errorf("column %d: type %q does not fit field %q", i, c.Type, c.Field)
+		}
+		if len(c.Headers) == 0 {
+			f.Columns[i].Headers = ercHeaders[c.Field]
+		}
+		if !c.Optional {
+			f.required = i + 1
+		}
+	}
+	for _, field := range ercRequiredFields {
+		if !seen[field] {
+			return fmt.Errorf("field %q is required", field)
+		}
+	}
+	return nil
+}
+
+// describe описание формата для отчёта о непонятном файле
+func (f *ErcFormat) describe() string {
+	if f.header != nil {
+		return fmt.Sprintf("%s: заголовок %q", f.Name, f.Header)
+	}
+	if f.required == len(f.Columns) {
+		return fmt.Sprintf("%s: %d столбцов через %q", f.Name, len(f.Columns), f.Delimiter)
+	}
+	return fmt.Sprintf("%s: от %d до %d столбцов через %q", f.Name, f.required, len(f.Columns), f.Delimiter)
+}
+
+// detect подходит ли первая строка файла (уже перекодированная) под формат, isHeader - строку надо пропустить
+func (f *ErcFormat) detect(line string) (ok, isHeader bool) {
+	if f.header != nil {
+		return f.header.MatchString(line), true
+	}
+	return f.fits(f.split(line)), false
+}
+
+// describeExcel описание формата xlsx для отчёта о непонятном файле: обязательные столбцы
+func (f *ErcFormat) describeExcel() string {
+	var headers []string
+	for _, c := range f.Columns {
+		if c.Field != "" && !c.Optional {
+			headers = append(headers, c.Headers[0])
+		}
+	}
+	return fmt.Sprintf("%s: столбцы %s", f.Name, strings.Join(headers, ", "))
+}
+
+// excelHeaders названия столбцов для поиска в заголовке таблицы xlsx
+func (f *ErcFormat) excelHeaders() map[string][]string {
+	names := make(map[string][]string)
+	for _, c := range f.Columns {
+		if c.Field != "" {
+			names[c.Field] = c.Headers
+		}
+	}
+	return names
+}
+
+// excelFits найдены ли в заголовке таблицы xlsx все обязательные столбцы
+func (f *ErcFormat) excelFits(columns map[string]int) bool {
+	for _, c := range f.Columns {
+		if _, ok := columns[c.Field]; c.Field != "" && !c.Optional && !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// excelCells значения строки xlsx в порядке столбцов формата. Даты и СНИЛС, которые Excel хранит
+// как числа, приводятся к виду, как в текстовом реестре.
+func (f *ErcFormat) excelCells(row []string, columns map[string]int) []string {
+	cells := make([]string, len(f.Columns))
+	for i, c := range f.Columns {
+		if c.Field == "" {
+			continue
+		}
+		cells[i] = excelCell(row, columns, c.Field)
+		switch {
+		case typeKinds[c.Type] == TypeDate:
+			cells[i] = utils.ExcelDate(cells[i])
+		case c.Type == TypeSnils:
+			cells[i] = utils.ExcelDigits(cells[i], 11)
+		}
+	}
+	return cells
+}
+
+func (f *ErcFormat) split(line string) []string {
+	return strings.Split(line, f.Delimiter)
+}
+
+func (f *ErcFormat) fits(cells []string) bool {
+	return len(cells) >= f.required && len(cells) <= len(f.Columns)
+}
+
+// FormatError файл не подходит ни под один известный формат
+type FormatError struct {
+	Line    int      // номер строки, по которой определялся формат
+	Value   string   // эта строка, для длинных строк только начало
+	Formats []string // описания известных форматов
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("неизвестный формат реестра ЕРЦ: строка %d %q не подходит ни под один формат (%s)",
+		e.Line, e.Value, strings.Join(e.Formats, "; "))
+}
+
+// maxRejectedReport сколько пропущенных строк перечисляется в RejectedRows.String
+const maxRejectedReport = 20
+
+// RejectedRow строка реестра, которую не удалось разобрать и которая не сохранена
+type RejectedRow struct {
+	Line   int    `json:"line"`   // номер строки в файле, с 1
+	Reason string `json:"reason"` // почему строка пропущена
+}
+
+// RejectedRows пропущенные строки реестра
+type RejectedRows []RejectedRow
+
+// String перечисляет пропущенные строки, для длинных списков только первые maxRejectedReport
+func (r RejectedRows) String() string {
+	if len(r) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "пропущено строк: %d", len(r))
+	for i, row := range r {
+		if i == maxRejectedReport {
+			fmt.Fprintf(&sb, "; и ещё %d", len(r)-i)
+			break
+		}
+		fmt.Fprintf(&sb, "; строка %d: %s", row.Line, row.Reason)
+	}
+	return sb.String()
+}
+
+// setErcField разбирает значение value по типу typ и записывает его в поле field строки r
+func setErcField(r *postgres.PersonFromERC, field, typ, value string) (err error) {
+	switch typeKinds[typ] {
+	case TypeString:
+		var v string
+		switch typ {
+		case TypeName:
+			v, err = parser.Name(value)
+		case TypeSnils:
+			v, err = parser.Snils(value)
+		default:
+			v, err = parser.String(value)
+		}
+		*ercStringField(r, field) = v
+	case TypeInt:
+		var v int
+		switch typ {
+		case TypeYear:
+			v, err = parser.Year(value)
+		case TypeSemester:
+			v, err = parser.Semester(value)
+		default:
+			v, err = parser.Int(value)
+		}
+		*ercIntField(r, field) = v
+	case TypeDate:
+		var v time.Time
+		v, err = parser.Date(value)
+		*ercDateField(r, field) = v
+	}
+	return err
+}
+
+func ercStringField(r *postgres.PersonFromERC, field string) *string {
+	switch field {
+	case "snils":
+		return &r.Snils
+	case "family":
+		return &r.Family
+	case "name":
+		return &r.Name
+	case "patronymic":
+		return &r.Patronymic
+	case "color":
+		return &r.Color
+	default:
+		return &r.CashierName
+	}
+}
+
+func ercIntField(r *postgres.PersonFromERC, field string) *int {
+	switch field {
+	case "year":
+		return &r.Year
+	case "semester":
+		return &r.Semester
+	case "count":
+		return &r.Count
+	case "spent":
+		return &r.Spent
+	default:
+		return &r.CashierID
+	}
+}
+
+func ercDateField(r *postgres.PersonFromERC, field string) *time.Time {
+	if field == "birthdate" {
+		return &r.Birthdate
+	}
+	return &r.Date
+}
@@ -0,0 +1,176 @@
+package persons
+
+import (
+	"errors"
+	"golang.org/x/text/encoding/charmap"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFormats сохраняет описание форматов во временный файл
+func writeFormats(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "formats.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const requiredColumns = `{"field": "snils"}, {"field": "birthdate"}, {"field": "family"}, {"field": "name"}, {"field": "patronymic"}`
+
+func TestLoadErcFormatsValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		formats string
+		err     string
+	}{
+		{"unknown field", `[{"name": "v2", "columns": [` + requiredColumns + `, {"field": "phone"}]}]`, `column 5: unknown field "phone"`},
+		{"duplicate field", `[{"name": "v2", "columns": [` + requiredColumns + `, {"field": "snils"}]}]`, `column 5: field "snils" is already used`},
+		{"incompatible type", `[{"name": "v2", "columns": [` + requiredColumns + `, {"field": "count", "type": "date"}]}]`, `column 5: type "date" does not fit field "count"`},
+		{"missing required field", `[{"name": "v2", "columns": [{"field": "snils"}, {"field": "family"}, {"field": "name"}, {"field": "patronymic"}]}]`, `field "birthdate" is required`},
+		{"unknown encoding", `[{"name": "v2", "encoding": "koi8-r", "columns": [` + requiredColumns + `]}]`, `unknown encoding "koi8-r"`},
+		{"invalid header", `[{"name": "v2", "header": "(", "columns": [` + requiredColumns + `]}]`, "missing closing )"},
+		{"empty name", `[{"columns": [` + requiredColumns + `]}]`, "name is empty"},
+		{"invalid json", `{"name": "v2"}`, "invalid ERC formats file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadErcFormats(writeFormats(t, tt.formats))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadErcFormatsDefaults(t *testing.T) {
+	path := writeFormats(t, `[{"name": "v2", "columns": [`+requiredColumns+`, {}, {"field": "count", "type": "int", "optional": true}, {"field": "date", "optional": true, "headers": ["Когда"]}]}]`)
+	formats, err := LoadErcFormats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(formats) != 2 || formats[0].Name != "v2" || formats[1].Name != DefaultErcFormat.Name {
+		t.Fatalf("formats: %+v", formats)
+	}
+	f := formats[0]
+	if f.Delimiter != "|" || f.Encoding != "windows-1251" || f.required != 5 {
+		t.Errorf("delimiter %q, encoding %q, required %d", f.Delimiter, f.Encoding, f.required)
+	}
+	if c := f.Columns[1]; c.Type != TypeDate || !reflect.DeepEqual(c.Headers, ercHeaders["birthdate"]) {
+		t.Errorf("birthdate column: %+v", c)
+	}
+	if c := f.Columns[5]; c.Type != "" || c.Headers != nil {
+		t.Errorf("skipped column: %+v", c)
+	}
+	if c := f.Columns[7]; c.Type != TypeDate || !reflect.DeepEqual(c.Headers, []string{"Когда"}) {
+		t.Errorf("date column: %+v", c)
+	}
+	if d := DefaultErcFormat; d.header != nil || d.required != 0 {
+		t.Error("LoadErcFormats changed DefaultErcFormat")
+	}
+}
+
+func TestErcFormatDetect(t *testing.T) {
+	formats, err := LoadErcFormats(writeFormats(t, `[
+		{"name": "v3", "header": "^Реестр ЕРЦ v3", "delimiter": ";", "columns": [`+requiredColumns+`]},
+		{"name": "v2", "delimiter": ";", "columns": [`+requiredColumns+`, {"field": "year"}, {"field": "color", "optional": true}, {"field": "count", "optional": true}]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3, v2 := &formats[0], &formats[1]
+
+	tests := []struct {
+		name     string
+		format   *ErcFormat
+		line     string
+		ok       bool
+		isHeader bool
+	}{
+		{"header", v3, "Реестр ЕРЦ v3 от 02.01.2022", true, true},
+		{"other header", v3, "Реестр ЕРЦ v2", false, true},
+		{"all columns", v2, "1;2;3;4;5;6;7;8", true, false},
+		{"without optional", v2, "1;2;3;4;5;6", true, false},
+		{"one optional", v2, "1;2;3;4;5;6;7", true, false},
+		{"required missing", v2, "1;2;3;4;5", false, false},
+		{"too many columns", v2, "1;2;3;4;5;6;7;8;9", false, false},
+		{"other delimiter", v2, "1|2|3|4|5|6|7|8", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, isHeader := tt.format.detect(tt.line)
+			if ok != tt.ok || isHeader != tt.isHeader {
+				t.Errorf("detect() = %v, %v, want %v, %v", ok, isHeader, tt.ok, tt.isHeader)
+			}
+		})
+	}
+	if d := v2.describe(); d != `v2: от 6 до 8 столбцов через ";"` {
+		t.Errorf("describe: %s", d)
+	}
+	if d := v3.describe(); d != `v3: заголовок "^Реестр ЕРЦ v3"` {
+		t.Errorf("describe: %s", d)
+	}
+}
+
+func TestParseDocumentOptionalColumns(t *testing.T) {
+	formats, err := LoadErcFormats(writeFormats(t, `[{"name": "v2", "header": "^Реестр", "encoding": "utf-8", "delimiter": ";",
+		"columns": [`+requiredColumns+`, {"field": "year"}, {"field": "cashier_id", "optional": true}, {"field": "cashier_name", "optional": true}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ErcParser{formats: formats}
+	text := strings.Join([]string{
+		"Реестр",
+		"112-233-445 95;04.03.1950;Иванов;Иван;Иванович;2022;5;Касса",
+		"112-233-445 95;04.03.1950;Иванов;Иван;Иванович;2022",
+		"112-233-445 95;04.03.1950;Иванов;Иван;Иванович;2022;;",
+		"112-233-445 95;04.03.1950;Иванов;Иван;Иванович;2022;5;Касса;лишний",
+	}, "\n")
+
+	result, rejected, err := p.ParseDocument(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 3 || len(rejected) != 1 || rejected[0].Line != 5 {
+		t.Fatalf("result: %+v, rejected: %+v", result, rejected)
+	}
+	if r := result[0]; r.CashierID != 5 || r.CashierName != "Касса" || r.LineNumber != 2 {
+		t.Errorf("full row: %+v", r)
+	}
+	for _, r := range result[1:] {
+		if len(r.Errors) != 0 || r.CashierID != 0 || r.CashierName != "" || r.Year != 2022 {
+			t.Errorf("row %d without optional columns: %+v", r.LineNumber, r)
+		}
+	}
+}
+
+func TestParseDocumentFormatError(t *testing.T) {
+	formats, err := LoadErcFormats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ErcParser{formats: formats}
+
+	data, err := charmap.Windows1251.NewEncoder().String("\r\n\r\nне реестр|" + strings.Repeat("я", 250) + "\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = p.ParseDocument(strings.NewReader(data))
+	var fe *FormatError
+	if !errors.As(err, &fe) {
+		t.Fatalf("err = %v, want *FormatError", err)
+	}
+	if fe.Line != 3 || !strings.HasPrefix(fe.Value, "не реестр|") || len([]rune(fe.Value)) != 201 || !strings.HasSuffix(fe.Value, "…") {
+		t.Errorf("line %d, value %q", fe.Line, fe.Value)
+	}
+	if !reflect.DeepEqual(fe.Formats, []string{`erc-v1: 13 столбцов через "|"`}) {
+		t.Errorf("formats: %q", fe.Formats)
+	}
+	if msg := fe.Error(); !strings.HasPrefix(msg, "неизвестный формат реестра ЕРЦ: строка 3 ") || !strings.Contains(msg, "(erc-v1: 13 столбцов") {
+		t.Errorf("message: %s", msg)
+	}
+}
@@ -0,0 +1,58 @@
+package persons
+
+import (
+	"github.com/morzik45/stk-registry/pkg/parser"
+	"strings"
+)
+
+// excelHeaderRows в скольких первых строках листа ищется строка заголовка таблицы
+const excelHeaderRows = 20
+
+// excelHeader ищет строку заголовка таблицы: первую строку, в которой найдены столбцы, достаточные для fits.
+// names - названия столбцов для каждого поля, регистр, "ё" и знаки препинания не учитываются.
+// Возвращает номер строки заголовка (-1 - не найдена) и номера столбцов найденных полей.
+func excelHeader(rows [][]string, names map[string][]string, fits func(columns map[string]int) bool) (int, map[string]int) {
+	fields := make(map[string]string)
+	for field, aliases := range names {
+		for _, alias := range aliases {
+			fields[parser.NameKey(alias)] = field
+		}
+	}
+	for i := 0; i < len(rows) && i < excelHeaderRows; i++ {
+		columns := make(map[string]int)
+		for j, cell := range rows[i] {
+			field, ok := fields[parser.NameKey(cell)]
+			if _, seen := columns[field]; ok && !seen {
+				columns[field] = j
+			}
+		}
+		if len(columns) > 0 && fits(columns) {
+			return i, columns
+		}
+	}
+	return -1, nil
+}
+
+// excelCell значение поля field в строке row, пустое, если столбца нет в заголовке или в строке
+func excelCell(row []string, columns map[string]int, field string) string {
+	j, ok := columns[field]
+	if !ok || j >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[j])
+}
+
+// excelEmpty все ячейки строки пустые
+func excelEmpty(row []string) bool {
+	for _, cell := range row {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// excelLine строка листа одной строкой, для сохранения исходных данных и отчётов об ошибках
+func excelLine(row []string) string {
+	return strings.Join(row, ";")
+}
@@ -0,0 +1,203 @@
+package persons
+
+import (
+	"bytes"
+	"github.com/xuri/excelize/v2"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// workbook собирает xlsx с одним листом из строк rows, nil - пустая ячейка
+func workbook(t *testing.T, rows [][]interface{}) []byte {
+	t.Helper()
+	f := excelize.NewFile()
+	sheet := f.GetSheetName(0)
+	for i, row := range rows {
+		for j, value := range row {
+			if value == nil {
+				continue
+			}
+			cell, err := excelize.CoordinatesToCellName(j+1, i+1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = f.SetCellValue(sheet, cell, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExcelHeader(t *testing.T) {
+	names := map[string][]string{
+		"fio":    {"ФИО", "Фамилия Имя Отчество"},
+		"family": {"Фамилия"},
+		"name":   {"Имя"},
+		"snils":  {"СНИЛС", "Номер СНИЛС"},
+		"date":   {"Дата готовности"},
+	}
+	fits := func(columns map[string]int) bool {
+		_, fio := columns["fio"]
+		_, family := columns["family"]
+		_, name := columns["name"]
+		_, snils := columns["snils"]
+		return (fio || family && name) && snils
+	}
+	tests := []struct {
+		name    string
+		rows    [][]string
+		header  int
+		columns map[string]int
+	}{
+		{
+			name:    "first row",
+			rows:    [][]string{{"ФИО", "СНИЛС", "Дата готовности"}, {"Иванов Иван", "11223344595", "44563"}},
+			header:  0,
+			columns: map[string]int{"fio": 0, "snils": 1, "date": 2},
+		},
+		{
+			name: "below title row",
+			rows: [][]string{
+				{"Список карт, готовых к выдаче"}, {}, {"№", "Фамилия", "Имя", "Отчество", "Номер СНИЛС"},
+				{"1", "Иванов", "Иван", "Иванович", "11223344595"},
+			},
+			header:  2,
+			columns: map[string]int{"family": 1, "name": 2, "snils": 4},
+		},
+		{
+			name:    "case, ё and punctuation ignored",
+			rows:    [][]string{{" фамилия, имя, отчество ", "снилс:", "ДАТА ГОТОВНОСТИ"}},
+			header:  0,
+			columns: map[string]int{"fio": 0, "snils": 1, "date": 2},
+		},
+		{
+			name:    "first of duplicate columns",
+			rows:    [][]string{{"СНИЛС", "ФИО", "СНИЛС"}},
+			header:  0,
+			columns: map[string]int{"snils": 0, "fio": 1},
+		},
+		{
+			name:   "not enough columns",
+			rows:   [][]string{{"Фамилия", "СНИЛС"}, {"Иванов", "11223344595"}},
+			header: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, columns := excelHeader(tt.rows, names, fits)
+			if header != tt.header || !reflect.DeepEqual(columns, tt.columns) {
+				t.Errorf("excelHeader() = %d, %v, want %d, %v", header, columns, tt.header, tt.columns)
+			}
+		})
+	}
+}
+
+func TestParseExcelFromRSTK(t *testing.T) {
+	types := []RstkType{{ID: 1, Header: regexp.MustCompile(`^Список карт`)}, {ID: 7}}
+	date := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+	// СНИЛС 012-345-678 19 Excel хранит числом без ведущего нуля
+	const snils = 1234567819
+
+	tests := []struct {
+		name   string
+		rows   [][]interface{}
+		typeID int
+		want   int // тип документа
+		line   int // номер строки с данными на листе
+	}{
+		{
+			name: "one fio column",
+			rows: [][]interface{}{
+				{"ФИО", "СНИЛС", "Дата готовности", "Номер карты"},
+				{"Иванов Иван Иванович", snils, date, "9643000000000001"},
+			},
+			typeID: 7, want: 7, line: 2,
+		},
+		{
+			name: "three fio columns below title row",
+			rows: [][]interface{}{
+				{"Список карт, готовых к выдаче"},
+				{},
+				{"Фамилия", "Имя", "Отчество", "Номер СНИЛС", "Дата", "PAN"},
+				{"Иванов", "Иван", "Иванович", snils, date, "9643000000000001"},
+			},
+			want: 1, line: 4,
+		},
+		{
+			name: "text cells",
+			rows: [][]interface{}{
+				{"Список карт"},
+				{"Получатель", "СНИЛС", "Дата выпуска", "Карта"},
+				{"Иванов Иван Иванович", "012-345-678 19", "02.01.2022", "9643000000000001"},
+			},
+			want: 1, line: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := ParseDocumentFromRSTK(bytes.NewReader(workbook(t, tt.rows)), types, tt.typeID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if doc.Type != tt.want || doc.Encoding != RstkExcel || doc.Delimiter != "" {
+				t.Errorf("type %d, encoding %q, delimiter %q", doc.Type, doc.Encoding, doc.Delimiter)
+			}
+			if len(doc.Persons) != 1 || len(doc.Rejected) != 0 {
+				t.Fatalf("persons: %+v, rejected: %+v", doc.Persons, doc.Rejected)
+			}
+			p := doc.Persons[0]
+			if p.Family != "Иванов" || p.Name != "Иван" || p.Patronymic != "Иванович" || len(p.Errors) != 0 {
+				t.Errorf("fio %q %q %q, errors %v", p.Family, p.Name, p.Patronymic, p.Errors)
+			}
+			if p.Snils != "01234567819" || !p.Date.Equal(date) || p.Number != "9643000000000001" {
+				t.Errorf("snils %q, date %s, number %q", p.Snils, p.Date, p.Number)
+			}
+			if p.LineNumber != tt.line {
+				t.Errorf("line %d, want %d", p.LineNumber, tt.line)
+			}
+		})
+	}
+}
+
+func TestParseExcelFromRSTKWithoutHeader(t *testing.T) {
+	data := workbook(t, [][]interface{}{{"Иванов Иван Иванович", 1234567819, "02.01.2022", "1"}})
+	doc, err := ParseDocumentFromRSTK(bytes.NewReader(data), nil, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Type != 0 || len(doc.Persons) != 0 {
+		t.Errorf("document without table header: %+v", doc)
+	}
+}
+
+func TestParseErcExcel(t *testing.T) {
+	formats, err := LoadErcFormats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ErcParser{formats: formats}
+	data := workbook(t, [][]interface{}{
+		{"Реестр выданных купонов"},
+		{"СНИЛС", "Дата рождения", "Фамилия", "Имя", "Отчество", "Год", "Полугодие", "Цвет", "Количество", "Израсходовано", "Дата выдачи", "Код кассира", "Кассир"},
+		{1234567819, time.Date(1950, 3, 4, 0, 0, 0, 0, time.UTC), "Иванов", "Иван", "Иванович", 2022, 1, "синий", 2, 1, "02.01.2022", 5, "Касса"},
+	})
+
+	result, rejected, err := p.ParseDocument(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 || len(rejected) != 0 {
+		t.Fatalf("result: %+v, rejected: %+v", result, rejected)
+	}
+	r := result[0]
+	if r.Snils != "01234567819" || r.Birthdate.Format("02.01.2006") != "04.03.1950" || r.LineNumber != 3 {
+		t.Errorf("snils %q, birthdate %s, line %d", r.Snils, r.Birthdate, r.LineNumber)
+	}
+}
@@ -1,107 +1,286 @@
 package persons
 
 import (
-	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
 	"fmt"
 	"github.com/morzik45/stk-registry/pkg/parser"
 	"github.com/morzik45/stk-registry/pkg/postgres"
 	"github.com/morzik45/stk-registry/pkg/utils"
 	"io"
 	"log"
+	"regexp"
 	"strings"
+	"unicode"
 )
 
+// rstkDelimiters разделители столбцов, из которых выбирается разделитель файла РСТК, при равенстве - первый
+var rstkDelimiters = []rune{',', ';', '\t'}
+
+// rstkSampleRows по скольким строкам определяется разделитель
+const rstkSampleRows = 20
+
+// RstkExcel вместо кодировки у списков в формате xlsx
+const RstkExcel = "xlsx"
+
+// rstkHeaders названия столбцов списка РСТК в xlsx. ФИО бывает одним столбцом или тремя.
+var rstkHeaders = map[string][]string{
+	"fio":        {"ФИО", "Фамилия Имя Отчество", "Фамилия, имя, отчество", "Получатель"},
+	"family":     {"Фамилия"},
+	"name":       {"Имя"},
+	"patronymic": {"Отчество"},
+	"snils":      {"СНИЛС", "Номер СНИЛС"},
+	"date":       {"Дата", "Дата выпуска", "Дата готовности", "Дата готовности к выдаче"},
+	"number":     {"Номер карты", "Номер", "Карта", "PAN"},
+}
+
+// RstkType тип документа РСТК, заголовок - первая непустая строка файла
+type RstkType struct {
+	ID     int
+	Header *regexp.Regexp // nil - тип можно только указать явно
+}
+
+// RstkDocument разобранный список карт РСТК
+type RstkDocument struct {
+	Type      int    // 0 - тип документа не определён
+	Encoding  string // кодировка файла, см. utils.DetectEncoding, для xlsx - RstkExcel
+	Delimiter string // разделитель столбцов, для xlsx пустой
+	Persons   []postgres.PersonFromRSTK
+	Rejected  RejectedRows // строки, которые не удалось разобрать
+}
+
 func Trim(data string) string {
 	return strings.TrimSpace(strings.TrimRight(strings.TrimLeft(data, "'"), "'"))
 }
 
-func ParseRowFromRSTK(data string) (postgres.PersonFromRSTK, error) {
+// ParseRowFromRSTK разбирает строку списка РСТК, уже разделённую на столбцы: ФИО, СНИЛС, дата, номер карты
+func ParseRowFromRSTK(rows []string) (postgres.PersonFromRSTK, error) {
 	var r postgres.PersonFromRSTK
 	var err error
-	rows := strings.Split(data, ",")
 	if len(rows) != 4 {
-		return postgres.PersonFromRSTK{}, fmt.Errorf("invalid row: %s", data)
+		return postgres.PersonFromRSTK{}, fmt.Errorf("invalid row: %q", rows)
 	}
 
 	r.Snils, err = parser.Snils(Trim(rows[1]))
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
-	}
+	r.Errors.Add(err, "snils", 1)
 
-	fio := strings.Split(Trim(rows[0]), " ")
+	// запятая в ФИО - тоже разделитель слов: "Иванов, Иван Иванович"
+	fio := strings.FieldsFunc(Trim(rows[0]), func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
 	if len(fio) < 2 {
-		return postgres.PersonFromRSTK{}, fmt.Errorf("invalid row: %s", data)
-	}
-	r.Family, err = parser.String(fio[0])
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
+		return postgres.PersonFromRSTK{}, fmt.Errorf("invalid row: %q", rows)
 	}
-	r.Name, err = parser.String(fio[1])
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
-	}
-	if len(fio) == 3 {
-		r.Patronymic, err = parser.String(fio[2])
-		if err != nil {
-			r.Errors = append(r.Errors, err.Error())
-		}
+	r.FamilyRaw, r.NameRaw = fio[0], fio[1]
+	r.Family, err = parser.Name(fio[0])
+	r.Errors.Add(err, "family", 0)
+	r.Name, err = parser.Name(fio[1])
+	r.Errors.Add(err, "name", 0)
+	if len(fio) >= 3 {
+		// отчество может быть из нескольких слов: "Гусейн оглы"
+		r.PatronymicRaw = strings.Join(fio[2:], " ")
+		r.Patronymic, err = parser.Name(r.PatronymicRaw)
+		r.Errors.Add(err, "patronymic", 0)
 	} else {
 		r.Patronymic = ""
-		r.Errors = append(r.Errors, "Не указанно отчество")
+		r.Errors = append(r.Errors, parser.Error{Code: parser.CodeEmptyField, Field: "patronymic", Value: Trim(rows[0]), Column: 0})
 	}
 
 	r.Date, err = parser.Date(Trim(rows[2]))
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
-	}
+	r.Errors.Add(err, "date", 2)
 
 	r.Number, err = parser.String(Trim(rows[3]))
-	if err != nil {
-		r.Errors = append(r.Errors, err.Error())
-	}
+	r.Errors.Add(err, "number", 3)
 
 	return r, nil
 }
 
-func ParseDocumentFromRSTK(reader io.Reader) (rs []postgres.PersonFromRSTK, type_ int) {
-	var err error
+// ParseDocumentFromRSTK разбирает список карт РСТК. Первая непустая строка - заголовок с типом документа
+// из types, остальные - CSV по RFC 4180 (значения в двойных кавычках могут содержать разделитель и переносы строк).
+// Если typeID задан, заголовок не обязателен. Кодировка и разделитель определяются по содержимому файла.
+// Строки, которые не удалось разобрать, не попадают в doc.Persons и возвращаются в doc.Rejected.
+func ParseDocumentFromRSTK(reader io.Reader, types []RstkType, typeID int) (doc RstkDocument, err error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return doc, err
+	}
+	if utils.IsExcel(data) {
+		return parseExcelFromRSTK(data, types, typeID)
+	}
+	doc.Encoding = utils.DetectEncoding(data)
+	data, err = utils.BytesFromEncoding(doc.Encoding, data)
+	if err != nil {
+		return doc, err
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+
+	// Тип определяется по первой непустой строке, если тип указан явно - строка пропускается,
+	// только если это заголовок
+	first := 0
+	for first < len(lines) && strings.TrimSpace(lines[first]) == "" {
+		first++
+	}
+	if first == len(lines) {
+		log.Printf("invalid document, empty")
+		return doc, nil
+	}
+	header := -1
+	if doc.Type = rstkTypeOf(types, lines[first]); doc.Type != 0 {
+		header = first
+	}
+	if typeID != 0 {
+		doc.Type = typeID
+	} else if doc.Type == 0 {
+		log.Printf("invalid document, unknown type: %s", lines[first])
+		return doc, nil
+	}
+	first = header // первая строка данных - first+1
+
+	body := strings.Join(lines[first+1:], "\n")
+	delimiter := detectDelimiter(body)
+	doc.Delimiter = string(delimiter)
 
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		var line string
-		line, err = utils.StringFromWindows1251(scanner.Text())
+	r := newRstkCsvReader(body, delimiter)
+	for {
+		var record []string
+		record, err = r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
 		if err != nil {
-			log.Println(err)
+			var pe *csv.ParseError
+			if !errors.As(err, &pe) {
+				return doc, err
+			}
+			doc.Rejected = append(doc.Rejected, RejectedRow{Line: first + 1 + pe.StartLine, Reason: pe.Err.Error()})
 			continue
 		}
+		startLine, _ := r.FieldPos(0)
+		lineNumber := first + 1 + startLine // номер строки в файле, с 1
 
-		// Сработает только на первой строке и определит тип или выкинет ошибку
-		// FIXME: Всегда будет только эти 2 типа? С точно такой формулировкой?
-		if type_ == 0 {
-			switch strings.ToLower(strings.TrimSpace(line)) {
-			case "список социальных карт":
-				type_ = 1
-			case "список банковских карт":
-				type_ = 2
-			default:
-				log.Printf("invalid document, unknown type: %s", line)
-				return nil, 0
-			}
+		// Пропускаем пустые строки
+		if len(record) == 1 && len(strings.TrimSpace(record[0])) < 2 {
 			continue
 		}
 
-		// Пропускаем пустые строки
-		if len(line) < 2 {
+		var p postgres.PersonFromRSTK
+		p, err = ParseRowFromRSTK(record)
+		if err != nil {
+			doc.Rejected = append(doc.Rejected, RejectedRow{Line: lineNumber, Reason: err.Error()})
 			continue
 		}
+		endLine, _ := r.FieldPos(len(record) - 1)
+		p.SourceLine = strings.Join(lines[lineNumber-1:first+1+endLine], "\n")
+		p.LineNumber = lineNumber
+		doc.Persons = append(doc.Persons, p)
+	}
+	return doc, nil
+}
+
+// parseExcelFromRSTK разбирает список карт РСТК в формате xlsx. Столбцы определяются по строке заголовка
+// таблицы (см. rstkHeaders), тип документа - по первой непустой строке над ней, если typeID не задан.
+func parseExcelFromRSTK(data []byte, types []RstkType, typeID int) (doc RstkDocument, err error) {
+	doc.Encoding = RstkExcel
+	rows, err := utils.ExcelRows(bytes.NewReader(data))
+	if err != nil {
+		return doc, err
+	}
+	header, columns := excelHeader(rows, rstkHeaders, func(columns map[string]int) bool {
+		_, fio := columns["fio"]
+		_, family := columns["family"]
+		_, name := columns["name"]
+		_, snils := columns["snils"]
+		_, date := columns["date"]
+		_, number := columns["number"]
+		return (fio || family && name) && snils && date && number
+	})
+	if header == -1 {
+		log.Printf("invalid document, table header not found")
+		return doc, nil
+	}
+	for i := 0; i < header; i++ {
+		if !excelEmpty(rows[i]) {
+			doc.Type = rstkTypeOf(types, strings.Join(rows[i], " "))
+			break
+		}
+	}
+	if typeID != 0 {
+		doc.Type = typeID
+	} else if doc.Type == 0 {
+		log.Printf("invalid document, unknown type")
+		return doc, nil
+	}
 
-		var r postgres.PersonFromRSTK
-		r, err = ParseRowFromRSTK(line)
+	for i := header + 1; i < len(rows); i++ {
+		row := rows[i]
+		if excelEmpty(row) {
+			continue
+		}
+		fio := excelCell(row, columns, "fio")
+		if _, ok := columns["fio"]; !ok {
+			fio = strings.Join([]string{
+				excelCell(row, columns, "family"), excelCell(row, columns, "name"), excelCell(row, columns, "patronymic"),
+			}, " ")
+		}
+		var p postgres.PersonFromRSTK
+		p, err = ParseRowFromRSTK([]string{
+			fio,
+			utils.ExcelDigits(excelCell(row, columns, "snils"), 11), // Excel теряет ведущие нули СНИЛС
+			utils.ExcelDate(excelCell(row, columns, "date")),
+			excelCell(row, columns, "number"),
+		})
 		if err != nil {
-			log.Println(err)
+			doc.Rejected = append(doc.Rejected, RejectedRow{Line: i + 1, Reason: err.Error()})
 			continue
 		}
-		rs = append(rs, r)
+		p.SourceLine, p.LineNumber = excelLine(row), i+1
+		doc.Persons = append(doc.Persons, p)
+	}
+	return doc, nil
+}
+
+// rstkTypeOf тип документа по строке заголовка, 0 - ни один тип не подошёл
+func rstkTypeOf(types []RstkType, line string) int {
+	for _, t := range types {
+		if t.Header != nil && t.Header.MatchString(strings.TrimSpace(line)) {
+			return t.ID
+		}
+	}
+	return 0
+}
+
+func newRstkCsvReader(body string, delimiter rune) *csv.Reader {
+	r := csv.NewReader(strings.NewReader(body))
+	r.Comma = delimiter
+	r.FieldsPerRecord = -1 // число столбцов проверяет ParseRowFromRSTK
+	r.LazyQuotes = true
+	return r
+}
+
+// detectDelimiter выбирает разделитель, с которым первые строки файла делятся на одинаковое
+// и наибольшее число столбцов. Разделители внутри кавычек не учитываются.
+func detectDelimiter(body string) rune {
+	best, bestColumns := rstkDelimiters[0], 1
+	for _, delimiter := range rstkDelimiters {
+		r := newRstkCsvReader(body, delimiter)
+		columns := 0
+		for i := 0; i < rstkSampleRows; i++ {
+			record, err := r.Read()
+			if err != nil {
+				break
+			}
+			if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+				continue
+			}
+			if columns == 0 {
+				columns = len(record)
+			} else if columns != len(record) {
+				columns = 0
+				break
+			}
+		}
+		if columns > bestColumns {
+			best, bestColumns = delimiter, columns
+		}
 	}
-	return
+	return best
 }
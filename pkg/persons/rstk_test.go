@@ -0,0 +1,158 @@
+package persons
+
+import (
+	"golang.org/x/text/encoding/charmap"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDetectDelimiter(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want rune
+	}{
+		{"comma", "Иванов Иван,11223344595,02.01.2022,1\nПетров Петр,11223344595,02.01.2022,2", ','},
+		{"semicolon", "Иванов Иван;11223344595;02.01.2022;1\nПетров Петр;11223344595;02.01.2022;2", ';'},
+		{"tab", "Иванов Иван\t11223344595\t02.01.2022\t1\nПетров Петр\t11223344595\t02.01.2022\t2", '\t'},
+		{"comma in name", "Иванов, Иван;11223344595;02.01.2022;1\nПетров, Петр;11223344595;02.01.2022;2", ';'},
+		{"quoted comma", "\"Иванов, Иван\",11223344595,02.01.2022,1\n\"Петров, Петр\",11223344595,02.01.2022,2", ','},
+		{"empty lines", "\nИванов Иван;11223344595;02.01.2022;1\n\nПетров Петр;11223344595;02.01.2022;2\n", ';'},
+		{"single column", "Иванов Иван\nПетров Петр", ','},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectDelimiter(tt.body); got != tt.want {
+				t.Errorf("detectDelimiter() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDocumentFromRSTK(t *testing.T) {
+	types := []RstkType{
+		{ID: 1, Header: regexp.MustCompile(`^Список карт`)},
+		{ID: 7}, // только явно
+	}
+	cp1251 := func(s string) string {
+		s, err := charmap.Windows1251.NewEncoder().String(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	cp866 := func(s string) string {
+		s, err := charmap.CodePage866.NewEncoder().String(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	type row struct {
+		line       int
+		family     string
+		source     string
+		patronymic string
+	}
+	tests := []struct {
+		name      string
+		data      string
+		typeID    int
+		wantType  int
+		encoding  string
+		delimiter string
+		rows      []row
+		rejected  []int
+	}{
+		{
+			name: "quoted name with comma and newline",
+			data: "Список карт\r\n" +
+				"\"Иванов, Иван Иванович\",112-233-445 95,02.01.2022,1\r\n" +
+				"\"Петров Петр\r\nПетрович\",112-233-445 95,03.01.2022,2\r\n" +
+				"Сидоров Сидор,112-233-445 95\r\n",
+			wantType: 1, encoding: "utf-8", delimiter: ",",
+			rows: []row{
+				{2, "Иванов", "\"Иванов, Иван Иванович\",112-233-445 95,02.01.2022,1", "Иванович"},
+				{3, "Петров", "\"Петров Петр\nПетрович\",112-233-445 95,03.01.2022,2", "Петрович"},
+			},
+			rejected: []int{5},
+		},
+		{
+			name:     "utf-8 with bom",
+			data:     "\xef\xbb\xbfСписок карт\n'Иванов Иван Иванович';112-233-445 95;02.01.2022;1\n",
+			wantType: 1, encoding: "utf-8-bom", delimiter: ";",
+			rows: []row{{2, "Иванов", "'Иванов Иван Иванович';112-233-445 95;02.01.2022;1", "Иванович"}},
+		},
+		{
+			name:     "cp1251 semicolon",
+			data:     cp1251("Список карт\r\n\r\nИванов Иван Иванович;112-233-445 95;02.01.2022;1\r\nПетров Петр;112-233-445 95;03.01.2022;2\r\n"),
+			wantType: 1, encoding: "windows-1251", delimiter: ";",
+			rows: []row{
+				{3, "Иванов", "Иванов Иван Иванович;112-233-445 95;02.01.2022;1", "Иванович"},
+				{4, "Петров", "Петров Петр;112-233-445 95;03.01.2022;2", ""},
+			},
+		},
+		{
+			name:     "cp866 tab",
+			data:     cp866("Список карт\r\nИванов Иван Иванович\t112-233-445 95\t02.01.2022\t1\r\n"),
+			wantType: 1, encoding: "cp866", delimiter: "\t",
+			rows: []row{{2, "Иванов", "Иванов Иван Иванович\t112-233-445 95\t02.01.2022\t1", "Иванович"}},
+		},
+		{
+			name:     "headerless with explicit type",
+			data:     cp1251("Иванов Иван Иванович;112-233-445 95;02.01.2022;1\r\nПетров;112-233-445 95;03.01.2022;2\r\nСидоров Сидор Сидорович;112-233-445 95;04.01.2022;3\r\n"),
+			typeID:   7,
+			wantType: 7, encoding: "windows-1251", delimiter: ";",
+			rows: []row{
+				{1, "Иванов", "Иванов Иван Иванович;112-233-445 95;02.01.2022;1", "Иванович"},
+				{3, "Сидоров", "Сидоров Сидор Сидорович;112-233-445 95;04.01.2022;3", "Сидорович"},
+			},
+			rejected: []int{2},
+		},
+		{
+			name:     "explicit type skips matching header",
+			data:     "Список карт\nИванов Иван Иванович,112-233-445 95,02.01.2022,1\n",
+			typeID:   7,
+			wantType: 7, encoding: "utf-8", delimiter: ",",
+			rows: []row{{2, "Иванов", "Иванов Иван Иванович,112-233-445 95,02.01.2022,1", "Иванович"}},
+		},
+		{
+			name:     "headerless without type",
+			data:     "Иванов Иван Иванович,112-233-445 95,02.01.2022,1\n",
+			wantType: 0, encoding: "utf-8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := ParseDocumentFromRSTK(strings.NewReader(tt.data), types, tt.typeID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if doc.Type != tt.wantType || doc.Encoding != tt.encoding || doc.Delimiter != tt.delimiter {
+				t.Errorf("type %d, encoding %q, delimiter %q", doc.Type, doc.Encoding, doc.Delimiter)
+			}
+			if len(doc.Persons) != len(tt.rows) {
+				t.Fatalf("persons: %+v", doc.Persons)
+			}
+			for i, want := range tt.rows {
+				p := doc.Persons[i]
+				if p.LineNumber != want.line || p.Family != want.family || p.Patronymic != want.patronymic || p.SourceLine != want.source {
+					t.Errorf("person %d: line %d, family %q, patronymic %q, source %q", i, p.LineNumber, p.Family, p.Patronymic, p.SourceLine)
+				}
+				if p.Snils != "11223344595" || p.Number == "" || p.Date.IsZero() {
+					t.Errorf("person %d: snils %q, number %q, date %s", i, p.Snils, p.Number, p.Date)
+				}
+			}
+			if len(doc.Rejected) != len(tt.rejected) {
+				t.Fatalf("rejected: %+v", doc.Rejected)
+			}
+			for i, line := range tt.rejected {
+				if doc.Rejected[i].Line != line || doc.Rejected[i].Reason == "" {
+					t.Errorf("rejected %d: %+v, want line %d", i, doc.Rejected[i], line)
+				}
+			}
+		})
+	}
+}
@@ -2,7 +2,10 @@ package postgres
 
 import (
 	"context"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/jmoiron/sqlx"
 	"go.uber.org/zap"
 	"time"
@@ -16,6 +19,41 @@ type CorrectPersonData struct {
 	Birthdate  time.Time `db:"birthdate"`
 }
 
+// SnilsCandidate запись из correct_person_data, похожая на строку с ошибкой в СНИЛС
+type SnilsCandidate struct {
+	Snils      string    `json:"snils"`
+	Family     string    `json:"family"`
+	Name       string    `json:"name"`
+	Patronymic string    `json:"patronymic"`
+	Birthdate  time.Time `json:"birthdate"`
+	Score      float64   `json:"score"`   // сходство ФИО от 0 до 1
+	Applied    bool      `json:"applied"` // СНИЛС кандидата подставлен в строку
+}
+
+// SnilsCandidates кандидаты по убыванию оценки, в базе хранятся как JSON, пустой список - NULL
+type SnilsCandidates []SnilsCandidate
+
+func (sc SnilsCandidates) Value() (driver.Value, error) {
+	if len(sc) == 0 {
+		return nil, nil
+	}
+	return json.Marshal([]SnilsCandidate(sc))
+}
+
+func (sc *SnilsCandidates) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*sc = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, (*[]SnilsCandidate)(sc))
+	case string:
+		return json.Unmarshal([]byte(v), (*[]SnilsCandidate)(sc))
+	default:
+		return fmt.Errorf("unsupported type %T for SnilsCandidates", value)
+	}
+}
+
 type CorrectPersonsData struct {
 	db     *sqlx.DB
 	stmts  []*sqlx.NamedStmt
@@ -23,6 +61,8 @@ type CorrectPersonsData struct {
 
 	searchSnils   func(ctx context.Context, person *CorrectPersonData) error
 	searchBySnils func(ctx context.Context, person *CorrectPersonData) error
+
+	selectByBirthdate func(ctx context.Context, birthdate time.Time) ([]CorrectPersonData, error)
 }
 
 func NewCorrectPersonsData(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*CorrectPersonsData, error) {
@@ -66,6 +106,12 @@ func (cpd *CorrectPersonsData) initCorrectPersonsData(ctx context.Context) (err
 	}
 	cpd.stmts = append(cpd.stmts, stmt)
 
+	cpd.selectByBirthdate, stmt, err = cpd.initSelectByBirthdate(ctx)
+	if err != nil {
+		return
+	}
+	cpd.stmts = append(cpd.stmts, stmt)
+
 	return
 }
 
@@ -80,9 +126,9 @@ func (cpd *CorrectPersonsData) initSearchSnils(ctx context.Context) (func(ctx co
 	query := `
 		SELECT "snils", "family", "name", "patronymic", "birthdate"
 		FROM correct_person_data
-		WHERE "family" = :family 
-		  AND "name" = :name 
-		  AND "patronymic" = :patronymic 
+		WHERE name_key("family") = name_key(:family)
+		  AND name_key("name") = name_key(:name)
+		  AND name_key("patronymic") = name_key(:patronymic)
 		  AND "birthdate" = :birthdate
 	`
 	stmt, err := cpd.db.PrepareNamedContext(ctx, query)
@@ -115,3 +161,28 @@ func (cpd *CorrectPersonsData) initSearchBySnils(ctx context.Context) (func(ctx
 		return stmt.GetContext(ctx, person, person)
 	}, stmt, nil
 }
+
+// SelectByBirthdate возвращает всех людей с датой рождения birthdate, среди них ищутся похожие ФИО
+func (cpd *CorrectPersonsData) SelectByBirthdate(ctx context.Context, birthdate time.Time) ([]CorrectPersonData, error) {
+	if cpd.selectByBirthdate == nil {
+		return nil, errors.New("selectByBirthdate func is not initialized")
+	}
+	return cpd.selectByBirthdate(ctx, birthdate)
+}
+
+func (cpd *CorrectPersonsData) initSelectByBirthdate(ctx context.Context) (func(ctx context.Context, birthdate time.Time) ([]CorrectPersonData, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT "snils", "family", "name", "patronymic", "birthdate"
+		FROM correct_person_data
+		WHERE "birthdate" = :birthdate
+		ORDER BY "snils"
+	`
+	stmt, err := cpd.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(ctx context.Context, birthdate time.Time) (persons []CorrectPersonData, err error) {
+		err = stmt.SelectContext(ctx, &persons, map[string]interface{}{"birthdate": birthdate})
+		return
+	}, stmt, nil
+}
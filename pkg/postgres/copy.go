@@ -0,0 +1,63 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// copyIn загружает count строк в таблицу table командой COPY FROM STDIN, row(i) - значения столбцов columns
+// для i-й строки. В отличие от многострочного INSERT, COPY не упирается в предел 65535 параметров запроса
+// и быстрее на больших файлах. Строки загружаются в транзакции tx, если tx == nil - в отдельной транзакции.
+func copyIn(ctx context.Context, db *sqlx.DB, tx *sqlx.Tx, table string, columns []string, count int, row func(i int) []interface{}) (err error) {
+	if tx == nil {
+		tx, err = db.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer func(tx *sqlx.Tx) { _ = tx.Rollback() }(tx)
+		if err = copyIn(ctx, db, tx, table, columns, count, row); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return fmt.Errorf("failed to prepare copy into %s: %s", table, err.Error())
+	}
+	defer func() { _ = stmt.Close() }()
+
+	for i := 0; i < count; i++ {
+		values := row(i)
+		for j := range values {
+			if values[j], err = copyValue(values[j]); err != nil {
+				return fmt.Errorf("copy into %s, row %d, column %s: %w", table, i, columns[j], err)
+			}
+		}
+		if _, err = stmt.ExecContext(ctx, values...); err != nil {
+			return fmt.Errorf("copy into %s, row %d: %w", table, i, err)
+		}
+	}
+	// Пустой Exec отправляет накопленные строки на сервер
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		return fmt.Errorf("copy into %s: %w", table, err)
+	}
+	return stmt.Close()
+}
+
+// copyValue значение для COPY. JSON из driver.Valuer передаётся строкой: []byte pq отправляет как bytea,
+// и в столбец jsonb попал бы "\x7b...".
+func copyValue(v interface{}) (interface{}, error) {
+	valuer, ok := v.(driver.Valuer)
+	if !ok {
+		return v, nil
+	}
+	value, err := valuer.Value()
+	if b, ok := value.([]byte); ok {
+		return string(b), err
+	}
+	return value, err
+}
@@ -0,0 +1,267 @@
+package postgres_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/parser"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"github.com/morzik45/stk-registry/pkg/postgres/pgtest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	selectErcPersons = `
+		SELECT id, erc_update_id, snils, birthdate, family, name, patronymic, family_raw, name_raw, patronymic_raw,
+		       year, semester, color, count, spent, date, cashier_id, cashier_name, errors, snils_candidates,
+		       source_line, line_number
+		FROM persons_from_erc
+		WHERE erc_update_id = $1
+		ORDER BY line_number`
+	selectRstkPersons = `
+		SELECT id, rstk_update_id, snils, family, name, patronymic, family_raw, name_raw, patronymic_raw, date, number,
+		       errors, source_line, line_number
+		FROM persons_from_rstk
+		WHERE rstk_update_id = $1
+		ORDER BY line_number`
+)
+
+var testDate = time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+
+func ercPersons(updateID, n int) []postgres.PersonFromERC {
+	persons := make([]postgres.PersonFromERC, n)
+	for i := range persons {
+		persons[i] = postgres.PersonFromERC{
+			ErcUpdateID: updateID,
+			Snils:       fmt.Sprintf("%011d", i),
+			Birthdate:   time.Date(1950, 3, 4, 0, 0, 0, 0, time.UTC),
+			Family:      "Иванов",
+			Name:        "Иван",
+			Patronymic:  "Иванович",
+			Year:        2022,
+			Semester:    1,
+			Color:       "синий",
+			Count:       2,
+			Spent:       1,
+			Date:        testDate,
+			CashierID:   5,
+			CashierName: "Касса",
+			SourceLine:  fmt.Sprintf("%011d|04.03.1950|ИВАНОВ|ИВАН|ИВАНОВИЧ|2022|1|синий|2|1|02.01.2022|5|Касса", i),
+			LineNumber:  i + 1,
+		}
+	}
+	return persons
+}
+
+func rstkPersons(updateID, n int) []postgres.PersonFromRSTK {
+	persons := make([]postgres.PersonFromRSTK, n)
+	for i := range persons {
+		persons[i] = postgres.PersonFromRSTK{
+			RstkUpdateID: updateID,
+			Snils:        fmt.Sprintf("%011d", i),
+			Family:       "Иванов",
+			Name:         "Иван",
+			Patronymic:   "Иванович",
+			Date:         testDate,
+			Number:       fmt.Sprintf("9643%012d", i),
+			SourceLine:   fmt.Sprintf("Иванов Иван Иванович,%011d,02.01.2022,9643%012d", i, i),
+			LineNumber:   i + 1,
+		}
+	}
+	return persons
+}
+
+func createErcUpdate(t testing.TB, db *postgres.DB) int {
+	t.Helper()
+	u := postgres.ErcUpdate{Name: "test.txt", Source: postgres.ErcSourceDropFolder}
+	if err := db.ErcUpdates.Create(context.Background(), &u, nil); err != nil {
+		t.Fatal(err)
+	}
+	return u.ID
+}
+
+func createRstkUpdate(t testing.TB, db *postgres.DB) int {
+	t.Helper()
+	u := postgres.RstkUpdate{TypeID: 1, FromDate: testDate}
+	if err := db.RstkUpdates.Create(context.Background(), &u, nil); err != nil {
+		t.Fatal(err)
+	}
+	return u.ID
+}
+
+func countRows(t testing.TB, db *postgres.DB, table, column string, updateID int) int {
+	t.Helper()
+	var n int
+	err := db.DB.Get(&n, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s = $1", table, column), updateID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPersonsFromERCCreateMany(t *testing.T) {
+	db := pgtest.New(t)
+	ctx := context.Background()
+	updateID := createErcUpdate(t, db)
+
+	persons := ercPersons(updateID, 3)
+	// Значения, которые COPY должен экранировать, и JSON в столбцах jsonb
+	persons[0].SourceLine = "tab\there\nnew line \\ backslash"
+	persons[0].FamilyRaw, persons[0].NameRaw, persons[0].PatronymicRaw = "ИВАНОВ", "ИВАН", "ИВАНОВИЧ"
+	persons[1].Errors = parser.Errors{{Code: parser.CodeEmptyField, Field: "snils", Value: "", Column: 0}}
+	persons[2].SnilsCandidates = postgres.SnilsCandidates{{
+		Snils: "11223344595", Family: "Иванов", Name: "Иван", Patronymic: "Иванович",
+		Birthdate: persons[2].Birthdate, Score: 0.95, Applied: true,
+	}}
+
+	// Откат транзакции вызывающего откатывает и загрузку
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.PersonsFromErc.CreateMany(ctx, persons, tx); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "persons_from_erc", "erc_update_id", updateID); n != 0 {
+		t.Fatalf("%d rows visible before commit", n)
+	}
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "persons_from_erc", "erc_update_id", updateID); n != 0 {
+		t.Fatalf("%d rows left after rollback", n)
+	}
+
+	tx, err = db.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.PersonsFromErc.CreateMany(ctx, persons, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []postgres.PersonFromERC
+	if err = db.DB.Select(&got, selectErcPersons, updateID); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(persons) {
+		t.Fatalf("got %d rows, want %d", len(got), len(persons))
+	}
+	for i := range got {
+		g, w := got[i], persons[i]
+		if !g.Birthdate.Equal(w.Birthdate) || !g.Date.Equal(w.Date) {
+			t.Errorf("row %d dates: got %s %s, want %s %s", i, g.Birthdate, g.Date, w.Birthdate, w.Date)
+		}
+		for j := range g.SnilsCandidates {
+			if !g.SnilsCandidates[j].Birthdate.Equal(w.SnilsCandidates[j].Birthdate) {
+				t.Errorf("row %d candidate birthdate: got %s", i, g.SnilsCandidates[j].Birthdate)
+			}
+			g.SnilsCandidates[j].Birthdate = w.SnilsCandidates[j].Birthdate
+		}
+		g.ID, g.Birthdate, g.Date = 0, w.Birthdate, w.Date
+		if !reflect.DeepEqual(g, w) {
+			t.Errorf("row %d:\ngot  %+v\nwant %+v", i, g, w)
+		}
+	}
+}
+
+func TestPersonsFromERCCreateManyWithoutTx(t *testing.T) {
+	db := pgtest.New(t)
+	updateID := createErcUpdate(t, db)
+	if err := db.PersonsFromErc.CreateMany(context.Background(), ercPersons(updateID, 5), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "persons_from_erc", "erc_update_id", updateID); n != 5 {
+		t.Fatalf("got %d rows, want 5", n)
+	}
+}
+
+func TestPersonsFromRSTKCreateMany(t *testing.T) {
+	db := pgtest.New(t)
+	ctx := context.Background()
+	updateID := createRstkUpdate(t, db)
+
+	persons := rstkPersons(updateID, 2)
+	persons[0].SourceLine = "\"Иванов,\nИван\",1,2,3"
+	persons[1].Errors = parser.Errors{{Code: parser.CodeEmptyField, Field: "patronymic", Value: "Иванов Иван", Column: 0}}
+
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.PersonsFromRSTK.CreateMany(ctx, persons, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "persons_from_rstk", "rstk_update_id", updateID); n != 0 {
+		t.Fatalf("%d rows left after rollback", n)
+	}
+
+	// Без транзакции загрузка идёт в своей транзакции, раньше здесь была паника
+	if err = db.PersonsFromRSTK.CreateMany(ctx, persons, nil); err != nil {
+		t.Fatal(err)
+	}
+	var got []postgres.PersonFromRSTK
+	if err = db.DB.Select(&got, selectRstkPersons, updateID); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(persons) {
+		t.Fatalf("got %d rows, want %d", len(got), len(persons))
+	}
+	for i := range got {
+		g, w := got[i], persons[i]
+		if !g.Date.Equal(w.Date) {
+			t.Errorf("row %d date: got %s, want %s", i, g.Date, w.Date)
+		}
+		g.ID, g.Date = 0, w.Date
+		if !reflect.DeepEqual(g, w) {
+			t.Errorf("row %d:\ngot  %+v\nwant %+v", i, g, w)
+		}
+	}
+}
+
+// benchmarkRows размер большого файла для бенчмарков
+const benchmarkRows = 100000
+
+// benchmarkCreateMany загружает строки в транзакции и откатывает её, чтобы каждая итерация начиналась с пустой таблицы
+func benchmarkCreateMany(b *testing.B, db *postgres.DB, createMany func(ctx context.Context, tx *sqlx.Tx) error) {
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx, err := db.BeginTx(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = createMany(ctx, tx); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		if err = tx.Rollback(); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkPersonsFromERCCreateMany(b *testing.B) {
+	db := pgtest.New(b)
+	persons := ercPersons(createErcUpdate(b, db), benchmarkRows)
+	benchmarkCreateMany(b, db, func(ctx context.Context, tx *sqlx.Tx) error {
+		return db.PersonsFromErc.CreateMany(ctx, persons, tx)
+	})
+}
+
+func BenchmarkPersonsFromRSTKCreateMany(b *testing.B) {
+	db := pgtest.New(b)
+	persons := rstkPersons(createRstkUpdate(b, db), benchmarkRows)
+	benchmarkCreateMany(b, db, func(ctx context.Context, tx *sqlx.Tx) error {
+		return db.PersonsFromRSTK.CreateMany(ctx, persons, tx)
+	})
+}
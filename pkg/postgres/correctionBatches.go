@@ -0,0 +1,540 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Состояние пакета коррекции
+const (
+	CorrectionBatchOpen      = "open"      // ждёт ответа
+	CorrectionBatchEscalated = "escalated" // ответа нет дольше срока, отправлено напоминание
+	CorrectionBatchClosed    = "closed"    // исправлены все записи
+	CorrectionBatchCancelled = "cancelled" // письмо не ушло, неисправленные записи вернулись в очередь на коррекцию
+)
+
+// Состояние записи в пакете коррекции
+const (
+	CorrectionRowPending   = "pending"   // ждёт исправления
+	CorrectionRowEscalated = "escalated" // ждёт исправления, срок вышел
+	CorrectionRowCorrected = "corrected" // исправлена
+)
+
+// CorrectionBatch записи с ошибками, отправленные на коррекцию одним письмом
+type CorrectionBatch struct {
+	ID          int        `db:"id" json:"id"`
+	OutboxID    *int       `db:"outbox_id" json:"outbox_id"`
+	MessageID   string     `db:"message_id" json:"message_id"` // без угловых скобок
+	Status      string     `db:"status" json:"status"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+	EscalatedAt *time.Time `db:"escalated_at" json:"escalated_at"`
+	ClosedAt    *time.Time `db:"closed_at" json:"closed_at"`
+}
+
+// CorrectionBatchInfo пакет коррекции с количеством записей по состояниям
+type CorrectionBatchInfo struct {
+	CorrectionBatch
+	Rows      int `db:"rows" json:"rows"`
+	Pending   int `db:"pending" json:"pending"`
+	Escalated int `db:"escalated" json:"escalated"`
+	Corrected int `db:"corrected" json:"corrected"`
+}
+
+// CorrectionBatchRow запись в пакете коррекции
+type CorrectionBatchRow struct {
+	BatchID      int        `db:"batch_id"`
+	PersonID     int        `db:"person_id"`
+	Status       string     `db:"status"`
+	ReplyEmailID *int       `db:"reply_email_id"`
+	CorrectedAt  *time.Time `db:"corrected_at"`
+}
+
+// CorrectionOverdue запись, на которую не ответили в срок
+type CorrectionOverdue struct {
+	PersonFromErcForCorrection
+	BatchID int       `db:"batch_id"`
+	SentAt  time.Time `db:"sent_at"`
+}
+
+type CorrectionBatches struct {
+	db     *sqlx.DB
+	stmts  []*sqlx.NamedStmt
+	logger *zap.Logger
+
+	create         func(ctx context.Context, batch *CorrectionBatch, personIDs []int, tx *sqlx.Tx) error
+	getByMessageID func(ctx context.Context, messageIDs []string, tx *sqlx.Tx) (CorrectionBatch, error)
+	waitingRows    func(ctx context.Context, personIDs []int, tx *sqlx.Tx) ([]CorrectionBatchRow, error)
+	markCorrected  func(ctx context.Context, row CorrectionBatchRow, emailID int, tx *sqlx.Tx) error
+	closeAnswered  func(ctx context.Context, batchID int, tx *sqlx.Tx) error
+	escalate       func(ctx context.Context, before time.Time, tx *sqlx.Tx) ([]CorrectionOverdue, error)
+	list           func(ctx context.Context, limit, offset int64) ([]CorrectionBatchInfo, error)
+	rowsByEmail    func(ctx context.Context, emailID int, tx *sqlx.Tx) ([]CorrectionBatchRow, error)
+	restoreRow     func(ctx context.Context, row CorrectionBatchRow, tx *sqlx.Tx) error
+	release        func(ctx context.Context, outboxID int, tx *sqlx.Tx) (int, error)
+}
+
+func NewCorrectionBatches(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*CorrectionBatches, error) {
+	cb := CorrectionBatches{
+		db:     db,
+		logger: logger,
+	}
+	ctxShort, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := cb.initCorrectionBatches(ctxShort)
+	if err != nil {
+		logger.Error("failed to init correctionBatches", zap.Error(err))
+		return nil, err
+	}
+	return &cb, nil
+}
+
+func (cb *CorrectionBatches) Close() error {
+	for _, stmt := range cb.stmts {
+		if stmt != nil {
+			err := stmt.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (cb *CorrectionBatches) initCorrectionBatches(ctx context.Context) (err error) {
+	var stmt, rowsStmt *sqlx.NamedStmt
+	cb.create, stmt, rowsStmt, err = cb.initCreate(ctx)
+	if err != nil {
+		return
+	}
+	cb.stmts = append(cb.stmts, stmt, rowsStmt)
+
+	cb.getByMessageID, stmt, err = cb.initGetByMessageID(ctx)
+	if err != nil {
+		return
+	}
+	cb.stmts = append(cb.stmts, stmt)
+
+	cb.waitingRows, stmt, err = cb.initWaitingRows(ctx)
+	if err != nil {
+		return
+	}
+	cb.stmts = append(cb.stmts, stmt)
+
+	cb.markCorrected, stmt, err = cb.initMarkCorrected(ctx)
+	if err != nil {
+		return
+	}
+	cb.stmts = append(cb.stmts, stmt)
+
+	cb.closeAnswered, stmt, err = cb.initCloseAnswered(ctx)
+	if err != nil {
+		return
+	}
+	cb.stmts = append(cb.stmts, stmt)
+
+	cb.escalate, stmt, err = cb.initEscalate(ctx)
+	if err != nil {
+		return
+	}
+	cb.stmts = append(cb.stmts, stmt)
+
+	cb.list, stmt, err = cb.initList(ctx)
+	if err != nil {
+		return
+	}
+	cb.stmts = append(cb.stmts, stmt)
+
+	cb.rowsByEmail, stmt, err = cb.initRowsByEmail(ctx)
+	if err != nil {
+		return
+	}
+	cb.stmts = append(cb.stmts, stmt)
+
+	cb.restoreRow, stmt, err = cb.initRestoreRow(ctx)
+	if err != nil {
+		return
+	}
+	cb.stmts = append(cb.stmts, stmt)
+
+	cb.release, stmt, err = cb.initRelease(ctx)
+	if err != nil {
+		return
+	}
+	cb.stmts = append(cb.stmts, stmt)
+
+	return
+}
+
+// Create сохраняет пакет вместе с записями personIDs (persons_from_erc.id)
+func (cb *CorrectionBatches) Create(ctx context.Context, batch *CorrectionBatch, personIDs []int, tx *sqlx.Tx) error {
+	if cb.create == nil {
+		return errors.New("create func is not defined")
+	}
+	return cb.create(ctx, batch, personIDs, tx)
+}
+
+func (cb *CorrectionBatches) initCreate(ctx context.Context) (func(ctx context.Context, batch *CorrectionBatch, personIDs []int, tx *sqlx.Tx) error, *sqlx.NamedStmt, *sqlx.NamedStmt, error) {
+	query := `
+		INSERT INTO correction_batches (outbox_id, message_id)
+		VALUES (:outbox_id, :message_id)
+		RETURNING id, status, created_at;
+	`
+	stmt, err := cb.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+	rowsQuery := `
+		INSERT INTO correction_batch_rows (batch_id, person_id)
+		SELECT :batch_id, UNNEST(CAST(:person_ids AS INTEGER[]));
+	`
+	rowsStmt, err := cb.db.PrepareNamedContext(ctx, rowsQuery)
+	if err != nil {
+		_ = stmt.Close()
+		return nil, nil, nil, fmt.Errorf("failed to prepare statement %s: %s", rowsQuery, err.Error())
+	}
+
+	return func(ctx context.Context, batch *CorrectionBatch, personIDs []int, tx *sqlx.Tx) error {
+		currentStmt, currentRowsStmt := stmt, rowsStmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+			currentRowsStmt = tx.NamedStmtContext(ctx, rowsStmt)
+		}
+		err := currentStmt.QueryRowxContext(ctx, *batch).Scan(&batch.ID, &batch.Status, &batch.CreatedAt)
+		if err != nil {
+			return err
+		}
+		ids := make(pq.Int64Array, 0, len(personIDs))
+		for _, id := range personIDs {
+			ids = append(ids, int64(id))
+		}
+		_, err = currentRowsStmt.ExecContext(ctx, map[string]interface{}{
+			"batch_id":   batch.ID,
+			"person_ids": ids,
+		})
+		return err
+	}, stmt, rowsStmt, nil
+}
+
+// GetByMessageID возвращает последний пакет, отправленный письмом с одним из messageIDs (без угловых скобок).
+// Если такого нет, возвращается sql.ErrNoRows.
+func (cb *CorrectionBatches) GetByMessageID(ctx context.Context, messageIDs []string, tx *sqlx.Tx) (CorrectionBatch, error) {
+	if cb.getByMessageID == nil {
+		return CorrectionBatch{}, errors.New("getByMessageID func is not defined")
+	}
+	return cb.getByMessageID(ctx, messageIDs, tx)
+}
+
+func (cb *CorrectionBatches) initGetByMessageID(ctx context.Context) (func(ctx context.Context, messageIDs []string, tx *sqlx.Tx) (CorrectionBatch, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT id, outbox_id, message_id, status, created_at, escalated_at, closed_at
+		FROM correction_batches
+		WHERE message_id <> '' AND message_id = ANY (:message_ids)
+		ORDER BY id DESC
+		LIMIT 1;
+	`
+	stmt, err := cb.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, messageIDs []string, tx *sqlx.Tx) (batch CorrectionBatch, err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		err = currentStmt.GetContext(ctx, &batch, map[string]interface{}{"message_ids": pq.StringArray(messageIDs)})
+		return
+	}, stmt, nil
+}
+
+// WaitingRows возвращает записи из personIDs, которые отправлены на коррекцию и ещё не исправлены
+func (cb *CorrectionBatches) WaitingRows(ctx context.Context, personIDs []int, tx *sqlx.Tx) ([]CorrectionBatchRow, error) {
+	if cb.waitingRows == nil {
+		return nil, errors.New("waitingRows func is not defined")
+	}
+	return cb.waitingRows(ctx, personIDs, tx)
+}
+
+func (cb *CorrectionBatches) initWaitingRows(ctx context.Context) (func(ctx context.Context, personIDs []int, tx *sqlx.Tx) ([]CorrectionBatchRow, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT batch_id, person_id, status
+		FROM correction_batch_rows
+		WHERE person_id = ANY (CAST(:person_ids AS INTEGER[]))
+		  AND status IN ('pending', 'escalated');
+	`
+	stmt, err := cb.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, personIDs []int, tx *sqlx.Tx) (rows []CorrectionBatchRow, err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		ids := make(pq.Int64Array, 0, len(personIDs))
+		for _, id := range personIDs {
+			ids = append(ids, int64(id))
+		}
+		err = currentStmt.SelectContext(ctx, &rows, map[string]interface{}{"person_ids": ids})
+		return
+	}, stmt, nil
+}
+
+// MarkCorrected отмечает запись исправленной письмом emailID
+func (cb *CorrectionBatches) MarkCorrected(ctx context.Context, row CorrectionBatchRow, emailID int, tx *sqlx.Tx) error {
+	if cb.markCorrected == nil {
+		return errors.New("markCorrected func is not defined")
+	}
+	return cb.markCorrected(ctx, row, emailID, tx)
+}
+
+func (cb *CorrectionBatches) initMarkCorrected(ctx context.Context) (func(ctx context.Context, row CorrectionBatchRow, emailID int, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `
+		UPDATE correction_batch_rows
+		SET status = 'corrected', reply_email_id = :email_id, corrected_at = CURRENT_TIMESTAMP
+		WHERE batch_id = :batch_id AND person_id = :person_id;
+	`
+	stmt, err := cb.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, row CorrectionBatchRow, emailID int, tx *sqlx.Tx) error {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		_, err := currentStmt.ExecContext(ctx, map[string]interface{}{
+			"batch_id":  row.BatchID,
+			"person_id": row.PersonID,
+			"email_id":  emailID,
+		})
+		return err
+	}, stmt, nil
+}
+
+// CloseAnswered закрывает пакет, если в нём не осталось неисправленных записей
+func (cb *CorrectionBatches) CloseAnswered(ctx context.Context, batchID int, tx *sqlx.Tx) error {
+	if cb.closeAnswered == nil {
+		return errors.New("closeAnswered func is not defined")
+	}
+	return cb.closeAnswered(ctx, batchID, tx)
+}
+
+func (cb *CorrectionBatches) initCloseAnswered(ctx context.Context) (func(ctx context.Context, batchID int, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `
+		UPDATE correction_batches cb
+		SET status = 'closed', closed_at = CURRENT_TIMESTAMP
+		WHERE cb.id = :batch_id
+		  AND cb.status <> 'closed'
+		  AND NOT EXISTS(SELECT 1
+		                 FROM correction_batch_rows cbr
+		                 WHERE cbr.batch_id = cb.id
+		                   AND cbr.status IN ('pending', 'escalated'));
+	`
+	stmt, err := cb.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, batchID int, tx *sqlx.Tx) error {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		_, err := currentStmt.ExecContext(ctx, map[string]interface{}{"batch_id": batchID})
+		return err
+	}, stmt, nil
+}
+
+// Escalate отмечает просроченными записи пакетов, отправленных раньше before и всё ещё ждущих ответа,
+// и возвращает их. Каждая запись возвращается один раз. Срок считается от фактической отправки письма
+// (outbox.sent_at), пакеты, письмо которых ещё не ушло, не эскалируются.
+func (cb *CorrectionBatches) Escalate(ctx context.Context, before time.Time, tx *sqlx.Tx) ([]CorrectionOverdue, error) {
+	if cb.escalate == nil {
+		return nil, errors.New("escalate func is not defined")
+	}
+	return cb.escalate(ctx, before, tx)
+}
+
+func (cb *CorrectionBatches) initEscalate(ctx context.Context) (func(ctx context.Context, before time.Time, tx *sqlx.Tx) ([]CorrectionOverdue, error), *sqlx.NamedStmt, error) {
+	query := `
+		WITH e AS (UPDATE correction_batch_rows cbr
+		           SET status = 'escalated'
+		           FROM correction_batches cb
+		                    INNER JOIN outbox o ON o.id = cb.outbox_id
+		           WHERE cb.id = cbr.batch_id
+		             AND o.status = 'sent'
+		             AND o.sent_at < :before
+		             AND cbr.status = 'pending'
+		           RETURNING cbr.batch_id, cbr.person_id, o.sent_at),
+		     b AS (UPDATE correction_batches
+		           SET status = 'escalated', escalated_at = CURRENT_TIMESTAMP
+		           WHERE id IN (SELECT batch_id FROM e) AND status = 'open')
+		SELECT e.batch_id, e.sent_at, pfe."id", pfe."family", pfe."name", pfe."patronymic",
+		       pfe."birthdate", pfe."snils"
+		FROM e
+		         INNER JOIN persons_from_erc pfe ON pfe.id = e.person_id
+		ORDER BY e.batch_id, pfe."id";
+	`
+	stmt, err := cb.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, before time.Time, tx *sqlx.Tx) (rows []CorrectionOverdue, err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		err = currentStmt.SelectContext(ctx, &rows, map[string]interface{}{"before": before})
+		return
+	}, stmt, nil
+}
+
+// List возвращает пакеты коррекции, новые первыми
+func (cb *CorrectionBatches) List(ctx context.Context, limit, offset int64) ([]CorrectionBatchInfo, error) {
+	if cb.list == nil {
+		return nil, errors.New("list func is not defined")
+	}
+	return cb.list(ctx, limit, offset)
+}
+
+func (cb *CorrectionBatches) initList(ctx context.Context) (func(ctx context.Context, limit, offset int64) ([]CorrectionBatchInfo, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT cb.id, cb.outbox_id, cb.message_id, cb.status, cb.created_at, cb.escalated_at, cb.closed_at,
+		       COUNT(cbr.person_id)                                       AS rows,
+		       COUNT(cbr.person_id) FILTER (WHERE cbr.status = 'pending')   AS pending,
+		       COUNT(cbr.person_id) FILTER (WHERE cbr.status = 'escalated') AS escalated,
+		       COUNT(cbr.person_id) FILTER (WHERE cbr.status = 'corrected') AS corrected
+		FROM correction_batches cb
+		         LEFT JOIN correction_batch_rows cbr ON cbr.batch_id = cb.id
+		GROUP BY cb.id
+		ORDER BY cb.id DESC
+		LIMIT :limit OFFSET :offset;
+	`
+	stmt, err := cb.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, limit, offset int64) (batches []CorrectionBatchInfo, err error) {
+		if limit == 0 {
+			limit = 100
+		}
+		batches = make([]CorrectionBatchInfo, 0)
+		err = stmt.SelectContext(ctx, &batches, map[string]interface{}{
+			"limit":  limit,
+			"offset": offset,
+		})
+		return
+	}, stmt, nil
+}
+
+// RowsByEmail возвращает записи пакетов коррекции, загруженные из вложений письма emailID, в любом состоянии
+func (cb *CorrectionBatches) RowsByEmail(ctx context.Context, emailID int, tx *sqlx.Tx) ([]CorrectionBatchRow, error) {
+	if cb.rowsByEmail == nil {
+		return nil, errors.New("rowsByEmail func is not defined")
+	}
+	return cb.rowsByEmail(ctx, emailID, tx)
+}
+
+func (cb *CorrectionBatches) initRowsByEmail(ctx context.Context) (func(ctx context.Context, emailID int, tx *sqlx.Tx) ([]CorrectionBatchRow, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT cbr.batch_id, cbr.person_id, cbr.status, cbr.reply_email_id, cbr.corrected_at
+		FROM correction_batch_rows cbr
+		         JOIN persons_from_erc pfe ON pfe.id = cbr.person_id
+		         JOIN erc_updates eu ON eu.id = pfe.erc_update_id
+		WHERE eu.email_id = :email_id
+		ORDER BY cbr.person_id;
+	`
+	stmt, err := cb.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, emailID int, tx *sqlx.Tx) (rows []CorrectionBatchRow, err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		err = currentStmt.SelectContext(ctx, &rows, map[string]interface{}{"email_id": emailID})
+		return
+	}, stmt, nil
+}
+
+// RestoreRow сохраняет запись пакета как есть, с состоянием и ответом. Нужна, чтобы перенести историю
+// коррекции на новую запись persons_from_erc после переразбора письма.
+func (cb *CorrectionBatches) RestoreRow(ctx context.Context, row CorrectionBatchRow, tx *sqlx.Tx) error {
+	if cb.restoreRow == nil {
+		return errors.New("restoreRow func is not defined")
+	}
+	return cb.restoreRow(ctx, row, tx)
+}
+
+func (cb *CorrectionBatches) initRestoreRow(ctx context.Context) (func(ctx context.Context, row CorrectionBatchRow, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `
+		INSERT INTO correction_batch_rows (batch_id, person_id, status, reply_email_id, corrected_at)
+		VALUES (:batch_id, :person_id, :status, :reply_email_id, :corrected_at);
+	`
+	stmt, err := cb.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, row CorrectionBatchRow, tx *sqlx.Tx) error {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		_, err := currentStmt.ExecContext(ctx, row)
+		return err
+	}, stmt, nil
+}
+
+// Release отменяет пакет, отправленный письмом outboxID, если письмо отменено или не ушло: пакет получает
+// статус cancelled, а неисправленные записи удаляются из него, чтобы уйти следующим пакетом.
+// Возвращает количество возвращённых в очередь записей.
+func (cb *CorrectionBatches) Release(ctx context.Context, outboxID int, tx *sqlx.Tx) (int, error) {
+	if cb.release == nil {
+		return 0, errors.New("release func is not defined")
+	}
+	return cb.release(ctx, outboxID, tx)
+}
+
+func (cb *CorrectionBatches) initRelease(ctx context.Context) (func(ctx context.Context, outboxID int, tx *sqlx.Tx) (int, error), *sqlx.NamedStmt, error) {
+	query := `
+		WITH released AS (
+			UPDATE correction_batches
+			SET status = 'cancelled', closed_at = CURRENT_TIMESTAMP
+			WHERE outbox_id = :outbox_id AND status <> 'cancelled'
+			RETURNING id
+		)
+		DELETE FROM correction_batch_rows
+		WHERE batch_id IN (SELECT id FROM released)
+		  AND status IN ('pending', 'escalated');
+	`
+	stmt, err := cb.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, outboxID int, tx *sqlx.Tx) (int, error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		res, err := currentStmt.ExecContext(ctx, map[string]interface{}{"outbox_id": outboxID})
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		return int(n), err
+	}, stmt, nil
+}
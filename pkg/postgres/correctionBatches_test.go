@@ -0,0 +1,61 @@
+package postgres_test
+
+import (
+	"context"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"github.com/morzik45/stk-registry/pkg/postgres/pgtest"
+	"testing"
+	"time"
+)
+
+func TestEscalateCountsFromSentAt(t *testing.T) {
+	db := pgtest.New(t)
+	ctx := context.Background()
+	updateID := createErcUpdate(t, db)
+	if err := db.PersonsFromErc.CreateMany(ctx, ercPersons(updateID, 3), nil); err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	if err := db.DB.Select(&ids, "SELECT id FROM persons_from_erc WHERE erc_update_id = $1 ORDER BY id", updateID); err != nil {
+		t.Fatal(err)
+	}
+
+	weekAgo := time.Now().AddDate(0, 0, -7)
+	// batch создаёт пакет из одной записи. sentAt == nil - письмо ещё в очереди.
+	batch := func(personID int, sentAt *time.Time) int {
+		m := postgres.OutboxMessage{Kind: postgres.OutboxCorrection, Recipients: []string{"erc@example.com"}, Subject: "correction"}
+		if err := db.Outbox.Create(ctx, &m, nil); err != nil {
+			t.Fatal(err)
+		}
+		if sentAt != nil {
+			m.Status, m.Attempts, m.SentAt = postgres.OutboxSent, 1, sentAt
+			if err := db.Outbox.Update(ctx, &m, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b := postgres.CorrectionBatch{OutboxID: &m.ID}
+		if err := db.CorrectionBatches.Create(ctx, &b, []int{personID}, nil); err != nil {
+			t.Fatal(err)
+		}
+		// Все пакеты созданы давно, просрочку определяет только время отправки
+		if _, err := db.DB.Exec("UPDATE correction_batches SET created_at = $1 WHERE id = $2", weekAgo, b.ID); err != nil {
+			t.Fatal(err)
+		}
+		return b.ID
+	}
+	now := time.Now()
+	overdueID := batch(ids[0], &weekAgo)
+	batch(ids[1], &now) // отправлен только что
+	batch(ids[2], nil)  // так и не отправлен
+
+	overdue, err := db.CorrectionBatches.Escalate(ctx, time.Now().AddDate(0, 0, -3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overdue) != 1 || overdue[0].BatchID != overdueID || overdue[0].ID != ids[0] {
+		t.Fatalf("overdue: %+v", overdue)
+	}
+	if !overdue[0].SentAt.Equal(weekAgo.Truncate(time.Microsecond)) {
+		t.Errorf("sent_at %s, want %s", overdue[0].SentAt, weekAgo)
+	}
+}
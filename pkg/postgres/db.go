@@ -17,12 +17,22 @@ type DB struct {
 	needClose []Closable
 
 	Emails             *Emails
+	EmailTypes         *EmailTypes
+	EmailAttachments   *EmailAttachments
 	ErcUpdates         *ErcUpdates
 	PersonsFromErc     *PersonsFromERC
 	RstkUpdates        *RstkUpdates
+	RstkUpdateTypes    *RstkUpdateTypes
 	PersonsFromRSTK    *PersonsFromRSTK
 	CorrectPersonsData *CorrectPersonsData
 	Breakers           *Breakers
+	ImapStates         *ImapStates
+	MailboxSeen        *MailboxSeen
+	Quarantine         *Quarantine
+	IngestionRuns      *IngestionRuns
+	Outbox             *Outbox
+	MailTemplates      *MailTemplates
+	CorrectionBatches  *CorrectionBatches
 }
 
 func NewDB(ctx context.Context, cfg *config.Config, logger *zap.Logger) (db *DB, err error) {
@@ -41,6 +51,18 @@ func NewDB(ctx context.Context, cfg *config.Config, logger *zap.Logger) (db *DB,
 	}
 	db.needClose = append(db.needClose, db.Emails)
 
+	db.EmailTypes, err = NewEmailTypes(ctx, db.DB, logger)
+	if err != nil {
+		return
+	}
+	db.needClose = append(db.needClose, db.EmailTypes)
+
+	db.EmailAttachments, err = NewEmailAttachments(ctx, db.DB, logger)
+	if err != nil {
+		return
+	}
+	db.needClose = append(db.needClose, db.EmailAttachments)
+
 	db.ErcUpdates, err = NewErcUpdates(ctx, db.DB, logger)
 	if err != nil {
 		return
@@ -59,6 +81,12 @@ func NewDB(ctx context.Context, cfg *config.Config, logger *zap.Logger) (db *DB,
 	}
 	db.needClose = append(db.needClose, db.RstkUpdates)
 
+	db.RstkUpdateTypes, err = NewRstkUpdateTypes(ctx, db.DB, logger)
+	if err != nil {
+		return
+	}
+	db.needClose = append(db.needClose, db.RstkUpdateTypes)
+
 	db.PersonsFromRSTK, err = NewPersonsFromRSTK(ctx, db.DB, logger)
 	if err != nil {
 		return
@@ -77,6 +105,48 @@ func NewDB(ctx context.Context, cfg *config.Config, logger *zap.Logger) (db *DB,
 	}
 	db.needClose = append(db.needClose, db.Breakers)
 
+	db.ImapStates, err = NewImapStates(ctx, db.DB, logger)
+	if err != nil {
+		return
+	}
+	db.needClose = append(db.needClose, db.ImapStates)
+
+	db.MailboxSeen, err = NewMailboxSeen(ctx, db.DB, logger)
+	if err != nil {
+		return
+	}
+	db.needClose = append(db.needClose, db.MailboxSeen)
+
+	db.Quarantine, err = NewQuarantine(ctx, db.DB, logger)
+	if err != nil {
+		return
+	}
+	db.needClose = append(db.needClose, db.Quarantine)
+
+	db.IngestionRuns, err = NewIngestionRuns(ctx, db.DB, logger)
+	if err != nil {
+		return
+	}
+	db.needClose = append(db.needClose, db.IngestionRuns)
+
+	db.Outbox, err = NewOutbox(ctx, db.DB, logger)
+	if err != nil {
+		return
+	}
+	db.needClose = append(db.needClose, db.Outbox)
+
+	db.MailTemplates, err = NewMailTemplates(ctx, db.DB, logger)
+	if err != nil {
+		return
+	}
+	db.needClose = append(db.needClose, db.MailTemplates)
+
+	db.CorrectionBatches, err = NewCorrectionBatches(ctx, db.DB, logger)
+	if err != nil {
+		return
+	}
+	db.needClose = append(db.needClose, db.CorrectionBatches)
+
 	return
 }
 
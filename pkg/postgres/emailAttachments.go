@@ -0,0 +1,203 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Итог обработки вложения письма
+const (
+	AttachmentOk         = "ok"          // данные вложения сохранены
+	AttachmentParseError = "parse_error" // вложение не удалось разобрать
+	AttachmentDBError    = "db_error"    // не удалось сохранить данные вложения
+)
+
+// EmailAttachment итог обработки одного вложения письма
+type EmailAttachment struct {
+	ID          int       `db:"id" json:"id"`
+	EmailID     int       `db:"email_id" json:"email_id"`
+	Filename    string    `db:"filename" json:"filename"`
+	ContentType string    `db:"content_type" json:"content_type"`
+	Handler     string    `db:"handler" json:"handler"`
+	Status      string    `db:"status" json:"status"`
+	Rows        int       `db:"rows" json:"rows"`
+	Error       string    `db:"error" json:"error"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+// FailedEmailInfo письмо, часть вложений которого не удалось обработать
+type FailedEmailInfo struct {
+	EmailID          int               `json:"email_id"`
+	MessageID        string            `json:"message_id"`
+	DatetimeReceived time.Time         `json:"datetime_received"`
+	Failed           int               `json:"failed"`
+	Attachments      []EmailAttachment `json:"attachments"`
+}
+
+type EmailAttachments struct {
+	db     *sqlx.DB
+	stmts  []*sqlx.NamedStmt
+	logger *zap.Logger
+
+	create          func(ctx context.Context, attachment *EmailAttachment, tx *sqlx.Tx) error
+	deleteByEmail   func(ctx context.Context, emailID int, tx *sqlx.Tx) error
+	getFailedEmails func(ctx context.Context) ([]FailedEmailInfo, error)
+}
+
+func NewEmailAttachments(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*EmailAttachments, error) {
+	ea := EmailAttachments{
+		db:     db,
+		logger: logger,
+	}
+	ctxShort, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := ea.initEmailAttachments(ctxShort)
+	if err != nil {
+		logger.Error("failed to init emailAttachments", zap.Error(err))
+		return nil, err
+	}
+	return &ea, nil
+}
+
+func (ea *EmailAttachments) Close() error {
+	for _, stmt := range ea.stmts {
+		if stmt != nil {
+			err := stmt.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ea *EmailAttachments) initEmailAttachments(ctx context.Context) (err error) {
+	var stmt *sqlx.NamedStmt
+	ea.create, stmt, err = ea.initCreate(ctx)
+	if err != nil {
+		return
+	}
+	ea.stmts = append(ea.stmts, stmt)
+
+	ea.deleteByEmail, stmt, err = ea.initDeleteByEmail(ctx)
+	if err != nil {
+		return
+	}
+	ea.stmts = append(ea.stmts, stmt)
+
+	ea.getFailedEmails, stmt, err = ea.initGetFailedEmails(ctx)
+	if err != nil {
+		return
+	}
+	ea.stmts = append(ea.stmts, stmt)
+
+	return
+}
+
+func (ea *EmailAttachments) Create(ctx context.Context, attachment *EmailAttachment, tx *sqlx.Tx) error {
+	if ea.create == nil {
+		return errors.New("create func is not defined")
+	}
+	return ea.create(ctx, attachment, tx)
+}
+
+func (ea *EmailAttachments) initCreate(ctx context.Context) (func(ctx context.Context, attachment *EmailAttachment, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `
+		INSERT INTO email_attachments (email_id, filename, content_type, handler, status, "rows", error)
+		VALUES (:email_id, :filename, :content_type, :handler, :status, :rows, :error)
+		RETURNING id;
+	`
+	stmt, err := ea.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, attachment *EmailAttachment, tx *sqlx.Tx) (err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		err = currentStmt.GetContext(ctx, &attachment.ID, *attachment)
+		return
+	}, stmt, nil
+}
+
+// DeleteByEmail удаляет итоги обработки вложений письма, например перед повторным разбором
+func (ea *EmailAttachments) DeleteByEmail(ctx context.Context, emailID int, tx *sqlx.Tx) error {
+	if ea.deleteByEmail == nil {
+		return errors.New("deleteByEmail func is not defined")
+	}
+	return ea.deleteByEmail(ctx, emailID, tx)
+}
+
+func (ea *EmailAttachments) initDeleteByEmail(ctx context.Context) (func(ctx context.Context, emailID int, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `DELETE FROM email_attachments WHERE email_id = :email_id;`
+	stmt, err := ea.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, emailID int, tx *sqlx.Tx) (err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		_, err = currentStmt.ExecContext(ctx, map[string]interface{}{"email_id": emailID})
+		return
+	}, stmt, nil
+}
+
+// GetFailedEmails возвращает письма, в которых хотя бы одно вложение не удалось обработать, новые первыми
+func (ea *EmailAttachments) GetFailedEmails(ctx context.Context) ([]FailedEmailInfo, error) {
+	if ea.getFailedEmails == nil {
+		return nil, errors.New("getFailedEmails func is not defined")
+	}
+	return ea.getFailedEmails(ctx)
+}
+
+func (ea *EmailAttachments) initGetFailedEmails(ctx context.Context) (func(ctx context.Context) ([]FailedEmailInfo, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT ea.id, ea.email_id, ea.filename, ea.content_type, ea.handler, ea.status, ea."rows", ea.error, ea.created_at,
+		       e.message_id, e.datetime_received
+		FROM email_attachments ea
+		         JOIN emails e ON e.id = ea.email_id
+		WHERE ea.email_id IN (SELECT email_id FROM email_attachments WHERE status <> 'ok')
+		ORDER BY e.datetime_received DESC, ea.email_id, ea.id;
+	`
+	stmt, err := ea.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context) ([]FailedEmailInfo, error) {
+		var rows []struct {
+			EmailAttachment
+			MessageID        string    `db:"message_id"`
+			DatetimeReceived time.Time `db:"datetime_received"`
+		}
+		err := stmt.SelectContext(ctx, &rows, struct{}{})
+		if err != nil {
+			return nil, err
+		}
+		result := make([]FailedEmailInfo, 0)
+		for _, row := range rows {
+			if len(result) == 0 || result[len(result)-1].EmailID != row.EmailID {
+				result = append(result, FailedEmailInfo{
+					EmailID:          row.EmailID,
+					MessageID:        row.MessageID,
+					DatetimeReceived: row.DatetimeReceived,
+				})
+			}
+			info := &result[len(result)-1]
+			info.Attachments = append(info.Attachments, row.EmailAttachment)
+			if row.Status != AttachmentOk {
+				info.Failed++
+			}
+		}
+		return result, nil
+	}, stmt, nil
+}
@@ -0,0 +1,82 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"time"
+)
+
+type EmailTypes struct {
+	db     *sqlx.DB
+	stmts  []*sqlx.NamedStmt
+	logger *zap.Logger
+
+	ensure func(ctx context.Context, name string, tx *sqlx.Tx) (int, error)
+}
+
+func NewEmailTypes(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*EmailTypes, error) {
+	et := EmailTypes{
+		db:     db,
+		logger: logger,
+	}
+	ctxShort, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := et.initEmailTypes(ctxShort)
+	if err != nil {
+		logger.Error("failed to init emailTypes", zap.Error(err))
+		return nil, err
+	}
+	return &et, nil
+}
+
+func (et *EmailTypes) Close() error {
+	for _, stmt := range et.stmts {
+		if stmt != nil {
+			err := stmt.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (et *EmailTypes) initEmailTypes(ctx context.Context) (err error) {
+	var stmt *sqlx.NamedStmt
+	et.ensure, stmt, err = et.initEnsure(ctx)
+	if err != nil {
+		return
+	}
+	et.stmts = append(et.stmts, stmt)
+
+	return
+}
+
+// Ensure возвращает идентификатор типа письма по имени, новый тип добавляется в email_types
+func (et *EmailTypes) Ensure(ctx context.Context, name string, tx *sqlx.Tx) (int, error) {
+	if et.ensure == nil {
+		return 0, errors.New("ensure func is not defined")
+	}
+	return et.ensure(ctx, name, tx)
+}
+
+func (et *EmailTypes) initEnsure(ctx context.Context) (func(ctx context.Context, name string, tx *sqlx.Tx) (int, error), *sqlx.NamedStmt, error) {
+	stmt, err := et.db.PrepareNamedContext(ctx, `
+		INSERT INTO email_types ("name", "description")
+		VALUES (:name, :name)
+		ON CONFLICT ("name") DO UPDATE SET "name" = EXCLUDED."name"
+		RETURNING "id"`)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(ctx context.Context, name string, tx *sqlx.Tx) (id int, err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		err = currentStmt.GetContext(ctx, &id, map[string]interface{}{"name": name})
+		return
+	}, stmt, nil
+}
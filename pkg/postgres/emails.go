@@ -9,6 +9,12 @@ import (
 	"time"
 )
 
+// Типы писем из таблицы email_types
+const (
+	EmailTypeErc        = 1 // реестр выданных купонов от ЕРЦ
+	EmailTypeCorrection = 2 // исправление данных по купонам
+)
+
 type Email struct {
 	ID               int       `db:"id"`
 	TypeID           int       `db:"type_id"`
@@ -17,6 +23,17 @@ type Email struct {
 	DatetimeReceived time.Time `db:"datetime_received"`
 	DatetimeParsed   time.Time `db:"datetime_parsed"`
 	File             []byte    `db:"file"`
+	SignatureStatus  string    `db:"signature_status"` // результат проверки подписи S/MIME, см. пакет smime
+	SignatureSigner  string    `db:"signature_signer"`
+	SignatureError   string    `db:"signature_error"`
+}
+
+// EmailFilter отбор писем: по идентификатору, по периоду получения или все (пустой фильтр)
+type EmailFilter struct {
+	ID     int       `db:"id"`
+	TypeID int       `db:"type_id"`
+	From   time.Time `db:"-"`
+	To     time.Time `db:"-"`
 }
 
 type Emails struct {
@@ -26,6 +43,9 @@ type Emails struct {
 
 	create              func(ctx context.Context, email *Email, tx *sqlx.Tx) error
 	getLastReceivedTime func(ctx context.Context, tx *sqlx.Tx) (time.Time, error)
+	getIDByMessageID    func(ctx context.Context, messageID string, tx *sqlx.Tx) (int, error)
+	selectIDs           func(ctx context.Context, filter EmailFilter) ([]int, error)
+	get                 func(ctx context.Context, id int, tx *sqlx.Tx) (Email, error)
 }
 
 func NewEmails(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*Emails, error) {
@@ -69,6 +89,24 @@ func (es *Emails) initEmails(ctx context.Context) (err error) {
 	}
 	es.stmts = append(es.stmts, stmt)
 
+	es.getIDByMessageID, stmt, err = es.initGetIDByMessageID(ctx)
+	if err != nil {
+		return
+	}
+	es.stmts = append(es.stmts, stmt)
+
+	es.selectIDs, stmt, err = es.initSelectIDs(ctx)
+	if err != nil {
+		return
+	}
+	es.stmts = append(es.stmts, stmt)
+
+	es.get, stmt, err = es.initGet(ctx)
+	if err != nil {
+		return
+	}
+	es.stmts = append(es.stmts, stmt)
+
 	return
 }
 
@@ -81,8 +119,10 @@ func (es *Emails) Create(ctx context.Context, email *Email, tx *sqlx.Tx) error {
 
 func (es *Emails) initCreate(ctx context.Context) (func(ctx context.Context, email *Email, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
 	query := `
-		INSERT INTO emails (type_id, message_id, from_address, datetime_received, datetime_parsed, file)
-		VALUES (:type_id, :message_id, :from_address, :datetime_received, :datetime_parsed, :file)
+		INSERT INTO emails (type_id, message_id, from_address, datetime_received, datetime_parsed, file,
+		                    signature_status, signature_signer, signature_error)
+		VALUES (:type_id, :message_id, :from_address, :datetime_received, :datetime_parsed, :file,
+		        :signature_status, :signature_signer, :signature_error)
 		RETURNING id;
 	`
 	stmt, err := es.db.PrepareNamedContext(ctx, query)
@@ -131,3 +171,103 @@ func (es *Emails) initGetLastReceivedTime(ctx context.Context) (func(ctx context
 		return ddt.DatetimeReceived, err
 	}, stmt, nil
 }
+
+// GetIDByMessageID возвращает идентификатор уже сохранённого письма с таким Message-ID, если письма нет - sql.ErrNoRows
+func (es *Emails) GetIDByMessageID(ctx context.Context, messageID string, tx *sqlx.Tx) (int, error) {
+	if es.getIDByMessageID == nil {
+		return 0, errors.New("getIDByMessageID func is not defined")
+	}
+	return es.getIDByMessageID(ctx, messageID, tx)
+}
+
+func (es *Emails) initGetIDByMessageID(ctx context.Context) (func(ctx context.Context, messageID string, tx *sqlx.Tx) (int, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT id
+		FROM emails
+		WHERE message_id = :message_id;
+	`
+	stmt, err := es.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, messageID string, tx *sqlx.Tx) (id int, err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		err = currentStmt.GetContext(ctx, &id, map[string]interface{}{"message_id": messageID})
+		return
+	}, stmt, nil
+}
+
+// SelectIDs возвращает идентификаторы писем, подходящих под фильтр, в порядке получения
+func (es *Emails) SelectIDs(ctx context.Context, filter EmailFilter) ([]int, error) {
+	if es.selectIDs == nil {
+		return nil, errors.New("selectIDs func is not defined")
+	}
+	return es.selectIDs(ctx, filter)
+}
+
+func (es *Emails) initSelectIDs(ctx context.Context) (func(ctx context.Context, filter EmailFilter) ([]int, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT id
+		FROM emails
+		WHERE (id = :id OR :id = 0)
+		  AND (type_id = :type_id OR :type_id = 0)
+		  AND (datetime_received >= to_timestamp(:from) OR :from = 0)
+		  AND (datetime_received <= to_timestamp(:to) OR :to = 0)
+		ORDER BY datetime_received, id;
+	`
+	stmt, err := es.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, filter EmailFilter) (ids []int, err error) {
+		var from, to int64
+		if !filter.From.IsZero() {
+			from = filter.From.Unix()
+		}
+		if !filter.To.IsZero() {
+			to = filter.To.Unix()
+		}
+		err = stmt.SelectContext(ctx, &ids, map[string]interface{}{
+			"id":      filter.ID,
+			"type_id": filter.TypeID,
+			"from":    from,
+			"to":      to,
+		})
+		return
+	}, stmt, nil
+}
+
+// Get возвращает письмо вместе с исходным текстом
+func (es *Emails) Get(ctx context.Context, id int, tx *sqlx.Tx) (Email, error) {
+	if es.get == nil {
+		return Email{}, errors.New("get func is not defined")
+	}
+	return es.get(ctx, id, tx)
+}
+
+func (es *Emails) initGet(ctx context.Context) (func(ctx context.Context, id int, tx *sqlx.Tx) (Email, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT id, type_id, message_id, from_address, datetime_received, datetime_parsed, file,
+		       signature_status, signature_signer, signature_error
+		FROM emails
+		WHERE id = :id;
+	`
+	stmt, err := es.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, id int, tx *sqlx.Tx) (email Email, err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		err = currentStmt.GetContext(ctx, &email, map[string]interface{}{"id": id})
+		return
+	}, stmt, nil
+}
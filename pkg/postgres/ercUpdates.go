@@ -6,7 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/jmoiron/sqlx"
-	"github.com/lib/pq"
+	"github.com/morzik45/stk-registry/pkg/parser"
 	"go.uber.org/zap"
 	"time"
 )
@@ -36,16 +36,26 @@ func (eue *ArrayError) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Откуда пришёл реестр ЕРЦ
+const (
+	ErcSourceEmail      = "email"
+	ErcSourceDropFolder = "drop_folder"
+)
+
 type ErcUpdate struct {
 	ID      int    `db:"id"`
-	EmailID int    `db:"email_id"`
+	EmailID *int   `db:"email_id"` // nil, если реестр загружен не из письма
 	Name    string `db:"name"`
+	Source  string `db:"source"`
 }
 
 type ErcUpdateInfo struct {
 	ID               int64           `db:"id" json:"id"`
+	Name             string          `db:"name" json:"name"` // имя файла
 	DatetimeReceived time.Time       `db:"datetime_received" json:"datetime_received"`
 	DatetimeParsed   time.Time       `db:"datetime_parsed" json:"datetime_parsed"`
+	Source           string          `db:"source" json:"source"`
+	SignatureStatus  string          `db:"signature_status" json:"signature_status"`
 	Lines            int             `db:"lines" json:"lines"`
 	Incorrect        json.RawMessage `db:"incorrect" json:"incorrect"`
 }
@@ -61,11 +71,23 @@ type ErcUpdateStats struct {
 }
 
 type ErcUpdateError struct {
-	ID        int64          `db:"id" json:"id"`
-	Snils     string         `db:"snils" json:"snils"`
-	Birthdate string         `db:"birthdate" json:"birthdate"`
-	FullName  string         `db:"full_name" json:"full_name"`
-	Errors    pq.StringArray `db:"errors" json:"errors"`
+	ID        int64         `db:"id" json:"id"`
+	Snils     string        `db:"snils" json:"snils"`
+	Birthdate string        `db:"birthdate" json:"birthdate"`
+	FullName  string        `db:"full_name" json:"full_name"`
+	Errors    parser.Errors `db:"errors" json:"errors"`
+
+	File       string `db:"file" json:"file"`
+	LineNumber int    `db:"line_number" json:"line_number"`
+	SourceLine string `db:"source_line" json:"source_line"`
+}
+
+// ErrorCodeStat сколько раз встречается ошибка разбора с кодом Code в поле Field
+type ErrorCodeStat struct {
+	Source string `db:"source" json:"source"` // erc или rstk
+	Code   string `db:"code" json:"code"`
+	Field  string `db:"field" json:"field"`
+	Count  int    `db:"count" json:"count"`
 }
 
 type ErcUpdates struct {
@@ -73,10 +95,12 @@ type ErcUpdates struct {
 	stmts  []*sqlx.NamedStmt
 	logger *zap.Logger
 
-	create    func(ctx context.Context, update *ErcUpdate, tx *sqlx.Tx) error
-	getInfo   func(ctx context.Context) ([]ErcUpdateInfo, error)
-	getStats  func(ctx context.Context) (ErcUpdateStats, error)
-	getErrors func(ctx context.Context) ([]ErcUpdateError, error)
+	create        func(ctx context.Context, update *ErcUpdate, tx *sqlx.Tx) error
+	getInfo       func(ctx context.Context) ([]ErcUpdateInfo, error)
+	getStats      func(ctx context.Context) (ErcUpdateStats, error)
+	getErrors     func(ctx context.Context) ([]ErcUpdateError, error)
+	getErrorCodes func(ctx context.Context) ([]ErrorCodeStat, error)
+	deleteByEmail func(ctx context.Context, emailID int, tx *sqlx.Tx) error
 }
 
 func NewErcUpdates(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*ErcUpdates, error) {
@@ -132,6 +156,18 @@ func (eus *ErcUpdates) initErcUpdates(ctx context.Context) (err error) {
 	}
 	eus.stmts = append(eus.stmts, stmt)
 
+	eus.getErrorCodes, stmt, err = eus.initGetErrorCodes(ctx)
+	if err != nil {
+		return
+	}
+	eus.stmts = append(eus.stmts, stmt)
+
+	eus.deleteByEmail, stmt, err = eus.initDeleteByEmail(ctx)
+	if err != nil {
+		return
+	}
+	eus.stmts = append(eus.stmts, stmt)
+
 	return
 }
 
@@ -144,8 +180,8 @@ func (eus *ErcUpdates) Create(ctx context.Context, update *ErcUpdate, tx *sqlx.T
 
 func (eus *ErcUpdates) initCreate(ctx context.Context) (func(ctx context.Context, update *ErcUpdate, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
 	stmt, err := eus.db.PrepareNamedContext(ctx, `
-		INSERT INTO erc_updates ("email_id", "name")
-		VALUES (:email_id, :name)
+		INSERT INTO erc_updates ("email_id", "name", "source")
+		VALUES (:email_id, :name, :source)
 		RETURNING id`)
 	if err != nil {
 		return nil, nil, err
@@ -169,20 +205,26 @@ func (eus *ErcUpdates) GetInfo(ctx context.Context) ([]ErcUpdateInfo, error) {
 func (eus *ErcUpdates) initGetInfo(ctx context.Context) (func(ctx context.Context) ([]ErcUpdateInfo, error), *sqlx.NamedStmt, error) {
 	stmt, err := eus.db.PrepareNamedContext(ctx, `
 		SELECT eu.id,
-			   e.datetime_received,
-			   e.datetime_parsed,
+			   eu.name,
+			   COALESCE(e.datetime_received, eu.created_at) AS "datetime_received",
+			   COALESCE(e.datetime_parsed, eu.created_at) AS "datetime_parsed",
+			   eu.source,
+			   COALESCE(e.signature_status, 'not_checked') AS "signature_status",
 			   COALESCE((SELECT count(*) FROM persons_from_erc AS pfe WHERE pfe.erc_update_id = eu.id), 0) AS "lines",
 			   COALESCE((SELECT to_json(array_agg(row_to_json(d)))
 				FROM (SELECT "id",
 							 pfe."snils"                                                  as "snils",
 							 pfe."birthdate"                                               AS "birthdate",
 							 pfe."family" || ' ' || pfe."name" || ' ' || pfe."patronymic" AS "full_name",
-							 pfe.errors
+							 pfe.errors,
+							 pfe."line_number",
+							 pfe."source_line"
 					  FROM persons_from_erc pfe
-					  WHERE pfe."erc_update_id" = eu.id AND pfe.errors IS NOT NULL) d), '[]')    AS "incorrect"
+					  WHERE pfe."erc_update_id" = eu.id AND pfe.errors IS NOT NULL
+					  ORDER BY pfe."line_number") d), '[]')    AS "incorrect"
 		FROM erc_updates AS eu
 				 LEFT JOIN emails e on e.id = eu.email_id
-		ORDER BY e.datetime_received DESC ;`,
+		ORDER BY 2 DESC ;`,
 	)
 	if err != nil {
 		return nil, nil, err
@@ -228,13 +270,17 @@ func (eus *ErcUpdates) GetErrors(ctx context.Context) ([]ErcUpdateError, error)
 
 func (eus *ErcUpdates) initGetErrors(ctx context.Context) (func(ctx context.Context) ([]ErcUpdateError, error), *sqlx.NamedStmt, error) {
 	stmt, err := eus.db.PrepareNamedContext(ctx, `
-		SELECT "id",
-			   "snils",
-			   "birthdate",
-			   "family" || ' ' || "name" || ' ' || "patronymic" AS "full_name",
-			   "errors"
-		FROM "persons_from_erc"
-		WHERE "errors" IS NOT NULL;`,
+		SELECT pfe."id",
+			   pfe."snils",
+			   pfe."birthdate",
+			   pfe."family" || ' ' || pfe."name" || ' ' || pfe."patronymic" AS "full_name",
+			   pfe."errors",
+			   eu."name" AS "file",
+			   pfe."line_number",
+			   pfe."source_line"
+		FROM "persons_from_erc" pfe
+				 INNER JOIN "erc_updates" eu ON eu.id = pfe.erc_update_id
+		WHERE pfe."errors" IS NOT NULL;`,
 	)
 	if err != nil {
 		return nil, nil, err
@@ -244,3 +290,57 @@ func (eus *ErcUpdates) initGetErrors(ctx context.Context) (func(ctx context.Cont
 		return errors, err
 	}, stmt, nil
 }
+
+// GetErrorCodes считает ошибки разбора по кодам и полям в записях ЕРЦ и РСТК
+func (eus *ErcUpdates) GetErrorCodes(ctx context.Context) ([]ErrorCodeStat, error) {
+	if eus.getErrorCodes == nil {
+		return []ErrorCodeStat{}, errors.New("getErrorCodes func is not defined")
+	}
+	return eus.getErrorCodes(ctx)
+}
+
+func (eus *ErcUpdates) initGetErrorCodes(ctx context.Context) (func(ctx context.Context) ([]ErrorCodeStat, error), *sqlx.NamedStmt, error) {
+	stmt, err := eus.db.PrepareNamedContext(ctx, `
+		SELECT 'erc' AS "source", e ->> 'code' AS "code", e ->> 'field' AS "field", count(*) AS "count"
+		FROM "persons_from_erc", jsonb_array_elements("errors") AS e
+		WHERE "errors" IS NOT NULL
+		GROUP BY 1, 2, 3
+		UNION ALL
+		SELECT 'rstk', e ->> 'code', e ->> 'field', count(*)
+		FROM "persons_from_rstk", jsonb_array_elements("errors") AS e
+		WHERE "errors" IS NOT NULL
+		GROUP BY 1, 2, 3
+		ORDER BY 4 DESC;`,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(ctx context.Context) (stats []ErrorCodeStat, err error) {
+		stats = make([]ErrorCodeStat, 0)
+		err = stmt.SelectContext(ctx, &stats, map[string]interface{}{})
+		return stats, err
+	}, stmt, nil
+}
+
+// DeleteByEmail удаляет все обновления, загруженные из письма, вместе с ними каскадно удаляются записи persons_from_erc
+func (eus *ErcUpdates) DeleteByEmail(ctx context.Context, emailID int, tx *sqlx.Tx) error {
+	if eus.deleteByEmail == nil {
+		return errors.New("deleteByEmail func is not defined")
+	}
+	return eus.deleteByEmail(ctx, emailID, tx)
+}
+
+func (eus *ErcUpdates) initDeleteByEmail(ctx context.Context) (func(ctx context.Context, emailID int, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	stmt, err := eus.db.PrepareNamedContext(ctx, `DELETE FROM erc_updates WHERE email_id = :email_id`)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(ctx context.Context, emailID int, tx *sqlx.Tx) (err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		_, err = currentStmt.ExecContext(ctx, map[string]interface{}{"email_id": emailID})
+		return
+	}, stmt, nil
+}
@@ -0,0 +1,120 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"time"
+)
+
+// ImapState хранит позицию, до которой почтовый ящик IMAP уже обработан.
+type ImapState struct {
+	Mailbox     string    `db:"mailbox"`
+	UidValidity uint32    `db:"uid_validity"`
+	LastUid     uint32    `db:"last_uid"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+type ImapStates struct {
+	db     *sqlx.DB
+	stmts  []*sqlx.NamedStmt
+	logger *zap.Logger
+
+	get  func(ctx context.Context, mailbox string) (ImapState, error)
+	save func(ctx context.Context, state *ImapState) error
+}
+
+func NewImapStates(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*ImapStates, error) {
+	is := ImapStates{
+		db:     db,
+		logger: logger,
+	}
+	ctxShort, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := is.initImapStates(ctxShort)
+	if err != nil {
+		logger.Error("failed to init imapStates", zap.Error(err))
+		return nil, err
+	}
+	return &is, nil
+}
+
+func (is *ImapStates) Close() error {
+	for _, stmt := range is.stmts {
+		if stmt != nil {
+			err := stmt.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (is *ImapStates) initImapStates(ctx context.Context) (err error) {
+	var stmt *sqlx.NamedStmt
+	is.get, stmt, err = is.initGet(ctx)
+	if err != nil {
+		return
+	}
+	is.stmts = append(is.stmts, stmt)
+
+	is.save, stmt, err = is.initSave(ctx)
+	if err != nil {
+		return
+	}
+	is.stmts = append(is.stmts, stmt)
+
+	return
+}
+
+// Get возвращает сохранённое состояние ящика, для нового ящика возвращается пустое состояние без ошибки
+func (is *ImapStates) Get(ctx context.Context, mailbox string) (ImapState, error) {
+	if is.get == nil {
+		return ImapState{}, errors.New("get func is not defined")
+	}
+	return is.get(ctx, mailbox)
+}
+
+func (is *ImapStates) initGet(ctx context.Context) (func(ctx context.Context, mailbox string) (ImapState, error), *sqlx.NamedStmt, error) {
+	stmt, err := is.db.PrepareNamedContext(ctx, `
+		SELECT "mailbox", "uid_validity", "last_uid", "updated_at"
+		FROM imap_states
+		WHERE "mailbox" = :mailbox`)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(ctx context.Context, mailbox string) (state ImapState, err error) {
+		err = stmt.GetContext(ctx, &state, map[string]interface{}{"mailbox": mailbox})
+		if errors.Is(err, sql.ErrNoRows) {
+			return ImapState{Mailbox: mailbox}, nil
+		}
+		return
+	}, stmt, nil
+}
+
+// Save сохраняет UIDVALIDITY и последний обработанный UID ящика
+func (is *ImapStates) Save(ctx context.Context, state *ImapState) error {
+	if is.save == nil {
+		return errors.New("save func is not defined")
+	}
+	return is.save(ctx, state)
+}
+
+func (is *ImapStates) initSave(ctx context.Context) (func(ctx context.Context, state *ImapState) error, *sqlx.NamedStmt, error) {
+	stmt, err := is.db.PrepareNamedContext(ctx, `
+		INSERT INTO imap_states ("mailbox", "uid_validity", "last_uid")
+		VALUES (:mailbox, :uid_validity, :last_uid)
+		ON CONFLICT ("mailbox") DO UPDATE SET "uid_validity" = EXCLUDED."uid_validity",
+		                                      "last_uid"     = EXCLUDED."last_uid",
+		                                      "updated_at"   = CURRENT_TIMESTAMP
+		RETURNING "updated_at"`)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(ctx context.Context, state *ImapState) error {
+		return stmt.GetContext(ctx, &state.UpdatedAt, *state)
+	}, stmt, nil
+}
@@ -0,0 +1,207 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Что запустило проверку почтового ящика
+const (
+	TriggerScheduler = "scheduler" // периодическая проверка
+	TriggerIdle      = "idle"      // сервер сообщил о новом письме (IMAP IDLE)
+	TriggerAPI       = "api"       // запрос /api/updates/uploadERC
+)
+
+// IngestionRun одна проверка почтового ящика
+type IngestionRun struct {
+	ID           int        `db:"id" json:"id"`
+	Trigger      string     `db:"trigger" json:"trigger"`
+	Mailbox      string     `db:"mailbox" json:"mailbox"`
+	StartedAt    time.Time  `db:"started_at" json:"started_at"`
+	FinishedAt   *time.Time `db:"finished_at" json:"finished_at"`
+	Seen         int        `db:"seen" json:"seen"`         // новых писем на сервере
+	Skipped      int        `db:"skipped" json:"skipped"`   // повторы, старые, в карантине
+	Ingested     int        `db:"ingested" json:"ingested"` // сохранено писем
+	Failed       int        `db:"failed" json:"failed"`     // не удалось обработать, будут обработаны ещё раз
+	RowsInserted int        `db:"rows_inserted" json:"rows_inserted"`
+	Error        string     `db:"error" json:"error"`
+}
+
+type IngestionRuns struct {
+	db     *sqlx.DB
+	stmts  []*sqlx.NamedStmt
+	logger *zap.Logger
+
+	create func(ctx context.Context, run *IngestionRun) error
+	finish func(ctx context.Context, run *IngestionRun) error
+	list   func(ctx context.Context, limit, offset int64) ([]IngestionRun, error)
+	count  func(ctx context.Context) (int, error)
+}
+
+func NewIngestionRuns(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*IngestionRuns, error) {
+	ir := IngestionRuns{
+		db:     db,
+		logger: logger,
+	}
+	ctxShort, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := ir.initIngestionRuns(ctxShort)
+	if err != nil {
+		logger.Error("failed to init ingestionRuns", zap.Error(err))
+		return nil, err
+	}
+	return &ir, nil
+}
+
+func (ir *IngestionRuns) Close() error {
+	for _, stmt := range ir.stmts {
+		if stmt != nil {
+			err := stmt.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ir *IngestionRuns) initIngestionRuns(ctx context.Context) (err error) {
+	var stmt *sqlx.NamedStmt
+	ir.create, stmt, err = ir.initCreate(ctx)
+	if err != nil {
+		return
+	}
+	ir.stmts = append(ir.stmts, stmt)
+
+	ir.finish, stmt, err = ir.initFinish(ctx)
+	if err != nil {
+		return
+	}
+	ir.stmts = append(ir.stmts, stmt)
+
+	ir.list, stmt, err = ir.initList(ctx)
+	if err != nil {
+		return
+	}
+	ir.stmts = append(ir.stmts, stmt)
+
+	ir.count, stmt, err = ir.initCount(ctx)
+	if err != nil {
+		return
+	}
+	ir.stmts = append(ir.stmts, stmt)
+
+	return
+}
+
+// Create записывает начало проверки
+func (ir *IngestionRuns) Create(ctx context.Context, run *IngestionRun) error {
+	if ir.create == nil {
+		return errors.New("create func is not defined")
+	}
+	return ir.create(ctx, run)
+}
+
+func (ir *IngestionRuns) initCreate(ctx context.Context) (func(ctx context.Context, run *IngestionRun) error, *sqlx.NamedStmt, error) {
+	query := `
+		INSERT INTO ingestion_runs ("trigger", "mailbox")
+		VALUES (:trigger, :mailbox)
+		RETURNING id, started_at;
+	`
+	stmt, err := ir.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, run *IngestionRun) error {
+		return stmt.QueryRowxContext(ctx, *run).Scan(&run.ID, &run.StartedAt)
+	}, stmt, nil
+}
+
+// Finish записывает итоги проверки
+func (ir *IngestionRuns) Finish(ctx context.Context, run *IngestionRun) error {
+	if ir.finish == nil {
+		return errors.New("finish func is not defined")
+	}
+	return ir.finish(ctx, run)
+}
+
+func (ir *IngestionRuns) initFinish(ctx context.Context) (func(ctx context.Context, run *IngestionRun) error, *sqlx.NamedStmt, error) {
+	query := `
+		UPDATE ingestion_runs
+		SET finished_at   = CURRENT_TIMESTAMP,
+		    seen          = :seen,
+		    skipped       = :skipped,
+		    ingested      = :ingested,
+		    failed        = :failed,
+		    rows_inserted = :rows_inserted,
+		    error         = :error
+		WHERE id = :id
+		RETURNING finished_at;
+	`
+	stmt, err := ir.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, run *IngestionRun) error {
+		return stmt.GetContext(ctx, &run.FinishedAt, *run)
+	}, stmt, nil
+}
+
+// List возвращает проверки, начиная с последней, и общее их количество
+func (ir *IngestionRuns) List(ctx context.Context, limit, offset int64) ([]IngestionRun, int, error) {
+	if ir.list == nil || ir.count == nil {
+		return nil, 0, errors.New("list func is not defined")
+	}
+	// Общее количество считается отдельно: за последней страницей строк нет, а проверки есть
+	total, err := ir.count(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	runs, err := ir.list(ctx, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return runs, total, nil
+}
+
+func (ir *IngestionRuns) initList(ctx context.Context) (func(ctx context.Context, limit, offset int64) ([]IngestionRun, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT id, "trigger", mailbox, started_at, finished_at, seen, skipped, ingested, failed, rows_inserted, error
+		FROM ingestion_runs
+		ORDER BY started_at DESC, id DESC
+		LIMIT :limit OFFSET :offset;
+	`
+	stmt, err := ir.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, limit, offset int64) ([]IngestionRun, error) {
+		runs := make([]IngestionRun, 0)
+		err := stmt.SelectContext(ctx, &runs, map[string]interface{}{
+			"limit":  limit,
+			"offset": offset,
+		})
+		return runs, err
+	}, stmt, nil
+}
+
+func (ir *IngestionRuns) initCount(ctx context.Context) (func(ctx context.Context) (int, error), *sqlx.NamedStmt, error) {
+	query := `SELECT COUNT(*) FROM ingestion_runs;`
+	stmt, err := ir.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context) (int, error) {
+		var total int
+		err := stmt.GetContext(ctx, &total, map[string]interface{}{})
+		return total, err
+	}, stmt, nil
+}
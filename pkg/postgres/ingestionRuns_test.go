@@ -0,0 +1,36 @@
+package postgres_test
+
+import (
+	"context"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"github.com/morzik45/stk-registry/pkg/postgres/pgtest"
+	"testing"
+)
+
+func TestIngestionRunsTotalPastLastPage(t *testing.T) {
+	db := pgtest.New(t)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := db.IngestionRuns.Create(ctx, &postgres.IngestionRun{Trigger: postgres.TriggerAPI, Mailbox: "INBOX"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		limit, offset int64
+		rows          int
+	}{
+		{limit: 2, offset: 0, rows: 2},
+		{limit: 2, offset: 2, rows: 1},
+		{limit: 2, offset: 10, rows: 0},
+	}
+	for _, tt := range tests {
+		runs, total, err := db.IngestionRuns.List(ctx, tt.limit, tt.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) != tt.rows || total != 3 {
+			t.Errorf("List(%d, %d): %d runs, total %d", tt.limit, tt.offset, len(runs), total)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"time"
+)
+
+// MailTemplate шаблоны исходящего письма вида Kind (Outbox*), заданные оператором
+type MailTemplate struct {
+	Kind      string    `db:"kind" json:"kind"`
+	Subject   string    `db:"subject" json:"subject"`
+	TextBody  string    `db:"text_body" json:"text_body"`
+	HTMLBody  string    `db:"html_body" json:"html_body"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+type MailTemplates struct {
+	db     *sqlx.DB
+	stmts  []*sqlx.NamedStmt
+	logger *zap.Logger
+
+	get    func(ctx context.Context, kind string) (MailTemplate, error)
+	list   func(ctx context.Context) ([]MailTemplate, error)
+	save   func(ctx context.Context, template *MailTemplate) error
+	delete func(ctx context.Context, kind string) error
+}
+
+func NewMailTemplates(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*MailTemplates, error) {
+	mt := MailTemplates{
+		db:     db,
+		logger: logger,
+	}
+	ctxShort, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := mt.initMailTemplates(ctxShort)
+	if err != nil {
+		logger.Error("failed to init mailTemplates", zap.Error(err))
+		return nil, err
+	}
+	return &mt, nil
+}
+
+func (mt *MailTemplates) Close() error {
+	for _, stmt := range mt.stmts {
+		if stmt != nil {
+			err := stmt.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (mt *MailTemplates) initMailTemplates(ctx context.Context) (err error) {
+	var stmt *sqlx.NamedStmt
+	mt.get, stmt, err = mt.initGet(ctx)
+	if err != nil {
+		return
+	}
+	mt.stmts = append(mt.stmts, stmt)
+
+	mt.list, stmt, err = mt.initList(ctx)
+	if err != nil {
+		return
+	}
+	mt.stmts = append(mt.stmts, stmt)
+
+	mt.save, stmt, err = mt.initSave(ctx)
+	if err != nil {
+		return
+	}
+	mt.stmts = append(mt.stmts, stmt)
+
+	mt.delete, stmt, err = mt.initDelete(ctx)
+	if err != nil {
+		return
+	}
+	mt.stmts = append(mt.stmts, stmt)
+
+	return
+}
+
+// Get возвращает шаблоны письма вида kind, если их нет - sql.ErrNoRows
+func (mt *MailTemplates) Get(ctx context.Context, kind string) (MailTemplate, error) {
+	if mt.get == nil {
+		return MailTemplate{}, errors.New("get func is not defined")
+	}
+	return mt.get(ctx, kind)
+}
+
+func (mt *MailTemplates) initGet(ctx context.Context) (func(ctx context.Context, kind string) (MailTemplate, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT kind, subject, text_body, html_body, updated_at
+		FROM mail_templates
+		WHERE kind = :kind;
+	`
+	stmt, err := mt.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, kind string) (template MailTemplate, err error) {
+		err = stmt.GetContext(ctx, &template, map[string]interface{}{"kind": kind})
+		return
+	}, stmt, nil
+}
+
+// List возвращает все шаблоны, заданные оператором
+func (mt *MailTemplates) List(ctx context.Context) ([]MailTemplate, error) {
+	if mt.list == nil {
+		return nil, errors.New("list func is not defined")
+	}
+	return mt.list(ctx)
+}
+
+func (mt *MailTemplates) initList(ctx context.Context) (func(ctx context.Context) ([]MailTemplate, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT kind, subject, text_body, html_body, updated_at
+		FROM mail_templates
+		ORDER BY kind;
+	`
+	stmt, err := mt.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context) (templates []MailTemplate, err error) {
+		templates = make([]MailTemplate, 0)
+		err = stmt.SelectContext(ctx, &templates, map[string]interface{}{})
+		return
+	}, stmt, nil
+}
+
+// Save создаёт или заменяет шаблоны письма вида template.Kind
+func (mt *MailTemplates) Save(ctx context.Context, template *MailTemplate) error {
+	if mt.save == nil {
+		return errors.New("save func is not defined")
+	}
+	return mt.save(ctx, template)
+}
+
+func (mt *MailTemplates) initSave(ctx context.Context) (func(ctx context.Context, template *MailTemplate) error, *sqlx.NamedStmt, error) {
+	query := `
+		INSERT INTO mail_templates (kind, subject, text_body, html_body)
+		VALUES (:kind, :subject, :text_body, :html_body)
+		ON CONFLICT (kind) DO UPDATE SET subject    = excluded.subject,
+		                                 text_body  = excluded.text_body,
+		                                 html_body  = excluded.html_body,
+		                                 updated_at = CURRENT_TIMESTAMP
+		RETURNING updated_at;
+	`
+	stmt, err := mt.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, template *MailTemplate) error {
+		return stmt.GetContext(ctx, &template.UpdatedAt, *template)
+	}, stmt, nil
+}
+
+// Delete удаляет шаблоны письма вида kind, после этого используются шаблоны по умолчанию.
+// Если шаблонов не было, возвращается sql.ErrNoRows.
+func (mt *MailTemplates) Delete(ctx context.Context, kind string) error {
+	if mt.delete == nil {
+		return errors.New("delete func is not defined")
+	}
+	return mt.delete(ctx, kind)
+}
+
+func (mt *MailTemplates) initDelete(ctx context.Context) (func(ctx context.Context, kind string) error, *sqlx.NamedStmt, error) {
+	query := `
+		DELETE FROM mail_templates
+		WHERE kind = :kind;
+	`
+	stmt, err := mt.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, kind string) error {
+		return execOne(ctx, stmt, map[string]interface{}{"kind": kind})
+	}, stmt, nil
+}
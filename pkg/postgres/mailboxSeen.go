@@ -0,0 +1,178 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Итог обработки письма из почтового ящика
+const (
+	SeenIngested         = "ingested"          // письмо сохранено в emails
+	SeenDuplicate        = "duplicate"         // письмо с таким Message-ID уже было сохранено ранее
+	SeenUnexpectedSender = "unexpected_sender" // письмо не от ЕРЦ и не с коррекцией (до появления карантина)
+	SeenQuarantined      = "quarantined"       // письмо помещено в карантин
+	SeenTooOld           = "too_old"           // письмо пришло раньше INIT_DATE
+	SeenInvalid          = "invalid"           // письмо не удалось разобрать
+)
+
+// SeenMessage письмо в почтовом ящике, которое уже обработано и больше не будет загружаться.
+type SeenMessage struct {
+	ID        int       `db:"id"`
+	Mailbox   string    `db:"mailbox"`
+	UID       string    `db:"uid"`
+	MessageID string    `db:"message_id"`
+	EmailID   *int      `db:"email_id"`
+	Status    string    `db:"status"`
+	SeenAt    time.Time `db:"seen_at"`
+}
+
+type MailboxSeen struct {
+	db     *sqlx.DB
+	stmts  []*sqlx.NamedStmt
+	logger *zap.Logger
+
+	create    func(ctx context.Context, message *SeenMessage, tx *sqlx.Tx) error
+	getUIDs   func(ctx context.Context, mailbox string) (map[string]struct{}, error)
+	getStored func(ctx context.Context, mailbox string) (map[string]time.Time, error)
+}
+
+func NewMailboxSeen(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*MailboxSeen, error) {
+	ms := MailboxSeen{
+		db:     db,
+		logger: logger,
+	}
+	ctxShort, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := ms.initMailboxSeen(ctxShort)
+	if err != nil {
+		logger.Error("failed to init mailboxSeen", zap.Error(err))
+		return nil, err
+	}
+	return &ms, nil
+}
+
+func (ms *MailboxSeen) Close() error {
+	for _, stmt := range ms.stmts {
+		if stmt != nil {
+			err := stmt.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ms *MailboxSeen) initMailboxSeen(ctx context.Context) (err error) {
+	var stmt *sqlx.NamedStmt
+	ms.create, stmt, err = ms.initCreate(ctx)
+	if err != nil {
+		return
+	}
+	ms.stmts = append(ms.stmts, stmt)
+
+	ms.getUIDs, stmt, err = ms.initGetUIDs(ctx)
+	if err != nil {
+		return
+	}
+	ms.stmts = append(ms.stmts, stmt)
+
+	ms.getStored, stmt, err = ms.initGetStored(ctx)
+	if err != nil {
+		return
+	}
+	ms.stmts = append(ms.stmts, stmt)
+
+	return
+}
+
+// Create отмечает письмо как обработанное, повторная отметка того же UID ничего не меняет
+func (ms *MailboxSeen) Create(ctx context.Context, message *SeenMessage, tx *sqlx.Tx) error {
+	if ms.create == nil {
+		return errors.New("create func is not defined")
+	}
+	return ms.create(ctx, message, tx)
+}
+
+func (ms *MailboxSeen) initCreate(ctx context.Context) (func(ctx context.Context, message *SeenMessage, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	stmt, err := ms.db.PrepareNamedContext(ctx, `
+		INSERT INTO mailbox_seen ("mailbox", "uid", "message_id", "email_id", "status")
+		VALUES (:mailbox, :uid, :message_id, :email_id, :status)
+		ON CONFLICT ("mailbox", "uid") DO NOTHING`)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(ctx context.Context, message *SeenMessage, tx *sqlx.Tx) (err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		_, err = currentStmt.ExecContext(ctx, *message)
+		return
+	}, stmt, nil
+}
+
+// GetUIDs возвращает UID всех уже обработанных писем ящика
+func (ms *MailboxSeen) GetUIDs(ctx context.Context, mailbox string) (map[string]struct{}, error) {
+	if ms.getUIDs == nil {
+		return nil, errors.New("getUIDs func is not defined")
+	}
+	return ms.getUIDs(ctx, mailbox)
+}
+
+func (ms *MailboxSeen) initGetUIDs(ctx context.Context) (func(ctx context.Context, mailbox string) (map[string]struct{}, error), *sqlx.NamedStmt, error) {
+	stmt, err := ms.db.PrepareNamedContext(ctx, `SELECT "uid" FROM mailbox_seen WHERE "mailbox" = :mailbox`)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(ctx context.Context, mailbox string) (map[string]struct{}, error) {
+		var uids []string
+		err := stmt.SelectContext(ctx, &uids, map[string]interface{}{"mailbox": mailbox})
+		if err != nil {
+			return nil, err
+		}
+		result := make(map[string]struct{}, len(uids))
+		for _, uid := range uids {
+			result[uid] = struct{}{}
+		}
+		return result, nil
+	}, stmt, nil
+}
+
+// GetStored возвращает UID писем ящика, сохранённых в emails, и время их получения.
+// Только такие письма можно удалять с сервера: исходный текст уже есть в БД.
+func (ms *MailboxSeen) GetStored(ctx context.Context, mailbox string) (map[string]time.Time, error) {
+	if ms.getStored == nil {
+		return nil, errors.New("getStored func is not defined")
+	}
+	return ms.getStored(ctx, mailbox)
+}
+
+func (ms *MailboxSeen) initGetStored(ctx context.Context) (func(ctx context.Context, mailbox string) (map[string]time.Time, error), *sqlx.NamedStmt, error) {
+	stmt, err := ms.db.PrepareNamedContext(ctx, `
+		SELECT ms."uid", e."datetime_received"
+		FROM mailbox_seen ms
+		JOIN emails e ON e."id" = ms."email_id"
+		WHERE ms."mailbox" = :mailbox AND octet_length(e."file") > 0`)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(ctx context.Context, mailbox string) (map[string]time.Time, error) {
+		var rows []struct {
+			UID              string    `db:"uid"`
+			DatetimeReceived time.Time `db:"datetime_received"`
+		}
+		err := stmt.SelectContext(ctx, &rows, map[string]interface{}{"mailbox": mailbox})
+		if err != nil {
+			return nil, err
+		}
+		result := make(map[string]time.Time, len(rows))
+		for _, row := range rows {
+			result[row.UID] = row.DatetimeReceived
+		}
+		return result, nil
+	}, stmt, nil
+}
@@ -0,0 +1,57 @@
+package postgres_test
+
+import (
+	"github.com/morzik45/stk-registry/pkg/parser"
+	"github.com/morzik45/stk-registry/pkg/postgres/pgtest"
+	"reflect"
+	"testing"
+)
+
+func TestErrorsMigratedAsLegacy(t *testing.T) {
+	mg := pgtest.NewAt(t, 13)
+	db := mg.DB
+
+	var ercUpdateID, rstkUpdateID int
+	if err := db.Get(&ercUpdateID, "INSERT INTO erc_updates (name, source) VALUES ('register.txt', 'drop_folder') RETURNING id"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(&rstkUpdateID, "INSERT INTO rstk_updates (type_id) VALUES (1) RETURNING id"); err != nil {
+		t.Fatal(err)
+	}
+	// До 000014 ошибки хранились массивом строк
+	for i, errs := range []string{"{\"неверный СНИЛС\",\"пустое отчество\"}", "{}", ""} {
+		var arg interface{}
+		if errs != "" {
+			arg = errs
+		}
+		_, err := db.Exec(`
+			INSERT INTO persons_from_erc (id, erc_update_id, snils, birthdate, family, name, year, semester, color, count, spent, date, errors)
+			VALUES ($1, $2, '123', '1950-03-04', 'Иванов', 'Иван', 2022, 1, 'синий', 2, 1, '2022-01-02', $3)`, i+1, ercUpdateID, arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`
+			INSERT INTO persons_from_rstk (id, rstk_update_id, snils, family, name, date, number, errors)
+			VALUES ($1, $2, '123', 'Иванов', 'Иван', '2022-01-02', $1::text, $3)`, i+1, rstkUpdateID, arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mg.Migrate(t, 14)
+
+	want := []parser.Errors{
+		{{Code: "legacy", Value: "неверный СНИЛС", Column: -1}, {Code: "legacy", Value: "пустое отчество", Column: -1}},
+		nil,
+		nil,
+	}
+	for _, table := range []string{"persons_from_erc", "persons_from_rstk"} {
+		var got []parser.Errors
+		if err := db.Select(&got, "SELECT errors FROM "+table+" ORDER BY id"); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s errors: %+v", table, got)
+		}
+	}
+}
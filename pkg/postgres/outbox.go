@@ -0,0 +1,412 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Виды исходящих писем
+const (
+	OutboxErcReport  = "erc_report" // отчёт о выданных картах для ЕРЦ
+	OutboxCorrection = "correction" // записи с ошибками на коррекцию
+	OutboxEscalation = "escalation" // напоминание о записях, не исправленных в срок
+)
+
+// Состояние исходящего письма
+const (
+	OutboxPending   = "pending"   // ждёт отправки, в том числе повторной
+	OutboxSent      = "sent"      // отправлено
+	OutboxFailed    = "failed"    // попытки кончились
+	OutboxCancelled = "cancelled" // отменено оператором
+)
+
+// OutboxMessage исходящее письмо
+type OutboxMessage struct {
+	ID            int                `db:"id" json:"id"`
+	Kind          string             `db:"kind" json:"kind"`
+	MessageID     string             `db:"message_id" json:"message_id"` // без угловых скобок, пустой - выбирается при отправке
+	Recipients    pq.StringArray     `db:"recipients" json:"recipients"`
+	Subject       string             `db:"subject" json:"subject"`
+	Body          string             `db:"body" json:"body"`
+	HTMLBody      string             `db:"html_body" json:"html_body"`
+	Status        string             `db:"status" json:"status"`
+	Attempts      int                `db:"attempts" json:"attempts"`
+	NextAttemptAt time.Time          `db:"next_attempt_at" json:"next_attempt_at"`
+	LastError     string             `db:"last_error" json:"last_error"`
+	CreatedAt     time.Time          `db:"created_at" json:"created_at"`
+	SentAt        *time.Time         `db:"sent_at" json:"sent_at"`
+	Attachments   []OutboxAttachment `db:"-" json:"-"`
+}
+
+// OutboxMessageInfo исходящее письмо для списка, вместо вложений только их имена
+type OutboxMessageInfo struct {
+	OutboxMessage
+	AttachmentNames json.RawMessage `db:"attachment_names" json:"attachments"`
+}
+
+// OutboxAttachment вложение исходящего письма
+type OutboxAttachment struct {
+	ID          int    `db:"id"`
+	OutboxID    int    `db:"outbox_id"`
+	Filename    string `db:"filename"`
+	ContentType string `db:"content_type"`
+	Data        []byte `db:"data"`
+}
+
+type Outbox struct {
+	db     *sqlx.DB
+	stmts  []*sqlx.NamedStmt
+	logger *zap.Logger
+
+	create           func(ctx context.Context, message *OutboxMessage, tx *sqlx.Tx) error
+	createAttachment func(ctx context.Context, attachment *OutboxAttachment, tx *sqlx.Tx) error
+	selectDue        func(ctx context.Context, limit int) ([]OutboxMessage, error)
+	getAttachments   func(ctx context.Context, id int) ([]OutboxAttachment, error)
+	update           func(ctx context.Context, message *OutboxMessage, tx *sqlx.Tx) error
+	list             func(ctx context.Context, status string, limit, offset int64) ([]OutboxMessageInfo, error)
+	resend           func(ctx context.Context, id int) error
+	cancel           func(ctx context.Context, id int, tx *sqlx.Tx) error
+}
+
+func NewOutbox(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*Outbox, error) {
+	o := Outbox{
+		db:     db,
+		logger: logger,
+	}
+	ctxShort, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := o.initOutbox(ctxShort)
+	if err != nil {
+		logger.Error("failed to init outbox", zap.Error(err))
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (o *Outbox) Close() error {
+	for _, stmt := range o.stmts {
+		if stmt != nil {
+			err := stmt.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) initOutbox(ctx context.Context) (err error) {
+	var stmt *sqlx.NamedStmt
+	o.create, stmt, err = o.initCreate(ctx)
+	if err != nil {
+		return
+	}
+	o.stmts = append(o.stmts, stmt)
+
+	o.createAttachment, stmt, err = o.initCreateAttachment(ctx)
+	if err != nil {
+		return
+	}
+	o.stmts = append(o.stmts, stmt)
+
+	o.selectDue, stmt, err = o.initSelectDue(ctx)
+	if err != nil {
+		return
+	}
+	o.stmts = append(o.stmts, stmt)
+
+	o.getAttachments, stmt, err = o.initGetAttachments(ctx)
+	if err != nil {
+		return
+	}
+	o.stmts = append(o.stmts, stmt)
+
+	o.update, stmt, err = o.initUpdate(ctx)
+	if err != nil {
+		return
+	}
+	o.stmts = append(o.stmts, stmt)
+
+	o.list, stmt, err = o.initList(ctx)
+	if err != nil {
+		return
+	}
+	o.stmts = append(o.stmts, stmt)
+
+	o.resend, stmt, err = o.initResend(ctx)
+	if err != nil {
+		return
+	}
+	o.stmts = append(o.stmts, stmt)
+
+	o.cancel, stmt, err = o.initCancel(ctx)
+	if err != nil {
+		return
+	}
+	o.stmts = append(o.stmts, stmt)
+
+	return
+}
+
+// Create ставит письмо в очередь на отправку вместе с вложениями
+func (o *Outbox) Create(ctx context.Context, message *OutboxMessage, tx *sqlx.Tx) error {
+	if o.create == nil || o.createAttachment == nil {
+		return errors.New("create func is not defined")
+	}
+	err := o.create(ctx, message, tx)
+	if err != nil {
+		return err
+	}
+	for i := range message.Attachments {
+		message.Attachments[i].OutboxID = message.ID
+		err = o.createAttachment(ctx, &message.Attachments[i], tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) initCreate(ctx context.Context) (func(ctx context.Context, message *OutboxMessage, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `
+		INSERT INTO outbox (kind, message_id, recipients, subject, body, html_body)
+		VALUES (:kind, :message_id, :recipients, :subject, :body, :html_body)
+		RETURNING id, status, next_attempt_at, created_at;
+	`
+	stmt, err := o.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, message *OutboxMessage, tx *sqlx.Tx) error {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		return currentStmt.QueryRowxContext(ctx, *message).
+			Scan(&message.ID, &message.Status, &message.NextAttemptAt, &message.CreatedAt)
+	}, stmt, nil
+}
+
+func (o *Outbox) initCreateAttachment(ctx context.Context) (func(ctx context.Context, attachment *OutboxAttachment, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `
+		INSERT INTO outbox_attachments (outbox_id, filename, content_type, data)
+		VALUES (:outbox_id, :filename, :content_type, :data)
+		RETURNING id;
+	`
+	stmt, err := o.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, attachment *OutboxAttachment, tx *sqlx.Tx) error {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		return currentStmt.GetContext(ctx, &attachment.ID, *attachment)
+	}, stmt, nil
+}
+
+// SelectDue возвращает письма, которые пора отправить, без вложений
+func (o *Outbox) SelectDue(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	if o.selectDue == nil {
+		return nil, errors.New("selectDue func is not defined")
+	}
+	return o.selectDue(ctx, limit)
+}
+
+func (o *Outbox) initSelectDue(ctx context.Context) (func(ctx context.Context, limit int) ([]OutboxMessage, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT id, kind, message_id, recipients, subject, body, html_body, status, attempts, next_attempt_at, last_error, created_at, sent_at
+		FROM outbox
+		WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+		ORDER BY next_attempt_at, id
+		LIMIT :limit;
+	`
+	stmt, err := o.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, limit int) (messages []OutboxMessage, err error) {
+		err = stmt.SelectContext(ctx, &messages, map[string]interface{}{"limit": limit})
+		return
+	}, stmt, nil
+}
+
+// GetAttachments возвращает вложения письма
+func (o *Outbox) GetAttachments(ctx context.Context, id int) ([]OutboxAttachment, error) {
+	if o.getAttachments == nil {
+		return nil, errors.New("getAttachments func is not defined")
+	}
+	return o.getAttachments(ctx, id)
+}
+
+func (o *Outbox) initGetAttachments(ctx context.Context) (func(ctx context.Context, id int) ([]OutboxAttachment, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT id, outbox_id, filename, content_type, data
+		FROM outbox_attachments
+		WHERE outbox_id = :outbox_id
+		ORDER BY id;
+	`
+	stmt, err := o.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, id int) (attachments []OutboxAttachment, err error) {
+		err = stmt.SelectContext(ctx, &attachments, map[string]interface{}{"outbox_id": id})
+		return
+	}, stmt, nil
+}
+
+// Update сохраняет итог попытки отправки
+func (o *Outbox) Update(ctx context.Context, message *OutboxMessage, tx *sqlx.Tx) error {
+	if o.update == nil {
+		return errors.New("update func is not defined")
+	}
+	return o.update(ctx, message, tx)
+}
+
+func (o *Outbox) initUpdate(ctx context.Context) (func(ctx context.Context, message *OutboxMessage, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `
+		UPDATE outbox
+		SET status          = :status,
+		    attempts        = :attempts,
+		    next_attempt_at = :next_attempt_at,
+		    last_error      = :last_error,
+		    sent_at         = :sent_at
+		WHERE id = :id AND status = 'pending';
+	`
+	stmt, err := o.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, message *OutboxMessage, tx *sqlx.Tx) error {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		_, err := currentStmt.ExecContext(ctx, *message)
+		return err
+	}, stmt, nil
+}
+
+// List возвращает исходящие письма, новые первыми, пустой status - все письма
+func (o *Outbox) List(ctx context.Context, status string, limit, offset int64) ([]OutboxMessageInfo, error) {
+	if o.list == nil {
+		return nil, errors.New("list func is not defined")
+	}
+	return o.list(ctx, status, limit, offset)
+}
+
+func (o *Outbox) initList(ctx context.Context) (func(ctx context.Context, status string, limit, offset int64) ([]OutboxMessageInfo, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT o.id, o.kind, o.message_id, o.recipients, o.subject, o.body, o.html_body, o.status, o.attempts, o.next_attempt_at, o.last_error,
+		       o.created_at, o.sent_at,
+		       COALESCE((SELECT json_agg(oa.filename ORDER BY oa.id) FROM outbox_attachments oa WHERE oa.outbox_id = o.id),
+		                '[]') AS attachment_names
+		FROM outbox o
+		WHERE o.status = :status OR :status = ''
+		ORDER BY o.created_at DESC, o.id DESC
+		LIMIT :limit OFFSET :offset;
+	`
+	stmt, err := o.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, status string, limit, offset int64) (messages []OutboxMessageInfo, err error) {
+		if limit == 0 {
+			limit = 100
+		}
+		messages = make([]OutboxMessageInfo, 0)
+		err = stmt.SelectContext(ctx, &messages, map[string]interface{}{
+			"status": status,
+			"limit":  limit,
+			"offset": offset,
+		})
+		return
+	}, stmt, nil
+}
+
+// Resend ставит письмо в очередь заново с новым счётчиком попыток. Если письма нет
+// или оно ещё ждёт отправки, возвращается sql.ErrNoRows. Неотправленные письма на коррекцию заново
+// не отправляются: их записи уже вернулись в очередь и уйдут следующим пакетом.
+func (o *Outbox) Resend(ctx context.Context, id int) error {
+	if o.resend == nil {
+		return errors.New("resend func is not defined")
+	}
+	return o.resend(ctx, id)
+}
+
+func (o *Outbox) initResend(ctx context.Context) (func(ctx context.Context, id int) error, *sqlx.NamedStmt, error) {
+	query := `
+		UPDATE outbox
+		SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP, last_error = '', sent_at = NULL
+		WHERE id = :id
+		  AND status <> 'pending'
+		  AND NOT (kind = 'correction' AND status IN ('failed', 'cancelled'));
+	`
+	stmt, err := o.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, id int) error {
+		return execOne(ctx, stmt, map[string]interface{}{"id": id})
+	}, stmt, nil
+}
+
+// Cancel отменяет отправку письма. Если письма нет или оно уже не ждёт отправки, возвращается sql.ErrNoRows.
+func (o *Outbox) Cancel(ctx context.Context, id int, tx *sqlx.Tx) error {
+	if o.cancel == nil {
+		return errors.New("cancel func is not defined")
+	}
+	return o.cancel(ctx, id, tx)
+}
+
+func (o *Outbox) initCancel(ctx context.Context) (func(ctx context.Context, id int, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `
+		UPDATE outbox
+		SET status = 'cancelled'
+		WHERE id = :id AND status IN ('pending', 'failed');
+	`
+	stmt, err := o.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, id int, tx *sqlx.Tx) error {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		return execOne(ctx, currentStmt, map[string]interface{}{"id": id})
+	}, stmt, nil
+}
+
+// execOne выполняет запрос, который должен изменить ровно одну строку
+func execOne(ctx context.Context, stmt *sqlx.NamedStmt, arg interface{}) error {
+	res, err := stmt.ExecContext(ctx, arg)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -4,8 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/jmoiron/sqlx"
-	"github.com/lib/pq"
+	"github.com/morzik45/stk-registry/pkg/parser"
 	"go.uber.org/zap"
 	"time"
 )
@@ -27,7 +28,17 @@ type PersonFromERC struct {
 	CashierID   int       `db:"cashier_id"`
 	CashierName string    `db:"cashier_name"`
 
-	Errors pq.StringArray `db:"errors"`
+	// ФИО как в файле, до приведения к единому виду
+	FamilyRaw     string `db:"family_raw"`
+	NameRaw       string `db:"name_raw"`
+	PatronymicRaw string `db:"patronymic_raw"`
+
+	// Строка файла после перекодировки и её номер в файле, с 1
+	SourceLine string `db:"source_line"`
+	LineNumber int    `db:"line_number"`
+
+	Errors          parser.Errors   `db:"errors"`
+	SnilsCandidates SnilsCandidates `db:"snils_candidates"` // кандидаты для восстановления СНИЛС, см. pkg/matching
 }
 
 type PersonsFromErcForWeb struct {
@@ -46,6 +57,18 @@ type PersonFromErcForCorrection struct {
 	Snils      string    `db:"snils"`
 }
 
+// PersonWithSnilsCandidates строка с ошибкой в СНИЛС, для которой нашлись похожие люди
+type PersonWithSnilsCandidates struct {
+	ID              int             `db:"id" json:"id"`
+	ErcUpdateID     int             `db:"erc_update_id" json:"erc_update_id"`
+	Snils           string          `db:"snils" json:"snils"`
+	Birthdate       time.Time       `db:"birthdate" json:"birthdate"`
+	Family          string          `db:"family" json:"family"`
+	Name            string          `db:"name" json:"name"`
+	Patronymic      string          `db:"patronymic" json:"patronymic"`
+	SnilsCandidates SnilsCandidates `db:"snils_candidates" json:"snils_candidates"`
+}
+
 type PersonsFromERC struct {
 	db     *sqlx.DB
 	stmts  []*sqlx.NamedStmt
@@ -55,6 +78,9 @@ type PersonsFromERC struct {
 	get                  func(ctx context.Context, search string, limit, offset int64) ([]PersonsFromErcForWeb, error)
 	selectForCorrection  func(ctx context.Context) ([]PersonFromErcForCorrection, error)
 	updateFromCorrection func(ctx context.Context, person PersonFromErcForCorrection, tx *sqlx.Tx) error
+	getByEmail           func(ctx context.Context, emailID int, tx *sqlx.Tx) ([]PersonFromERC, error)
+	listSnilsCandidates  func(ctx context.Context, limit, offset int64) ([]PersonWithSnilsCandidates, error)
+	confirmSnils         func(ctx context.Context, id int, snils string, tx *sqlx.Tx) error
 }
 
 func NewPersonsFromERC(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*PersonsFromERC, error) {
@@ -110,6 +136,24 @@ func (pfp *PersonsFromERC) initPersonsFromErc(ctx context.Context) (err error) {
 	}
 	pfp.stmts = append(pfp.stmts, stmt)
 
+	pfp.getByEmail, stmt, err = pfp.initGetByEmail(ctx)
+	if err != nil {
+		return
+	}
+	pfp.stmts = append(pfp.stmts, stmt)
+
+	pfp.listSnilsCandidates, stmt, err = pfp.initListSnilsCandidates(ctx)
+	if err != nil {
+		return
+	}
+	pfp.stmts = append(pfp.stmts, stmt)
+
+	pfp.confirmSnils, stmt, err = pfp.initConfirmSnils(ctx)
+	if err != nil {
+		return
+	}
+	pfp.stmts = append(pfp.stmts, stmt)
+
 	return
 }
 
@@ -120,28 +164,24 @@ func (pfp *PersonsFromERC) CreateMany(ctx context.Context, persons []PersonFromE
 	return pfp.createMany(ctx, persons, tx)
 }
 
-func (pfp *PersonsFromERC) initCreateMany(ctx context.Context) (func(ctx context.Context, persons []PersonFromERC, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
-	query := `
-		INSERT INTO persons_from_erc ("erc_update_id", "snils", "birthdate", "family", "name", "patronymic", "year",
-		                                   "semester", "color", "count", "spent", "date", "cashier_id", "cashier_name",
-		                                   "errors")
-		VALUES (:erc_update_id, :snils, :birthdate, :family, :name, :patronymic, :year, :semester, :color, :count,
-		        :spent, :date, :cashier_id, :cashier_name, :errors)`
+// ercCopyColumns столбцы persons_from_erc, которые заполняет CreateMany, в порядке значений copyRow
+var ercCopyColumns = []string{"erc_update_id", "snils", "birthdate", "family", "name", "patronymic", "family_raw",
+	"name_raw", "patronymic_raw", "year", "semester", "color", "count", "spent", "date", "cashier_id", "cashier_name",
+	"errors", "snils_candidates", "source_line", "line_number"}
 
-	stmt, err := pfp.db.PrepareNamedContext(ctx, query)
-	if err != nil {
-		return nil, nil, err
-	}
+func (p *PersonFromERC) copyRow() []interface{} {
+	return []interface{}{p.ErcUpdateID, p.Snils, p.Birthdate, p.Family, p.Name, p.Patronymic, p.FamilyRaw,
+		p.NameRaw, p.PatronymicRaw, p.Year, p.Semester, p.Color, p.Count, p.Spent, p.Date, p.CashierID, p.CashierName,
+		p.Errors, p.SnilsCandidates, p.SourceLine, p.LineNumber}
+}
+
+// initCreateMany вставка через COPY, подготовленного запроса нет
+func (pfp *PersonsFromERC) initCreateMany(ctx context.Context) (func(ctx context.Context, persons []PersonFromERC, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
 	return func(ctx context.Context, persons []PersonFromERC, tx *sqlx.Tx) error {
-		// FIXME: С первой попытки не получилось используя NamedStmt вставлять слайс персон в один запрос. Доработать.
-		//currentStmt := stmt
-		//if tx != nil {
-		//	currentStmt = tx.NamedStmtContext(ctx, stmt)
-		//}
-		_, err = tx.NamedExecContext(ctx, query, persons)
-		//_, err = currentStmt.ExecContext(ctx, persons)
-		return err
-	}, stmt, nil
+		return copyIn(ctx, pfp.db, tx, "persons_from_erc", ercCopyColumns, len(persons), func(i int) []interface{} {
+			return persons[i].copyRow()
+		})
+	}, nil, nil
 }
 
 func (pfp *PersonsFromERC) Get(ctx context.Context, search string, limit, offset int64) ([]PersonsFromErcForWeb, error) {
@@ -155,9 +195,9 @@ func (pfp *PersonsFromERC) initGet(ctx context.Context) (func(ctx context.Contex
 	query := `
 		WITH a AS (SELECT DISTINCT "snils", "birthdate", "family", "name", "patronymic"
 				   FROM persons_from_erc
-				   WHERE LOWER("family") LIKE '%' || LOWER(:search) || '%'
-					  OR LOWER("name") LIKE '%' || LOWER(:search) || '%'
-					  OR LOWER("patronymic") LIKE '%' || LOWER(:search) || '%'
+				   WHERE REPLACE(LOWER("family"), 'ё', 'е') LIKE '%' || REPLACE(LOWER(:search), 'ё', 'е') || '%'
+					  OR REPLACE(LOWER("name"), 'ё', 'е') LIKE '%' || REPLACE(LOWER(:search), 'ё', 'е') || '%'
+					  OR REPLACE(LOWER("patronymic"), 'ё', 'е') LIKE '%' || REPLACE(LOWER(:search), 'ё', 'е') || '%'
 					  OR "snils" LIKE '%' || :search || '%'
 				   ORDER BY "family"
 				   LIMIT :limit OFFSET :offset)
@@ -165,9 +205,12 @@ func (pfp *PersonsFromERC) initGet(ctx context.Context) (func(ctx context.Contex
 			   a."birthdate"                                           AS "birthdate",
 			   a."family" || ' ' || a."name" || ' ' || a."patronymic" AS "full_name",
 			   (SELECT to_json(array_agg(row_to_json(d)))
-				FROM (SELECT "id", "count", "date", "color", '(' || "cashier_id" || ') ' || "cashier_name" AS "cashier"
-					  FROM persons_from_erc
-					  WHERE "snils" = a."snils") d)                   as "sale_coupons"
+				FROM (SELECT pfe."id", pfe."count", pfe."date", pfe."color",
+							 '(' || pfe."cashier_id" || ') ' || pfe."cashier_name" AS "cashier",
+							 eu."name" AS "file", pfe."line_number", pfe."source_line"
+					  FROM persons_from_erc pfe
+							   INNER JOIN erc_updates eu ON eu.id = pfe.erc_update_id
+					  WHERE pfe."snils" = a."snils") d)               as "sale_coupons"
 		FROM a;`
 
 	stmt, err := pfp.db.PrepareNamedContext(ctx, query)
@@ -202,8 +245,9 @@ func (pfp *PersonsFromERC) initSelectForCorrection(ctx context.Context) (func(ct
 			   "patronymic",
 			   "birthdate",
 			   "snils"
-		FROM persons_from_erc
+		FROM persons_from_erc pfe
 		WHERE "errors" IS NOT NULL
+		  AND NOT EXISTS(SELECT 1 FROM correction_batch_rows cbr WHERE cbr.person_id = pfe.id) -- ещё не отправляли
 		ORDER BY "id";
 	`
 	stmt, err := pfp.db.PrepareNamedContext(ctx, query)
@@ -239,10 +283,115 @@ func (pfp *PersonsFromERC) initUpdateFromCorrection(ctx context.Context) (func(c
 		return nil, nil, err
 	}
 	return func(ctx context.Context, person PersonFromErcForCorrection, tx *sqlx.Tx) error {
+		// Подготовленный запрос не подменяем: после конца транзакции он был бы уже недействителен
+		currentStmt := stmt
 		if tx != nil {
-			stmt = tx.NamedStmtContext(ctx, stmt)
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
 		}
-		_, err = stmt.ExecContext(ctx, person)
+		_, err := currentStmt.ExecContext(ctx, person)
 		return err
 	}, stmt, nil
 }
+
+// GetByEmail возвращает все записи, загруженные из вложений письма
+func (pfp *PersonsFromERC) GetByEmail(ctx context.Context, emailID int, tx *sqlx.Tx) ([]PersonFromERC, error) {
+	if pfp.getByEmail == nil {
+		return nil, errors.New("getByEmail func is not defined")
+	}
+	return pfp.getByEmail(ctx, emailID, tx)
+}
+
+func (pfp *PersonsFromERC) initGetByEmail(ctx context.Context) (func(ctx context.Context, emailID int, tx *sqlx.Tx) ([]PersonFromERC, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT pfe."id", pfe."erc_update_id", pfe."snils", pfe."birthdate", pfe."family", pfe."name", pfe."patronymic",
+		       pfe."family_raw", pfe."name_raw", pfe."patronymic_raw", pfe."year", pfe."semester", pfe."color",
+		       pfe."count", pfe."spent", pfe."date", pfe."cashier_id", pfe."cashier_name", pfe."errors",
+		       pfe."snils_candidates", pfe."source_line", pfe."line_number"
+		FROM persons_from_erc pfe
+				 INNER JOIN erc_updates eu ON eu.id = pfe.erc_update_id
+		WHERE eu.email_id = :email_id
+		ORDER BY pfe."id";
+	`
+	stmt, err := pfp.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(ctx context.Context, emailID int, tx *sqlx.Tx) (persons []PersonFromERC, err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		err = currentStmt.SelectContext(ctx, &persons, map[string]interface{}{"email_id": emailID})
+		return
+	}, stmt, nil
+}
+
+// ListSnilsCandidates возвращает строки, где СНИЛС не подставился сам и ждёт выбора оператора
+func (pfp *PersonsFromERC) ListSnilsCandidates(ctx context.Context, limit, offset int64) ([]PersonWithSnilsCandidates, error) {
+	if pfp.listSnilsCandidates == nil {
+		return nil, errors.New("listSnilsCandidates func is not defined")
+	}
+	return pfp.listSnilsCandidates(ctx, limit, offset)
+}
+
+func (pfp *PersonsFromERC) initListSnilsCandidates(ctx context.Context) (func(ctx context.Context, limit, offset int64) ([]PersonWithSnilsCandidates, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT "id", "erc_update_id", "snils", "birthdate", "family", "name", "patronymic", "snils_candidates"
+		FROM persons_from_erc
+		WHERE "snils_candidates" IS NOT NULL
+		  AND NOT "snils_candidates" @> jsonb_build_array(jsonb_build_object('applied', TRUE))
+		ORDER BY "id"
+		LIMIT :limit OFFSET :offset;
+	`
+	stmt, err := pfp.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+	return func(ctx context.Context, limit, offset int64) (persons []PersonWithSnilsCandidates, err error) {
+		if limit == 0 {
+			limit = 100
+		}
+		persons = make([]PersonWithSnilsCandidates, 0)
+		err = stmt.SelectContext(ctx, &persons, map[string]interface{}{
+			"limit":  limit,
+			"offset": offset,
+		})
+		return
+	}, stmt, nil
+}
+
+// ConfirmSnils подставляет в строку id СНИЛС одного из её кандидатов, выбранного оператором,
+// и убирает ошибки СНИЛС. Возвращает sql.ErrNoRows, если такого кандидата нет или выбор уже сделан.
+func (pfp *PersonsFromERC) ConfirmSnils(ctx context.Context, id int, snils string, tx *sqlx.Tx) error {
+	if pfp.confirmSnils == nil {
+		return errors.New("confirmSnils func is not defined")
+	}
+	return pfp.confirmSnils(ctx, id, snils, tx)
+}
+
+func (pfp *PersonsFromERC) initConfirmSnils(ctx context.Context) (func(ctx context.Context, id int, snils string, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `
+		UPDATE persons_from_erc
+		SET "snils"            = :snils,
+		    "errors"           = (SELECT jsonb_agg(e)
+		                          FROM jsonb_array_elements("errors") e
+		                          WHERE e ->> 'field' <> 'snils'),
+		    "snils_candidates" = (SELECT jsonb_agg(c || jsonb_build_object('applied', TRUE))
+		                          FROM jsonb_array_elements("snils_candidates") c
+		                          WHERE c ->> 'snils' = :snils)
+		WHERE "id" = :id
+		  AND "snils_candidates" @> jsonb_build_array(jsonb_build_object('snils', CAST(:snils AS TEXT)))
+		  AND NOT "snils_candidates" @> jsonb_build_array(jsonb_build_object('applied', TRUE));
+	`
+	stmt, err := pfp.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+	return func(ctx context.Context, id int, snils string, tx *sqlx.Tx) error {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		return execOne(ctx, currentStmt, map[string]interface{}{"id": id, "snils": snils})
+	}, stmt, nil
+}
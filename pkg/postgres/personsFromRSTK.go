@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 	"github.com/jmoiron/sqlx"
-	"github.com/lib/pq"
+	"github.com/morzik45/stk-registry/pkg/parser"
 	"go.uber.org/zap"
 	"time"
 )
@@ -19,7 +19,16 @@ type PersonFromRSTK struct {
 	Date         time.Time `db:"date"`
 	Number       string    `db:"number"`
 
-	Errors pq.StringArray `db:"errors"`
+	// ФИО как в файле, до приведения к единому виду
+	FamilyRaw     string `db:"family_raw"`
+	NameRaw       string `db:"name_raw"`
+	PatronymicRaw string `db:"patronymic_raw"`
+
+	// Строка файла после перекодировки и её номер в файле, с 1
+	SourceLine string `db:"source_line"`
+	LineNumber int    `db:"line_number"`
+
+	Errors parser.Errors `db:"errors"`
 }
 
 type PersonsFromRSTK struct {
@@ -75,25 +84,20 @@ func (pfr *PersonsFromRSTK) CreateMany(ctx context.Context, persons []PersonFrom
 	return pfr.createMany(ctx, persons, tx)
 }
 
-func (pfr *PersonsFromRSTK) initCreateMany(ctx context.Context) (func(ctx context.Context, persons []PersonFromRSTK, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
-	query := `
-		INSERT INTO persons_from_rstk ("rstk_update_id", "snils", "family", "name", "patronymic", "date", "number",
-		                               "errors")
-		VALUES (:rstk_update_id, :snils, :family, :name, :patronymic, :date, :number, :errors)
-	`
+// rstkCopyColumns столбцы persons_from_rstk, которые заполняет CreateMany, в порядке значений copyRow
+var rstkCopyColumns = []string{"rstk_update_id", "snils", "family", "name", "patronymic", "family_raw", "name_raw",
+	"patronymic_raw", "date", "number", "errors", "source_line", "line_number"}
 
-	stmt, err := pfr.db.PrepareNamedContext(ctx, query)
-	if err != nil {
-		return nil, nil, err
-	}
+func (p *PersonFromRSTK) copyRow() []interface{} {
+	return []interface{}{p.RstkUpdateID, p.Snils, p.Family, p.Name, p.Patronymic, p.FamilyRaw, p.NameRaw,
+		p.PatronymicRaw, p.Date, p.Number, p.Errors, p.SourceLine, p.LineNumber}
+}
+
+// initCreateMany вставка через COPY, подготовленного запроса нет
+func (pfr *PersonsFromRSTK) initCreateMany(ctx context.Context) (func(ctx context.Context, persons []PersonFromRSTK, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
 	return func(ctx context.Context, persons []PersonFromRSTK, tx *sqlx.Tx) error {
-		// FIXME: С первой попытки не получилось используя NamedStmt вставлять слайс персон в один запрос. Доработать.
-		//currentStmt := stmt
-		//if tx != nil {
-		//	currentStmt = tx.NamedStmtContext(ctx, stmt)
-		//}
-		_, err = tx.NamedExecContext(ctx, query, persons)
-		//_, err = currentStmt.ExecContext(ctx, persons)
-		return err
-	}, stmt, nil
+		return copyIn(ctx, pfr.db, tx, "persons_from_rstk", rstkCopyColumns, len(persons), func(i int) []interface{} {
+			return persons[i].copyRow()
+		})
+	}, nil, nil
 }
@@ -0,0 +1,160 @@
+// Package pgtest создаёт для тестов отдельную базу PostgreSQL с применёнными миграциями.
+//
+// Тесты с базой запускаются, только если задана переменная TEST_POSTGRES_DSN, например:
+//
+//	TEST_POSTGRES_DSN="host=localhost port=5432 user=postgres password=12345 sslmode=disable" go test ./...
+//
+// Иначе такие тесты пропускаются.
+package pgtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang-migrate/migrate/v4"
+	migratepg "github.com/golang-migrate/migrate/v4/database/postgres"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/jmoiron/sqlx"
+	"github.com/morzik45/stk-registry/pkg/config"
+	"github.com/morzik45/stk-registry/pkg/postgres"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chdirMutex миграции ищутся относительно рабочей папки, её меняют на время создания базы
+var chdirMutex sync.Mutex
+
+// New создаёт пустую базу с миграциями, база удаляется после теста
+func New(tb testing.TB) *postgres.DB {
+	tb.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cfg := createDatabase(ctx, tb)
+
+	chdirMutex.Lock()
+	defer chdirMutex.Unlock()
+	wd, err := os.Getwd()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = os.Chdir(root()); err != nil {
+		tb.Fatal(err)
+	}
+	db, err := postgres.NewDB(ctx, cfg, zap.NewNop())
+	if chdirErr := os.Chdir(wd); chdirErr != nil {
+		tb.Fatal(chdirErr)
+	}
+	if err != nil {
+		tb.Fatalf("open test database: %s", err)
+	}
+	tb.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// Migrator пустая база с миграциями до заданной версии, чтобы проверять сами миграции на старых данных
+type Migrator struct {
+	DB *sqlx.DB
+	m  *migrate.Migrate
+}
+
+// NewAt создаёт пустую базу с миграциями до версии version включительно, база удаляется после теста
+func NewAt(tb testing.TB, version uint) *Migrator {
+	tb.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cfg := createDatabase(ctx, tb)
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		cfg.Postgres.Host, cfg.Postgres.Port, cfg.Postgres.Username, cfg.Postgres.Password, cfg.Postgres.DBName, cfg.Postgres.SSLMode))
+	if err != nil {
+		tb.Fatalf("open test database: %s", err)
+	}
+	tb.Cleanup(func() { _ = db.Close() })
+	driver, err := migratepg.WithInstance(db.DB, &migratepg.Config{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	m, err := migrate.NewWithDatabaseInstance("file://"+filepath.ToSlash(filepath.Join(root(), "migrations")), "postgres", driver)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _, _ = m.Close() }) // отдаёт соединение до закрытия db
+	mg := &Migrator{DB: db, m: m}
+	mg.Migrate(tb, version)
+	return mg
+}
+
+// Migrate применяет или откатывает миграции до версии version
+func (mg *Migrator) Migrate(tb testing.TB, version uint) {
+	tb.Helper()
+	if err := mg.m.Migrate(version); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		tb.Fatalf("migrate to %d: %s", version, err)
+	}
+}
+
+// createDatabase создаёт пустую базу, удаляемую после теста, и возвращает параметры подключения к ней.
+// Если TEST_POSTGRES_DSN не задана, тест пропускается.
+func createDatabase(ctx context.Context, tb testing.TB) *config.Config {
+	tb.Helper()
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		tb.Skip("TEST_POSTGRES_DSN is not set")
+	}
+	admin, err := sqlx.ConnectContext(ctx, "postgres", dsn)
+	if err != nil {
+		tb.Fatalf("connect to test postgres: %s", err)
+	}
+	name := fmt.Sprintf("stk_test_%d_%d", os.Getpid(), time.Now().UnixNano())
+	if _, err = admin.ExecContext(ctx, "CREATE DATABASE "+name); err != nil {
+		_ = admin.Close()
+		tb.Fatalf("create test database: %s", err)
+	}
+	tb.Cleanup(func() {
+		if _, err := admin.Exec("DROP DATABASE IF EXISTS " + name); err != nil {
+			tb.Logf("drop test database %s: %s", name, err)
+		}
+		_ = admin.Close()
+	})
+
+	cfg := configFromDSN(dsn)
+	cfg.Postgres.DBName = name
+	return cfg
+}
+
+// configFromDSN переносит параметры подключения вида "key=value key=value" в конфиг
+func configFromDSN(dsn string) *config.Config {
+	cfg := &config.Config{}
+	cfg.Postgres.Host, cfg.Postgres.Port, cfg.Postgres.SSLMode = "localhost", 5432, "disable"
+	for _, kv := range strings.Fields(dsn) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "host":
+			cfg.Postgres.Host = parts[1]
+		case "port":
+			cfg.Postgres.Port, _ = strconv.Atoi(parts[1])
+		case "user":
+			cfg.Postgres.Username = parts[1]
+		case "password":
+			cfg.Postgres.Password = parts[1]
+		case "sslmode":
+			cfg.Postgres.SSLMode = parts[1]
+		}
+	}
+	return cfg
+}
+
+// root корень репозитория, в нём лежит папка migrations
+func root() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "..")
+}
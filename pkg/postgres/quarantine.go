@@ -0,0 +1,230 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Причина помещения письма в карантин
+const (
+	QuarantineUnexpectedSender       = "unexpected_sender"       // отправитель не ЕРЦ и не коррекция
+	QuarantineUnrecognizedAttachment = "unrecognized_attachment" // ни одно вложение не удалось разобрать
+	QuarantineUnsigned               = "unsigned"                // письмо без подписи S/MIME
+	QuarantineBadSignature           = "bad_signature"           // подпись S/MIME неверна
+)
+
+// Состояние письма в карантине
+const (
+	QuarantinePending   = "pending"   // ждёт решения оператора
+	QuarantineAssigned  = "assigned"  // оператор указал тип, письмо обработано
+	QuarantineDiscarded = "discarded" // оператор отклонил письмо
+)
+
+// QuarantinedEmail письмо, которое не удалось обработать автоматически
+type QuarantinedEmail struct {
+	ID               int        `db:"id" json:"id"`
+	MessageID        string     `db:"message_id" json:"message_id"`
+	FromAddress      string     `db:"from_address" json:"from_address"`
+	Subject          string     `db:"subject" json:"subject"`
+	Headers          string     `db:"headers" json:"headers"`
+	Reason           string     `db:"reason" json:"reason"`
+	Details          string     `db:"details" json:"details"`
+	DatetimeReceived time.Time  `db:"datetime_received" json:"datetime_received"`
+	File             []byte     `db:"file" json:"-"`
+	Status           string     `db:"status" json:"status"`
+	EmailID          *int       `db:"email_id" json:"email_id"`
+	CreatedAt        time.Time  `db:"created_at" json:"created_at"`
+	ResolvedAt       *time.Time `db:"resolved_at" json:"resolved_at"`
+}
+
+type Quarantine struct {
+	db     *sqlx.DB
+	stmts  []*sqlx.NamedStmt
+	logger *zap.Logger
+
+	create  func(ctx context.Context, q *QuarantinedEmail, tx *sqlx.Tx) error
+	list    func(ctx context.Context, status string) ([]QuarantinedEmail, error)
+	get     func(ctx context.Context, id int, tx *sqlx.Tx) (QuarantinedEmail, error)
+	resolve func(ctx context.Context, id int, status string, emailID *int, tx *sqlx.Tx) error
+}
+
+func NewQuarantine(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*Quarantine, error) {
+	q := Quarantine{
+		db:     db,
+		logger: logger,
+	}
+	ctxShort, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := q.initQuarantine(ctxShort)
+	if err != nil {
+		logger.Error("failed to init quarantine", zap.Error(err))
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (q *Quarantine) Close() error {
+	for _, stmt := range q.stmts {
+		if stmt != nil {
+			err := stmt.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (q *Quarantine) initQuarantine(ctx context.Context) (err error) {
+	var stmt *sqlx.NamedStmt
+	q.create, stmt, err = q.initCreate(ctx)
+	if err != nil {
+		return
+	}
+	q.stmts = append(q.stmts, stmt)
+
+	q.list, stmt, err = q.initList(ctx)
+	if err != nil {
+		return
+	}
+	q.stmts = append(q.stmts, stmt)
+
+	q.get, stmt, err = q.initGet(ctx)
+	if err != nil {
+		return
+	}
+	q.stmts = append(q.stmts, stmt)
+
+	q.resolve, stmt, err = q.initResolve(ctx)
+	if err != nil {
+		return
+	}
+	q.stmts = append(q.stmts, stmt)
+
+	return
+}
+
+// Create помещает письмо в карантин, письмо с тем же Message-ID повторно не добавляется
+func (q *Quarantine) Create(ctx context.Context, email *QuarantinedEmail, tx *sqlx.Tx) error {
+	if q.create == nil {
+		return errors.New("create func is not defined")
+	}
+	return q.create(ctx, email, tx)
+}
+
+func (q *Quarantine) initCreate(ctx context.Context) (func(ctx context.Context, email *QuarantinedEmail, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `
+		INSERT INTO quarantine (message_id, from_address, subject, headers, reason, details, datetime_received, file)
+		VALUES (:message_id, :from_address, :subject, :headers, :reason, :details, :datetime_received, :file)
+		ON CONFLICT (message_id) DO NOTHING;
+	`
+	stmt, err := q.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, email *QuarantinedEmail, tx *sqlx.Tx) (err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		_, err = currentStmt.ExecContext(ctx, *email)
+		return
+	}, stmt, nil
+}
+
+// List возвращает письма карантина без исходного текста, пустой status - все письма
+func (q *Quarantine) List(ctx context.Context, status string) ([]QuarantinedEmail, error) {
+	if q.list == nil {
+		return nil, errors.New("list func is not defined")
+	}
+	return q.list(ctx, status)
+}
+
+func (q *Quarantine) initList(ctx context.Context) (func(ctx context.Context, status string) ([]QuarantinedEmail, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT id, message_id, from_address, subject, headers, reason, details, datetime_received,
+		       status, email_id, created_at, resolved_at
+		FROM quarantine
+		WHERE status = :status OR :status = ''
+		ORDER BY datetime_received DESC;
+	`
+	stmt, err := q.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, status string) (emails []QuarantinedEmail, err error) {
+		emails = make([]QuarantinedEmail, 0)
+		err = stmt.SelectContext(ctx, &emails, map[string]interface{}{"status": status})
+		return
+	}, stmt, nil
+}
+
+// Get возвращает письмо карантина вместе с исходным текстом, в транзакции строка блокируется до её завершения
+func (q *Quarantine) Get(ctx context.Context, id int, tx *sqlx.Tx) (QuarantinedEmail, error) {
+	if q.get == nil {
+		return QuarantinedEmail{}, errors.New("get func is not defined")
+	}
+	return q.get(ctx, id, tx)
+}
+
+func (q *Quarantine) initGet(ctx context.Context) (func(ctx context.Context, id int, tx *sqlx.Tx) (QuarantinedEmail, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT id, message_id, from_address, subject, headers, reason, details, datetime_received, file,
+		       status, email_id, created_at, resolved_at
+		FROM quarantine
+		WHERE id = :id
+		FOR UPDATE;
+	`
+	stmt, err := q.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, id int, tx *sqlx.Tx) (email QuarantinedEmail, err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		err = currentStmt.GetContext(ctx, &email, map[string]interface{}{"id": id})
+		return
+	}, stmt, nil
+}
+
+// Resolve сохраняет решение оператора по письму
+func (q *Quarantine) Resolve(ctx context.Context, id int, status string, emailID *int, tx *sqlx.Tx) error {
+	if q.resolve == nil {
+		return errors.New("resolve func is not defined")
+	}
+	return q.resolve(ctx, id, status, emailID, tx)
+}
+
+func (q *Quarantine) initResolve(ctx context.Context) (func(ctx context.Context, id int, status string, emailID *int, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `
+		UPDATE quarantine
+		SET status = :status, email_id = :email_id, resolved_at = CURRENT_TIMESTAMP
+		WHERE id = :id;
+	`
+	stmt, err := q.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, id int, status string, emailID *int, tx *sqlx.Tx) (err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		_, err = currentStmt.ExecContext(ctx, map[string]interface{}{
+			"id":       id,
+			"status":   status,
+			"email_id": emailID,
+		})
+		return
+	}, stmt, nil
+}
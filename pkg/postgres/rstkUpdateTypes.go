@@ -0,0 +1,164 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"time"
+)
+
+// RstkUpdateType тип документа РСТК (программа карт). Тип определяется по первой строке файла,
+// которая должна подходить под регулярное выражение HeaderPattern.
+type RstkUpdateType struct {
+	ID            int    `db:"id" json:"id"`
+	Name          string `db:"name" json:"name"`
+	Description   string `db:"description" json:"description"`
+	HeaderPattern string `db:"header_pattern" json:"header_pattern"` // пустое - только при явном указании типа
+}
+
+type RstkUpdateTypes struct {
+	db     *sqlx.DB
+	stmts  []*sqlx.NamedStmt
+	logger *zap.Logger
+
+	list   func(ctx context.Context, tx *sqlx.Tx) ([]RstkUpdateType, error)
+	save   func(ctx context.Context, t *RstkUpdateType, tx *sqlx.Tx) error
+	delete func(ctx context.Context, name string) error
+}
+
+func NewRstkUpdateTypes(ctx context.Context, db *sqlx.DB, logger *zap.Logger) (*RstkUpdateTypes, error) {
+	rut := RstkUpdateTypes{
+		db:     db,
+		logger: logger,
+	}
+	ctxShort, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	err := rut.initRstkUpdateTypes(ctxShort)
+	if err != nil {
+		logger.Error("failed to init rstkUpdateTypes", zap.Error(err))
+		return nil, err
+	}
+	return &rut, nil
+}
+
+func (rut *RstkUpdateTypes) Close() error {
+	for _, stmt := range rut.stmts {
+		if stmt != nil {
+			err := stmt.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (rut *RstkUpdateTypes) initRstkUpdateTypes(ctx context.Context) (err error) {
+	var stmt *sqlx.NamedStmt
+	rut.list, stmt, err = rut.initList(ctx)
+	if err != nil {
+		return
+	}
+	rut.stmts = append(rut.stmts, stmt)
+
+	rut.save, stmt, err = rut.initSave(ctx)
+	if err != nil {
+		return
+	}
+	rut.stmts = append(rut.stmts, stmt)
+
+	rut.delete, stmt, err = rut.initDelete(ctx)
+	if err != nil {
+		return
+	}
+	rut.stmts = append(rut.stmts, stmt)
+
+	return
+}
+
+// List возвращает все типы документов РСТК в порядке проверки заголовков
+func (rut *RstkUpdateTypes) List(ctx context.Context, tx *sqlx.Tx) ([]RstkUpdateType, error) {
+	if rut.list == nil {
+		return nil, errors.New("list func is not defined")
+	}
+	return rut.list(ctx, tx)
+}
+
+func (rut *RstkUpdateTypes) initList(ctx context.Context) (func(ctx context.Context, tx *sqlx.Tx) ([]RstkUpdateType, error), *sqlx.NamedStmt, error) {
+	query := `
+		SELECT id, name, description, header_pattern
+		FROM rstk_update_types
+		ORDER BY id;
+	`
+	stmt, err := rut.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, tx *sqlx.Tx) (types []RstkUpdateType, err error) {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		types = make([]RstkUpdateType, 0)
+		err = currentStmt.SelectContext(ctx, &types, map[string]interface{}{})
+		return
+	}, stmt, nil
+}
+
+// Save добавляет тип документа или обновляет описание и заголовок типа с тем же именем, заполняет ID
+func (rut *RstkUpdateTypes) Save(ctx context.Context, t *RstkUpdateType, tx *sqlx.Tx) error {
+	if rut.save == nil {
+		return errors.New("save func is not defined")
+	}
+	return rut.save(ctx, t, tx)
+}
+
+func (rut *RstkUpdateTypes) initSave(ctx context.Context) (func(ctx context.Context, t *RstkUpdateType, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
+	query := `
+		INSERT INTO rstk_update_types (name, description, header_pattern)
+		VALUES (:name, :description, :header_pattern)
+		ON CONFLICT (name) DO UPDATE SET description    = excluded.description,
+		                                 header_pattern = excluded.header_pattern
+		RETURNING id;
+	`
+	stmt, err := rut.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, t *RstkUpdateType, tx *sqlx.Tx) error {
+		currentStmt := stmt
+		if tx != nil {
+			currentStmt = tx.NamedStmtContext(ctx, stmt)
+		}
+		return currentStmt.GetContext(ctx, &t.ID, *t)
+	}, stmt, nil
+}
+
+// Delete удаляет тип документа, по которому ещё ничего не загружено.
+// Если типа нет или по нему есть загрузки, возвращается sql.ErrNoRows.
+func (rut *RstkUpdateTypes) Delete(ctx context.Context, name string) error {
+	if rut.delete == nil {
+		return errors.New("delete func is not defined")
+	}
+	return rut.delete(ctx, name)
+}
+
+func (rut *RstkUpdateTypes) initDelete(ctx context.Context) (func(ctx context.Context, name string) error, *sqlx.NamedStmt, error) {
+	query := `
+		DELETE FROM rstk_update_types rut
+		WHERE rut.name = :name
+		  AND NOT EXISTS(SELECT 1 FROM rstk_updates ru WHERE ru.type_id = rut.id);
+	`
+	stmt, err := rut.db.PrepareNamedContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement %s: %s", query, err.Error())
+	}
+
+	return func(ctx context.Context, name string) error {
+		return execOne(ctx, stmt, map[string]interface{}{"name": name})
+	}, stmt, nil
+}
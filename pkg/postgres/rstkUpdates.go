@@ -14,13 +14,18 @@ type RstkUpdate struct {
 	UploadedAt time.Time `db:"uploaded_at"`
 	TypeID     int       `db:"type_id"`
 	FromDate   time.Time `db:"from_date"`
+	Encoding   string    `db:"encoding"`  // кодировка файла
+	Delimiter  string    `db:"delimiter"` // разделитель столбцов
 }
 
 type RstkUpdateInfo struct {
 	ID         int64           `db:"id" json:"id"`
 	TypeID     int             `db:"type_id" json:"type_id"`
+	TypeName   string          `db:"type_name" json:"type_name"`
 	UploadedAt time.Time       `db:"uploaded_at" json:"uploaded_at"`
 	FromDate   time.Time       `db:"from_date" json:"from_date"`
+	Encoding   string          `db:"encoding" json:"encoding"`
+	Delimiter  string          `db:"delimiter" json:"delimiter"`
 	Lines      int             `db:"lines" json:"lines"`
 	Errors     json.RawMessage `db:"errors" json:"errors"`
 }
@@ -115,8 +120,8 @@ func (ru *RstkUpdates) Create(ctx context.Context, update *RstkUpdate, tx *sqlx.
 
 func (ru *RstkUpdates) initCreate(ctx context.Context) (func(ctx context.Context, update *RstkUpdate, tx *sqlx.Tx) error, *sqlx.NamedStmt, error) {
 	stmt, err := ru.db.PrepareNamedContext(ctx, `
-		INSERT INTO rstk_updates ("type_id", "from_date")
-		VALUES (:type_id, :from_date)
+		INSERT INTO rstk_updates ("type_id", "from_date", "encoding", "delimiter")
+		VALUES (:type_id, :from_date, :encoding, :delimiter)
 		RETURNING id`)
 	if err != nil {
 		return nil, nil, err
@@ -140,16 +145,20 @@ func (ru *RstkUpdates) GetInfo(ctx context.Context) ([]RstkUpdateInfo, error) {
 
 func (ru *RstkUpdates) initGetInfo(ctx context.Context) (func(ctx context.Context) ([]RstkUpdateInfo, error), *sqlx.NamedStmt, error) {
 	stmt, err := ru.db.PrepareNamedContext(ctx, `
-		SELECT ru.id, ru."type_id", ru.uploaded_at, ru.from_date,
+		SELECT ru.id, ru."type_id", rut.description AS type_name, ru.uploaded_at, ru.from_date, ru.encoding, ru.delimiter,
 		       COALESCE((SELECT COUNT(*) FROM persons_from_rstk WHERE rstk_update_id = ru.id), 0) AS lines,
 		       	COALESCE((SELECT to_json(array_agg(row_to_json(d)))
 				FROM (SELECT "id",
 							 pfr."snils"                                                  as "snils",
 							 pfr."family" || ' ' || pfr."name" || ' ' || pfr."patronymic" AS "full_name",
-							 pfr."errors"
+							 pfr."errors",
+							 pfr."line_number",
+							 pfr."source_line"
 					  FROM persons_from_rstk pfr
-					  WHERE pfr."rstk_update_id" = ru."id" AND pfr."errors" IS NOT NULL) d), '[]')    AS "errors"
+					  WHERE pfr."rstk_update_id" = ru."id" AND pfr."errors" IS NOT NULL
+					  ORDER BY pfr."line_number") d), '[]')    AS "errors"
 		FROM rstk_updates AS ru
+				 INNER JOIN rstk_update_types rut ON rut.id = ru.type_id
 		ORDER BY ru.uploaded_at DESC;
 		`)
 	if err != nil {
@@ -0,0 +1,222 @@
+// Package unpack распаковывает архивы zip, gzip и tar (в том числе .tar.gz) из вложений писем.
+//
+// Архивы распаковываются в память, поэтому размер, количество файлов и вложенность ограничены Limits,
+// чтобы архив-бомба не положил сервис.
+package unpack
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+var (
+	ErrTooManyEntries = errors.New("в архиве слишком много файлов")
+	ErrTooLarge       = errors.New("архив после распаковки слишком большой")
+	ErrTooDeep        = errors.New("слишком глубокая вложенность архивов")
+)
+
+// Limits ограничения на распаковку одного вложения, считаются по всем уровням вложенности
+type Limits struct {
+	MaxEntries int   // файлов всего
+	MaxSize    int64 // байт после распаковки всего
+	MaxDepth   int   // уровней вложенности архивов, 1 - архив без вложенных архивов
+}
+
+// File файл из архива
+type File struct {
+	Name string
+	Data []byte
+}
+
+// IsArchive сообщает, нужно ли распаковывать вложение. Решение принимается по имени и типу файла,
+// а не по содержимому: xlsx тоже zip, но его разбирают как есть.
+func IsArchive(filename, contentType string) bool {
+	return kind(filename, contentType) != ""
+}
+
+func kind(filename, contentType string) string {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".zip":
+		return "zip"
+	case ".gz", ".gzip", ".tgz":
+		return "gzip"
+	case ".tar":
+		return "tar"
+	case "":
+		switch strings.ToLower(contentType) {
+		case "application/zip", "application/x-zip-compressed":
+			return "zip"
+		case "application/gzip", "application/x-gzip", "application/x-gtar", "application/x-compressed-tar":
+			return "gzip"
+		case "application/x-tar":
+			return "tar"
+		}
+	}
+	return ""
+}
+
+// Unpack распаковывает архив name, вложенные архивы распаковываются до MaxDepth.
+func Unpack(name, contentType string, r io.Reader, limits Limits) ([]File, error) {
+	u := unpacker{limits: limits}
+	// Сам архив в распакованный размер не входит, но больше лимита быть не может
+	data, err := io.ReadAll(io.LimitReader(r, limits.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limits.MaxSize {
+		return nil, ErrTooLarge
+	}
+	err = u.unpack(name, contentType, data, 1)
+	if err != nil {
+		return nil, err
+	}
+	return u.files, nil
+}
+
+type unpacker struct {
+	limits  Limits
+	files   []File
+	entries int
+	size    int64
+}
+
+func (u *unpacker) unpack(name, contentType string, data []byte, depth int) error {
+	if depth > u.limits.MaxDepth {
+		return ErrTooDeep
+	}
+	switch kind(name, contentType) {
+	case "zip":
+		return u.unpackZip(data, depth)
+	case "gzip":
+		return u.unpackGzip(name, data, depth)
+	case "tar":
+		return u.unpackTar(bytes.NewReader(data), depth)
+	default:
+		return fmt.Errorf("unknown archive: %s", name)
+	}
+}
+
+func (u *unpacker) unpackZip(data []byte, depth int) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		inner, err := u.read(rc)
+		_ = rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if err = u.add(f.Name, inner, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *unpacker) unpackGzip(name string, data []byte, depth int) error {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	// .tar.gz разбирается потоком, как один архив: файлы tar считаются по тем же лимитам, что и файлы zip
+	br := bufio.NewReaderSize(gr, tarMagicEnd)
+	if isTar(name, gr.Name, br) {
+		return u.unpackTar(br, depth)
+	}
+	// Склеенные gzip-потоки дают один файл, как у gunzip
+	inner, err := u.read(br)
+	if err != nil {
+		return err
+	}
+	innerName := gr.Name
+	if innerName == "" {
+		innerName = strings.TrimSuffix(strings.TrimSuffix(path.Base(name), path.Ext(name)), ".tar")
+	}
+	return u.add(innerName, inner, depth)
+}
+
+// tarMagicOffset, tarMagicEnd положение признака "ustar" в заголовке tar
+const (
+	tarMagicOffset = 257
+	tarMagicEnd    = tarMagicOffset + 5
+)
+
+// isTar сообщает, что внутри gzip архив tar: по имени архива (.tar.gz, .tgz), имени файла
+// в заголовке gzip или по признаку в начале распакованных данных
+func isTar(name, innerName string, br *bufio.Reader) bool {
+	name = strings.ToLower(name)
+	if strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz") ||
+		strings.HasSuffix(strings.ToLower(innerName), ".tar") {
+		return true
+	}
+	head, _ := br.Peek(tarMagicEnd)
+	return len(head) == tarMagicEnd && string(head[tarMagicOffset:]) == "ustar"
+}
+
+func (u *unpacker) unpackTar(r io.Reader, depth int) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Каталоги, ссылки и прочие служебные записи пропускаем
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		inner, err := u.read(tr)
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if err = u.add(hdr.Name, inner, depth); err != nil {
+			return err
+		}
+	}
+}
+
+// add добавляет распакованный файл, вложенный архив распаковывается дальше
+func (u *unpacker) add(name string, data []byte, depth int) error {
+	if IsArchive(name, "") {
+		return u.unpack(name, "", data, depth+1)
+	}
+	u.entries++
+	if u.entries > u.limits.MaxEntries {
+		return ErrTooManyEntries
+	}
+	u.files = append(u.files, File{Name: name, Data: data})
+	return nil
+}
+
+// read читает данные, не выходя за оставшийся лимит размера
+func (u *unpacker) read(r io.Reader) ([]byte, error) {
+	remaining := u.limits.MaxSize - u.size
+	data, err := io.ReadAll(io.LimitReader(r, remaining+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > remaining {
+		return nil, ErrTooLarge
+	}
+	u.size += int64(len(data))
+	return data, nil
+}
@@ -0,0 +1,134 @@
+package unpack
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var testLimits = Limits{MaxEntries: 10, MaxSize: 1 << 20, MaxDepth: 2}
+
+func tarData(t *testing.T, files []File) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.Name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(f.Data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Name = name
+	if _, err := gw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipData(t *testing.T, files []File) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(f.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUnpackTarGz(t *testing.T) {
+	files := []File{{Name: "dir/a.txt", Data: []byte("a")}, {Name: "b.xlsx", Data: []byte("b")}}
+	data := gzipData(t, "", tarData(t, files))
+
+	for _, name := range []string{"registers.tar.gz", "registers.tgz", "registers.gz"} {
+		if !IsArchive(name, "") {
+			t.Fatalf("IsArchive(%s) = false", name)
+		}
+		// registers.gz распознаётся по содержимому
+		got, err := Unpack(name, "", bytes.NewReader(data), testLimits)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, files) {
+			t.Errorf("%s: got %+v, want %+v", name, got, files)
+		}
+	}
+}
+
+func TestUnpackTarNested(t *testing.T) {
+	inner := []File{{Name: "a.txt", Data: []byte("a")}}
+	data := gzipData(t, "", tarData(t, []File{{Name: "inner.zip", Data: zipData(t, inner)}}))
+	got, err := Unpack("outer.tar.gz", "", bytes.NewReader(data), testLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, inner) {
+		t.Errorf("got %+v, want %+v", got, inner)
+	}
+
+	// tar.gz - один уровень, вложенный zip - второй, третьего уже нельзя
+	limits := testLimits
+	limits.MaxDepth = 1
+	if _, err = Unpack("outer.tar.gz", "", bytes.NewReader(data), limits); !errors.Is(err, ErrTooDeep) {
+		t.Errorf("depth limit: got %v, want %v", err, ErrTooDeep)
+	}
+}
+
+func TestUnpackTarLimits(t *testing.T) {
+	files := []File{{Name: "a.txt", Data: make([]byte, 600)}, {Name: "b.txt", Data: make([]byte, 600)}}
+	data := gzipData(t, "", tarData(t, files))
+
+	limits := testLimits
+	limits.MaxEntries = 1
+	if _, err := Unpack("x.tar.gz", "", bytes.NewReader(data), limits); !errors.Is(err, ErrTooManyEntries) {
+		t.Errorf("entries limit: got %v, want %v", err, ErrTooManyEntries)
+	}
+
+	limits = testLimits
+	limits.MaxSize = 1000
+	if _, err := Unpack("x.tar.gz", "", bytes.NewReader(data), limits); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("size limit: got %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestUnpackGzipSingleFile(t *testing.T) {
+	data := gzipData(t, "register.txt", []byte("line"))
+	got, err := Unpack("register.txt.gz", "", bytes.NewReader(data), testLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []File{{Name: "register.txt", Data: []byte("line")}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
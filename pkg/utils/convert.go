@@ -2,8 +2,10 @@ package utils
 
 import (
 	"bytes"
+	"fmt"
 	"golang.org/x/text/encoding/charmap"
 	"io/ioutil"
+	"unicode/utf8"
 )
 
 func StringFromWindows1251(data string) (string, error) {
@@ -13,3 +15,59 @@ func StringFromWindows1251(data string) (string, error) {
 	}
 	return string(b), nil
 }
+
+// StringFromEncoding перекодирует строку в UTF-8 из кодировки encoding, см. BytesFromEncoding
+func StringFromEncoding(encoding, data string) (string, error) {
+	b, err := BytesFromEncoding(encoding, []byte(data))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Кодировки, которые умеет определять DetectEncoding
+const (
+	EncodingUTF8    = "utf-8"
+	EncodingUTF8BOM = "utf-8-bom"
+	EncodingCP1251  = "windows-1251"
+	EncodingCP866   = "cp866"
+)
+
+// DetectEncoding определяет кодировку текста: UTF-8 с BOM или без, иначе Windows-1251 или CP866.
+// Однобайтовые кодировки различаются по частоте байтов, которые в одной из них - русские буквы,
+// а в другой почти не встречаются.
+func DetectEncoding(data []byte) string {
+	if bytes.HasPrefix(data, []byte("\xef\xbb\xbf")) {
+		return EncodingUTF8BOM
+	}
+	if utf8.Valid(data) {
+		return EncodingUTF8
+	}
+	cp1251, cp866 := 0, 0
+	for _, b := range data {
+		switch {
+		case b >= 0x80 && b <= 0xaf: // CP866: А-Я, а-п
+			cp866++
+		case b >= 0xc0 && b <= 0xdf, b >= 0xf0: // Windows-1251: А-Я, р-я
+			cp1251++
+		}
+	}
+	if cp866 > cp1251 {
+		return EncodingCP866
+	}
+	return EncodingCP1251
+}
+
+// BytesFromEncoding перекодирует текст в UTF-8 из кодировки encoding, BOM убирается
+func BytesFromEncoding(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingUTF8, EncodingUTF8BOM:
+		return bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), nil
+	case EncodingCP1251:
+		return ioutil.ReadAll(charmap.Windows1251.NewDecoder().Reader(bytes.NewReader(data)))
+	case EncodingCP866:
+		return ioutil.ReadAll(charmap.CodePage866.NewDecoder().Reader(bytes.NewReader(data)))
+	default:
+		return nil, fmt.Errorf("unknown encoding %s", encoding)
+	}
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"golang.org/x/text/encoding/charmap"
+	"testing"
+)
+
+func TestDetectEncoding(t *testing.T) {
+	const (
+		fio   = "Иванов Иван Иванович;112-233-445 95;02.01.2022;Ёлкина Юлия Эдуардовна"
+		lower = "съешь же ещё этих мягких французских булок"
+	)
+	tests := []struct {
+		name    string
+		text    string
+		charmap *charmap.Charmap // nil - текст в UTF-8
+		bom     bool
+		want    string
+	}{
+		{name: "ascii", text: "Ivanov;11223344595", want: EncodingUTF8},
+		{name: "utf-8", text: fio, want: EncodingUTF8},
+		{name: "utf-8 with bom", text: fio, bom: true, want: EncodingUTF8BOM},
+		{name: "windows-1251", text: fio, charmap: charmap.Windows1251, want: EncodingCP1251},
+		{name: "windows-1251 lowercase", text: lower, charmap: charmap.Windows1251, want: EncodingCP1251},
+		{name: "cp866", text: fio, charmap: charmap.CodePage866, want: EncodingCP866},
+		{name: "cp866 lowercase", text: lower, charmap: charmap.CodePage866, want: EncodingCP866},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte(tt.text)
+			if tt.charmap != nil {
+				var err error
+				if data, err = tt.charmap.NewEncoder().Bytes(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.bom {
+				data = append([]byte("\xef\xbb\xbf"), data...)
+			}
+
+			got := DetectEncoding(data)
+			if got != tt.want {
+				t.Fatalf("DetectEncoding() = %s, want %s", got, tt.want)
+			}
+			decoded, err := BytesFromEncoding(got, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(decoded) != tt.text {
+				t.Errorf("decoded %q, want %q", decoded, tt.text)
+			}
+		})
+	}
+}
+
+func TestBytesFromEncodingUnknown(t *testing.T) {
+	if _, err := BytesFromEncoding("koi8-r", []byte("text")); err == nil {
+		t.Error("unknown encoding accepted")
+	}
+}
@@ -3,11 +3,13 @@ package utils
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"github.com/morzik45/stk-registry/pkg/parser"
 	"github.com/morzik45/stk-registry/pkg/postgres"
 	"github.com/xuri/excelize/v2"
 	"go.uber.org/zap"
 	"io"
+	"math"
 	"strconv"
 	"time"
 )
@@ -147,17 +149,17 @@ func ParseExcelForCorrection(buf io.Reader, logger *zap.Logger) (r []postgres.Pe
 			logger.Error("Неверный формат поля ID", zap.Error(err), zap.String("row", row[0]))
 			continue
 		}
-		p.Family, err = parser.String(row[1])
+		p.Family, err = parser.Name(row[1])
 		if err != nil {
 			logger.Error("Неверный формат поля Фамилия", zap.Error(err), zap.String("row", row[1]))
 			continue
 		}
-		p.Name, err = parser.String(row[2])
+		p.Name, err = parser.Name(row[2])
 		if err != nil {
 			logger.Error("Неверный формат поля Имя", zap.Error(err), zap.String("row", row[2]))
 			continue
 		}
-		p.Patronymic, err = parser.String(row[3])
+		p.Patronymic, err = parser.Name(row[3])
 		if err != nil {
 			logger.Error("Неверный формат поля Отчество", zap.Error(err), zap.String("row", row[3]))
 			continue
@@ -180,3 +182,42 @@ func ParseExcelForCorrection(buf io.Reader, logger *zap.Logger) (r []postgres.Pe
 	}
 	return
 }
+
+// IsExcel похоже ли содержимое файла на xlsx: xlsx - это zip-архив
+func IsExcel(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04"))
+}
+
+// ExcelRows возвращает строки первого листа xlsx. Значения не форматируются: числа остаются как в файле,
+// даты - порядковыми номерами дней (см. ExcelDate). Номер строки на листе - индекс + 1.
+func ExcelRows(reader io.Reader) ([][]string, error) {
+	file, err := excelize.OpenReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.GetRows(file.GetSheetName(0), excelize.Options{RawCellValue: true})
+}
+
+// ExcelDate приводит дату, которую Excel хранит как число, к виду ДД.ММ.ГГГГ, остальные значения не меняет
+func ExcelDate(value string) string {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		return value
+	}
+	t, err := excelize.ExcelDateToTime(f, false)
+	if err != nil {
+		return value
+	}
+	return t.Format("02.01.2006")
+}
+
+// ExcelDigits возвращает ведущие нули числу, которое Excel хранит как число (СНИЛС 012-345-678 90
+// превращается в 1234567890), дополняя его до length цифр. Остальные значения не меняет.
+func ExcelDigits(value string, length int) string {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 || f != math.Trunc(f) {
+		return value
+	}
+	return fmt.Sprintf("%0*.0f", length, f)
+}
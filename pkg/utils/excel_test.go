@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"github.com/xuri/excelize/v2"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExcelDigits(t *testing.T) {
+	tests := []struct {
+		value  string
+		length int
+		want   string
+	}{
+		{"1234567890", 11, "01234567890"},
+		{"12345678901", 11, "12345678901"},
+		{"1.23456789E+9", 11, "01234567890"},
+		{"0", 11, "00000000000"},
+		{"012-345-678 90", 11, "012-345-678 90"},
+		{"1234.5", 11, "1234.5"},
+		{"-1", 11, "-1"},
+		{"", 11, ""},
+	}
+	for _, tt := range tests {
+		if got := ExcelDigits(tt.value, tt.length); got != tt.want {
+			t.Errorf("ExcelDigits(%q, %d) = %q, want %q", tt.value, tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestExcelDate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"44563", "02.01.2022"},
+		{"18326", "04.03.1950"},
+		{"44563.75", "02.01.2022"}, // дата со временем
+		{"02.01.2022", "02.01.2022"},
+		{"0", "0"},
+		{"", ""},
+		{"не дата", "не дата"},
+	}
+	for _, tt := range tests {
+		if got := ExcelDate(tt.value); got != tt.want {
+			t.Errorf("ExcelDate(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestExcelRowsRawValues(t *testing.T) {
+	f := excelize.NewFile()
+	sheet := f.GetSheetName(0)
+	for cell, value := range map[string]interface{}{
+		"A1": "СНИЛС", "B1": "Дата",
+		"A2": 1234567890, "B2": time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC),
+	} {
+		if err := f.SetCellValue(sheet, cell, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsExcel(buf.Bytes()) {
+		t.Fatal("xlsx not recognized")
+	}
+
+	rows, err := ExcelRows(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"СНИЛС", "Дата"}, {"1234567890", "44563"}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("rows %q, want %q", rows, want)
+	}
+	if snils, date := ExcelDigits(rows[1][0], 11), ExcelDate(rows[1][1]); snils != "01234567890" || date != "02.01.2022" {
+		t.Errorf("snils %q, date %q", snils, date)
+	}
+}